@@ -54,10 +54,11 @@ func (this *consensusAction) ConsensusLog(peerId string, msgType string, consens
 
 	var response *entity2.ChainMessage
 	var err error
+	//共识的日志不等待回应，对方处理以后另外发送下一阶段的消息
 	if peerId == consensusLog.PrimaryPeerId { // 定位器之间
-		response, err = sender.DirectSend(&chainMessage)
+		response, err = sender.DirectPost(&chainMessage)
 	} else {
-		response, err = this.Send(&chainMessage)
+		response, err = this.Post(&chainMessage)
 	}
 	if err != nil {
 		return nil, err
@@ -69,6 +70,20 @@ func (this *consensusAction) ConsensusLog(peerId string, msgType string, consens
 	return nil, nil
 }
 
+/*
+*
+共识消息的校验规则，负载只能是DataBlock或者ConsensusLog，必须指定目标节点，必须签名防止重放
+*/
+func (this *consensusAction) RegistSchema(msgTypes ...string) {
+	for _, msgType := range msgTypes {
+		handler.RegistChainMessageSchema(msgType, &handler.ChainMessageSchema{
+			RequiredFields: []string{"TargetPeerId"},
+			PayloadTypes:   []string{handler.PayloadType_DataBlock, handler.PayloadType_ConsensusLog},
+			NeedSignature:  true,
+		})
+	}
+}
+
 func init() {
 	ConsensusAction = consensusAction{}
 	ConsensusAction.MsgType = msgtype.CONSENSUS
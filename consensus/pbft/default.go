@@ -487,4 +487,5 @@ func init() {
 	handler.RegistChainMessageHandler(msgtype.CONSENSUS_PBFT_PREPARED, action.ConsensusAction.Send, pbftConsensus.ReceivePrepared, action.ConsensusAction.Response)
 	handler.RegistChainMessageHandler(msgtype.CONSENSUS_PBFT_COMMITED, action.ConsensusAction.Send, pbftConsensus.ReceiveCommited, action.ConsensusAction.Response)
 	handler.RegistChainMessageHandler(msgtype.CONSENSUS_PBFT_REPLY, action.ConsensusAction.Send, pbftConsensus.ReceiveCommited, action.ConsensusAction.Response)
+	action.ConsensusAction.RegistSchema(msgtype.CONSENSUS_PBFT, msgtype.CONSENSUS_PBFT_PREPREPARED, msgtype.CONSENSUS_PBFT_PREPARED, msgtype.CONSENSUS_PBFT_COMMITED, msgtype.CONSENSUS_PBFT_REPLY)
 }
@@ -484,4 +484,5 @@ func init() {
 	handler.RegistChainMessageHandler(msgtype.CONSENSUS_RAFT_PREPARED, action.ConsensusAction.Send, raftConsensus.ReceivePrepared, action.ConsensusAction.Response)
 	handler.RegistChainMessageHandler(msgtype.CONSENSUS_RAFT_COMMITED, action.ConsensusAction.Send, raftConsensus.ReceiveCommited, action.ConsensusAction.Response)
 	handler.RegistChainMessageHandler(msgtype.CONSENSUS_RAFT_REPLY, action.ConsensusAction.Send, raftConsensus.ReceiveReply, action.ConsensusAction.Response)
+	action.ConsensusAction.RegistSchema(msgtype.CONSENSUS_RAFT, msgtype.CONSENSUS_RAFT_PREPREPARED, msgtype.CONSENSUS_RAFT_PREPARED, msgtype.CONSENSUS_RAFT_COMMITED, msgtype.CONSENSUS_RAFT_REPLY)
 }
@@ -3,6 +3,7 @@ package libp2p
 import (
 	"github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-node/libp2p/pipe/handler"
+	handler2 "github.com/curltech/go-colla-node/p2p/chain/handler"
 	"github.com/libp2p/go-libp2p/core/network"
 	connmgr "github.com/libp2p/go-libp2p/p2p/net/connmgr"
 	ma "github.com/multiformats/go-multiaddr"
@@ -46,6 +47,7 @@ func (nn *cmNotifee) Disconnected(n network.Network, c network.Conn) {
 	addr := c.RemoteMultiaddr().String()
 	logger.Sugar.Debugf("New Disconnected! %v %v, addr:%v", peerId, c.ID(), addr)
 	handler.Disconnect(peerId, "", c.ID())
+	handler2.RemoveCapability(peerId, "", c.ID())
 }
 
 // Listen is no-op in this implementation.
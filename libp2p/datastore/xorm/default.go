@@ -581,4 +581,13 @@ func init() {
 
 	handler.RegistDatastore(ns.PeerTransaction_ChannelArticle_Prefix, NewXormDatastore())
 	handler.RegistKeyname(ns.PeerTransaction_ChannelArticle_Prefix, ns.PeerTransaction_ChannelArticle_KeyKind)
+
+	handler.RegistDatastore(ns.PreKeyBundle_Prefix, NewXormDatastore())
+	handler.RegistKeyname(ns.PreKeyBundle_Prefix, dhtentity.PreKeyBundle{}.KeyName())
+
+	handler.RegistDatastore(ns.Group_Prefix, NewXormDatastore())
+	handler.RegistKeyname(ns.Group_Prefix, dhtentity.Group{}.KeyName())
+
+	handler.RegistDatastore(ns.Topic_Prefix, NewXormDatastore())
+	handler.RegistKeyname(ns.Topic_Prefix, dhtentity.Topic{}.KeyName())
 }
@@ -17,6 +17,7 @@ import (
 	"github.com/curltech/go-colla-node/libp2p/pubsub"
 	"github.com/curltech/go-colla-node/libp2p/routingtable"
 	"github.com/curltech/go-colla-node/libp2p/util"
+	handler2 "github.com/curltech/go-colla-node/p2p/chain/handler"
 	service1 "github.com/curltech/go-colla-node/p2p/chain/service"
 	"github.com/curltech/go-colla-node/p2p/dht/entity"
 	"github.com/curltech/go-colla-node/p2p/dht/service"
@@ -163,9 +164,9 @@ func p2pOptions() []libp2p.Option {
 	//	logger.Sugar.Infof("start NATManager option")
 	//}
 
-	// Attempt to open ConnectionGater，控制连接的安全性
+	// Attempt to open ConnectionGater，控制连接的安全性，拒绝被限流禁止的peer
 	if config.Libp2pParams.ConnectionGater {
-		connectionGater := libp2p.ConnectionGater(nil)
+		connectionGater := libp2p.ConnectionGater(NewBanGater())
 		options = append(options, connectionGater)
 		logger.Sugar.Debugf("start ConnectionGater option")
 	}
@@ -473,7 +474,9 @@ func Start() {
 	//routingDiscovery()
 	//10.局域网可设置mdns路由发现方式
 	//mdns()
-	//11.schedule to delete expired data blocks
+	//11.发布前向安全会话的预共享密钥包，并定期更换预共享密钥
+	go handler2.LoopPreKeyBundle()
+	//12.schedule to delete expired data blocks
 	go func() {
 		ticker := time.NewTicker(time.Minute * 60)
 		for range ticker.C {
@@ -137,6 +137,12 @@ func dhtOptions() []kaddht.Option {
 	options = append(options, validator)
 	validator = kaddht.NamespacedValidator(ns.PeerTransaction_ChannelArticle_Prefix, ns.PeerTransactionValidator{})
 	options = append(options, validator)
+	validator = kaddht.NamespacedValidator(ns.PreKeyBundle_Prefix, ns.PreKeyBundleValidator{})
+	options = append(options, validator)
+	validator = kaddht.NamespacedValidator(ns.Group_Prefix, ns.GroupValidator{})
+	options = append(options, validator)
+	validator = kaddht.NamespacedValidator(ns.Topic_Prefix, ns.TopicValidator{})
+	options = append(options, validator)
 
 	// RoutingTableRefreshPeriod sets the period for refreshing buckets in the
 	// routing table. The DHT will refresh buckets every period by:
@@ -11,6 +11,7 @@ import (
 	"github.com/curltech/go-colla-node/libp2p/ns"
 	"github.com/curltech/go-colla-node/libp2p/routingtable"
 	"github.com/curltech/go-colla-node/p2p/dht/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
 	u "github.com/ipfs/boxo/util"
 	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
@@ -308,6 +309,8 @@ func (this *PeerEntityDHT) PutMyself() error {
 		return err
 	}
 	peerEndpoint.ActiveStatus = entity.ActiveStatus_Up
+	peerEndpoint.ProtocolVersion = msgtype.ProtocolVersion
+	peerEndpoint.Capabilities = msgtype.Capabilities()
 	bytePeerEndpoint, err := message.Marshal(peerEndpoint)
 	if err != nil {
 		return err
@@ -0,0 +1,46 @@
+package libp2p
+
+import (
+	"github.com/curltech/go-colla-core/logger"
+	handler2 "github.com/curltech/go-colla-node/p2p/chain/handler"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+/*
+*
+拒绝被限流临时禁止的peer的连接，禁止到期后自动允许
+*/
+type BanGater struct {
+}
+
+func NewBanGater() *BanGater {
+	return &BanGater{}
+}
+
+func (g *BanGater) InterceptPeerDial(p peer.ID) bool {
+	return !handler2.IsBanned(p.String())
+}
+
+func (g *BanGater) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool {
+	return !handler2.IsBanned(p.String())
+}
+
+func (g *BanGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g *BanGater) InterceptSecured(direction network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	if handler2.IsBanned(p.String()) {
+		logger.Sugar.Debugf("reject banned peer: %v, addr: %v", p.String(), addrs.RemoteMultiaddr().String())
+		return false
+	}
+
+	return true
+}
+
+func (g *BanGater) InterceptUpgraded(conn network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -9,6 +9,7 @@ import (
 	entity2 "github.com/curltech/go-colla-node/p2p/chain/entity"
 	"github.com/curltech/go-colla-node/p2p/dht/entity"
 	record "github.com/libp2p/go-libp2p-record"
+	"strings"
 )
 
 const PeerEndpoint_Prefix = "peerEndpoint"
@@ -26,6 +27,10 @@ const PeerTransaction_GroupFile_Prefix = "peerTransactionGroupFile"
 const PeerTransaction_Channel_Prefix = "peerTransactionChannel"
 const PeerTransaction_ChannelArticle_Prefix = "peerTransactionChannelArticle"
 const TransactionKey_Prefix = "transactionKey"
+const PreKeyBundle_Prefix = "preKeyBundle"
+const Group_Prefix = "group"
+const Topic_Prefix = "topic"
+const Presence_Prefix = "presence"
 
 const PeerClient_KeyKind = "PeerId"
 const PeerClient_Mobile_KeyKind = "Mobile"
@@ -150,6 +155,35 @@ func GetPeerTransactionChannelArticleKey(id string) string {
 	return key
 }
 
+func GetPreKeyBundleKey(peerId string) string {
+	key := fmt.Sprintf("/%v/%v", PreKeyBundle_Prefix, peerId)
+
+	return key
+}
+
+func GetGroupKey(groupId string) string {
+	key := fmt.Sprintf("/%v/%v", Group_Prefix, groupId)
+
+	return key
+}
+
+func GetTopicKey(topicName string) string {
+	key := fmt.Sprintf("/%v/%v", Topic_Prefix, topicName)
+
+	return key
+}
+
+// GetPresenceTopic peerId的在线状态发布的主题
+func GetPresenceTopic(peerId string) string {
+	topic := fmt.Sprintf("/%v/%v", Presence_Prefix, peerId)
+
+	return topic
+}
+
+func IsPresenceTopic(topic string) bool {
+	return strings.HasPrefix(topic, "/"+Presence_Prefix+"/")
+}
+
 type PeerEndpointValidator struct {
 }
 
@@ -390,3 +424,311 @@ func (v TransactionKeyValidator) Select(key string, vals [][]byte) (int, error)
 }
 
 var _ record.Validator = TransactionKeyValidator{}
+
+type PreKeyBundleValidator struct {
+}
+
+/*
+*
+预共享密钥包的校验函数，用peer的openpgp公钥校验签名，由chain的handler注册，
+没有注册的时候拒绝所有的预共享密钥包
+*/
+var preKeyBundleVerifier func(preKeyBundle *entity.PreKeyBundle) error
+
+func RegistPreKeyBundleVerifier(verifier func(preKeyBundle *entity.PreKeyBundle) error) {
+	preKeyBundleVerifier = verifier
+}
+
+// Validate conforms to the Validator interface.
+// 预共享密钥包必须是peer自己签名的，否则伪造的更新的包会替换真正的包
+func (v PreKeyBundleValidator) Validate(key string, value []byte) error {
+	ns, key, err := record.SplitKey(key)
+	if err != nil {
+		return err
+	}
+	if ns != PreKeyBundle_Prefix {
+		return errors.New("invalid namespace:" + ns)
+	}
+	if preKeyBundleVerifier == nil {
+		return errors.New("NoPreKeyBundleVerifier")
+	}
+	preKeyBundles := make([]*entity.PreKeyBundle, 0)
+	err = message.Unmarshal(value, &preKeyBundles)
+	if err != nil {
+		preKeyBundle := &entity.PreKeyBundle{}
+		err = message.Unmarshal(value, preKeyBundle)
+		if err != nil {
+			logger.Sugar.Errorf("failed to unmarshal record from value", "key", key, "error", err)
+			return err
+		}
+		preKeyBundles = append(preKeyBundles, preKeyBundle)
+	}
+	for _, preKeyBundle := range preKeyBundles {
+		if preKeyBundle.PeerId != key {
+			return errors.New("InconsistentPreKeyBundlePeerId")
+		}
+		err = preKeyBundleVerifier(preKeyBundle)
+		if err != nil {
+			logger.Sugar.Errorf("invalid preKeyBundle record key: %v, error: %v", key, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Select conforms to the Validator interface.
+// 签名校验通过的最新的预共享密钥包优先
+func (v PreKeyBundleValidator) Select(key string, vals [][]byte) (int, error) {
+	currentVal := vals[0]
+	existingVal := vals[1]
+	currentEntity := entity.PreKeyBundle{}
+	err := message.Unmarshal(currentVal, &currentEntity)
+	if err != nil {
+		currentEntities := make([]*entity.PreKeyBundle, 0)
+		err := message.Unmarshal(currentVal, &currentEntities)
+		if err != nil || len(currentEntities) == 0 {
+			logger.Sugar.Errorf("failed to unmarshal current record from value", "key", key, "error", err)
+			return 1, err
+		}
+		currentEntity = *currentEntities[0]
+	}
+	existingEntities := make([]*entity.PreKeyBundle, 0)
+	err = message.Unmarshal(existingVal, &existingEntities)
+	if err != nil {
+		logger.Sugar.Errorf("failed to unmarshal existing records from value", "key", key, "error", err)
+		return 1, err
+	}
+	for _, existingEntity := range existingEntities {
+		if existingEntity.PeerId == currentEntity.PeerId &&
+			currentEntity.LastUpdateTime != nil && existingEntity.LastUpdateTime != nil &&
+			currentEntity.LastUpdateTime.UTC().Before(existingEntity.LastUpdateTime.UTC()) {
+			return 1, nil
+		}
+	}
+	if preKeyBundleVerifier == nil || preKeyBundleVerifier(&currentEntity) != nil {
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+var _ record.Validator = PreKeyBundleValidator{}
+
+type GroupValidator struct {
+}
+
+/*
+*
+群组记录的校验函数，校验签名，previous不为空的时候校验相对原来的记录的版本和签名者，
+由chain的handler注册，没有注册的时候拒绝所有的群组记录
+*/
+var groupVerifier func(group *entity.Group, previous *entity.Group) error
+
+// groupLocal 本地保存的群组记录，用于校验新的记录的版本延续
+var groupLocal func(groupId string) *entity.Group
+
+func RegistGroupVerifier(verifier func(group *entity.Group, previous *entity.Group) error, local func(groupId string) *entity.Group) {
+	groupVerifier = verifier
+	groupLocal = local
+}
+
+func unmarshalGroups(value []byte) ([]*entity.Group, error) {
+	groups := make([]*entity.Group, 0)
+	err := message.Unmarshal(value, &groups)
+	if err != nil {
+		group := &entity.Group{}
+		err = message.Unmarshal(value, group)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+// Validate conforms to the Validator interface.
+// 群组必须是群主或者管理员签名的，版本比本地的记录高的时候签名者必须是原来的群主或者管理员
+func (v GroupValidator) Validate(key string, value []byte) error {
+	ns, key, err := record.SplitKey(key)
+	if err != nil {
+		return err
+	}
+	if ns != Group_Prefix {
+		return errors.New("invalid namespace:" + ns)
+	}
+	if groupVerifier == nil {
+		return errors.New("NoGroupVerifier")
+	}
+	groups, err := unmarshalGroups(value)
+	if err != nil {
+		logger.Sugar.Errorf("failed to unmarshal record from value", "key", key, "error", err)
+		return err
+	}
+	for _, group := range groups {
+		if group.GroupId != key {
+			return errors.New("InconsistentGroupId")
+		}
+		var previous *entity.Group
+		if groupLocal != nil {
+			previous = groupLocal(group.GroupId)
+		}
+		err = groupVerifier(group, previous)
+		if err != nil {
+			logger.Sugar.Errorf("invalid group record key: %v, error: %v", key, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Select conforms to the Validator interface.
+// 成员版本高而且与原来的记录延续的群组优先
+func (v GroupValidator) Select(key string, vals [][]byte) (int, error) {
+	currentVal := vals[0]
+	existingVal := vals[1]
+	currentEntity := entity.Group{}
+	err := message.Unmarshal(currentVal, &currentEntity)
+	if err != nil {
+		currentEntities := make([]*entity.Group, 0)
+		err := message.Unmarshal(currentVal, &currentEntities)
+		if err != nil || len(currentEntities) == 0 {
+			logger.Sugar.Errorf("failed to unmarshal current record from value", "key", key, "error", err)
+			return 1, err
+		}
+		currentEntity = *currentEntities[0]
+	}
+	existingEntities := make([]*entity.Group, 0)
+	err = message.Unmarshal(existingVal, &existingEntities)
+	if err != nil {
+		logger.Sugar.Errorf("failed to unmarshal existing records from value", "key", key, "error", err)
+		return 1, err
+	}
+	for _, existingEntity := range existingEntities {
+		if existingEntity.GroupId != currentEntity.GroupId {
+			continue
+		}
+		if currentEntity.Version < existingEntity.Version {
+			return 1, nil
+		}
+		//版本高的记录必须由原来的群主或者管理员签名，否则是伪造的
+		if groupVerifier == nil || groupVerifier(&currentEntity, existingEntity) != nil {
+			return 1, nil
+		}
+	}
+
+	return 0, nil
+}
+
+var _ record.Validator = GroupValidator{}
+
+type TopicValidator struct {
+}
+
+/*
+*
+主题访问控制记录的校验函数，校验所有者的签名，previous不为空的时候校验相对原来的记录的版本和所有者，
+由chain的handler注册，没有注册的时候拒绝所有的主题记录
+*/
+var topicVerifier func(topic *entity.Topic, previous *entity.Topic) error
+
+// topicLocal 本地保存的主题记录，用于校验新的记录的版本延续
+var topicLocal func(topicName string) *entity.Topic
+
+func RegistTopicVerifier(verifier func(topic *entity.Topic, previous *entity.Topic) error, local func(topicName string) *entity.Topic) {
+	topicVerifier = verifier
+	topicLocal = local
+}
+
+func unmarshalTopics(value []byte) ([]*entity.Topic, error) {
+	topics := make([]*entity.Topic, 0)
+	err := message.Unmarshal(value, &topics)
+	if err != nil {
+		topic := &entity.Topic{}
+		err = message.Unmarshal(value, topic)
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+
+	return topics, nil
+}
+
+// Validate conforms to the Validator interface.
+// 主题必须是所有者签名的，版本比本地的记录高的时候所有者不能改变
+func (v TopicValidator) Validate(key string, value []byte) error {
+	ns, key, err := record.SplitKey(key)
+	if err != nil {
+		return err
+	}
+	if ns != Topic_Prefix {
+		return errors.New("invalid namespace:" + ns)
+	}
+	if topicVerifier == nil {
+		return errors.New("NoTopicVerifier")
+	}
+	topics, err := unmarshalTopics(value)
+	if err != nil {
+		logger.Sugar.Errorf("failed to unmarshal record from value", "key", key, "error", err)
+		return err
+	}
+	for _, topic := range topics {
+		if topic.TopicName != key {
+			return errors.New("InconsistentTopicName")
+		}
+		var previous *entity.Topic
+		if topicLocal != nil {
+			previous = topicLocal(topic.TopicName)
+		}
+		err = topicVerifier(topic, previous)
+		if err != nil {
+			logger.Sugar.Errorf("invalid topic record key: %v, error: %v", key, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Select conforms to the Validator interface.
+// 访问控制版本高而且与原来的记录延续的主题优先
+func (v TopicValidator) Select(key string, vals [][]byte) (int, error) {
+	currentVal := vals[0]
+	existingVal := vals[1]
+	currentEntity := entity.Topic{}
+	err := message.Unmarshal(currentVal, &currentEntity)
+	if err != nil {
+		currentEntities := make([]*entity.Topic, 0)
+		err := message.Unmarshal(currentVal, &currentEntities)
+		if err != nil || len(currentEntities) == 0 {
+			logger.Sugar.Errorf("failed to unmarshal current record from value", "key", key, "error", err)
+			return 1, err
+		}
+		currentEntity = *currentEntities[0]
+	}
+	existingEntities := make([]*entity.Topic, 0)
+	err = message.Unmarshal(existingVal, &existingEntities)
+	if err != nil {
+		logger.Sugar.Errorf("failed to unmarshal existing records from value", "key", key, "error", err)
+		return 1, err
+	}
+	for _, existingEntity := range existingEntities {
+		if existingEntity.TopicName != currentEntity.TopicName {
+			continue
+		}
+		if currentEntity.Version < existingEntity.Version {
+			return 1, nil
+		}
+		//版本高的记录必须由原来的所有者签名，否则是伪造的
+		if topicVerifier == nil || topicVerifier(&currentEntity, existingEntity) != nil {
+			return 1, nil
+		}
+	}
+
+	return 0, nil
+}
+
+var _ record.Validator = TopicValidator{}
@@ -2,11 +2,14 @@ package pipe
 
 import (
 	"bufio"
+	"errors"
 	"github.com/curltech/go-colla-core/config"
 	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
 	"github.com/libp2p/go-libp2p/core/network"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +26,38 @@ type Pipe struct {
 	inChan  chan []byte
 	sync    bool
 	mutex   sync.Mutex
+	// 协商的协议是帧格式，否则是原来以'\n'结尾的格式
+	framed bool
+	// 协商的消息编码，二进制编码只能使用帧格式
+	codec string
+	// 写锁，原来的格式一个消息连续写出
+	writeMutex sync.Mutex
+	// 帧格式的写出调度，按照优先级交替写出各个消息的帧
+	writer *frameWriter
+	// 下一个请求的流编号，主动创建管道的一方使用奇数，被动接收的一方使用偶数，避免冲突
+	nextStreamId uint64
+	// 等待同步回应的请求，流编号与接收通道的映射
+	pending map[uint64]chan []byte
+	// 管道关闭的时候调用，用于从连接池中移除
+	closeHandler func(pipe *Pipe)
+	closeOnce    sync.Once
+	closed       bool
+	// 最后读写的时间（UnixNano），用于连接池的空闲超时
+	lastActiveTime int64
+	// 正在写出的消息数，包括异步的写
+	writing int64
+	// 同时处理的消息数的信号量，达到上限的时候停止读
+	dispatchSem chan struct{}
+}
+
+// maxDispatch 每个管道同时处理的消息数的上限
+var maxDispatch = 16
+
+func init() {
+	maxDispatch, _ = config.GetInt("libp2p.pipe.maxDispatch", 16)
+	if maxDispatch <= 0 {
+		maxDispatch = 1
+	}
 }
 
 /*
@@ -31,15 +66,31 @@ handler是读到数据时的处理器
 */
 func CreatePipe(stream network.Stream, handler func(data []byte, pipe *Pipe) ([]byte, error), direct string) (*Pipe, error) {
 	pipe := &Pipe{
-		stream:  stream,
-		handler: handler,
-		direct:  direct,
+		stream:      stream,
+		handler:     handler,
+		direct:      direct,
+		framed:      IsFrameProtocol(stream.Protocol()),
+		codec:       CodecOfProtocol(stream.Protocol()),
+		inChan:      make(chan []byte, 1),
+		pending:     make(map[uint64]chan []byte),
+		dispatchSem: make(chan struct{}, maxDispatch),
 	}
+	if direct == msgtype.MsgDirect_Request {
+		pipe.nextStreamId = 1
+	} else {
+		pipe.nextStreamId = 2
+	}
+	pipe.touch()
 	// Create a buffered stream so that read and writes are non blocking.
 	pipe.rw = bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
 
-	// 启动读协程
-	go pipe.Read()
+	// 启动读协程，帧格式的管道在流的整个生命周期内循环读
+	go pipe.loopRead()
+	// 帧格式的管道启动写协程
+	if pipe.framed {
+		pipe.writer = newFrameWriter()
+		go pipe.loopWrite()
+	}
 
 	return pipe, nil
 }
@@ -48,28 +99,191 @@ func (pipe *Pipe) GetStream() network.Stream {
 	return pipe.stream
 }
 
+func (pipe *Pipe) GetDirect() string {
+	return pipe.direct
+}
+
+func (pipe *Pipe) IsFramed() bool {
+	return pipe.framed
+}
+
+// Codec 协商的消息编码
+func (pipe *Pipe) Codec() string {
+	return pipe.codec
+}
+
+func (pipe *Pipe) touch() {
+	atomic.StoreInt64(&pipe.lastActiveTime, time.Now().UnixNano())
+}
+
+// LastActiveTime 最后读写的时间
+func (pipe *Pipe) LastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&pipe.lastActiveTime))
+}
+
+// InFlight 正在等待同步回应的请求数
+func (pipe *Pipe) InFlight() int {
+	pipe.mutex.Lock()
+	defer pipe.mutex.Unlock()
+
+	return len(pipe.pending)
+}
+
+// Load 管道的负载，正在写出的消息数加上等待同步回应的请求数，连接池选择负载最小的管道
+func (pipe *Pipe) Load() int {
+	return int(atomic.LoadInt64(&pipe.writing)) + pipe.InFlight()
+}
+
+func (pipe *Pipe) IsClosed() bool {
+	pipe.mutex.Lock()
+	defer pipe.mutex.Unlock()
+
+	return pipe.closed
+}
+
+/*
+*
+设置管道关闭时的处理器，关闭，重置，读超时或者读错误的时候只调用一次
+*/
+func (pipe *Pipe) SetCloseHandler(closeHandler func(pipe *Pipe)) {
+	pipe.mutex.Lock()
+	defer pipe.mutex.Unlock()
+	pipe.closeHandler = closeHandler
+}
+
 func (pipe *Pipe) Close() error {
+	defer pipe.release()
+
 	return pipe.stream.Close()
 }
 
 func (pipe *Pipe) Reset() error {
-	pipe.Close()
+	defer pipe.release()
+	pipe.stream.Close()
 
 	return pipe.stream.Reset()
 }
 
-// 内部实现
-func (pipe *Pipe) Read() []byte {
-	var (
-		data []byte
-		err  error
-	)
+/*
+*
+标记关闭，唤醒所有等待回应的请求，调用关闭处理器
+*/
+func (pipe *Pipe) release() {
+	pipe.closeOnce.Do(func() {
+		pipe.mutex.Lock()
+		pipe.closed = true
+		for streamId, ch := range pipe.pending {
+			close(ch)
+			delete(pipe.pending, streamId)
+		}
+		closeHandler := pipe.closeHandler
+		pipe.mutex.Unlock()
+		if pipe.writer != nil {
+			pipe.writer.close()
+		}
+		if closeHandler != nil {
+			closeHandler(pipe)
+		}
+	})
+}
+
+func (pipe *Pipe) setReadDeadline() {
 	var readTimeout = config.Libp2pParams.ReadTimeout
 	if readTimeout > 0 {
 		pipe.stream.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(readTimeout)))
 	} else {
 		pipe.stream.SetReadDeadline(time.Time{})
 	}
+}
+
+func (pipe *Pipe) loopRead() {
+	if !pipe.framed {
+		pipe.Read()
+		return
+	}
+	reader := newFrameReader(pipe.rw.Reader)
+	for {
+		pipe.setReadDeadline()
+		streamId, data, err := reader.readMessage()
+		if err != nil {
+			// 判断是不是超时
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				logger.Sugar.Errorf("ReadMessage timeout remote: %v\n", pipe.stream.ID())
+			}
+			pipe.Reset()
+			return
+		}
+		pipe.touch()
+		logger.Sugar.Debugf("Read streamId:%v data length:%v", streamId, len(data))
+		// 等待中的同步回应直接交给请求方，不占用处理的名额，否则处理器中的同步请求等不到回应
+		if pipe.resolve(streamId, data) {
+			continue
+		}
+		// 处理的协程达到上限的时候阻塞在这里不再读，由流控让对方放慢发送
+		pipe.dispatchSem <- struct{}{}
+		go func(streamId uint64, data []byte) {
+			defer func() { <-pipe.dispatchSem }()
+			pipe.dispatch(streamId, data)
+		}(streamId, data)
+	}
+}
+
+/*
+*
+流编号与自己的奇偶相同并且有等待的请求，把回应交给请求方
+*/
+func (pipe *Pipe) resolve(streamId uint64, data []byte) bool {
+	if streamId%2 != pipe.nextStreamId%2 {
+		return false
+	}
+	pipe.mutex.Lock()
+	ch, ok := pipe.pending[streamId]
+	delete(pipe.pending, streamId)
+	pipe.mutex.Unlock()
+	if ok {
+		ch <- data
+	}
+
+	return ok
+}
+
+/*
+*
+流编号与自己的奇偶相同的是对自己请求的异步回应，否则是对方的请求
+对方的请求处理后把结果用同一个流编号写回，回应不再写回，避免来回循环
+*/
+func (pipe *Pipe) dispatch(streamId uint64, data []byte) {
+	if streamId%2 == pipe.nextStreamId%2 {
+		if pipe.handler != nil {
+			_, err := pipe.handler(data, pipe)
+			if err != nil {
+				logger.Sugar.Errorf("Error pipe.handler:%v", err)
+			}
+		}
+		return
+	}
+	if pipe.handler == nil {
+		return
+	}
+	data, err := pipe.handler(data, pipe)
+	if err != nil {
+		logger.Sugar.Errorf("Error pipe.handler:%v", err)
+	}
+	if data != nil {
+		err = pipe.write(streamId, data, msgtype.PriorityOf(data))
+		if err != nil {
+			logger.Sugar.Errorf("pipe.write failure: %v", err)
+		}
+	}
+}
+
+// Read 原来的格式只读一个消息，处理并写回结果后重置流
+func (pipe *Pipe) Read() []byte {
+	var (
+		data []byte
+		err  error
+	)
+	pipe.setReadDeadline()
 	data, err = pipe.rw.ReadBytes('\n')
 	logger.Sugar.Infof("Read data length:%v", len(data))
 	if err != nil {
@@ -86,9 +300,15 @@ func (pipe *Pipe) Read() []byte {
 			if err != nil {
 				logger.Sugar.Errorf("Error pipe.handler")
 			}
+			if data != nil {
+				_, _, err = pipe.Write(data, false)
+				if err != nil {
+					logger.Sugar.Errorf("pipe.Write failure: %v", err)
+				}
+			}
 		}
-
 	}
+	pipe.Reset()
 
 	return data
 }
@@ -106,21 +326,86 @@ func (pipe *Pipe) read(data []byte) []byte {
 	return data
 }
 
+/*
+*
+写一个消息，sync为true的时候返回接收回应的通道，优先级按照数据的大小决定
+*/
 func (pipe *Pipe) Write(data []byte, sync bool) (*Pipe, <-chan []byte, error) {
-	var (
-		err error
-	)
+	return pipe.WritePriority(data, sync, msgtype.PriorityOf(data))
+}
+
+/*
+*
+按照优先级写一个消息，sync为true的时候返回接收回应的通道
+帧格式的管道每个请求使用新的流编号，可以有多个并发的同步请求
+优先级高的消息可以插在优先级低的大消息的帧之间写出，原来的格式不区分优先级
+*/
+func (pipe *Pipe) WritePriority(data []byte, sync bool, priority msgtype.Priority) (*Pipe, <-chan []byte, error) {
+	if !pipe.framed {
+		return pipe.writeLine(data, sync)
+	}
+	pipe.mutex.Lock()
+	if pipe.closed {
+		pipe.mutex.Unlock()
+		return pipe, nil, errors.New("PipeClosed")
+	}
+	streamId := pipe.nextStreamId
+	pipe.nextStreamId += 2
+	var ch chan []byte
+	if sync {
+		ch = make(chan []byte, 1)
+		pipe.pending[streamId] = ch
+	}
+	pipe.mutex.Unlock()
+	err := pipe.write(streamId, data, priority)
+	if err != nil {
+		pipe.mutex.Lock()
+		delete(pipe.pending, streamId)
+		pipe.mutex.Unlock()
+		pipe.Reset()
+
+		return pipe, nil, err
+	}
+	if sync {
+		return pipe, ch, nil
+	}
+
+	return pipe, nil, nil
+}
+
+/*
+*
+放入写协程的队列，等待所有的帧写出
+*/
+func (pipe *Pipe) write(streamId uint64, data []byte, priority msgtype.Priority) error {
+	logger.Sugar.Debugf("streamId:%v, connId:%v, frameStreamId:%v, priority:%v", pipe.stream.ID(), pipe.stream.Conn().ID(), streamId, priority)
+	atomic.AddInt64(&pipe.writing, 1)
+	defer atomic.AddInt64(&pipe.writing, -1)
+
+	return <-pipe.writer.push(streamId, data, priority)
+}
+
+func (pipe *Pipe) setWriteDeadline() {
 	var writeTimeout = config.Libp2pParams.WriteTimeout
 	if writeTimeout > 0 {
 		pipe.stream.SetWriteDeadline(time.Now().Add(time.Millisecond * time.Duration(writeTimeout)))
 	} else {
 		pipe.stream.SetWriteDeadline(time.Time{})
 	}
-	data = append(data, '\n')
+}
+
+func (pipe *Pipe) writeLine(data []byte, sync bool) (*Pipe, <-chan []byte, error) {
+	var (
+		err error
+	)
+	pipe.writeMutex.Lock()
+	defer pipe.writeMutex.Unlock()
+	pipe.setWriteDeadline()
 	streamId := pipe.stream.ID()
 	connId := pipe.stream.Conn().ID()
 	logger.Sugar.Debugf("streamId:%v, connId:%v", streamId, connId)
-	_, err = pipe.stream.Write(data)
+	data = append(data, '\n')
+	_, err = pipe.rw.Write(data)
 	if err != nil {
 		logger.Sugar.Errorf("Error writing to buffer")
 
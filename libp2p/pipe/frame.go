@@ -0,0 +1,211 @@
+package pipe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-node/p2p/codec"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"io"
+	"strings"
+)
+
+/*
+*
+帧格式，替代原来以'\n'结尾的消息格式，数据中可以包含任意字节
+每一帧：uvarint长度 | 版本 | 帧类型 | uvarint流编号 | 数据，长度是长度之后所有的字节数
+大消息拆成多个续帧（FrameType_Continuation），最后一帧是FrameType_Data，接收方按流编号拼接后再处理
+流编号用于同一个管道上多个并发的请求，回应使用请求的流编号
+*/
+const (
+	FrameVersion byte = 1
+
+	FrameType_Data         byte = 0
+	FrameType_Continuation byte = 1
+)
+
+// FrameProtocolSuffix 支持帧格式的协议编号后缀，比如/chain/1.0.0/frame/1
+const FrameProtocolSuffix = "/frame/1"
+
+// MaxFrameSize 每一帧数据的最大字节数，超过的拆成续帧
+const MaxFrameSize = 64 * 1024
+
+// maxMessageSize 拼接后消息的最大字节数，防止对方发送无限长的续帧耗尽内存
+var maxMessageSize = 64 * 1024 * 1024
+
+// frameEnable 过渡期间可以关闭帧格式，只使用原来的'\n'格式
+var frameEnable = true
+
+func init() {
+	frameEnable, _ = config.GetBool("libp2p.frame.enable", true)
+	maxMessageSize, _ = config.GetInt("libp2p.frame.maxMessageSize", 64*1024*1024)
+}
+
+/*
+*
+协议编号对应的帧格式协议编号
+*/
+func FrameProtocolID(protocolID protocol.ID) protocol.ID {
+	if IsFrameProtocol(protocolID) {
+		return protocolID
+	}
+	return protocolID + FrameProtocolSuffix
+}
+
+/*
+*
+二进制编码的协议编号，编码作为帧格式之前的一段，比如/chain/1.0.0/cbor/frame/1
+*/
+func CodecProtocolID(protocolID protocol.ID, c string) protocol.ID {
+	return FrameProtocolID(BaseProtocolID(protocolID) + protocol.ID("/"+c))
+}
+
+/*
+*
+协议编号协商的消息编码，原来的协议和json的帧格式都是json
+*/
+func CodecOfProtocol(protocolID protocol.ID) string {
+	id := strings.TrimSuffix(string(protocolID), FrameProtocolSuffix)
+	if IsFrameProtocol(protocolID) && strings.HasSuffix(id, "/"+codec.Codec_Cbor) {
+		return codec.Codec_Cbor
+	}
+
+	return codec.Codec_Json
+}
+
+/*
+*
+帧格式和编码的协议编号对应的原始协议编号，用于查找协议的消息处理器
+*/
+func BaseProtocolID(protocolID protocol.ID) protocol.ID {
+	id := strings.TrimSuffix(string(protocolID), FrameProtocolSuffix)
+
+	return protocol.ID(strings.TrimSuffix(id, "/"+codec.Codec_Cbor))
+}
+
+func IsFrameProtocol(protocolID protocol.ID) bool {
+	return strings.HasSuffix(string(protocolID), FrameProtocolSuffix)
+}
+
+/*
+*
+创建流的时候协商的协议编号列表，优先使用二进制编码的帧格式，然后是json的帧格式，
+对方都不支持的时候使用原来的格式
+*/
+func ProtocolIDs(protocolID protocol.ID) []protocol.ID {
+	protocolID = BaseProtocolID(protocolID)
+	if !frameEnable {
+		return []protocol.ID{protocolID}
+	}
+	if codec.Enable() {
+		return []protocol.ID{CodecProtocolID(protocolID, codec.Codec_Cbor), FrameProtocolID(protocolID), protocolID}
+	}
+	return []protocol.ID{FrameProtocolID(protocolID), protocolID}
+}
+
+/*
+*
+写出消息的下一帧，返回剩余的数据，最后一帧的时候last为true
+*/
+func writeChunk(w *bufio.Writer, streamId uint64, data []byte) ([]byte, bool, error) {
+	frameType := FrameType_Data
+	chunk := data
+	if len(chunk) > MaxFrameSize {
+		frameType = FrameType_Continuation
+		chunk = data[:MaxFrameSize]
+	}
+	err := writeFrame(w, frameType, streamId, chunk)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return data[len(chunk):], frameType == FrameType_Data, nil
+}
+
+func writeFrame(w *bufio.Writer, frameType byte, streamId uint64, chunk []byte) error {
+	id := make([]byte, binary.MaxVarintLen64)
+	idLen := binary.PutUvarint(id, streamId)
+	header := make([]byte, binary.MaxVarintLen64+2)
+	n := binary.PutUvarint(header, uint64(2+idLen+len(chunk)))
+	header[n] = FrameVersion
+	header[n+1] = frameType
+	_, err := w.Write(header[:n+2])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(id[:idLen])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(chunk)
+
+	return err
+}
+
+/*
+*
+帧的接收缓存，续帧按流编号分别拼接，直到收到最后一帧
+*/
+type frameReader struct {
+	r        *bufio.Reader
+	partials map[uint64][]byte
+	size     int
+}
+
+func newFrameReader(r *bufio.Reader) *frameReader {
+	return &frameReader{r: r, partials: make(map[uint64][]byte)}
+}
+
+/*
+*
+读一个完整的消息，返回流编号和数据
+*/
+func (this *frameReader) readMessage() (uint64, []byte, error) {
+	for {
+		frameType, streamId, chunk, err := readFrame(this.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if frameType != FrameType_Data && frameType != FrameType_Continuation {
+			return 0, nil, errors.New("UnknownFrameType")
+		}
+		if this.size+len(chunk) > maxMessageSize {
+			return 0, nil, errors.New("MessageTooLarge")
+		}
+		data := append(this.partials[streamId], chunk...)
+		if frameType == FrameType_Continuation {
+			this.partials[streamId] = data
+			this.size += len(chunk)
+			continue
+		}
+		this.size -= len(data) - len(chunk)
+		delete(this.partials, streamId)
+
+		return streamId, data, nil
+	}
+}
+
+func readFrame(r *bufio.Reader) (byte, uint64, []byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if length < 3 || length > MaxFrameSize+2+binary.MaxVarintLen64 {
+		return 0, 0, nil, errors.New("InvalidFrameLength")
+	}
+	frame := make([]byte, length)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if frame[0] != FrameVersion {
+		return 0, 0, nil, errors.New("UnsupportedFrameVersion")
+	}
+	streamId, n := binary.Uvarint(frame[2:])
+	if n <= 0 {
+		return 0, 0, nil, errors.New("InvalidStreamId")
+	}
+
+	return frame[1], streamId, frame[2+n:], nil
+}
@@ -17,27 +17,24 @@ libp2p的流处理模块把接收的数据分发到这里，通用的消息处
 */
 func HandleRaw(data []byte, p *pipe.Pipe) ([]byte, error) {
 	stream := p.GetStream()
-	protocolID := stream.Protocol()
+	//帧格式的协议和原来的协议使用同一个消息处理器
+	protocolID := pipe.BaseProtocolID(stream.Protocol())
 	protocolMessageHandler, err := handler.GetProtocolMessageHandler(string(protocolID))
 	if err != nil {
 		logger.Sugar.Errorf(err.Error())
+		return nil, err
 	}
 	//调用Receive函数或者Response函数处理
 	sessId := p.GetStream().Conn().ID()
 	remotePeerId := p.GetStream().Conn().RemotePeer().String()
 	remoteAddr := p.GetStream().Conn().RemoteMultiaddr().String()
-	ResponsePipePool[sessId] = p
+	ResponsePipePool.Put(sessId, p)
 	data, err = protocolMessageHandler.MessageHandler(data, remotePeerId, "", sessId, remoteAddr)
-	//如果处理器返回了Response，则写回到原来的管道，并关闭管道
+	//处理器返回的Response由管道写回，帧格式的管道使用请求的流编号，原来的格式写回后重置流
 	if data != nil {
 		logger.Sugar.Debugf("read data:%v", string(data))
 		logger.Sugar.Debugf("read protocolID:%v", protocolID)
-		_, _, err := p.Write(data, false)
-		if err != nil {
-			logger.Sugar.Errorf("HandleRaw-pipe.Write failure: %v", err)
-		}
 	}
-	p.Reset()
 
 	return data, nil
 }
@@ -45,9 +42,12 @@ func HandleRaw(data []byte, p *pipe.Pipe) ([]byte, error) {
 /*
 *
 根据配置的协议编号自定义流协议，其他peer连接自己的时候，用于在节点间接收和发送数据
+同时注册帧格式的协议编号，过渡期间两种格式的对方都可以连接
 */
 func ProtocolStream(protocolID protocol.ID) {
-	global.Global.Host.SetStreamHandler(protocolID, func(stream network.Stream) {
-		CreatePipe(stream, msgtype.MsgDirect_Response)
-	})
+	for _, id := range pipe.ProtocolIDs(protocolID) {
+		global.Global.Host.SetStreamHandler(id, func(stream network.Stream) {
+			CreatePipe(stream, msgtype.MsgDirect_Response)
+		})
+	}
 }
@@ -0,0 +1,359 @@
+package handler
+
+import (
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/pipe"
+	"github.com/libp2p/go-libp2p/core/network"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+*
+管道池的计数
+*/
+type PipePoolMetrics struct {
+	Opened  int64 `json:"opened"`
+	Reused  int64 `json:"reused"`
+	Evicted int64 `json:"evicted"`
+	Size    int   `json:"size"`
+}
+
+/*
+*
+线程安全的管道池，同一个键（peerId或者connectSessionId）可以有多个管道，不超过maxStreams
+空闲超过idleTimeout的管道被重置并移除
+创建管道之前在锁内预留位置，避免并发创建超过上限，或者创建以后放不进池中
+*/
+type PipePool struct {
+	name  string
+	mutex sync.RWMutex
+	// 预留的位置释放或者管道移除的时候通知等待的acquire
+	released *sync.Cond
+	pipes    map[string][]*pipe.Pipe
+	// 正在创建的管道数
+	reserved    map[string]int
+	maxStreams  int
+	idleTimeout time.Duration
+	opened      int64
+	reused      int64
+	evicted     int64
+}
+
+func NewPipePool(name string, maxStreams int, idleTimeout time.Duration) *PipePool {
+	if maxStreams <= 0 {
+		maxStreams = 1
+	}
+	pool := &PipePool{
+		name:        name,
+		pipes:       make(map[string][]*pipe.Pipe),
+		reserved:    make(map[string]int),
+		maxStreams:  maxStreams,
+		idleTimeout: idleTimeout,
+	}
+	pool.released = sync.NewCond(&pool.mutex)
+	if idleTimeout > 0 {
+		go pool.loopIdle()
+	}
+
+	return pool
+}
+
+/*
+*
+取得一个没有关闭的管道，优先负载最小的管道
+*/
+func (this *PipePool) Get(key string) *pipe.Pipe {
+	this.mutex.RLock()
+	selected := this.pick(key)
+	this.mutex.RUnlock()
+	if selected != nil {
+		this.reusing()
+	}
+
+	return selected
+}
+
+// pick 负载最小的没有关闭的管道，调用者持有锁
+func (this *PipePool) pick(key string) *pipe.Pipe {
+	var selected *pipe.Pipe
+	selectedLoad := 0
+	for _, p := range this.pipes[key] {
+		if p.IsClosed() {
+			continue
+		}
+		load := p.Load()
+		if selected == nil || load < selectedLoad {
+			selected = p
+			selectedLoad = load
+		}
+	}
+
+	return selected
+}
+
+/*
+*
+取得可以复用的管道，没有的时候预留一个位置，返回nil和true，调用者创建管道以后调用commit，失败调用cancel
+shareBusy为false的时候只复用空闲的管道，所有的管道都忙而且没有达到上限的时候预留位置创建新的管道
+已有的管道和预留的位置在任何预留之前都计入上限，没有可用的管道而且达到上限的时候，
+比如并发的第一批调用者，等待正在创建的管道放入池中或者取消
+*/
+func (this *PipePool) acquire(key string, shareBusy bool) (*pipe.Pipe, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for {
+		selected := this.pick(key)
+		full := len(this.pipes[key])+this.reserved[key] >= this.maxStreams
+		if selected != nil && (shareBusy || selected.Load() == 0 || full) {
+			this.reusing()
+			return selected, false
+		}
+		if !full {
+			break
+		}
+		this.released.Wait()
+	}
+	this.reserved[key]++
+	this.opening()
+
+	return nil, true
+}
+
+/*
+*
+放入预留了位置的管道，已经存在或者已经关闭返回false
+*/
+func (this *PipePool) commit(key string, p *pipe.Pipe) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.unreserve(key)
+	if p.IsClosed() {
+		return false
+	}
+	ps := this.pipes[key]
+	for _, old := range ps {
+		if old == p {
+			return false
+		}
+	}
+	this.pipes[key] = append(ps, p)
+
+	return true
+}
+
+/*
+*
+创建管道失败或者管道不放入池中，取消预留的位置
+*/
+func (this *PipePool) cancel(key string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.unreserve(key)
+}
+
+func (this *PipePool) unreserve(key string) {
+	this.reserved[key]--
+	if this.reserved[key] <= 0 {
+		delete(this.reserved, key)
+	}
+	this.released.Broadcast()
+}
+
+/*
+*
+放入管道，已经存在，已经关闭或者达到上限返回false
+*/
+func (this *PipePool) Put(key string, p *pipe.Pipe) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if p.IsClosed() {
+		return false
+	}
+	ps := this.pipes[key]
+	for _, old := range ps {
+		if old == p {
+			return false
+		}
+	}
+	if len(ps) >= this.maxStreams {
+		return false
+	}
+	this.pipes[key] = append(ps, p)
+
+	return true
+}
+
+/*
+*
+移除管道，返回是否存在
+*/
+func (this *PipePool) Remove(key string, p *pipe.Pipe) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	ps := this.pipes[key]
+	for i, old := range ps {
+		if old == p {
+			ps = append(ps[:i:i], ps[i+1:]...)
+			if len(ps) == 0 {
+				delete(this.pipes, key)
+			} else {
+				this.pipes[key] = ps
+			}
+			atomic.AddInt64(&this.evicted, 1)
+			this.released.Broadcast()
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+*
+在所有的键下查找并移除管道
+*/
+func (this *PipePool) RemovePipe(p *pipe.Pipe) bool {
+	this.mutex.RLock()
+	key := ""
+	found := false
+	for k, ps := range this.pipes {
+		for _, old := range ps {
+			if old == p {
+				key = k
+				found = true
+				break
+			}
+		}
+	}
+	this.mutex.RUnlock()
+	if found {
+		return this.Remove(key, p)
+	}
+
+	return false
+}
+
+/*
+*
+移除指定流的管道
+*/
+func (this *PipePool) RemoveStream(key string, streamId string) {
+	this.mutex.RLock()
+	var found *pipe.Pipe
+	for _, p := range this.pipes[key] {
+		if p.GetStream().ID() == streamId {
+			found = p
+			break
+		}
+	}
+	this.mutex.RUnlock()
+	if found != nil {
+		this.Remove(key, found)
+	}
+}
+
+func (this *PipePool) opening() {
+	atomic.AddInt64(&this.opened, 1)
+}
+
+func (this *PipePool) reusing() {
+	atomic.AddInt64(&this.reused, 1)
+}
+
+func (this *PipePool) Metrics() *PipePoolMetrics {
+	this.mutex.RLock()
+	size := 0
+	for _, ps := range this.pipes {
+		size += len(ps)
+	}
+	this.mutex.RUnlock()
+
+	return &PipePoolMetrics{
+		Opened:  atomic.LoadInt64(&this.opened),
+		Reused:  atomic.LoadInt64(&this.reused),
+		Evicted: atomic.LoadInt64(&this.evicted),
+		Size:    size,
+	}
+}
+
+/*
+*
+定时重置空闲的管道，管道的关闭处理器负责从池中移除
+*/
+func (this *PipePool) loopIdle() {
+	ticker := time.NewTicker(this.idleTimeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		var idles []*pipe.Pipe
+		now := time.Now()
+		this.mutex.RLock()
+		for _, ps := range this.pipes {
+			for _, p := range ps {
+				if p.InFlight() == 0 && now.Sub(p.LastActiveTime()) > this.idleTimeout {
+					idles = append(idles, p)
+				}
+			}
+		}
+		this.mutex.RUnlock()
+		for _, p := range idles {
+			logger.Sugar.Debugf("%v reset idle pipe, streamId: %v", this.name, p.GetStream().ID())
+			_ = p.Reset()
+		}
+	}
+}
+
+/*
+*
+线程安全的libp2p连接池，connectSessionId与连接的映射
+*/
+type ConnectionPool struct {
+	mutex sync.RWMutex
+	conns map[string]network.Conn
+}
+
+func NewConnectionPool() *ConnectionPool {
+	return &ConnectionPool{conns: make(map[string]network.Conn)}
+}
+
+func (this *ConnectionPool) Get(connectSessionId string) (network.Conn, bool) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	conn, ok := this.conns[connectSessionId]
+
+	return conn, ok
+}
+
+/*
+*
+放入连接，返回被替换的旧连接
+*/
+func (this *ConnectionPool) Put(connectSessionId string, conn network.Conn) network.Conn {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	old, ok := this.conns[connectSessionId]
+	this.conns[connectSessionId] = conn
+	if ok && old != conn {
+		return old
+	}
+
+	return nil
+}
+
+func (this *ConnectionPool) Delete(connectSessionId string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	_, ok := this.conns[connectSessionId]
+	delete(this.conns, connectSessionId)
+
+	return ok
+}
+
+func pipePoolParams() (int, time.Duration) {
+	maxStreams, _ := config.GetInt("libp2p.pipe.maxStreamsPerPeer", 4)
+	idleTimeout, _ := config.GetInt("libp2p.pipe.idleTimeout", 300000)
+
+	return maxStreams, time.Millisecond * time.Duration(idleTimeout)
+}
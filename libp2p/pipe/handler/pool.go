@@ -1,11 +1,12 @@
 package handler
 
 import (
-	"context"
+	"errors"
 	"github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-node/libp2p/global"
 	"github.com/curltech/go-colla-node/libp2p/ns"
 	"github.com/curltech/go-colla-node/libp2p/pipe"
+	"github.com/curltech/go-colla-node/p2p/codec"
 	"github.com/curltech/go-colla-node/p2p/dht/entity"
 	"github.com/curltech/go-colla-node/p2p/dht/service"
 	"github.com/curltech/go-colla-node/p2p/msgtype"
@@ -18,41 +19,155 @@ import (
 	"time"
 )
 
-// PipePool libp2p的连接池
-var NetworkConnectionPool = make(map[string]network.Conn)
+// NetworkConnectionPool libp2p的连接池
+var NetworkConnectionPool = NewConnectionPool()
 
-var RequestPipePool = make(map[string]*pipe.Pipe)
+// RequestPipePool 主动创建的管道，按照对方的peerId复用
+var RequestPipePool *PipePool
 
-var ResponsePipePool = make(map[string]*pipe.Pipe)
+// ResponsePipePool 对方创建的管道，按照connectSessionId查找
+var ResponsePipePool *PipePool
+
+// 管道创建以后的处理器，比如与对方握手
+var pipeOpenedHandlers = make([]func(p *pipe.Pipe), 0)
+
+/*
+*
+登记管道创建以后的处理器，处理器不能阻塞，需要通信的在另外的协程中进行
+*/
+func RegistPipeOpenedHandler(pipeOpenedHandler func(p *pipe.Pipe)) {
+	pipeOpenedHandlers = append(pipeOpenedHandlers, pipeOpenedHandler)
+}
+
+func init() {
+	maxStreams, idleTimeout := pipePoolParams()
+	RequestPipePool = NewPipePool("RequestPipePool", maxStreams, idleTimeout)
+	ResponsePipePool = NewPipePool("ResponsePipePool", maxStreams, idleTimeout)
+}
 
 func GetResponsePipe(connectSessionId string) *pipe.Pipe {
-	p, ok := ResponsePipePool[connectSessionId]
-	if ok {
+	p, reserved := ResponsePipePool.acquire(connectSessionId, true)
+	if !reserved {
 		return p
-	} else {
-		conn, ok := NetworkConnectionPool[connectSessionId]
-		if ok {
-			stream, err := conn.NewStream(context.Background())
-			if err != nil {
-				logger.Sugar.Errorf(err.Error())
-				return nil
-			}
-			_ = stream.SetProtocol(global.Global.ChainProtocolID)
-			p, err := pipe.CreatePipe(stream, HandleRaw, msgtype.MsgDirect_Request)
-			if err != nil {
-				logger.Sugar.Errorf(err.Error())
-				return nil
-			}
-			if p != nil {
-				ResponsePipePool[connectSessionId] = p
-				return p
-			}
+	}
+	conn, ok := NetworkConnectionPool.Get(connectSessionId)
+	if !ok {
+		ResponsePipePool.cancel(connectSessionId)
+		return nil
+	}
+	//管道已经关闭，在原来的连接上重新建立流
+	stream, err := global.Global.Host.NewStream(global.Global.Context, conn.RemotePeer(), pipe.ProtocolIDs(global.Global.ChainProtocolID)...)
+	if err != nil {
+		ResponsePipePool.cancel(connectSessionId)
+		logger.Sugar.Errorf(err.Error())
+		return nil
+	}
+	p, err = newPipe(stream, msgtype.MsgDirect_Request)
+	if err != nil {
+		ResponsePipePool.cancel(connectSessionId)
+		_ = stream.Reset()
+		logger.Sugar.Errorf(err.Error())
+		return nil
+	}
+	ResponsePipePool.commit(connectSessionId, p)
+
+	return p
+}
+
+/*
+*
+创建管道，管道关闭的时候从连接池中移除，创建以后调用登记的处理器
+*/
+func newPipe(stream network.Stream, direct string) (*pipe.Pipe, error) {
+	p, err := pipe.CreatePipe(stream, HandleRaw, direct)
+	if err != nil {
+		return nil, err
+	}
+	p.SetCloseHandler(evict)
+	for _, pipeOpenedHandler := range pipeOpenedHandlers {
+		pipeOpenedHandler(p)
+	}
+
+	return p, nil
+}
+
+/*
+*
+从连接池中移除管道
+*/
+func evict(p *pipe.Pipe) {
+	ResponsePipePool.RemovePipe(p)
+	RequestPipePool.RemovePipe(p)
+	logger.Sugar.Debugf("evict pipe, connectSessionId: %v, streamId: %v", p.GetStream().Conn().ID(), p.GetStream().ID())
+}
+
+/*
+*
+按照优先级写到peer的请求管道，写失败的时候重置管道，重新建立一次流再写
+消息按照管道协商的编码序列化
+*/
+func WriteRequestPipe(peerId string, protocolId string, encoded *codec.Encoded, priority msgtype.Priority) (*pipe.Pipe, error) {
+	var err error
+	for i := 0; i < 2; i++ {
+		p := GetRequestPipe(peerId, protocolId)
+		if p == nil {
+			return nil, errors.New("NoPipe")
+		}
+		var data []byte
+		data, err = encoded.Marshal(p.Codec())
+		if err != nil {
+			return nil, err
+		}
+		_, _, err = p.WritePriority(data, false, priority)
+		if err == nil {
+			return p, nil
 		}
+		logger.Sugar.Errorf("pipe.Write failure: %v, reconnect", err)
+		_ = p.Reset()
 	}
-	return nil
+
+	return nil, err
+}
+
+/*
+*
+按照优先级写到connectSessionId的回应管道，写失败的时候重置管道，在原来的连接上重新建立一次流再写
+消息按照管道协商的编码序列化
+*/
+func WriteResponsePipe(connectSessionId string, encoded *codec.Encoded, priority msgtype.Priority) (*pipe.Pipe, error) {
+	var err error
+	for i := 0; i < 2; i++ {
+		p := GetResponsePipe(connectSessionId)
+		if p == nil {
+			return nil, errors.New("NoPipe")
+		}
+		var data []byte
+		data, err = encoded.Marshal(p.Codec())
+		if err != nil {
+			return nil, err
+		}
+		_, _, err = p.WritePriority(data, false, priority)
+		if err == nil {
+			return p, nil
+		}
+		logger.Sugar.Errorf("pipe.Write failure: %v, reconnect", err)
+		_ = p.Reset()
+	}
+
+	return nil, err
 }
 
-// GetRequestPipe 主动发送消息获取管道，如果流不存在，创建一个
+// GetPipePoolMetrics 管道池的计数，key是管道池的名字
+func GetPipePoolMetrics() map[string]*PipePoolMetrics {
+	return map[string]*PipePoolMetrics{
+		"request":  RequestPipePool.Metrics(),
+		"response": ResponsePipePool.Metrics(),
+	}
+}
+
+// GetRequestPipe 主动发送消息获取管道，帧格式的管道可以复用，
+// 已有的管道都在写出或者等待回应并且没有达到上限的时候创建一个新的
+// 原来格式的管道只能用一次，不放入连接池
 func GetRequestPipe(peerId string, protocolId string) *pipe.Pipe {
 	var id peer.ID
 	if strings.HasPrefix(peerId, "/") {
@@ -81,32 +196,42 @@ func GetRequestPipe(peerId string, protocolId string) *pipe.Pipe {
 			id = p
 		}
 	}
+	key := id.String()
+	p, reserved := RequestPipePool.acquire(key, false)
+	if !reserved {
+		return p
+	}
 	// 主动创建流和管道与其他peer沟通，发消息，handler用于最终发送前消息的预先处理，或者接收消息后的处理
-	stream, err := global.Global.Host.NewStream(global.Global.Context, id, protocol.ID(protocolId))
+	stream, err := global.Global.Host.NewStream(global.Global.Context, id, pipe.ProtocolIDs(protocol.ID(protocolId))...)
 	if err != nil {
+		RequestPipePool.cancel(key)
 		logger.Sugar.Errorf("NewStream failed:%v", err)
 		return nil
+	}
+	// 设置通用的收到消息流的处理器，被动接收其他peer发送过来的消息，无论哪种协议类型，都放在HandleRaw中分发
+	p, err = newPipe(stream, msgtype.MsgDirect_Request)
+	if err != nil {
+		RequestPipePool.cancel(key)
+		_ = stream.Reset()
+		logger.Sugar.Errorf(err.Error())
+		return nil
+	}
+	//帧格式的管道可以并发复用，放入连接池，原来的格式写一次以后关闭，不占用预留的位置
+	if p.IsFramed() {
+		RequestPipePool.commit(key, p)
 	} else {
-		// 设置通用的收到消息流的处理器，被动接收其他peer发送过来的消息，无论哪种协议类型，都放在HandleRaw中分发
-		p, err := pipe.CreatePipe(stream, HandleRaw, msgtype.MsgDirect_Request)
-		if err != nil {
-			logger.Sugar.Errorf(err.Error())
-			return nil
-		}
-		if p != nil {
-			conn := p.GetStream().Conn()
-			if conn != nil {
-				peerId := conn.RemotePeer().String()
-				logger.Sugar.Debugf("GetRequestPipe-remote peer: %v %v, steamId: %v", peerId, conn.ID(), stream.ID())
-			}
-			return p
-		}
+		RequestPipePool.cancel(key)
 	}
-	return nil
+	conn := p.GetStream().Conn()
+	if conn != nil {
+		logger.Sugar.Debugf("GetRequestPipe-remote peer: %v %v, steamId: %v", conn.RemotePeer().String(), conn.ID(), stream.ID())
+	}
+
+	return p
 }
 
 func CreatePipe(stream network.Stream, direct string) *pipe.Pipe {
-	p, err := pipe.CreatePipe(stream, HandleRaw, direct)
+	p, err := newPipe(stream, direct)
 	if err != nil {
 		logger.Sugar.Errorf(err.Error())
 		return nil
@@ -118,21 +243,13 @@ func CreatePipe(stream network.Stream, direct string) *pipe.Pipe {
 			logger.Sugar.Debugf("CreatePipe-remote peer: %v %v, steamId: %v", peerId, conn.ID(), stream.ID())
 			connectSessionId := conn.ID()
 			logger.Sugar.Debugf("CreatePipe-connectSessionId: %v", connectSessionId)
-			oldConn, ok := NetworkConnectionPool[connectSessionId]
-			if ok {
-				if conn != oldConn {
-					logger.Sugar.Debugf("----------CreatePipe-resetConn: v%", connectSessionId)
-					_ = oldConn.Close()
-					NetworkConnectionPool[connectSessionId] = conn
-				}
-			} else {
-				logger.Sugar.Debugf("----------CreatePipe-newConn: %v", connectSessionId)
-				NetworkConnectionPool[connectSessionId] = conn
-			}
-			_, ok = ResponsePipePool[connectSessionId]
-			if !ok {
-				ResponsePipePool[connectSessionId] = p
+			oldConn := NetworkConnectionPool.Put(connectSessionId, conn)
+			if oldConn != nil {
+				logger.Sugar.Debugf("----------CreatePipe-resetConn: %v", connectSessionId)
+				_ = oldConn.Close()
 			}
+			ResponsePipePool.opening()
+			ResponsePipePool.Put(connectSessionId, p)
 		}
 		return p
 	}
@@ -141,20 +258,15 @@ func CreatePipe(stream network.Stream, direct string) *pipe.Pipe {
 
 func Close(peerId string, protocolId string, connectSessionId string, streamId string) {
 	logger.Sugar.Debugf("Close-connectSessionId: %v", connectSessionId)
-	p, ok := ResponsePipePool[connectSessionId]
-	if ok {
-		if p.GetStream().ID() == streamId {
-			delete(ResponsePipePool, connectSessionId)
-		}
-	}
+	ResponsePipePool.RemoveStream(connectSessionId, streamId)
+	RequestPipePool.RemoveStream(peerId, streamId)
 }
 
 func Disconnect(peerId string, clientId string, connectSessionId string) {
 	logger.Sugar.Debugf("Disconnect-connectSessionId: %v", connectSessionId)
-	_, ok := NetworkConnectionPool[connectSessionId]
+	ok := NetworkConnectionPool.Delete(connectSessionId)
 	if ok {
 		logger.Sugar.Debugf("----------deleteConn: %v", connectSessionId)
-		delete(NetworkConnectionPool, connectSessionId)
 		// 更新信息
 		k := ns.GetPeerClientKey(peerId)
 		peerClients, err := service.GetPeerClientService().GetLocals(k, clientId)
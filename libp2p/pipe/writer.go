@@ -0,0 +1,160 @@
+package pipe
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"sync"
+)
+
+/*
+*
+帧格式管道的写出任务，一个消息的剩余数据
+*/
+type writeTask struct {
+	streamId uint64
+	data     []byte
+	priority msgtype.Priority
+	done     chan error
+}
+
+/*
+*
+帧格式管道的写出调度，每个优先级一个队列
+大消息按帧写出，每写完一帧重新选择优先级最高的任务，实时的消息不用等待大消息写完
+同一个优先级的任务轮流写出，接收方按照流编号拼接续帧
+*/
+type frameWriter struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	queues [msgtype.PriorityCount][]*writeTask
+	closed bool
+}
+
+func newFrameWriter() *frameWriter {
+	writer := &frameWriter{}
+	writer.cond = sync.NewCond(&writer.mutex)
+
+	return writer
+}
+
+/*
+*
+加入写出队列，返回写完或者失败的通知通道
+*/
+func (this *frameWriter) push(streamId uint64, data []byte, priority msgtype.Priority) <-chan error {
+	if priority < msgtype.Priority_Realtime || priority >= msgtype.PriorityCount {
+		priority = msgtype.Priority_Normal
+	}
+	task := &writeTask{streamId: streamId, data: data, priority: priority, done: make(chan error, 1)}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		task.done <- errors.New("PipeClosed")
+		return task.done
+	}
+	this.queues[priority] = append(this.queues[priority], task)
+	this.cond.Signal()
+
+	return task.done
+}
+
+/*
+*
+取优先级最高的任务，没有任务的时候等待，关闭以后返回false
+*/
+func (this *frameWriter) next() (*writeTask, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for {
+		if this.closed {
+			return nil, false
+		}
+		for priority, queue := range this.queues {
+			if len(queue) > 0 {
+				task := queue[0]
+				queue[0] = nil
+				this.queues[priority] = queue[1:]
+				return task, true
+			}
+		}
+		this.cond.Wait()
+	}
+}
+
+/*
+*
+还有剩余数据的任务放回自己队列的末尾
+*/
+func (this *frameWriter) requeue(task *writeTask) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		task.done <- errors.New("PipeClosed")
+		return
+	}
+	this.queues[task.priority] = append(this.queues[task.priority], task)
+}
+
+func (this *frameWriter) empty() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, queue := range this.queues {
+		if len(queue) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+*
+关闭以后所有没有写完的任务失败
+*/
+func (this *frameWriter) close() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return
+	}
+	this.closed = true
+	for priority, queue := range this.queues {
+		for _, task := range queue {
+			task.done <- errors.New("PipeClosed")
+		}
+		this.queues[priority] = nil
+	}
+	this.cond.Broadcast()
+}
+
+/*
+*
+帧格式管道的写协程，每次写出一帧，队列空的时候才Flush，写失败的时候重置管道
+*/
+func (pipe *Pipe) loopWrite() {
+	for {
+		task, ok := pipe.writer.next()
+		if !ok {
+			return
+		}
+		pipe.touch()
+		pipe.setWriteDeadline()
+		rest, last, err := writeChunk(pipe.rw.Writer, task.streamId, task.data)
+		if err == nil && (last || pipe.writer.empty()) {
+			err = pipe.rw.Flush()
+		}
+		if err != nil {
+			logger.Sugar.Errorf("Error writing frame, streamId: %v, error: %v", task.streamId, err)
+			task.done <- err
+			pipe.Reset()
+			return
+		}
+		if last {
+			task.done <- nil
+			continue
+		}
+		task.data = rest
+		pipe.writer.requeue(task)
+	}
+}
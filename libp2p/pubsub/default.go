@@ -1,10 +1,12 @@
 package pubsub
 
 import (
+	"context"
 	"github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-node/libp2p/global"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"sync"
 )
 
 var messageHandler func(data []byte, remotePeerId string, clientId string, connectSessionId string, remoteAddr string) ([]byte, error)
@@ -26,48 +28,81 @@ var Pubsub *pubsub.PubSub
 
 var PubsubTopicPool = make(map[string]*PubsubTopic, 0)
 
+var mutex sync.Mutex
+
+var messageValidator func(topicname string, data []byte) bool
+
 /*
 *
-加入主题，可以向这个主题发消息
-如果主题不存在，创建新的
+注册主题消息的校验器，GossipSub转发和分发消息之前调用，校验失败的消息丢弃，不再转发
 */
-func joinTopic(topicname string) (*PubsubTopic, error) {
-	// create a new PubSub service using the GossipSub router
-	var err error
-	pubsubTopic, ok := PubsubTopicPool[topicname]
-	if !ok {
-		Pubsub, err = pubsub.NewGossipSub(global.Global.Context, global.Global.Host)
+func RegistValidator(validator func(topicname string, data []byte) bool) {
+	messageValidator = validator
+}
+
+/*
+*
+所有的主题共用一个GossipSub
+*/
+func getPubsub() (*pubsub.PubSub, error) {
+	if Pubsub == nil {
+		ps, err := pubsub.NewGossipSub(global.Global.Context, global.Global.Host)
 		if err != nil {
 			return nil, err
 		}
-		pubsubTopic = &PubsubTopic{}
-		PubsubTopicPool[topicname] = pubsubTopic
+		Pubsub = ps
+	}
+
+	return Pubsub, nil
+}
+
+/*
+*
+加入主题，可以向这个主题发消息
+如果主题不存在，创建新的，同时注册主题的消息校验器
+*/
+func joinTopic(topicname string) (*PubsubTopic, error) {
+	pubsubTopic, ok := PubsubTopicPool[topicname]
+	if ok {
+		return pubsubTopic, nil
 	}
-	if pubsubTopic.Topic != nil {
-		pubsubTopic.Topic.Close()
-		pubsubTopic.Topic = nil
+	ps, err := getPubsub()
+	if err != nil {
+		return nil, err
 	}
-	topic, err := Pubsub.Join(topicname, nil)
+	err = ps.RegisterTopicValidator(topicname, func(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+		if messageValidator == nil {
+			return true
+		}
+		return messageValidator(topicname, msg.Data)
+	})
 	if err != nil {
 		return nil, err
 	}
-	pubsubTopic.Topic = topic
+	topic, err := ps.Join(topicname, nil)
+	if err != nil {
+		_ = ps.UnregisterTopicValidator(topicname)
+		return nil, err
+	}
+	pubsubTopic = &PubsubTopic{Topic: topic}
+	PubsubTopicPool[topicname] = pubsubTopic
 
 	return pubsubTopic, nil
 }
 
 /*
 *
-订阅主题，可以接收发给这个主题的消息
+订阅主题，可以接收发给这个主题的消息，已经订阅的直接返回
 */
 func Subscribe(topicname string) (*PubsubTopic, error) {
-	var err error
-	pubsubTopic, ok := PubsubTopicPool[topicname]
-	if !ok {
-		pubsubTopic, err = joinTopic(topicname)
-		if err != nil {
-			return nil, err
-		}
+	mutex.Lock()
+	defer mutex.Unlock()
+	pubsubTopic, err := joinTopic(topicname)
+	if err != nil {
+		return nil, err
+	}
+	if pubsubTopic.Sub != nil {
+		return pubsubTopic, nil
 	}
 	pubsubTopic.Sub, err = pubsubTopic.Topic.Subscribe()
 	if err != nil {
@@ -80,25 +115,49 @@ func Subscribe(topicname string) (*PubsubTopic, error) {
 
 /*
 *
-无限循环读取
+取消订阅主题，仍然可以向这个主题发消息
 */
-func subLoop(sub *pubsub.Subscription) error {
+func Unsubscribe(topicname string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	pubsubTopic, ok := PubsubTopicPool[topicname]
+	if !ok || pubsubTopic.Sub == nil {
+		return
+	}
+	pubsubTopic.Sub.Cancel()
+	pubsubTopic.Sub = nil
+}
+
+/*
+*
+无限循环读取，取消订阅的时候结束
+*/
+func subLoop(sub *pubsub.Subscription) {
 	for {
 		topicMsg, err := sub.Next(global.Global.Context)
 		if err != nil {
-			logger.Sugar.Errorf("%v", err)
-			continue
+			logger.Sugar.Errorf("topic: %v subscription end: %v", sub.Topic(), err)
+			return
 		}
-		messageHandler(topicMsg.Data, "", "", "", "")
+		_, _ = messageHandler(topicMsg.Data, "", "", "", "")
 	}
-
-	return nil
 }
 
+/*
+*
+向主题发消息，没有加入的主题先加入
+*/
 func SendRaw(topicname string, data []byte) {
-	pubsubTopic, ok := PubsubTopicPool[topicname]
-	if ok {
-		pubsubTopic.Topic.Publish(global.Global.Context, data, pubHandle)
+	mutex.Lock()
+	pubsubTopic, err := joinTopic(topicname)
+	mutex.Unlock()
+	if err != nil {
+		logger.Sugar.Errorf("cannot join topic: %v, err: %v", topicname, err)
+		return
+	}
+	err = pubsubTopic.Topic.Publish(global.Global.Context, data, pubHandle)
+	if err != nil {
+		logger.Sugar.Errorf("publish topic: %v failure: %v", topicname, err)
 	}
 }
 
@@ -1,6 +1,7 @@
 package action
 
 import (
+	"context"
 	"github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-core/util/security"
 	"github.com/curltech/go-colla-node/p2p/chain/handler"
@@ -43,12 +44,32 @@ func (this *BaseAction) Send(chainMessage *entity.ChainMessage) (*entity.ChainMe
 	return response, err
 }
 
+/**
+主动发送消息，请求消息会等待对方的回应，直到ctx超时或者取消
+*/
+func (this *BaseAction) SendWithContext(ctx context.Context, chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+	logger.Sugar.Infof("Send %v message", this.MsgType)
+	response, err := sender.SendWithContext(ctx, chainMessage)
+
+	return response, err
+}
+
+/**
+主动发送不需要等待回应的消息，发出以后立即返回
+*/
+func (this *BaseAction) Post(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+	logger.Sugar.Infof("Post %v message", this.MsgType)
+	response, err := sender.Post(chainMessage)
+
+	return response, err
+}
+
 /**
 接收消息进行处理，返回为空则没有返回消息，否则，有返回消息
 */
 func (this *BaseAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
 	logger.Sugar.Infof("Receive %v message", this.MsgType)
-	go sender.RelaySend(chainMessage)
+	go sender.Relay(chainMessage)
 	response := handler.Response(chainMessage.MessageType, time.Now())
 
 	return response, nil
@@ -34,4 +34,9 @@ func init() {
 	ChatAction = chatAction{}
 	ChatAction.MsgType = msgtype.CHAT
 	handler.RegistChainMessageHandler(msgtype.CHAT, ChatAction.Send, ChatAction.Receive, ChatAction.Response)
+	handler.RegistChainMessageSchema(msgtype.CHAT, &handler.ChainMessageSchema{
+		RequiredFields:  []string{"TargetPeerId"},
+		StoreAndForward: true,
+		NeedReceipt:     true,
+	})
 }
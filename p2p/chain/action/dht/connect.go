@@ -39,6 +39,30 @@ func (conn *connectAction) Receive(chainMessage *entity2.ChainMessage) (*entity2
 	if err != nil {
 		return response, err
 	}
+	//连接的PeerClient必须是发送者自己，会话在成功以后绑定到这个PeerClient
+	if chainMessage.SrcPeerId != "" && peerClient.PeerId != chainMessage.SrcPeerId {
+		return response, errors.New("IdentityMismatch")
+	}
+	if chainMessage.SrcClientId != "" && peerClient.ClientId != chainMessage.SrcClientId {
+		return response, errors.New("IdentityMismatch")
+	}
+	//已经保存的公钥不能替换，只有登录时校验过的公钥可以第一次登记，防止用连接替换公钥劫持登录
+	err = handler.CheckPeerPublicKey(chainMessage.ConnectSessionId, peerClient)
+	if err != nil {
+		return response, err
+	}
+	//客户端声明的协议版本和能力与本节点协商，保存协商的结果
+	handshake, err := handler.Negotiate(&entity2.Handshake{
+		PeerId:          peerClient.PeerId,
+		ClientId:        peerClient.ClientId,
+		ProtocolVersion: peerClient.ProtocolVersion,
+		Capabilities:    peerClient.Capabilities,
+	})
+	if err != nil {
+		return response, err
+	}
+	peerClient.ProtocolVersion = handshake.ProtocolVersion
+	peerClient.Capabilities = handshake.Capabilities
 	peerClient.ConnectSessionId = chainMessage.SrcConnectSessionId
 	peerClient.ConnectPeerId = chainMessage.SrcConnectPeerId
 	peerClient.ConnectAddress = chainMessage.SrcConnectAddress
@@ -48,6 +72,7 @@ func (conn *connectAction) Receive(chainMessage *entity2.ChainMessage) (*entity2
 	if err != nil {
 		return response, err
 	}
+	handler.RecordCapability(peerClient.PeerId, peerClient.ClientId, peerClient.ConnectSessionId, handshake)
 	logger.Sugar.Infof("peer connected successfully and put peer client, peerId: %v, connectSessionId: %v, activeStatus: %v", peerClient.PeerId, peerClient.ConnectSessionId, peerClient.ActiveStatus)
 	go conn.returnPeerEndpoint(chainMessage)
 	peerId := peerClient.PeerId
@@ -89,6 +114,8 @@ func (conn *connectAction) returnPeerEndpoint(chainMessage *entity2.ChainMessage
 	if err != nil {
 		response = handler.Error(msgtype.FINDPEER, err)
 	}
+	peerEndpoint.ProtocolVersion = msgtype.ProtocolVersion
+	peerEndpoint.Capabilities = msgtype.Capabilities()
 	peers = append(peers, &peerEndpoint)
 	var key = ns.GetPeerEndpointKey(peerEndpoint.PeerId)
 	// 添加最近节点
@@ -145,4 +172,9 @@ func init() {
 	ConnectAction = connectAction{}
 	ConnectAction.MsgType = msgtype.CONNECT
 	handler.RegistChainMessageHandler(msgtype.CONNECT, ConnectAction.Send, ConnectAction.Receive, ConnectAction.Response)
+	handler.RegistChainMessageSchema(msgtype.CONNECT, &handler.ChainMessageSchema{
+		PayloadTypes:         []string{handler.PayloadType_PeerClient},
+		ResponsePayloadTypes: []string{handler.PayloadType_PeerClients, handler.PayloadType_PeerEndpoints},
+		PayloadLimit:         handler.PayloadLimit,
+	})
 }
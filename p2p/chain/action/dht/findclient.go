@@ -16,33 +16,28 @@ type findClientAction struct {
 
 var FindClientAction findClientAction
 
+const PayloadType_FindClientCondition = "findClientCondition"
+
+// FindClientCondition FINDCLIENT请求的查询条件
+type FindClientCondition struct {
+	PeerId string `json:"peerId,omitempty"`
+	Mobile string `json:"mobile,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
 // Receive 根据peerid，mobile，name进行peerclient的查询，返回查询的结果
 func (this *findClientAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
 	logger.Sugar.Infof("Receive %v message", this.MsgType)
 	var response *entity.ChainMessage = nil
-	conditionBean, ok := chainMessage.Payload.(map[string]interface{})
-	if !ok {
+	condition := &FindClientCondition{}
+	err := handler.DecodePayload(chainMessage.Payload, condition)
+	if err != nil {
 		response = handler.Error(chainMessage.MessageType, errors.New("ErrorCondition"))
 		return response, nil
 	}
-	var peerId string = ""
-	var mobile string = ""
-	var email string = ""
-	var name string = ""
-	if conditionBean["peerId"] != nil {
-		peerId = conditionBean["peerId"].(string)
-	}
-	if conditionBean["mobile"] != nil {
-		mobile = conditionBean["mobile"].(string)
-	}
-	if conditionBean["email"] != nil {
-		email = conditionBean["email"].(string)
-	}
-	if conditionBean["name"] != nil {
-		name = conditionBean["name"].(string)
-	}
 
-	peerClients, err := service.GetPeerClientService().GetValues(peerId, mobile, email, name)
+	peerClients, err := service.GetPeerClientService().GetValues(condition.PeerId, condition.Mobile, condition.Email, condition.Name)
 	if err != nil {
 		response = handler.Error(chainMessage.MessageType, err)
 		return response, nil
@@ -56,5 +51,11 @@ func (this *findClientAction) Receive(chainMessage *entity.ChainMessage) (*entit
 func init() {
 	FindClientAction = findClientAction{}
 	FindClientAction.MsgType = msgtype.FINDCLIENT
+	handler.RegistPayloadType(PayloadType_FindClientCondition, func() interface{} { return &FindClientCondition{} })
 	handler.RegistChainMessageHandler(msgtype.FINDCLIENT, FindClientAction.Send, FindClientAction.Receive, FindClientAction.Response)
+	handler.RegistChainMessageSchema(msgtype.FINDCLIENT, &handler.ChainMessageSchema{
+		PayloadTypes:         []string{handler.PayloadType_Map, PayloadType_FindClientCondition},
+		ResponsePayloadTypes: []string{handler.PayloadType_PeerClients},
+		PayloadLimit:         handler.PayloadLimit,
+	})
 }
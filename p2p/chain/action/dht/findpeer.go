@@ -16,21 +16,26 @@ type findPeerAction struct {
 
 var FindPeerAction findPeerAction
 
+const PayloadType_FindPeerCondition = "findPeerCondition"
+
+// FindPeerCondition FINDPEER请求的查询条件
+type FindPeerCondition struct {
+	PeerId string `json:"peerId,omitempty"`
+}
+
 /**
 接收消息进行处理，返回为空则没有返回消息，否则，有返回消息
 */
 func (this *findPeerAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
 	logger.Sugar.Infof("Receive %v message", this.MsgType)
 	var response *entity.ChainMessage = nil
-	conditionBean, ok := chainMessage.Payload.(map[string]interface{})
-	if !ok {
+	condition := &FindPeerCondition{}
+	err := handler.DecodePayload(chainMessage.Payload, condition)
+	if err != nil {
 		response = handler.Error(chainMessage.MessageType, errors.New("ErrorCondition"))
 		return response, nil
 	}
-	var peerId string = ""
-	if conditionBean["peerId"] != nil {
-		peerId = conditionBean["peerId"].(string)
-	}
+	peerId := condition.PeerId
 	if len(peerId) > 0 {
 		addrInfo, err := service.GetPeerEndpointService().FindPeer(peerId)
 		if err != nil {
@@ -46,5 +51,10 @@ func (this *findPeerAction) Receive(chainMessage *entity.ChainMessage) (*entity.
 func init() {
 	FindPeerAction = findPeerAction{}
 	FindPeerAction.MsgType = msgtype.FINDPEER
+	handler.RegistPayloadType(PayloadType_FindPeerCondition, func() interface{} { return &FindPeerCondition{} })
 	handler.RegistChainMessageHandler(msgtype.FINDPEER, FindPeerAction.Send, FindPeerAction.Receive, FindPeerAction.Response)
+	handler.RegistChainMessageSchema(msgtype.FINDPEER, &handler.ChainMessageSchema{
+		PayloadTypes: []string{handler.PayloadType_Map, PayloadType_FindPeerCondition},
+		PayloadLimit: handler.PayloadLimit,
+	})
 }
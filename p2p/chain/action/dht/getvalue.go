@@ -39,4 +39,8 @@ func init() {
 	GetValueAction = getValueAction{}
 	GetValueAction.MsgType = msgtype.GETVALUE
 	handler.RegistChainMessageHandler(msgtype.GETVALUE, GetValueAction.Send, GetValueAction.Receive, GetValueAction.Response)
+	handler.RegistChainMessageSchema(msgtype.GETVALUE, &handler.ChainMessageSchema{
+		PayloadTypes: []string{handler.PayloadType_String},
+		PayloadLimit: handler.PayloadLimit,
+	})
 }
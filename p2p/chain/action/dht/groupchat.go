@@ -0,0 +1,184 @@
+package dht
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/global"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/p2p/chain/action"
+	"github.com/curltech/go-colla-node/p2p/chain/handler"
+	"github.com/curltech/go-colla-node/p2p/chain/handler/sender"
+	"github.com/curltech/go-colla-node/p2p/dht/service"
+	"github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"github.com/curltech/go-colla-node/p2p/push"
+)
+
+type groupChatAction struct {
+	action.BaseAction
+}
+
+var GroupChatAction groupChatAction
+
+/*
+*
+发送群组消息，由自己按照群组成员分发，payload用每个成员的公钥加密对称秘钥
+*/
+func (this *groupChatAction) GroupChat(groupId string, data interface{}) error {
+	chainMessage := this.PrepareSend("", data, "")
+	chainMessage.TargetGroupId = groupId
+	chainMessage.NeedEncrypt = true
+	err := handler.SendValidate(chainMessage)
+	if err != nil {
+		return err
+	}
+	_, err = handler.Encrypt(chainMessage)
+	if err != nil {
+		return err
+	}
+	err = handler.SignMessage(chainMessage)
+	if err != nil {
+		return err
+	}
+	// 转发链不为空，其他连接节点只送达自己的客户端
+	err = handler.AppendHop(chainMessage)
+	if err != nil {
+		return err
+	}
+
+	return this.fanOut(chainMessage, false)
+}
+
+/*
+*
+接收群组消息：发送者的连接节点向自己的客户端送达，为每个其他的连接节点转发一份，
+其他连接节点转发来的消息只送达自己的客户端
+*/
+func (this *groupChatAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+	logger.Sugar.Infof("Receive %v message", this.MsgType)
+	relayed := len(chainMessage.Hops) > 0
+	if !relayed {
+		err := sender.PrepareRelay(chainMessage)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := this.fanOut(chainMessage, relayed)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (this *groupChatAction) fanOut(chainMessage *entity.ChainMessage, relayed bool) error {
+	group, err := service.GetGroupService().GetValue(chainMessage.TargetGroupId)
+	if err != nil {
+		return err
+	}
+	err = handler.VerifyGroup(group)
+	if err != nil {
+		return err
+	}
+	if !group.IsMember(chainMessage.SrcPeerId) {
+		return errors.New("NotGroupMember")
+	}
+	// 连接节点与它的客户端成员
+	remotes := make(map[string][]string)
+	params := map[string]string{"name": senderName(chainMessage.SrcPeerId), "group": group.Name}
+	for _, peerId := range group.PeerIds() {
+		if peerId == chainMessage.SrcPeerId || global.IsMyself(peerId) {
+			continue
+		}
+		peerClient, _, err := sender.Lookup(peerId, "")
+		if err == nil && peerClient != nil && global.IsMyself(peerClient.ConnectPeerId) {
+			go sender.ForwardPeerClient(memberMessage(chainMessage, peerId), peerClient)
+			push.NotifyMessage(peerClient, push.Subtype_GroupChat, group.GroupId, params)
+			continue
+		}
+		if relayed {
+			continue
+		}
+		if err == nil && peerClient != nil && peerClient.ConnectPeerId != "" {
+			remotes[peerClient.ConnectPeerId] = append(remotes[peerClient.ConnectPeerId], peerId)
+			continue
+		}
+		// 找不到连接节点的成员单独转发，无法送达的时候保存
+		go sender.RelaySend(memberMessage(chainMessage, peerId))
+	}
+	for connectPeerId, peerIds := range remotes {
+		go forwardGroup(chainMessage, connectPeerId, peerIds)
+	}
+
+	return nil
+}
+
+// senderName 推送通知中显示的发送者名称，找不到的时候使用peerId
+func senderName(peerId string) string {
+	peerClients, err := service.GetPeerClientService().GetLocals(ns.GetPeerClientKey(peerId), "")
+	if err == nil && len(peerClients) > 0 && peerClients[0].Name != "" {
+		return peerClients[0].Name
+	}
+
+	return peerId
+}
+
+/*
+*
+转发给另一个连接节点，只带上这个节点的成员的PayloadKeys，失败的时候为每个成员单独转发
+*/
+func forwardGroup(chainMessage *entity.ChainMessage, connectPeerId string, peerIds []string) {
+	c := *chainMessage
+	c.PayloadKeys = filterPayloadKeys(chainMessage.PayloadKeys, peerIds...)
+	err := sender.WritePeerEndpoint(&c, connectPeerId)
+	if err == nil {
+		return
+	}
+	logger.Sugar.Errorf("forward group message uuid: %v to: %v failure: %v", chainMessage.UUID, connectPeerId, err)
+	for _, peerId := range peerIds {
+		_, _ = sender.RelaySend(memberMessage(chainMessage, peerId))
+	}
+}
+
+/*
+*
+给一个成员的副本，填写TargetPeerId，密文不变
+*/
+func memberMessage(chainMessage *entity.ChainMessage, peerId string) *entity.ChainMessage {
+	c := *chainMessage
+	c.TargetPeerId = peerId
+	c.Hops = append([]*entity.Hop(nil), chainMessage.Hops...)
+	c.PayloadKeys = filterPayloadKeys(chainMessage.PayloadKeys, peerId)
+
+	return &c
+}
+
+func filterPayloadKeys(payloadKeys []*entity.PayloadKey, peerIds ...string) []*entity.PayloadKey {
+	if len(payloadKeys) == 0 {
+		return payloadKeys
+	}
+	filtered := make([]*entity.PayloadKey, 0, len(peerIds))
+	for _, payloadKey := range payloadKeys {
+		for _, peerId := range peerIds {
+			if payloadKey.PeerId == peerId {
+				filtered = append(filtered, payloadKey)
+				break
+			}
+		}
+	}
+
+	return filtered
+}
+
+func init() {
+	GroupChatAction = groupChatAction{}
+	GroupChatAction.MsgType = msgtype.GROUPCHAT
+	handler.RegistChainMessageHandler(msgtype.GROUPCHAT, GroupChatAction.Send, GroupChatAction.Receive, GroupChatAction.Response)
+	handler.RegistChainMessageSchema(msgtype.GROUPCHAT, &handler.ChainMessageSchema{
+		RequiredFields:  []string{"TargetGroupId"},
+		PayloadLimit:    handler.PayloadLimit,
+		NeedSignature:   true,
+		StoreAndForward: true,
+		NeedReceipt:     true,
+	})
+}
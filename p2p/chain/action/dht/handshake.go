@@ -0,0 +1,174 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/global"
+	"github.com/curltech/go-colla-node/libp2p/pipe"
+	handler1 "github.com/curltech/go-colla-node/libp2p/pipe/handler"
+	"github.com/curltech/go-colla-node/p2p/chain/action"
+	"github.com/curltech/go-colla-node/p2p/chain/handler"
+	"github.com/curltech/go-colla-node/p2p/chain/handler/sender"
+	"github.com/curltech/go-colla-node/p2p/dht/service"
+	"github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"sync"
+	"time"
+)
+
+type handshakeAction struct {
+	action.BaseAction
+}
+
+var HandshakeAction handshakeAction
+
+var handshakeTimeout = 10 * time.Second
+
+// 正在握手的peerId，避免同一个节点同时打开多个流的时候重复握手
+var handshaking sync.Map
+
+/*
+*
+本节点打开到其他节点的流以后，在另外的协程中握手，同一个连接已经协商过的不再握手
+*/
+func (this *handshakeAction) pipeOpened(p *pipe.Pipe) {
+	if p.GetDirect() != msgtype.MsgDirect_Request {
+		return
+	}
+	stream := p.GetStream()
+	if pipe.BaseProtocolID(stream.Protocol()) != global.Global.ChainProtocolID {
+		return
+	}
+	conn := stream.Conn()
+	if conn == nil {
+		return
+	}
+	peerId := conn.RemotePeer().String()
+	connectionId := conn.ID()
+	if handler.HasCapability(peerId, "", connectionId) {
+		return
+	}
+	if _, loaded := handshaking.LoadOrStore(peerId, connectionId); loaded {
+		return
+	}
+	go func() {
+		defer handshaking.Delete(peerId)
+		_, err := this.Handshake(peerId, connectionId)
+		if err != nil {
+			logger.Sugar.Warnf("handshake with peer: %v failure: %v", peerId, err)
+		}
+	}()
+}
+
+/*
+*
+与节点握手，记录协商的结果
+对方拒绝版本的时候记录错误，以后发往这个节点的消息都返回这个错误，
+对方是不认识握手的老节点或者没有回应的时候作为老版本记录
+*/
+func (this *handshakeAction) Handshake(peerId string, connectionId string) (*entity.Handshake, error) {
+	chainMessage := this.PrepareSend(peerId, handler.LocalHandshake(), peerId)
+	chainMessage.PayloadType = handler.PayloadType_Handshake
+	chainMessage.NeedCompress = false
+	ctx, cancel := context.WithTimeout(global.Global.Context, handshakeTimeout)
+	defer cancel()
+	response, err := sender.DirectSendWithContext(ctx, chainMessage)
+	if err != nil {
+		if ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, err
+		}
+		handshake := &entity.Handshake{PeerId: peerId, ProtocolVersion: msgtype.LegacyProtocolVersion}
+		if err.Error() == handler.ErrUnsupportedProtocolVersion.Error() {
+			handshake.Error = err.Error()
+			handler.RecordCapability(peerId, "", connectionId, handshake)
+			return handshake, err
+		}
+		logger.Sugar.Debugf("handshake with peer: %v failure: %v, as legacy peer", peerId, err)
+		handler.RecordCapability(peerId, "", connectionId, handshake)
+		return handshake, nil
+	}
+	remote := &entity.Handshake{}
+	err = handler.DecodePayload(response.Payload, remote)
+	if err != nil {
+		return nil, err
+	}
+	//对方回应的是它协商的结果，本节点再协商一次，结果是相同的
+	handshake, err := handler.Negotiate(remote)
+	if err != nil {
+		handshake = &entity.Handshake{PeerId: peerId, ProtocolVersion: remote.ProtocolVersion, Error: err.Error()}
+		handler.RecordCapability(peerId, "", connectionId, handshake)
+		return handshake, err
+	}
+	handshake.PeerId = peerId
+	handler.RecordCapability(peerId, "", connectionId, handshake)
+	updatePeerEndpoint(handshake)
+
+	return handshake, nil
+}
+
+/*
+*
+接收节点的握手，协商版本和能力，回应协商的结果，版本不兼容的返回UnsupportedProtocolVersion错误
+*/
+func (this *handshakeAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+	logger.Sugar.Infof("Receive %v message", this.MsgType)
+	remote := &entity.Handshake{}
+	err := handler.DecodePayload(chainMessage.Payload, remote)
+	if err != nil {
+		return nil, err
+	}
+	peerId := chainMessage.SrcPeerId
+	if peerId == "" {
+		peerId = remote.PeerId
+	}
+	handshake, err := handler.Negotiate(remote)
+	if err != nil {
+		handler.RecordCapability(peerId, "", chainMessage.ConnectSessionId, &entity.Handshake{PeerId: peerId, ProtocolVersion: remote.ProtocolVersion, Error: err.Error()})
+		return nil, err
+	}
+	record := *handshake
+	record.PeerId = peerId
+	handler.RecordCapability(peerId, "", chainMessage.ConnectSessionId, &record)
+	updatePeerEndpoint(&record)
+	response := handler.Response(chainMessage.MessageType, handshake)
+	response.PayloadType = handler.PayloadType_Handshake
+	response.NeedCompress = false
+
+	return response, nil
+}
+
+/*
+*
+把协商的结果写到本地保存的节点信息，供查询
+*/
+func updatePeerEndpoint(handshake *entity.Handshake) {
+	peerEndpoints, err := service.GetPeerEndpointService().GetLocal(handshake.PeerId)
+	if err != nil {
+		logger.Sugar.Errorf("failed to GetLocal PeerEndPoint: %v, err: %v", handshake.PeerId, err)
+		return
+	}
+	for _, peerEndpoint := range peerEndpoints {
+		peerEndpoint.ProtocolVersion = handshake.ProtocolVersion
+		peerEndpoint.Capabilities = handshake.Capabilities
+		err = service.GetPeerEndpointService().PutLocal(peerEndpoint)
+		if err != nil {
+			logger.Sugar.Errorf("failed to PutLocal PeerEndPoint: %v, err: %v", handshake.PeerId, err)
+		}
+	}
+}
+
+func init() {
+	timeout, _ := config.GetInt("p2p.chain.handshakeTimeout", 10000)
+	handshakeTimeout = time.Millisecond * time.Duration(timeout)
+	HandshakeAction = handshakeAction{}
+	HandshakeAction.MsgType = msgtype.HANDSHAKE
+	handler.RegistChainMessageHandler(msgtype.HANDSHAKE, HandshakeAction.Send, HandshakeAction.Receive, HandshakeAction.Response)
+	handler.RegistChainMessageSchema(msgtype.HANDSHAKE, &handler.ChainMessageSchema{
+		PayloadTypes:         []string{handler.PayloadType_Handshake},
+		ResponsePayloadTypes: []string{handler.PayloadType_Handshake},
+		PayloadLimit:         handler.PayloadLimit,
+	})
+	handler1.RegistPipeOpenedHandler(HandshakeAction.pipeOpened)
+}
@@ -35,7 +35,7 @@ peerId如果为空，发送的对象是自己，需要检查如果是自己，
 func (this *ionSignalAction) Signal(peerId string, data interface{}, targetPeerId string) (interface{}, error) {
 	chainMessage := this.PrepareSend(peerId, data, targetPeerId)
 
-	response, err := this.Send(chainMessage)
+	response, err := this.Post(chainMessage)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +64,7 @@ func (this *ionSignalAction) Receive(chainMessage *entity.ChainMessage) (*entity
 			response = handler.Response(chainMessage.MessageType, res)
 		}
 	} else {
-		return sender.RelaySend(chainMessage)
+		return sender.Relay(chainMessage)
 	}
 
 	return response, err
@@ -74,4 +74,8 @@ func init() {
 	IonSignalAction = ionSignalAction{}
 	IonSignalAction.MsgType = msgtype.IONSIGNAL
 	handler.RegistChainMessageHandler(msgtype.IONSIGNAL, IonSignalAction.Send, IonSignalAction.Receive, IonSignalAction.Response)
+	handler.RegistChainMessageSchema(msgtype.IONSIGNAL, &handler.ChainMessageSchema{
+		RequiredFields: []string{"TargetPeerId"},
+		PayloadTypes:   []string{handler.PayloadType_Map},
+	})
 }
@@ -0,0 +1,67 @@
+package dht
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/p2p/chain/action"
+	"github.com/curltech/go-colla-node/p2p/chain/handler"
+	"github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+)
+
+type loginAction struct {
+	action.BaseAction
+}
+
+var LoginAction loginAction
+
+/*
+*
+接收客户端的登录，没有签名的请求回应随机数，有签名的请求校验以后绑定连接会话
+已经登录的会话不能再登录为其他peerId
+*/
+func (this *loginAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+	logger.Sugar.Infof("Receive %v message", this.MsgType)
+	login := &entity.Login{}
+	err := handler.DecodePayload(chainMessage.Payload, login)
+	if err != nil {
+		return nil, err
+	}
+	connectSessionId := chainMessage.ConnectSessionId
+	session := handler.GetSession(connectSessionId)
+	if session != nil && (session.PeerId != login.PeerId || session.ClientId != login.ClientId) {
+		return nil, errors.New("IdentityMismatch")
+	}
+	var result *entity.Login
+	if login.Signature == "" {
+		nonce, err := handler.Challenge(connectSessionId, login.PeerId, login.ClientId)
+		if err != nil {
+			return nil, err
+		}
+		result = &entity.Login{PeerId: login.PeerId, ClientId: login.ClientId, Nonce: nonce}
+	} else {
+		_, err = handler.Login(connectSessionId, login)
+		if err != nil {
+			logger.Sugar.Warnf("session: %v login peerId: %v failure: %v", connectSessionId, login.PeerId, err)
+			return nil, err
+		}
+		logger.Sugar.Infof("session: %v login peerId: %v, clientId: %v", connectSessionId, login.PeerId, login.ClientId)
+		result = &entity.Login{PeerId: login.PeerId, ClientId: login.ClientId}
+	}
+	response := handler.Response(chainMessage.MessageType, result)
+	response.PayloadType = handler.PayloadType_Login
+	response.NeedCompress = false
+
+	return response, nil
+}
+
+func init() {
+	LoginAction = loginAction{}
+	LoginAction.MsgType = msgtype.LOGIN
+	handler.RegistChainMessageHandler(msgtype.LOGIN, LoginAction.Send, LoginAction.Receive, LoginAction.Response)
+	handler.RegistChainMessageSchema(msgtype.LOGIN, &handler.ChainMessageSchema{
+		PayloadTypes:         []string{handler.PayloadType_Login},
+		ResponsePayloadTypes: []string{handler.PayloadType_Login},
+		PayloadLimit:         handler.PayloadLimit,
+	})
+}
@@ -3,7 +3,6 @@ package dht
 import (
 	"errors"
 	"github.com/curltech/go-colla-core/logger"
-	"github.com/curltech/go-colla-core/util/message"
 	"github.com/curltech/go-colla-node/livekit"
 	"github.com/curltech/go-colla-node/p2p/chain/action"
 	"github.com/curltech/go-colla-node/p2p/chain/handler"
@@ -19,6 +18,8 @@ type manageRoomAction struct {
 
 var ManageRoomAction manageRoomAction
 
+const PayloadType_LiveKitManageRoom = "liveKitManageRoom"
+
 type LiveKitManageRoom struct {
 	ManageType      string                   `json:"manageType,omitempty"`
 	EmptyTimeout    int64                    `json:"emptyTimeout,omitempty"`
@@ -37,18 +38,7 @@ func (this *manageRoomAction) Receive(chainMessage *entity.ChainMessage) (*entit
 	var response *entity.ChainMessage = nil
 	liveKitManageRoom := &LiveKitManageRoom{}
 	if chainMessage.Payload != nil {
-		conditionBean, ok := chainMessage.Payload.(map[string]interface{})
-		if !ok {
-			response = handler.Error(chainMessage.MessageType, errors.New("ErrorCondition"))
-			return response, nil
-		}
-		data, err := message.Marshal(conditionBean)
-		if err != nil {
-			response = handler.Error(chainMessage.MessageType, errors.New("ErrorCondition"))
-			return response, nil
-		}
-
-		err = message.Unmarshal(data, liveKitManageRoom)
+		err := handler.DecodePayload(chainMessage.Payload, liveKitManageRoom)
 		if err != nil {
 			response = handler.Error(chainMessage.MessageType, errors.New("ErrorCondition"))
 			return response, nil
@@ -115,5 +105,10 @@ func (this *manageRoomAction) Receive(chainMessage *entity.ChainMessage) (*entit
 func init() {
 	ManageRoomAction = manageRoomAction{}
 	ManageRoomAction.MsgType = msgtype.ManageRoom
+	handler.RegistPayloadType(PayloadType_LiveKitManageRoom, func() interface{} { return &LiveKitManageRoom{} })
 	handler.RegistChainMessageHandler(msgtype.ManageRoom, ManageRoomAction.Send, ManageRoomAction.Receive, ManageRoomAction.Response)
+	handler.RegistChainMessageSchema(msgtype.ManageRoom, &handler.ChainMessageSchema{
+		PayloadTypes: []string{handler.PayloadType_Map, PayloadType_LiveKitManageRoom},
+		PayloadLimit: handler.PayloadLimit,
+	})
 }
@@ -66,4 +66,8 @@ func init() {
 	PeerEndPointAction = peerEndPointAction{}
 	PeerEndPointAction.MsgType = msgtype.PEERENDPOINT
 	handler.RegistChainMessageHandler(msgtype.PEERENDPOINT, PeerEndPointAction.Send, PeerEndPointAction.Receive, PeerEndPointAction.Response)
+	handler.RegistChainMessageSchema(msgtype.PEERENDPOINT, &handler.ChainMessageSchema{
+		PayloadTypes: []string{handler.PayloadType_PeerEndpoint},
+		PayloadLimit: handler.PayloadLimit,
+	})
 }
@@ -35,4 +35,7 @@ func init() {
 	PingAction = pingAction{}
 	PingAction.MsgType = msgtype.PING
 	handler.RegistChainMessageHandler(msgtype.PING, PingAction.Send, PingAction.Receive, PingAction.Response)
+	handler.RegistChainMessageSchema(msgtype.PING, &handler.ChainMessageSchema{
+		PayloadLimit: handler.PayloadLimit,
+	})
 }
@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/p2p/chain/action"
+	"github.com/curltech/go-colla-node/p2p/chain/handler"
+	"github.com/curltech/go-colla-node/p2p/chain/handler/sender"
+	entity1 "github.com/curltech/go-colla-node/p2p/dht/entity"
+	"github.com/curltech/go-colla-node/p2p/dht/service"
+	"github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+)
+
+type presenceAction struct {
+	action.BaseAction
+}
+
+var PresenceAction presenceAction
+
+const PayloadType_PresenceCondition = "presenceCondition"
+
+// PresenceCondition PRESENCE请求关注或者取消关注的peerIds
+type PresenceCondition struct {
+	PeerIds []string `json:"peerIds,omitempty"`
+	Unwatch bool     `json:"unwatch,omitempty"`
+}
+
+/*
+*
+有主题的是在线状态主题收到的变化，写给关注的本地客户端
+没有主题的是本地客户端关注或者取消关注，关注的时候返回这些peerId当前的在线状态
+*/
+func (this *presenceAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+	logger.Sugar.Infof("Receive %v message", this.MsgType)
+	if chainMessage.Topic != "" {
+		this.deliver(chainMessage)
+		return nil, nil
+	}
+	condition := &PresenceCondition{}
+	err := handler.DecodePayload(chainMessage.Payload, condition)
+	if err != nil || len(condition.PeerIds) == 0 {
+		return handler.Error(chainMessage.MessageType, errors.New("NullPeerId")), nil
+	}
+	if len(condition.PeerIds) > handler.PresenceMaxWatch() {
+		return handler.Error(chainMessage.MessageType, errors.New("TooManyPeerIds")), nil
+	}
+	peerClient, err := subscriber(chainMessage)
+	if err != nil {
+		return handler.Error(chainMessage.MessageType, err), nil
+	}
+	if condition.Unwatch {
+		handler.UnwatchPresence(condition.PeerIds, peerClient)
+		return handler.Ok(chainMessage.MessageType), nil
+	}
+	err = handler.WatchPresence(condition.PeerIds, peerClient)
+	if err != nil {
+		return handler.Error(chainMessage.MessageType, err), nil
+	}
+	response := handler.Response(chainMessage.MessageType, this.current(condition.PeerIds))
+	response.PayloadType = handler.PayloadType_Presences
+
+	return response, nil
+}
+
+/*
+*
+在线状态的变化写给关注的本地客户端
+*/
+func (this *presenceAction) deliver(chainMessage *entity.ChainMessage) {
+	presence := &entity.Presence{}
+	err := handler.DecodePayload(chainMessage.Payload, presence)
+	if err != nil || presence.PeerId == "" || chainMessage.Topic != ns.GetPresenceTopic(presence.PeerId) {
+		logger.Sugar.Warnf("invalid presence message uuid: %v", chainMessage.UUID)
+		return
+	}
+	for _, peerClient := range handler.GetPresenceWatchers(presence.PeerId) {
+		err = sender.WritePeerClient(chainMessage, peerClient)
+		if err != nil {
+			logger.Sugar.Warnf("deliver presence peerId: %v to peerId: %v failure: %v", presence.PeerId, peerClient.PeerId, err)
+			handler.UnwatchPresence([]string{presence.PeerId}, peerClient)
+		}
+	}
+}
+
+/*
+*
+分布式查询peerIds当前的在线状态，不可见的跳过
+*/
+func (this *presenceAction) current(peerIds []string) []*entity.Presence {
+	presences := make([]*entity.Presence, 0, len(peerIds))
+	for _, peerId := range peerIds {
+		peerClients, err := service.GetPeerClientService().GetValues(peerId, "", "", "")
+		if err != nil {
+			continue
+		}
+		for _, peerClient := range peerClients {
+			if !peerClient.IsVisible(entity1.Visibility_Presence) {
+				continue
+			}
+			presences = append(presences, &entity.Presence{
+				PeerId:         peerClient.PeerId,
+				ClientId:       peerClient.ClientId,
+				ActiveStatus:   peerClient.ActiveStatus,
+				LastAccessTime: peerClient.LastAccessTime,
+			})
+		}
+	}
+
+	return presences
+}
+
+func init() {
+	PresenceAction = presenceAction{}
+	PresenceAction.MsgType = msgtype.PRESENCE
+	handler.RegistPayloadType(PayloadType_PresenceCondition, func() interface{} { return &PresenceCondition{} })
+	handler.RegistChainMessageHandler(msgtype.PRESENCE, PresenceAction.Send, PresenceAction.Receive, PresenceAction.Response)
+	handler.RegistChainMessageSchema(msgtype.PRESENCE, &handler.ChainMessageSchema{
+		PayloadTypes:         []string{handler.PayloadType_Map, PayloadType_PresenceCondition, handler.PayloadType_Presence},
+		ResponsePayloadTypes: []string{handler.PayloadType_Presences},
+		PayloadLimit:         handler.PayloadLimit,
+	})
+}
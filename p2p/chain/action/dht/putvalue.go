@@ -110,6 +110,38 @@ func (this *putValueAction) Receive(chainMessage *entity2.ChainMessage) (*entity
 				dataBlock, ok := v.(*entity1.DataBlock)
 				if ok {
 					key = "/" + ns.DataBlock_Prefix + "/" + dataBlock.BlockId
+				} else {
+					preKeyBundle, ok := v.(*entity.PreKeyBundle)
+					if ok {
+						// 只能发布自己的预共享密钥包
+						if preKeyBundle.PeerId != chainMessage.SrcPeerId {
+							response = handler.Error(chainMessage.MessageType, errors.New("InconsistentPreKeyBundlePeerId"))
+							return response, nil
+						}
+						key = ns.GetPreKeyBundleKey(preKeyBundle.PeerId)
+					} else {
+						group, ok := v.(*entity.Group)
+						if ok {
+							// 群组由群主创建，由群主或者管理员修改
+							err := handler.CheckGroupUpdate(group, chainMessage.SrcPeerId)
+							if err != nil {
+								response = handler.Error(chainMessage.MessageType, err)
+								return response, nil
+							}
+							key = ns.GetGroupKey(group.GroupId)
+						} else {
+							topic, ok := v.(*entity.Topic)
+							if ok {
+								// 主题的访问控制由所有者发布
+								err := handler.CheckTopicUpdate(topic, chainMessage.SrcPeerId)
+								if err != nil {
+									response = handler.Error(chainMessage.MessageType, err)
+									return response, nil
+								}
+								key = ns.GetTopicKey(topic.TopicName)
+							}
+						}
+					}
 				}
 			}
 		}
@@ -133,4 +165,10 @@ func init() {
 	PutValueAction = putValueAction{}
 	PutValueAction.MsgType = msgtype.PUTVALUE
 	handler.RegistChainMessageHandler(msgtype.PUTVALUE, PutValueAction.Send, PutValueAction.Receive, PutValueAction.Response)
+	handler.RegistChainMessageSchema(msgtype.PUTVALUE, &handler.ChainMessageSchema{
+		PayloadTypes: []string{handler.PayloadType_PeerClient, handler.PayloadType_PeerEndpoint,
+			handler.PayloadType_ChainApp, handler.PayloadType_DataBlock, handler.PayloadType_PreKeyBundle,
+			handler.PayloadType_Group, handler.PayloadType_Topic},
+		NeedSignature: true,
+	})
 }
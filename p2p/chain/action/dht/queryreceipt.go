@@ -0,0 +1,67 @@
+package dht
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/p2p/chain/action"
+	"github.com/curltech/go-colla-node/p2p/chain/handler"
+	"github.com/curltech/go-colla-node/p2p/msg/entity"
+	service2 "github.com/curltech/go-colla-node/p2p/msg/service"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+)
+
+type queryReceiptAction struct {
+	action.BaseAction
+}
+
+var QueryReceiptAction queryReceiptAction
+
+const PayloadType_QueryReceiptCondition = "queryReceiptCondition"
+
+// QueryReceiptCondition QUERYRECEIPT请求的查询条件，原消息的uuids
+type QueryReceiptCondition struct {
+	UUIDs []string `json:"uuids,omitempty"`
+}
+
+// Receive 根据原消息的uuids查询发送者发送的消息的回执，返回查询的结果
+func (this *queryReceiptAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+	logger.Sugar.Infof("Receive %v message", this.MsgType)
+	var response *entity.ChainMessage = nil
+	condition := &QueryReceiptCondition{}
+	err := handler.DecodePayload(chainMessage.Payload, condition)
+	if err != nil {
+		response = handler.Error(chainMessage.MessageType, errors.New("ErrorCondition"))
+		return response, nil
+	}
+	uuids := make([]string, 0, len(condition.UUIDs))
+	for _, uuid := range condition.UUIDs {
+		if uuid != "" {
+			uuids = append(uuids, uuid)
+		}
+	}
+	if len(uuids) == 0 {
+		response = handler.Error(chainMessage.MessageType, errors.New("NullUUID"))
+		return response, nil
+	}
+	receipts, err := service2.GetReceiptService().FindReceipts(chainMessage.SrcPeerId, uuids)
+	if err != nil {
+		response = handler.Error(chainMessage.MessageType, err)
+		return response, nil
+	}
+	response = handler.Response(chainMessage.MessageType, receipts)
+	response.PayloadType = handler.PayloadType_Receipts
+
+	return response, nil
+}
+
+func init() {
+	QueryReceiptAction = queryReceiptAction{}
+	QueryReceiptAction.MsgType = msgtype.QUERYRECEIPT
+	handler.RegistPayloadType(PayloadType_QueryReceiptCondition, func() interface{} { return &QueryReceiptCondition{} })
+	handler.RegistChainMessageHandler(msgtype.QUERYRECEIPT, QueryReceiptAction.Send, QueryReceiptAction.Receive, QueryReceiptAction.Response)
+	handler.RegistChainMessageSchema(msgtype.QUERYRECEIPT, &handler.ChainMessageSchema{
+		PayloadTypes:         []string{handler.PayloadType_Map, PayloadType_QueryReceiptCondition},
+		ResponsePayloadTypes: []string{handler.PayloadType_Receipts},
+		PayloadLimit:         handler.PayloadLimit,
+	})
+}
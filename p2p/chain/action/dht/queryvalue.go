@@ -23,38 +23,48 @@ type queryValueAction struct {
 
 var QueryValueAction queryValueAction
 
+const PayloadType_QueryValueCondition = "queryValueCondition"
+
+// QueryValueCondition QUERYVALUE请求的查询条件
+// GetAllBlockIndex为true的时候按照BlockType查询所有块的索引，否则按照BlockId和SliceNumber查询分片
+type QueryValueCondition struct {
+	GetAllBlockIndex     bool   `json:"getAllBlockIndex,omitempty"`
+	BlockType            string `json:"blockType,omitempty"`
+	CreatePeerId         string `json:"createPeerId,omitempty"`
+	BusinessNumber       string `json:"businessNumber,omitempty"`
+	ParentBusinessNumber string `json:"parentBusinessNumber,omitempty"`
+	BlockId              string `json:"blockId,omitempty"`
+	SliceNumber          uint64 `json:"sliceNumber,omitempty"`
+	ReceiverPeer         bool   `json:"receiverPeer,omitempty"`
+	ReceiverPeerId       string `json:"receiverPeerId,omitempty"`
+}
+
 /**
 接收消息进行处理，返回为空则没有返回消息，否则，有返回消息
 */
 func (this *queryValueAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
 	logger.Sugar.Infof("Receive %v message", this.MsgType)
 	var response *entity.ChainMessage = nil
-	conditionBean, ok := chainMessage.Payload.(map[string]interface{})
-	if !ok {
+	condition := &QueryValueCondition{}
+	err := handler.DecodePayload(chainMessage.Payload, condition)
+	if err != nil {
 		response = handler.Error(chainMessage.MessageType, errors.New("ErrorCondition"))
 		return response, nil
 	}
-	var getAllBlockIndex bool = false
-	if conditionBean["getAllBlockIndex"] != nil {
-		getAllBlockIndex = conditionBean["getAllBlockIndex"].(bool)
-	}
+	getAllBlockIndex := condition.GetAllBlockIndex
 
 	dataBlocks := make([]*entity2.DataBlock, 0)
 	if getAllBlockIndex == true {
 		ptMap := make(map[string]*entity2.PeerTransaction, 0)
-		var blockType, createPeerId, receiverPeerId, businessNumber, parentBusinessNumber string
-		if conditionBean["blockType"] != nil {
-			blockType = conditionBean["blockType"].(string)
-		}
+		var createPeerId, receiverPeerId, businessNumber, parentBusinessNumber string
+		blockType := condition.BlockType
 		if len(blockType) == 0 {
 			response = handler.Error(chainMessage.MessageType, errors.New("NullBlockType"))
 			return response, nil
 		}
 		var key, keyKind string
 		if blockType == entity2.BlockType_Collection {
-			if conditionBean["createPeerId"] != nil {
-				createPeerId = conditionBean["createPeerId"].(string)
-			}
+			createPeerId = condition.CreatePeerId
 			if len(createPeerId) == 0 {
 				response = handler.Error(chainMessage.MessageType, errors.New("NullCreatePeerId"))
 				return response, nil
@@ -62,9 +72,7 @@ func (this *queryValueAction) Receive(chainMessage *entity.ChainMessage) (*entit
 			key = ns.GetPeerTransactionSrcKey(createPeerId)
 			keyKind = ns.PeerTransaction_Src_KeyKind
 		} else if blockType == entity2.BlockType_P2pChat {
-			if conditionBean["businessNumber"] != nil {
-				businessNumber = conditionBean["businessNumber"].(string)
-			}
+			businessNumber = condition.BusinessNumber
 			if len(businessNumber) == 0 {
 				response = handler.Error(chainMessage.MessageType, errors.New("NullBusinessNumber"))
 				return response, nil
@@ -72,9 +80,7 @@ func (this *queryValueAction) Receive(chainMessage *entity.ChainMessage) (*entit
 			key = ns.GetPeerTransactionP2pChatKey(businessNumber)
 			keyKind = ns.PeerTransaction_P2PChat_KeyKind
 		} else if blockType == entity2.BlockType_GroupFile {
-			if conditionBean["businessNumber"] != nil {
-				businessNumber = conditionBean["businessNumber"].(string)
-			}
+			businessNumber = condition.BusinessNumber
 			if len(businessNumber) == 0 {
 				response = handler.Error(chainMessage.MessageType, errors.New("NullBusinessNumber"))
 				return response, nil
@@ -93,9 +99,7 @@ func (this *queryValueAction) Receive(chainMessage *entity.ChainMessage) (*entit
 			key = ns.GetPeerTransactionChannelKey(fmt.Sprintf("%v-%v", dhtentity.TransactionType_DataBlock, entity2.BlockType_Channel))
 			keyKind = ns.PeerTransaction_Channel_KeyKind
 		} else if blockType == entity2.BlockType_ChannelArticle {
-			if conditionBean["parentBusinessNumber"] != nil {
-				parentBusinessNumber = conditionBean["parentBusinessNumber"].(string)
-			}
+			parentBusinessNumber = condition.ParentBusinessNumber
 			if len(parentBusinessNumber) == 0 {
 				response = handler.Error(chainMessage.MessageType, errors.New("NullParentBusinessNumber"))
 				return response, nil
@@ -181,27 +185,16 @@ func (this *queryValueAction) Receive(chainMessage *entity.ChainMessage) (*entit
 			dataBlocks = append(dataBlocks, &db)
 		}
 	} else {
-		var blockId string = ""
-		if conditionBean["blockId"] != nil {
-			blockId = conditionBean["blockId"].(string)
-		}
+		blockId := condition.BlockId
 		if len(blockId) == 0 {
 			response = handler.Error(chainMessage.MessageType, errors.New("NullBlockId"))
 			return response, nil
 		}
-		var sliceNumber uint64 = 0
-		if conditionBean["sliceNumber"] != nil {
-			sliceNumber = uint64(conditionBean["sliceNumber"].(float64))
-		}
-		var receiverPeer bool = false
-		if conditionBean["receiverPeer"] != nil {
-			receiverPeer = conditionBean["receiverPeer"].(bool)
-		}
+		sliceNumber := condition.SliceNumber
+		receiverPeer := condition.ReceiverPeer
 		var receiverPeerId string = ""
 		if receiverPeer == true {
-			if conditionBean["receiverPeerId"] != nil {
-				receiverPeerId = conditionBean["receiverPeerId"].(string)
-			}
+			receiverPeerId = condition.ReceiverPeerId
 			if len(receiverPeerId) == 0 {
 				response = handler.Error(chainMessage.MessageType, errors.New("NullReceiverPeerId"))
 				return response, nil
@@ -313,7 +306,7 @@ func (this *queryValueAction) Receive(chainMessage *entity.ChainMessage) (*entit
 		}
 	}
 	response = handler.Response(chainMessage.MessageType, dataBlocks)
-	response.PayloadType = handler.PayloadType_DataBlock
+	response.PayloadType = handler.PayloadType_DataBlocks
 
 	return response, nil
 }
@@ -321,5 +314,10 @@ func (this *queryValueAction) Receive(chainMessage *entity.ChainMessage) (*entit
 func init() {
 	QueryValueAction = queryValueAction{}
 	QueryValueAction.MsgType = msgtype.QUERYVALUE
+	handler.RegistPayloadType(PayloadType_QueryValueCondition, func() interface{} { return &QueryValueCondition{} })
 	handler.RegistChainMessageHandler(msgtype.QUERYVALUE, QueryValueAction.Send, QueryValueAction.Receive, QueryValueAction.Response)
+	handler.RegistChainMessageSchema(msgtype.QUERYVALUE, &handler.ChainMessageSchema{
+		PayloadTypes: []string{handler.PayloadType_Map, PayloadType_QueryValueCondition},
+		PayloadLimit: handler.PayloadLimit,
+	})
 }
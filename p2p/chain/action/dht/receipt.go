@@ -0,0 +1,155 @@
+package dht
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/global"
+	"github.com/curltech/go-colla-node/p2p/chain/action"
+	"github.com/curltech/go-colla-node/p2p/chain/handler"
+	"github.com/curltech/go-colla-node/p2p/chain/handler/sender"
+	"github.com/curltech/go-colla-node/p2p/msg/entity"
+	service2 "github.com/curltech/go-colla-node/p2p/msg/service"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"time"
+)
+
+type receiptAction struct {
+	action.BaseAction
+}
+
+var ReceiptAction receiptAction
+
+/*
+*
+发送回执给原消息的发送者，回执的负载是Receipt
+*/
+func (this *receiptAction) Receipt(receipt *entity.Receipt) (interface{}, error) {
+	chainMessage := this.PrepareSend("", receipt, receipt.SrcPeerId)
+	chainMessage.PayloadType = handler.PayloadType_Receipt
+
+	response, err := this.Post(chainMessage)
+	if err != nil {
+		return nil, err
+	}
+	if response != nil {
+		return response.Payload, nil
+	}
+
+	return nil, nil
+}
+
+/*
+*
+接收者或者节点直接发给本节点的回执，保存下来
+*/
+func (this *receiptAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+	logger.Sugar.Infof("Receive %v message", this.MsgType)
+	receipt, err := checkReceipt(chainMessage)
+	if err != nil {
+		return handler.Error(chainMessage.MessageType, err), nil
+	}
+	_, err = service2.GetReceiptService().Record(receipt)
+	if err != nil {
+		return handler.Error(chainMessage.MessageType, err), nil
+	}
+
+	return nil, nil
+}
+
+/*
+*
+消息到达接收者的连接节点或者设备时的处理：
+回执到达原发送者的连接节点，保存供原发送者查询
+需要回执的消息，保存回执并发回给原发送者，状态没有前进的回执不重复发送
+*/
+func (this *receiptAction) deliver(chainMessage *entity.ChainMessage, status string) {
+	if chainMessage.MessageType == msgtype.RECEIPT {
+		if chainMessage.NeedEncrypt {
+			return
+		}
+		_, err := handler.Decrypt(chainMessage)
+		if err != nil {
+			logger.Sugar.Errorf("Decrypt receipt uuid: %v failure: %v", chainMessage.UUID, err)
+			return
+		}
+		receipt, err := checkReceipt(chainMessage)
+		if err == nil {
+			_, err = service2.GetReceiptService().Record(receipt)
+		}
+		if err != nil {
+			logger.Sugar.Errorf("Record receipt uuid: %v failure: %v", chainMessage.UUID, err)
+		}
+		return
+	}
+	if !handler.IsNeedReceipt(chainMessage.MessageType) || chainMessage.SrcPeerId == "" {
+		return
+	}
+	currentTime := time.Now()
+	receipt := &entity.Receipt{}
+	receipt.UUID = chainMessage.UUID
+	receipt.MessageType = chainMessage.MessageType
+	receipt.SrcPeerId = chainMessage.SrcPeerId
+	receipt.TargetPeerId = chainMessage.TargetPeerId
+	receipt.TargetClientId = chainMessage.TargetClientId
+	receipt.Status = status
+	receipt.StatusDate = &currentTime
+	changed, err := service2.GetReceiptService().Record(receipt)
+	if err != nil {
+		logger.Sugar.Errorf("Record receipt uuid: %v failure: %v", chainMessage.UUID, err)
+		return
+	}
+	if !changed || global.IsMyself(receipt.SrcPeerId) {
+		return
+	}
+	//原发送者不支持回执的时候只保存，由它查询
+	if !handler.SupportCapability(receipt.SrcPeerId, chainMessage.SrcClientId, msgtype.Capability_Receipt) {
+		return
+	}
+	_, err = this.Receipt(receipt)
+	if err != nil {
+		logger.Sugar.Warnf("send receipt uuid: %v status: %v failure: %v", receipt.UUID, status, err)
+	}
+}
+
+/*
+*
+取得回执并校验回执的发送者：读的回执只能由原消息的接收者发送，
+送达的回执也可以由接收者登记的连接节点发送，否则任何节点都可以伪造其他接收者的回执
+*/
+func checkReceipt(chainMessage *entity.ChainMessage) (*entity.Receipt, error) {
+	receipt, ok := chainMessage.Payload.(*entity.Receipt)
+	if !ok || receipt == nil {
+		return nil, errors.New("InvalidReceipt")
+	}
+	if receipt.UUID == "" {
+		return nil, errors.New("NullUUID")
+	}
+	if chainMessage.SrcPeerId == "" {
+		return nil, errors.New("NullSrcPeerId")
+	}
+	if chainMessage.SrcPeerId != receipt.TargetPeerId {
+		if receipt.Status == msgtype.RECEIPT_READ {
+			return nil, errors.New("InconsistentReceiptSender")
+		}
+		peerClient, _, err := sender.Lookup(receipt.TargetPeerId, receipt.TargetClientId)
+		if err != nil || peerClient == nil || peerClient.ConnectPeerId != chainMessage.SrcPeerId {
+			return nil, errors.New("InconsistentReceiptSender")
+		}
+	}
+	receipt.Id = 0
+
+	return receipt, nil
+}
+
+func init() {
+	ReceiptAction = receiptAction{}
+	ReceiptAction.MsgType = msgtype.RECEIPT
+	handler.RegistChainMessageHandler(msgtype.RECEIPT, ReceiptAction.Send, ReceiptAction.Receive, ReceiptAction.Response)
+	handler.RegistChainMessageSchema(msgtype.RECEIPT, &handler.ChainMessageSchema{
+		RequiredFields:  []string{"TargetPeerId"},
+		PayloadTypes:    []string{handler.PayloadType_Receipt},
+		PayloadLimit:    handler.PayloadLimit,
+		StoreAndForward: true,
+	})
+	sender.RegistDeliverHandler(ReceiptAction.deliver)
+}
@@ -41,7 +41,7 @@ peerId如果为空，发送的对象是自己，需要检查如果是自己，
 func (this *signalAction) Signal(connectPeerId string, data interface{}, targetPeerId string) (interface{}, error) {
 	chainMessage := this.PrepareSend(connectPeerId, data, targetPeerId)
 
-	response, err := this.Send(chainMessage)
+	response, err := this.Post(chainMessage)
 	if err != nil {
 		return nil, err
 	}
@@ -68,7 +68,7 @@ func (this *signalAction) Receive(chainMessage *entity.ChainMessage) (*entity.Ch
 			}
 		}
 	} else {
-		go sender.RelaySend(chainMessage)
+		go sender.Relay(chainMessage)
 	}
 	response := handler.Response(chainMessage.MessageType, time.Now())
 
@@ -79,4 +79,8 @@ func init() {
 	SignalAction = signalAction{}
 	SignalAction.MsgType = msgtype.SIGNAL
 	handler.RegistChainMessageHandler(msgtype.SIGNAL, SignalAction.Send, SignalAction.Receive, SignalAction.Response)
+	handler.RegistChainMessageSchema(msgtype.SIGNAL, &handler.ChainMessageSchema{
+		RequiredFields: []string{"TargetPeerId"},
+		PayloadTypes:   []string{handler.PayloadType_Map},
+	})
 }
@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/p2p/chain/action"
+	"github.com/curltech/go-colla-node/p2p/chain/handler"
+	entity1 "github.com/curltech/go-colla-node/p2p/dht/entity"
+	"github.com/curltech/go-colla-node/p2p/dht/service"
+	"github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+)
+
+type subscribeAction struct {
+	action.BaseAction
+}
+
+var SubscribeAction subscribeAction
+
+type unsubscribeAction struct {
+	action.BaseAction
+}
+
+var UnsubscribeAction unsubscribeAction
+
+const PayloadType_TopicCondition = "topicCondition"
+
+// TopicCondition SUBSCRIBE和UNSUBSCRIBE请求的主题
+type TopicCondition struct {
+	TopicName string `json:"topicName,omitempty"`
+}
+
+/*
+*
+订阅请求的客户端，连接在本节点上，使用请求的连接会话
+*/
+func subscriber(chainMessage *entity.ChainMessage) (*entity1.PeerClient, error) {
+	peerClients, err := service.GetPeerClientService().GetLocals(ns.GetPeerClientKey(chainMessage.SrcPeerId), chainMessage.SrcClientId)
+	if err != nil {
+		return nil, err
+	}
+	if len(peerClients) == 0 || chainMessage.ConnectSessionId == "" {
+		return nil, errors.New("NoLocalPeerClient")
+	}
+	peerClient := *peerClients[0]
+	peerClient.ConnectSessionId = chainMessage.ConnectSessionId
+
+	return &peerClient, nil
+}
+
+func topicName(chainMessage *entity.ChainMessage) (string, error) {
+	condition := &TopicCondition{}
+	err := handler.DecodePayload(chainMessage.Payload, condition)
+	if err != nil || condition.TopicName == "" {
+		return "", errors.New("NullTopicName")
+	}
+
+	return condition.TopicName, nil
+}
+
+// Receive 本地客户端订阅主题，检查主题的访问控制，主题的消息写到请求的连接会话
+func (this *subscribeAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+	logger.Sugar.Infof("Receive %v message", this.MsgType)
+	name, err := topicName(chainMessage)
+	if err != nil {
+		return handler.Error(chainMessage.MessageType, err), nil
+	}
+	peerClient, err := subscriber(chainMessage)
+	if err != nil {
+		return handler.Error(chainMessage.MessageType, err), nil
+	}
+	err = handler.SubscribeTopic(name, peerClient)
+	if err != nil {
+		return handler.Error(chainMessage.MessageType, err), nil
+	}
+
+	return handler.Ok(chainMessage.MessageType), nil
+}
+
+// Receive 本地客户端取消订阅主题
+func (this *unsubscribeAction) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+	logger.Sugar.Infof("Receive %v message", this.MsgType)
+	name, err := topicName(chainMessage)
+	if err != nil {
+		return handler.Error(chainMessage.MessageType, err), nil
+	}
+	handler.UnsubscribeTopic(name, &entity1.PeerClient{PeerId: chainMessage.SrcPeerId, ConnectSessionId: chainMessage.ConnectSessionId})
+
+	return handler.Ok(chainMessage.MessageType), nil
+}
+
+func init() {
+	SubscribeAction = subscribeAction{}
+	SubscribeAction.MsgType = msgtype.SUBSCRIBE
+	UnsubscribeAction = unsubscribeAction{}
+	UnsubscribeAction.MsgType = msgtype.UNSUBSCRIBE
+	handler.RegistPayloadType(PayloadType_TopicCondition, func() interface{} { return &TopicCondition{} })
+	handler.RegistChainMessageHandler(msgtype.SUBSCRIBE, SubscribeAction.Send, SubscribeAction.Receive, SubscribeAction.Response)
+	handler.RegistChainMessageSchema(msgtype.SUBSCRIBE, &handler.ChainMessageSchema{
+		PayloadTypes:  []string{handler.PayloadType_Map, PayloadType_TopicCondition},
+		PayloadLimit:  handler.PayloadLimit,
+		NeedSignature: true,
+	})
+	handler.RegistChainMessageHandler(msgtype.UNSUBSCRIBE, UnsubscribeAction.Send, UnsubscribeAction.Receive, UnsubscribeAction.Response)
+	handler.RegistChainMessageSchema(msgtype.UNSUBSCRIBE, &handler.ChainMessageSchema{
+		PayloadTypes: []string{handler.PayloadType_Map, PayloadType_TopicCondition},
+		PayloadLimit: handler.PayloadLimit,
+	})
+}
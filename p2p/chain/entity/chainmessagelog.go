@@ -9,7 +9,12 @@ type ChainMessageLog struct {
 	entity.StatusEntity `xorm:"extends"`
 	UUID                string `xorm:"varchar(255)" json:"uuid,omitempty"`
 	MessageType         string `xorm:"varchar(255)" json:"messageType,omitempty"`
-	Action              string `xorm:"varchar(255)" json:"action,omitempty"`
+	MessageDirect       string `xorm:"varchar(255)" json:"messageDirect,omitempty"`
+	// 记录的环节：发送，转发，接收
+	Action string `xorm:"varchar(255)" json:"action,omitempty"`
+	// 记录日志的节点和消息已经经过的转发节点数
+	HopPeerId string `xorm:"varchar(255)" json:"hopPeerId,omitempty"`
+	HopCount  int    `json:"hopCount,omitempty"`
 	// 消息发送的源地址
 	SrcPeerId string `xorm:"varchar(255)" json:"srcPeerId,omitempty"`
 	// 消息发送的目标地址
@@ -37,8 +42,18 @@ type ChainMessageLog struct {
 	ResponseCode    string `xorm:"varchar(255)" json:"responseCode,omitempty"`
 	ResponseMessage string `xorm:"varchar(10485760)" json:"responseMessage,omitempty"`
 	ResponsePayload string `xorm:"varchar(10485760)" json:"responsePayload,omitempty"`
+	// 回应的状态码
+	StatusCode int `json:"statusCode,omitempty"`
+	// 发送到收到回应，或者接收到处理完成的毫秒数
+	Latency int64 `json:"latency,omitempty"`
 }
 
+const (
+	ChainMessageLogAction_Send    = "Send"
+	ChainMessageLogAction_Relay   = "Relay"
+	ChainMessageLogAction_Receive = "Receive"
+)
+
 func (ChainMessageLog) TableName() string {
 	return "blc_chainmessagelog"
 }
@@ -5,16 +5,17 @@ import (
 	"github.com/ProtonMail/gopenpgp/v3/crypto"
 	"github.com/curltech/go-colla-core/crypto/openpgp"
 	"github.com/curltech/go-colla-core/crypto/std"
+	"github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-core/util/compress"
-	"github.com/curltech/go-colla-core/util/message"
 	"github.com/curltech/go-colla-node/libp2p/global"
 	"github.com/curltech/go-colla-node/libp2p/util"
-	entity2 "github.com/curltech/go-colla-node/p2p/chain/entity"
+	"github.com/curltech/go-colla-node/p2p/codec"
 	"github.com/curltech/go-colla-node/p2p/dht/entity"
 	"github.com/curltech/go-colla-node/p2p/dht/service"
 	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
 	"github.com/curltech/go-colla-node/p2p/msgtype"
 	"net/http"
+	"time"
 )
 
 /*
@@ -22,15 +23,20 @@ import (
 在发送前校验各字段，然后再加密等处理
 */
 func SendValidate(msg *msg1.ChainMessage) error {
-	return nil
+	err := validate(msg, msg.MessageDirect)
+	if err != nil {
+		return err
+	}
+
+	return CheckCapability(msg)
 }
 
 /*
 *
-在接收解密处理后校验，然后再进行业务处理
+在接收后分发之前校验，不合格的消息直接拒绝，不再解密和进行业务处理
 */
 func ReceiveValidate(msg *msg1.ChainMessage) error {
-	return nil
+	return validate(msg, msg.MessageDirect)
 }
 
 /*
@@ -38,7 +44,7 @@ func ReceiveValidate(msg *msg1.ChainMessage) error {
 在发送回应数据前校验，然后再加密等处理
 */
 func ResponseValidate(msg *msg1.ChainMessage) error {
-	return nil
+	return validate(msg, msgtype.MsgDirect_Response)
 }
 
 func Encrypt(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
@@ -49,18 +55,18 @@ func Encrypt(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
 		return msg, nil
 	}
 
-	data, err := message.Marshal(msg.Payload)
+	//负载使用消息的编码，比如回应二进制编码的请求的时候负载也使用二进制编码
+	data, err := codec.Marshal(msg.Codec, msg.Payload)
 	if err != nil {
 		return nil, errors.New("PayloadMarshalFailure")
 	}
 
+	if msg.NeedEncrypt == true && msg.TargetPeerId == "" && (len(msg.TargetPeerIds) > 0 || msg.TargetGroupId != "") {
+		return encryptMulti(msg, data)
+	}
 	var openpgpPub *crypto.Key
 	if msg.NeedEncrypt == true {
-		targetPeerId := msg.TargetPeerId
-		if targetPeerId == "" {
-			targetPeerId, _ = util.GetIdAddr(msg.ConnectPeerId)
-		}
-		openpgpPub, err = GetPublicKey(targetPeerId)
+		openpgpPub, err = GetPublicKey(targetPeerIdOf(msg))
 		if err != nil {
 			msg.NeedEncrypt = false
 			return msg, err
@@ -75,6 +81,19 @@ func Encrypt(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
 		msg.NeedCompress = false
 	}
 	if msg.NeedEncrypt == true {
+		//优先使用与目标协商的前向安全会话，对方不支持的时候使用openpgp
+		if SupportCapability(targetPeerIdOf(msg), msg.TargetClientId, msgtype.Capability_Session) {
+			header, ciphertext, err := sessionEncrypt(targetPeerIdOf(msg), openpgpPub, data)
+			if err == nil {
+				msg.SessionHeader = header
+				msg.PayloadKey = ""
+				msg.TransportPayload = std.EncodeBase64(ciphertext)
+				msg.Payload = nil
+
+				return msg, nil
+			}
+			logger.Sugar.Debugf("session encrypt failure: %v, use openpgp", err)
+		}
 		key := std.GenerateSecretKey(32)
 		data, err = openpgp.EncryptSymmetrical([]byte(key), data)
 		if err != nil {
@@ -94,6 +113,120 @@ func Encrypt(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
 	return msg, nil
 }
 
+/*
+*
+多个接收者的加密，payload只用随机的对称秘钥加密一次，对称秘钥用每个接收者的公钥分别加密放入PayloadKeys
+不使用前向安全会话，因为会话是点对点的，没有公钥的接收者被跳过
+*/
+func encryptMulti(msg *msg1.ChainMessage, data []byte) (*msg1.ChainMessage, error) {
+	targetPeerIds, err := recipientsOf(msg)
+	if err != nil {
+		msg.NeedEncrypt = false
+		return msg, err
+	}
+	openpgpPubs := make(map[string]*crypto.Key, len(targetPeerIds))
+	for _, targetPeerId := range targetPeerIds {
+		openpgpPub, err := GetPublicKey(targetPeerId)
+		if err != nil {
+			logger.Sugar.Warnf("recipient: %v has no public key: %v", targetPeerId, err)
+			continue
+		}
+		openpgpPubs[targetPeerId] = openpgpPub
+	}
+	if len(openpgpPubs) == 0 {
+		msg.NeedEncrypt = false
+		return msg, errors.New("NoTargetPublicKey")
+	}
+	signature, _ := openpgp.Sign(global.Global.PrivateKey, data)
+	msg.PayloadSignature = std.EncodeBase64(signature)
+	if msg.NeedCompress == true && len(string(data)) > CompressLimit {
+		data = compress.GzipCompress(data)
+	} else {
+		msg.NeedCompress = false
+	}
+	key := std.GenerateSecretKey(32)
+	data, err = openpgp.EncryptSymmetrical([]byte(key), data)
+	if err != nil {
+		msg.NeedEncrypt = false
+		return msg, err
+	}
+	payloadKeys := make([]*msg1.PayloadKey, 0, len(openpgpPubs))
+	for _, targetPeerId := range targetPeerIds {
+		openpgpPub, ok := openpgpPubs[targetPeerId]
+		if !ok {
+			continue
+		}
+		payloadKey, err := openpgp.EncryptKey([]byte(key), openpgpPub)
+		if err != nil {
+			msg.NeedEncrypt = false
+			return msg, err
+		}
+		payloadKeys = append(payloadKeys, &msg1.PayloadKey{PeerId: targetPeerId, PayloadKey: std.EncodeBase64(payloadKey)})
+	}
+	msg.PayloadKey = ""
+	msg.PayloadKeys = payloadKeys
+	msg.TransportPayload = std.EncodeBase64(data)
+	msg.Payload = nil
+
+	return msg, nil
+}
+
+/*
+*
+多个接收者的消息的接收者，群组消息是校验过的群组的成员，不包括自己
+*/
+func recipientsOf(msg *msg1.ChainMessage) ([]string, error) {
+	if len(msg.TargetPeerIds) > 0 {
+		return msg.TargetPeerIds, nil
+	}
+	group, err := service.GetGroupService().GetValue(msg.TargetGroupId)
+	if err != nil {
+		return nil, err
+	}
+	err = VerifyGroup(group)
+	if err != nil {
+		return nil, err
+	}
+	targetPeerIds := make([]string, 0, len(group.Members)+1)
+	for _, peerId := range group.PeerIds() {
+		if !global.IsMyself(peerId) {
+			targetPeerIds = append(targetPeerIds, peerId)
+		}
+	}
+
+	return targetPeerIds, nil
+}
+
+/*
+*
+多个接收者的消息中自己的对称秘钥，没有的时候返回PayloadKey
+*/
+func payloadKeyOf(msg *msg1.ChainMessage) (string, error) {
+	if len(msg.PayloadKeys) == 0 {
+		return msg.PayloadKey, nil
+	}
+	for _, payloadKey := range msg.PayloadKeys {
+		if global.IsMyself(payloadKey.PeerId) {
+			return payloadKey.PayloadKey, nil
+		}
+	}
+
+	return "", errors.New("NoPayloadKey")
+}
+
+/*
+*
+加密的目标，没有TargetPeerId的时候是连接的节点
+*/
+func targetPeerIdOf(msg *msg1.ChainMessage) string {
+	targetPeerId := msg.TargetPeerId
+	if targetPeerId == "" {
+		targetPeerId, _ = util.GetIdAddr(msg.ConnectPeerId)
+	}
+
+	return targetPeerId
+}
+
 func GetPublicKey(targetPeerId string) (*crypto.Key, error) {
 	targetPublicKey := ""
 	if targetPeerId == "" {
@@ -147,11 +280,20 @@ const (
 	PayloadType_ChainApp     = "chainApp"
 	PayloadType_DataBlock    = "dataBlock"
 	PayloadType_ConsensusLog = "consensusLog"
+	PayloadType_PreKeyBundle = "preKeyBundle"
+	PayloadType_Group        = "group"
+	PayloadType_Topic        = "topic"
+	PayloadType_Presence     = "presence"
+	PayloadType_Handshake    = "handshake"
+	PayloadType_Login        = "login"
+	PayloadType_Receipt      = "receipt"
 
 	PayloadType_PeerClients   = "peerClients"
 	PayloadType_PeerEndpoints = "peerEndpoints"
 	PayloadType_ChainApps     = "chainApps"
 	PayloadType_DataBlocks    = "dataBlocks"
+	PayloadType_Receipts      = "receipts"
+	PayloadType_Presences     = "presences"
 
 	PayloadType_String = "string"
 	PayloadType_Map    = "map"
@@ -162,7 +304,17 @@ func Decrypt(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
 		return msg, errors.New("NoTransportPayload")
 	}
 	data := std.DecodeBase64(msg.TransportPayload)
-	if msg.NeedEncrypt == true && msg.PayloadKey != "" {
+	if msg.NeedEncrypt == true && msg.SessionHeader != nil {
+		var err error
+		data, err = sessionDecrypt(msg.SrcPeerId, msg.SessionHeader, data)
+		if err != nil {
+			return msg, err
+		}
+	} else if msg.NeedEncrypt == true && (msg.PayloadKey != "" || len(msg.PayloadKeys) > 0) {
+		transportPayloadKey, err := payloadKeyOf(msg)
+		if err != nil {
+			return msg, err
+		}
 		srcPublicKey, err := GetPublicKey(msg.SrcPeerId)
 		if err == nil {
 			payloadSignature := std.DecodeBase64(msg.PayloadSignature)
@@ -175,7 +327,7 @@ func Decrypt(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
 				}
 			}
 		}
-		payloadKey := std.DecodeBase64(msg.PayloadKey)
+		payloadKey := std.DecodeBase64(transportPayloadKey)
 		secretKey, err := openpgp.DecryptKey(payloadKey, global.Global.PrivateKey)
 		if err != nil {
 			return msg, err
@@ -188,23 +340,7 @@ func Decrypt(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
 	if msg.NeedCompress == true {
 		data = compress.GzipUncompress(data)
 	}
-	var err error
-	var payload interface{}
-	switch msg.PayloadType {
-	case PayloadType_String:
-		payload = ""
-	case PayloadType_PeerClient:
-		payload = &entity.PeerClient{}
-	case PayloadType_PeerEndpoint:
-		payload = &entity.PeerEndpoint{}
-	case PayloadType_DataBlock:
-		payload = &entity2.DataBlock{}
-	case PayloadType_ConsensusLog:
-		payload = &entity2.ConsensusLog{}
-	default: // PayloadType_Map
-		payload = make(map[string]interface{})
-	}
-	err = message.Unmarshal(data, &payload)
+	payload, err := unmarshalPayload(msg.PayloadType, data)
 	msg.Payload = payload
 	msg.TransportPayload = ""
 	return msg, err
@@ -222,6 +358,18 @@ func Error(msgType string, err error) *msg1.ChainMessage {
 	return &errMessage
 }
 
+func NoResponse(msgType string) *msg1.ChainMessage {
+	noResponseMessage := msg1.ChainMessage{}
+	noResponseMessage.Payload = msgtype.NO_RESPONSE
+	noResponseMessage.PayloadType = PayloadType_String
+	noResponseMessage.Tip = msgtype.NO_RESPONSE
+	noResponseMessage.MessageType = msgType
+	noResponseMessage.MessageDirect = msgtype.MsgDirect_Response
+	noResponseMessage.StatusCode = http.StatusRequestTimeout
+
+	return &noResponseMessage
+}
+
 func Response(msgType string, payload interface{}) *msg1.ChainMessage {
 	responseMessage := msg1.ChainMessage{}
 	responseMessage.Payload = payload
@@ -232,6 +380,17 @@ func Response(msgType string, payload interface{}) *msg1.ChainMessage {
 	return &responseMessage
 }
 
+/*
+*
+转发节点收到请求以后的确认，不是目标的回应，不带请求的UUID
+*/
+func Accepted(msgType string) *msg1.ChainMessage {
+	acceptedMessage := Response(msgType, time.Now())
+	acceptedMessage.StatusCode = http.StatusAccepted
+
+	return acceptedMessage
+}
+
 func Ok(msgType string) *msg1.ChainMessage {
 	okMessage := msg1.ChainMessage{}
 	okMessage.Payload = msgtype.OK
@@ -245,7 +404,10 @@ func Ok(msgType string) *msg1.ChainMessage {
 }
 
 func SetResponse(request *msg1.ChainMessage, response *msg1.ChainMessage) {
-	response.UUID = request.UUID
+	//转发节点的确认不能唤醒源节点等待目标回应的请求
+	if response.StatusCode != http.StatusAccepted {
+		response.UUID = request.UUID
+	}
 	response.SrcConnectAddress = request.SrcConnectAddress
 	response.SrcPeerId = request.SrcPeerId
 	response.ConnectAddress = request.ConnectAddress
@@ -253,5 +415,7 @@ func SetResponse(request *msg1.ChainMessage, response *msg1.ChainMessage) {
 	response.ConnectSessionId = request.ConnectSessionId
 	response.Topic = request.Topic
 	response.MessageDirect = msgtype.MsgDirect_Response
-	response.StatusCode = http.StatusOK
+	if response.StatusCode == 0 {
+		response.StatusCode = http.StatusOK
+	}
 }
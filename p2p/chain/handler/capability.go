@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-node/libp2p/global"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"sync"
+)
+
+/*
+*
+协商的能力：
+1.节点按照peerId记录，客户端按照peerId/clientId记录，同一个连接重复握手的时候不再协商
+2.没有记录的和老版本的对方认为支持所有的能力，保持原来的行为，由原来的降级处理（比如会话加密失败使用openpgp）
+3.声明了版本的对方严格按照协商的能力，发送对方不支持的消息类型返回UnsupportedCapability错误，
+版本不兼容的对方除了握手以外的消息都返回UnsupportedProtocolVersion错误
+*/
+var ErrUnsupportedProtocolVersion = errors.New("UnsupportedProtocolVersion")
+
+var minProtocolVersion = msgtype.LegacyProtocolVersion
+
+type capabilityRecord struct {
+	handshake *msg1.Handshake
+	// libp2p的连接编号或者websocket的连接会话，连接变化的时候重新握手
+	connectionId string
+}
+
+var capabilityMutex sync.RWMutex
+
+var capabilityRecords = make(map[string]*capabilityRecord)
+
+func init() {
+	minProtocolVersion, _ = config.GetInt("p2p.chain.minProtocolVersion", msgtype.LegacyProtocolVersion)
+}
+
+// LocalHandshake 本节点的协议版本和能力
+func LocalHandshake() *msg1.Handshake {
+	return &msg1.Handshake{
+		PeerId:             global.Global.MyselfPeer.PeerId,
+		ProtocolVersion:    msgtype.ProtocolVersion,
+		MinProtocolVersion: minProtocolVersion,
+		Capabilities:       msgtype.Capabilities(),
+	}
+}
+
+/*
+*
+与对方声明的版本和能力协商，返回协商的结果，版本不兼容的时候返回错误
+对方没有声明版本的是老版本，没有声明能力
+*/
+func Negotiate(remote *msg1.Handshake) (*msg1.Handshake, error) {
+	version := remote.ProtocolVersion
+	if version <= 0 {
+		version = msgtype.LegacyProtocolVersion
+	}
+	remoteMinVersion := remote.MinProtocolVersion
+	if remoteMinVersion <= 0 {
+		remoteMinVersion = msgtype.LegacyProtocolVersion
+	}
+	if version > msgtype.ProtocolVersion {
+		version = msgtype.ProtocolVersion
+	}
+	if version < minProtocolVersion || version < remoteMinVersion {
+		return nil, ErrUnsupportedProtocolVersion
+	}
+	handshake := LocalHandshake()
+	handshake.ProtocolVersion = version
+	if remote.ProtocolVersion <= 0 {
+		handshake.Capabilities = nil
+		return handshake, nil
+	}
+	capabilities := make([]string, 0, len(remote.Capabilities))
+	for _, capability := range handshake.Capabilities {
+		if containsCapability(remote.Capabilities, capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	handshake.Capabilities = capabilities
+
+	return handshake, nil
+}
+
+func containsCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+func capabilityKey(peerId string, clientId string) string {
+	if clientId == "" {
+		return peerId
+	}
+
+	return peerId + "/" + clientId
+}
+
+/*
+*
+记录与对方协商的结果，clientId为空的是节点
+*/
+func RecordCapability(peerId string, clientId string, connectionId string, handshake *msg1.Handshake) {
+	if peerId == "" || handshake == nil {
+		return
+	}
+	capabilityMutex.Lock()
+	defer capabilityMutex.Unlock()
+	capabilityRecords[capabilityKey(peerId, clientId)] = &capabilityRecord{handshake: handshake, connectionId: connectionId}
+}
+
+/*
+*
+删除在连接connectionId上协商的记录，连接断开以后调用，对方重新连接的时候重新握手
+peerId为空的时候删除这个连接上所有的记录，connectionId为空的时候不比较连接
+*/
+func RemoveCapability(peerId string, clientId string, connectionId string) {
+	capabilityMutex.Lock()
+	defer capabilityMutex.Unlock()
+	if peerId == "" {
+		for key, record := range capabilityRecords {
+			if record.connectionId == connectionId {
+				delete(capabilityRecords, key)
+			}
+		}
+		return
+	}
+	key := capabilityKey(peerId, clientId)
+	record, ok := capabilityRecords[key]
+	if ok && (connectionId == "" || record.connectionId == connectionId) {
+		delete(capabilityRecords, key)
+	}
+}
+
+// HasCapability 是否已经在这个连接上与对方协商过
+func HasCapability(peerId string, clientId string, connectionId string) bool {
+	capabilityMutex.RLock()
+	defer capabilityMutex.RUnlock()
+	record, ok := capabilityRecords[capabilityKey(peerId, clientId)]
+
+	return ok && record.connectionId == connectionId
+}
+
+/*
+*
+查询与对方协商的结果，客户端没有记录的时候使用所在节点的记录，都没有的返回nil
+*/
+func GetCapability(peerId string, clientId string) *msg1.Handshake {
+	capabilityMutex.RLock()
+	defer capabilityMutex.RUnlock()
+	record, ok := capabilityRecords[capabilityKey(peerId, clientId)]
+	if !ok && clientId != "" {
+		record, ok = capabilityRecords[peerId]
+	}
+	if !ok {
+		return nil
+	}
+	handshake := *record.handshake
+	handshake.Capabilities = append([]string(nil), record.handshake.Capabilities...)
+
+	return &handshake
+}
+
+/*
+*
+对方是否支持能力，没有记录的和老版本的认为支持
+*/
+func SupportCapability(peerId string, clientId string, capability string) bool {
+	handshake := GetCapability(peerId, clientId)
+	if handshake == nil {
+		return true
+	}
+	if handshake.Error != "" {
+		return false
+	}
+	if handshake.ProtocolVersion <= msgtype.LegacyProtocolVersion {
+		return true
+	}
+
+	return containsCapability(handshake.Capabilities, capability)
+}
+
+/*
+*
+发送请求之前检查目标是否支持，握手和连接的消息不检查
+*/
+func CheckCapability(msg *msg1.ChainMessage) error {
+	if msg.MessageDirect != msgtype.MsgDirect_Request {
+		return nil
+	}
+	if msg.MessageType == msgtype.HANDSHAKE || msg.MessageType == msgtype.CONNECT {
+		return nil
+	}
+	targetPeerId := targetPeerIdOf(msg)
+	if targetPeerId == "" || global.IsMyself(targetPeerId) {
+		return nil
+	}
+	handshake := GetCapability(targetPeerId, msg.TargetClientId)
+	if handshake == nil {
+		return nil
+	}
+	if handshake.Error != "" {
+		return errors.New(handshake.Error)
+	}
+	capability := msgtype.GetMessageCapability(msg.MessageType)
+	if capability != "" && !SupportCapability(targetPeerId, msg.TargetClientId, capability) {
+		return errors.New("UnsupportedCapability:" + capability)
+	}
+
+	return nil
+}
+
+/*
+*
+接收消息的时候检查对方的版本，版本不兼容的对方除了握手以外的消息都拒绝，peerId是认证过的对方
+*/
+func ReceiveCapability(msg *msg1.ChainMessage, peerId string) error {
+	if peerId == "" || msg.MessageType == msgtype.HANDSHAKE {
+		return nil
+	}
+	handshake := GetCapability(peerId, "")
+	if handshake != nil && handshake.Error == ErrUnsupportedProtocolVersion.Error() {
+		return &ValidateError{Code: ErrUnsupportedProtocolVersion.Error(), MsgType: msg.MessageType, Field: "ProtocolVersion"}
+	}
+
+	return nil
+}
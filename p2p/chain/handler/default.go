@@ -14,6 +14,10 @@ type ChainMessageHandler struct {
 	ReceiveHandler  func(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error)
 	SendHandler     func(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error)
 	ResponseHandler func(chainMessage *entity.ChainMessage) error
+	/**
+	校验规则，为空只做公共的校验
+	*/
+	Schema *ChainMessageSchema
 }
 
 /**
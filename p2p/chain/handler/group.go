@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/crypto/openpgp"
+	"github.com/curltech/go-colla-core/crypto/std"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/p2p/dht/entity"
+	"github.com/curltech/go-colla-node/p2p/dht/service"
+	"strconv"
+	"strings"
+)
+
+/*
+*
+群组签名的数据，覆盖群组编号，群主，管理员，成员和版本
+*/
+func groupSignatureData(group *entity.Group) []byte {
+	return []byte(group.GroupId + "|" + group.OwnerPeerId + "|" + strings.Join(group.Admins, ",") + "|" +
+		strings.Join(group.Members, ",") + "|" + strconv.FormatInt(group.Version, 10))
+}
+
+/*
+*
+校验群组是签名者的openpgp私钥签名的，签名者必须是群主或者管理员
+从DHT中取得的群组在使用前都要校验，DHT的记录可能被其他节点伪造
+*/
+func VerifyGroup(group *entity.Group) error {
+	if group.GroupId == "" || group.OwnerPeerId == "" || group.Signature == "" {
+		return errors.New("InvalidGroup")
+	}
+	if !group.IsAdmin(group.SignerPeerId) {
+		return errors.New("GroupSignerNotAdmin")
+	}
+	openpgpPub, err := GetPublicKey(group.SignerPeerId)
+	if err != nil {
+		return err
+	}
+	pass, _ := openpgp.Verify(openpgpPub, groupSignatureData(group), std.DecodeBase64(group.Signature))
+	if !pass {
+		return errors.New("GroupVerifyFailure")
+	}
+
+	return nil
+}
+
+/*
+*
+校验群组相对原来的记录的延续：版本不能降低，相同的版本必须是同一个记录，
+版本升高的时候签名者必须是原来的群主或者管理员，只有原来的群主可以转让群组
+原来的记录不存在或者校验失败的时候不限制
+*/
+func checkGroupContinuity(group *entity.Group, previous *entity.Group) error {
+	if previous == nil || previous.GroupId != group.GroupId || VerifyGroup(previous) != nil {
+		return nil
+	}
+	if group.Version < previous.Version {
+		return errors.New("StaleGroupVersion")
+	}
+	if group.Version == previous.Version {
+		if group.Signature != previous.Signature {
+			return errors.New("GroupVersionConflict")
+		}
+		return nil
+	}
+	if !previous.IsAdmin(group.SignerPeerId) {
+		return errors.New("GroupAdminRequired")
+	}
+	if group.OwnerPeerId != previous.OwnerPeerId && previous.OwnerPeerId != group.SignerPeerId {
+		return errors.New("GroupOwnerRequired")
+	}
+
+	return nil
+}
+
+/*
+*
+DHT的群组记录的校验，校验签名和相对原来的记录的延续，由ns.GroupValidator调用
+*/
+func verifyGroupRecord(group *entity.Group, previous *entity.Group) error {
+	err := VerifyGroup(group)
+	if err != nil {
+		return err
+	}
+
+	return checkGroupContinuity(group, previous)
+}
+
+func localGroup(groupId string) *entity.Group {
+	group, err := service.GetGroupService().GetLocal(groupId)
+	if err != nil {
+		return nil
+	}
+
+	return group
+}
+
+/*
+*
+发布群组之前校验：新的群组由群主发布，修改的群组版本必须更高，而且由原来的群主或者管理员签名，
+只有原来的群主可以转让群组
+*/
+func CheckGroupUpdate(group *entity.Group, srcPeerId string) error {
+	if group.SignerPeerId != srcPeerId {
+		return errors.New("InconsistentGroupSignerPeerId")
+	}
+	err := VerifyGroup(group)
+	if err != nil {
+		return err
+	}
+	existing, err := service.GetGroupService().GetValue(group.GroupId)
+	if err != nil || existing == nil || VerifyGroup(existing) != nil {
+		if group.OwnerPeerId != srcPeerId {
+			return errors.New("GroupOwnerRequired")
+		}
+		return nil
+	}
+	if group.Version <= existing.Version {
+		return errors.New("StaleGroupVersion")
+	}
+
+	return checkGroupContinuity(group, existing)
+}
+
+func init() {
+	ns.RegistGroupVerifier(verifyGroupRecord, localGroup)
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"github.com/curltech/go-colla-node/libp2p/global"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+)
+
+/*
+*
+消息与认证的身份绑定：
+1.libp2p的连接是认证过的，没有转发记录的请求SrcPeerId必须是连接的对方节点，
+经过转发的请求最后一个转发节点必须是对方节点，SrcPeerId不是对方节点的时候必须有SrcPeerId的消息签名，
+整个转发链的签名从消息签名开始逐跳校验，否则任何节点都可以追加一跳冒充别的SrcPeerId
+2.websocket和https的请求绑定到连接会话的身份，绑定以后SrcPeerId和SrcClientId必须与会话一致，
+要求登录的时候（p2p.chain.login.enforce），没有登录的会话只能向本节点发送允许匿名的消息，比如LOGIN，
+不要求登录的时候，没有绑定的会话只能发送CONNECT，没有SrcPeerId的匿名请求，或者SrcPeerId签名的请求
+3.回应必须来自请求写到的对方节点或者会话，在sender.ValidateResponder中校验，
+没有登录的会话的回应同样只能是允许匿名的消息类型，主题的消息由GossipSub的校验器校验发布者
+*/
+const (
+	ValidateCode_IdentityMismatch = "IdentityMismatch"
+	ValidateCode_UnboundSession   = "UnboundSession"
+	ValidateCode_Unauthenticated  = "Unauthenticated"
+)
+
+// ValidatePeerIdentity 校验libp2p连接的对方节点remotePeerId发来的请求
+func ValidatePeerIdentity(msg *msg1.ChainMessage, remotePeerId string) error {
+	if msg.MessageDirect != msgtype.MsgDirect_Request {
+		return nil
+	}
+	n := len(msg.Hops)
+	if n > 0 {
+		if msg.Hops[n-1].PeerId != remotePeerId {
+			return &ValidateError{Code: ValidateCode_IdentityMismatch, MsgType: msg.MessageType, Field: "Hops"}
+		}
+		//源连接节点是源节点自己，或者是第一个转发的节点
+		if msg.SrcConnectPeerId != "" && msg.SrcConnectPeerId != msg.SrcPeerId && msg.SrcConnectPeerId != msg.Hops[0].PeerId {
+			return &ValidateError{Code: ValidateCode_IdentityMismatch, MsgType: msg.MessageType, Field: "SrcConnectPeerId"}
+		}
+		if msg.SrcPeerId == remotePeerId {
+			return nil
+		}
+		//源节点不是对方节点，身份只能由源节点的签名和转发链证明
+		if msg.SrcPeerId == "" || msg.MessageSignature == "" {
+			return &ValidateError{Code: ValidateCode_NeedSignature, MsgType: msg.MessageType, Field: "MessageSignature"}
+		}
+		err := verifyMessage(msg)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			err = verifyHop(msg, i)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if msg.SrcPeerId != remotePeerId {
+		return &ValidateError{Code: ValidateCode_IdentityMismatch, MsgType: msg.MessageType, Field: "SrcPeerId"}
+	}
+	if msg.SrcConnectPeerId != "" && msg.SrcConnectPeerId != remotePeerId {
+		return &ValidateError{Code: ValidateCode_IdentityMismatch, MsgType: msg.MessageType, Field: "SrcConnectPeerId"}
+	}
+
+	return nil
+}
+
+/*
+*
+校验websocket和https会话发来的消息，sessionPeerId为空表示会话还没有绑定身份
+绑定的会话中没有填写的SrcPeerId和SrcClientId使用会话的身份
+*/
+func ValidateSessionIdentity(msg *msg1.ChainMessage, sessionPeerId string, sessionClientId string) error {
+	if msg.MessageDirect != msgtype.MsgDirect_Request {
+		if sessionPeerId == "" && LoginEnforce() && !IsAnonymousMessageType(msg.MessageType) {
+			return &ValidateError{Code: ValidateCode_Unauthenticated, MsgType: msg.MessageType, Field: "MessageType"}
+		}
+		return nil
+	}
+	if sessionPeerId == "" && LoginEnforce() {
+		if !IsAnonymousMessageType(msg.MessageType) {
+			return &ValidateError{Code: ValidateCode_Unauthenticated, MsgType: msg.MessageType, Field: "MessageType"}
+		}
+		if (msg.TargetPeerId != "" && !global.IsMyself(msg.TargetPeerId)) || len(msg.TargetPeerIds) > 0 || msg.TargetGroupId != "" || msg.Topic != "" {
+			return &ValidateError{Code: ValidateCode_Unauthenticated, MsgType: msg.MessageType, Field: "TargetPeerId"}
+		}
+		if msg.SrcPeerId == "" || msg.MessageType == msgtype.LOGIN || msg.MessageSignature != "" {
+			return nil
+		}
+		return &ValidateError{Code: ValidateCode_UnboundSession, MsgType: msg.MessageType, Field: "SrcPeerId"}
+	}
+	if sessionPeerId == "" {
+		//签名的请求在ReplayValidate中已经用SrcPeerId的公钥校验
+		if msg.SrcPeerId == "" || msg.MessageType == msgtype.CONNECT || msg.MessageSignature != "" {
+			return nil
+		}
+		return &ValidateError{Code: ValidateCode_UnboundSession, MsgType: msg.MessageType, Field: "SrcPeerId"}
+	}
+	if msg.SrcPeerId == "" {
+		msg.SrcPeerId = sessionPeerId
+	} else if msg.SrcPeerId != sessionPeerId {
+		return &ValidateError{Code: ValidateCode_IdentityMismatch, MsgType: msg.MessageType, Field: "SrcPeerId"}
+	}
+	if msg.SrcClientId == "" {
+		msg.SrcClientId = sessionClientId
+	} else if sessionClientId != "" && msg.SrcClientId != sessionClientId {
+		return &ValidateError{Code: ValidateCode_IdentityMismatch, MsgType: msg.MessageType, Field: "SrcClientId"}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+/*
+*
+拦截器链中的下一步，最后一步是action的ReceiveHandler或者ResponseHandler
+*/
+type Invoker func(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error)
+
+/*
+*
+接收的消息在分发到action之前经过的拦截器，调用next继续处理，不调用next直接返回结果
+请求和回应都经过拦截器，可以根据MessageDirect区分，回应的处理结果总是nil
+*/
+type Interceptor func(chainMessage *entity.ChainMessage, next Invoker) (*entity.ChainMessage, error)
+
+type namedInterceptor struct {
+	name        string
+	interceptor Interceptor
+}
+
+/*
+*
+全局的拦截器对所有的消息类型有效，在消息类型的拦截器的外层，按照登记的顺序从外到内
+*/
+var interceptors = make([]*namedInterceptor, 0)
+
+var msgTypeInterceptors = make(map[string][]*namedInterceptor)
+
+/*
+*
+配置中停用的拦截器的名称，逗号分隔，比如p2p.chain.interceptor.disable: log,CHAT.log
+消息类型的拦截器用消息类型.名称停用
+*/
+var disabledInterceptors = make(map[string]bool)
+
+func init() {
+	disable, _ := config.GetString("p2p.chain.interceptor.disable", "")
+	for _, name := range strings.Split(disable, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			disabledInterceptors[name] = true
+		}
+	}
+	RegistInterceptor("recover", recoverInterceptor)
+	RegistInterceptor("log", logInterceptor)
+}
+
+/*
+*
+登记全局的拦截器，同名的拦截器被替换
+*/
+func RegistInterceptor(name string, interceptor Interceptor) {
+	interceptors = registInterceptor(interceptors, name, interceptor)
+}
+
+/*
+*
+登记消息类型的拦截器，同名的拦截器被替换
+*/
+func RegistMsgTypeInterceptor(msgType string, name string, interceptor Interceptor) {
+	msgTypeInterceptors[msgType] = registInterceptor(msgTypeInterceptors[msgType], name, interceptor)
+}
+
+func registInterceptor(chain []*namedInterceptor, name string, interceptor Interceptor) []*namedInterceptor {
+	for _, ni := range chain {
+		if ni.name == name {
+			logger.Sugar.Warnf("Interceptor:%v exist, will be replaced", name)
+			ni.interceptor = interceptor
+			return chain
+		}
+	}
+
+	return append(chain, &namedInterceptor{name: name, interceptor: interceptor})
+}
+
+/*
+*
+用拦截器包裹最后一步，停用的拦截器被跳过
+*/
+func (this *ChainMessageHandler) chain(last Invoker) Invoker {
+	invoker := last
+	local := msgTypeInterceptors[this.MsgType]
+	for i := len(local) - 1; i >= 0; i-- {
+		if disabledInterceptors[this.MsgType+"."+local[i].name] {
+			continue
+		}
+		invoker = wrap(local[i].interceptor, invoker)
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		if disabledInterceptors[interceptors[i].name] {
+			continue
+		}
+		invoker = wrap(interceptors[i].interceptor, invoker)
+	}
+
+	return invoker
+}
+
+func wrap(interceptor Interceptor, next Invoker) Invoker {
+	return func(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+		return interceptor(chainMessage, next)
+	}
+}
+
+/*
+*
+经过拦截器链调用ReceiveHandler
+*/
+func (this *ChainMessageHandler) Receive(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+	if this.ReceiveHandler == nil {
+		return nil, errors.New("NoReceiveHandler")
+	}
+
+	return this.chain(this.ReceiveHandler)(chainMessage)
+}
+
+/*
+*
+经过拦截器链调用ResponseHandler
+*/
+func (this *ChainMessageHandler) Response(chainMessage *entity.ChainMessage) error {
+	if this.ResponseHandler == nil {
+		return nil
+	}
+	_, err := this.chain(func(chainMessage *entity.ChainMessage) (*entity.ChainMessage, error) {
+		return nil, this.ResponseHandler(chainMessage)
+	})(chainMessage)
+
+	return err
+}
+
+/*
+*
+action的处理函数panic的时候返回错误，不影响其他的消息
+*/
+func recoverInterceptor(chainMessage *entity.ChainMessage, next Invoker) (response *entity.ChainMessage, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Sugar.Errorf("handle %v message uuid: %v panic: %v\n%s", chainMessage.MessageType, chainMessage.UUID, r, debug.Stack())
+			response = nil
+			err = errors.New("HandlerPanic")
+		}
+	}()
+
+	return next(chainMessage)
+}
+
+/*
+*
+记录每个消息的处理时间和错误
+*/
+func logInterceptor(chainMessage *entity.ChainMessage, next Invoker) (*entity.ChainMessage, error) {
+	start := time.Now()
+	response, err := next(chainMessage)
+	elapsed := time.Since(start)
+	if err != nil {
+		logger.Sugar.Warnf("handle %v %v message uuid: %v srcPeerId: %v elapsed: %v error: %v", chainMessage.MessageDirect,
+			chainMessage.MessageType, chainMessage.UUID, chainMessage.SrcPeerId, elapsed, err)
+	} else if chainMessage.MessageDirect == msgtype.MsgDirect_Request {
+		logger.Sugar.Debugf("handle %v message uuid: %v srcPeerId: %v elapsed: %v", chainMessage.MessageType,
+			chainMessage.UUID, chainMessage.SrcPeerId, elapsed)
+	}
+
+	return response, err
+}
@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/crypto/openpgp"
+	"github.com/curltech/go-colla-core/crypto/std"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/global"
+	"github.com/curltech/go-colla-node/p2p/dht/entity"
+	"github.com/curltech/go-colla-node/p2p/dht/service"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*
+websocket和https会话的登录：
+1.客户端发送LOGIN，节点为会话生成一次性的随机数，有效期是p2p.chain.login.nonceTimeout
+2.客户端用PeerPublicKey对应的openpgp私钥对 随机数|peerId|clientId|节点peerId 签名，再次发送LOGIN
+3.节点用保存的这个peerId的PeerClient.PeerPublicKey校验签名，查询失败的时候拒绝登录，
+已经保存了公钥的时候登录时提供的公钥必须与保存的一致，
+还没有保存公钥的是第一次登记，用登录时提供的公钥校验签名，证明持有对应的私钥，登录以后的CONNECT保存这个公钥，
+校验通过以后会话绑定到这个身份，以后会话的请求都使用这个身份，会话断开的时候解除
+4.没有登录的会话只能向本节点发送少数几种消息，比如LOGIN，PING
+5.p2p.chain.login.enforce缺省为false，兼容老的客户端，CONNECT成功的时候绑定会话，不校验签名，
+但是没有登录的会话不能登记或者替换PeerPublicKey，客户端都升级并且保存了公钥以后再打开
+*/
+type Session struct {
+	PeerId   string
+	ClientId string
+	// 登录时校验过签名的公钥，CONNECT绑定的会话为空
+	PeerPublicKey string
+	LoginTime     time.Time
+}
+
+type loginChallenge struct {
+	peerId   string
+	clientId string
+	nonce    string
+	expireAt time.Time
+}
+
+var loginEnforce = false
+
+var nonceTimeout = time.Minute
+
+var loginMutex sync.RWMutex
+
+// 连接会话与绑定的身份的映射
+var sessions = make(map[string]*Session)
+
+// 连接会话与等待签名的随机数的映射
+var loginChallenges = make(map[string]*loginChallenge)
+
+// 没有登录的会话可以发送的消息类型
+var anonymousMessageTypes = map[string]bool{
+	msgtype.LOGIN:    true,
+	msgtype.PING:     true,
+	msgtype.FINDPEER: true,
+}
+
+func init() {
+	loginEnforce, _ = config.GetBool("p2p.chain.login.enforce", false)
+	timeout, _ := config.GetInt("p2p.chain.login.nonceTimeout", 60000)
+	nonceTimeout = time.Millisecond * time.Duration(timeout)
+	anonymous, _ := config.GetString("p2p.chain.login.anonymous", "")
+	for _, msgType := range strings.Split(anonymous, ",") {
+		msgType = strings.TrimSpace(msgType)
+		if msgType != "" {
+			RegistAnonymousMessageType(msgType)
+		}
+	}
+}
+
+// LoginEnforce 会话是否必须登录才能绑定身份
+func LoginEnforce() bool {
+	return loginEnforce
+}
+
+// RegistAnonymousMessageType 登记没有登录的会话可以发送的消息类型
+func RegistAnonymousMessageType(msgType string) {
+	loginMutex.Lock()
+	defer loginMutex.Unlock()
+	anonymousMessageTypes[msgType] = true
+}
+
+func IsAnonymousMessageType(msgType string) bool {
+	loginMutex.RLock()
+	defer loginMutex.RUnlock()
+
+	return anonymousMessageTypes[msgType]
+}
+
+// GetSession 连接会话绑定的身份，没有绑定的返回nil
+func GetSession(connectSessionId string) *Session {
+	loginMutex.RLock()
+	defer loginMutex.RUnlock()
+	session, ok := sessions[connectSessionId]
+	if !ok {
+		return nil
+	}
+	s := *session
+
+	return &s
+}
+
+/*
+*
+会话绑定身份，已经绑定了其他peerId的会话不能改变
+*/
+func BindSession(connectSessionId string, session *Session) error {
+	if connectSessionId == "" || session == nil || session.PeerId == "" {
+		return errors.New("NullSession")
+	}
+	loginMutex.Lock()
+	defer loginMutex.Unlock()
+	old, ok := sessions[connectSessionId]
+	if ok && (old.PeerId != session.PeerId || old.ClientId != session.ClientId) {
+		return errors.New("IdentityMismatch")
+	}
+	session.LoginTime = time.Now()
+	sessions[connectSessionId] = session
+
+	return nil
+}
+
+// RemoveSession 会话断开的时候解除绑定的身份和等待签名的随机数
+func RemoveSession(connectSessionId string) {
+	loginMutex.Lock()
+	defer loginMutex.Unlock()
+	delete(sessions, connectSessionId)
+	delete(loginChallenges, connectSessionId)
+}
+
+/*
+*
+为会话生成一次性的随机数，同一个会话重新请求的时候替换原来的
+*/
+func Challenge(connectSessionId string, peerId string, clientId string) (string, error) {
+	if connectSessionId == "" {
+		return "", errors.New("NoConnectSession")
+	}
+	if peerId == "" {
+		return "", errors.New("NoPeerId")
+	}
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	nonce := std.EncodeBase64(buf)
+	now := time.Now()
+	loginMutex.Lock()
+	defer loginMutex.Unlock()
+	loginChallenges[connectSessionId] = &loginChallenge{peerId: peerId, clientId: clientId, nonce: nonce, expireAt: now.Add(nonceTimeout)}
+	// 顺便清除过期的随机数，https的会话没有断开的通知
+	if len(loginChallenges) > 10000 {
+		for k, v := range loginChallenges {
+			if now.After(v.expireAt) {
+				delete(loginChallenges, k)
+			}
+		}
+	}
+
+	return nonce, nil
+}
+
+// loginSignatureData 登录签名的数据，包含节点的peerId，签名不能用于登录其他节点
+func loginSignatureData(login *msg1.Login) []byte {
+	data := fmt.Sprintf("%v|%v|%v|%v", login.Nonce, login.PeerId, login.ClientId, global.Global.PeerId.String())
+
+	return []byte(data)
+}
+
+var errNoPeerPublicKey = errors.New("NoPeerPublicKey")
+
+/*
+*
+peerId保存的公钥，多个客户端的时候使用第一个有公钥的PeerClient，没有保存的返回errNoPeerPublicKey
+*/
+func getPeerPublicKey(peerId string) (string, error) {
+	peerClients, err := service.GetPeerClientService().GetValues(peerId, "", "", "")
+	if err != nil {
+		logger.Sugar.Warnf("get peer client: %v failure: %v", peerId, err)
+		return "", errors.New("GetPeerPublicKeyFailure")
+	}
+	for _, peerClient := range peerClients {
+		if peerClient.PeerPublicKey != "" {
+			return peerClient.PeerPublicKey, nil
+		}
+	}
+
+	return "", errNoPeerPublicKey
+}
+
+/*
+*
+校验会话的随机数和签名，随机数只能使用一次，通过以后会话绑定到登录的身份
+*/
+func Login(connectSessionId string, login *msg1.Login) (*Session, error) {
+	loginMutex.Lock()
+	challenge, ok := loginChallenges[connectSessionId]
+	delete(loginChallenges, connectSessionId)
+	loginMutex.Unlock()
+	if !ok || time.Now().After(challenge.expireAt) {
+		return nil, errors.New("NoLoginNonce")
+	}
+	if challenge.nonce != login.Nonce || challenge.peerId != login.PeerId || challenge.clientId != login.ClientId {
+		return nil, errors.New("InvalidLoginNonce")
+	}
+	peerPublicKey, err := getPeerPublicKey(login.PeerId)
+	if err == errNoPeerPublicKey && login.PeerPublicKey != "" {
+		//第一次登记，签名证明持有提供的公钥对应的私钥
+		peerPublicKey = login.PeerPublicKey
+	} else if err != nil {
+		return nil, err
+	} else if login.PeerPublicKey != "" && login.PeerPublicKey != peerPublicKey {
+		return nil, errors.New("PeerPublicKeyMismatch")
+	}
+	publicKey, err := openpgp.LoadPublicKey(std.DecodeBase64(peerPublicKey))
+	if err != nil {
+		return nil, errors.New("LoadPeerPublicKeyFailure")
+	}
+	pass, _ := openpgp.Verify(publicKey, loginSignatureData(login), std.DecodeBase64(login.Signature))
+	if !pass {
+		return nil, errors.New("LoginVerifyFailure")
+	}
+	session := &Session{PeerId: login.PeerId, ClientId: login.ClientId, PeerPublicKey: peerPublicKey}
+	err = BindSession(connectSessionId, session)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+/*
+*
+CONNECT保存PeerClient之前确定PeerPublicKey：已经保存的公钥不能替换，
+还没有保存的只能登记登录时校验过的公钥，没有登录的会话提供的公钥不保存
+*/
+func CheckPeerPublicKey(connectSessionId string, peerClient *entity.PeerClient) error {
+	storedPublicKey, err := getPeerPublicKey(peerClient.PeerId)
+	if err != nil && err != errNoPeerPublicKey {
+		return err
+	}
+	verifiedPublicKey := ""
+	session := GetSession(connectSessionId)
+	if session != nil && session.PeerId == peerClient.PeerId {
+		verifiedPublicKey = session.PeerPublicKey
+	}
+	if storedPublicKey != "" {
+		if (peerClient.PeerPublicKey != "" && peerClient.PeerPublicKey != storedPublicKey) ||
+			(verifiedPublicKey != "" && verifiedPublicKey != storedPublicKey) {
+			return errors.New("PeerPublicKeyMismatch")
+		}
+		peerClient.PeerPublicKey = storedPublicKey
+		return nil
+	}
+	if verifiedPublicKey != "" && peerClient.PeerPublicKey != "" && peerClient.PeerPublicKey != verifiedPublicKey {
+		return errors.New("PeerPublicKeyMismatch")
+	}
+	peerClient.PeerPublicKey = verifiedPublicKey
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/util/message"
+	entity2 "github.com/curltech/go-colla-node/p2p/chain/entity"
+	"github.com/curltech/go-colla-node/p2p/codec"
+	"github.com/curltech/go-colla-node/p2p/dht/entity"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"reflect"
+	"sync"
+)
+
+/*
+*
+PayloadType的工厂，返回用于解码的空对象的指针，比如&entity.PeerClient{}，列表返回切片的指针
+*/
+type PayloadFactory func() interface{}
+
+var payloadFactories = make(map[string]PayloadFactory)
+
+var payloadMutex sync.RWMutex
+
+/*
+*
+登记PayloadType，Decrypt按照PayloadType把TransportPayload解码成工厂创建的对象
+扩展的包在自己的init中登记自己的PayloadType，没有登记的PayloadType解码成map[string]interface{}
+*/
+func RegistPayloadType(name string, factory PayloadFactory) {
+	payloadMutex.Lock()
+	defer payloadMutex.Unlock()
+	_, found := payloadFactories[name]
+	if found {
+		logger.Sugar.Warnf("PayloadType:%v is registed, will be replaced", name)
+	}
+	payloadFactories[name] = factory
+}
+
+/*
+*
+解码PayloadType对应的对象，列表返回切片本身而不是切片的指针，自动识别json和二进制编码
+*/
+func unmarshalPayload(payloadType string, data []byte) (interface{}, error) {
+	payloadMutex.RLock()
+	factory, found := payloadFactories[payloadType]
+	payloadMutex.RUnlock()
+	var payload interface{}
+	if found {
+		payload = factory()
+	} else {
+		payload = make(map[string]interface{})
+	}
+	err := codec.Unmarshal(data, &payload)
+	if err != nil {
+		return payload, err
+	}
+	v := reflect.ValueOf(payload)
+	if v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Kind() == reflect.Slice {
+		payload = v.Elem().Interface()
+	}
+
+	return payload, nil
+}
+
+/*
+*
+把Payload转换成typed指向的类型，typed是指针
+已经是同一类型的时候直接赋值，否则（比如老的客户端发送的map）经过一次序列化转换
+*/
+func DecodePayload(payload interface{}, typed interface{}) error {
+	if payload == nil {
+		return errors.New("NullPayload")
+	}
+	t := reflect.ValueOf(typed)
+	if t.Kind() != reflect.Ptr || t.IsNil() {
+		return errors.New("InvalidTypedPayload")
+	}
+	v := reflect.ValueOf(payload)
+	if v.Type() == t.Type() {
+		t.Elem().Set(v.Elem())
+		return nil
+	}
+	if v.Type() == t.Elem().Type() {
+		t.Elem().Set(v)
+		return nil
+	}
+	data, err := message.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return message.Unmarshal(data, typed)
+}
+
+func init() {
+	RegistPayloadType(PayloadType_String, func() interface{} { return "" })
+	RegistPayloadType(PayloadType_PeerClient, func() interface{} { return &entity.PeerClient{} })
+	RegistPayloadType(PayloadType_PeerEndpoint, func() interface{} { return &entity.PeerEndpoint{} })
+	RegistPayloadType(PayloadType_ChainApp, func() interface{} { return &entity.ChainApp{} })
+	RegistPayloadType(PayloadType_DataBlock, func() interface{} { return &entity2.DataBlock{} })
+	RegistPayloadType(PayloadType_ConsensusLog, func() interface{} { return &entity2.ConsensusLog{} })
+	RegistPayloadType(PayloadType_PreKeyBundle, func() interface{} { return &entity.PreKeyBundle{} })
+	RegistPayloadType(PayloadType_Group, func() interface{} { return &entity.Group{} })
+	RegistPayloadType(PayloadType_Topic, func() interface{} { return &entity.Topic{} })
+	RegistPayloadType(PayloadType_Presence, func() interface{} { return &msg1.Presence{} })
+	RegistPayloadType(PayloadType_Handshake, func() interface{} { return &msg1.Handshake{} })
+	RegistPayloadType(PayloadType_Login, func() interface{} { return &msg1.Login{} })
+	RegistPayloadType(PayloadType_Receipt, func() interface{} { return &msg1.Receipt{} })
+
+	RegistPayloadType(PayloadType_PeerClients, func() interface{} { return &[]*entity.PeerClient{} })
+	RegistPayloadType(PayloadType_PeerEndpoints, func() interface{} { return &[]*entity.PeerEndpoint{} })
+	RegistPayloadType(PayloadType_ChainApps, func() interface{} { return &[]*entity.ChainApp{} })
+	RegistPayloadType(PayloadType_DataBlocks, func() interface{} { return &[]*entity2.DataBlock{} })
+	RegistPayloadType(PayloadType_Receipts, func() interface{} { return &[]*msg1.Receipt{} })
+	RegistPayloadType(PayloadType_Presences, func() interface{} { return &[]*msg1.Presence{} })
+}
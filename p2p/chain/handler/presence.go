@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/util/message"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/libp2p/pubsub"
+	"github.com/curltech/go-colla-node/p2p/dht/entity"
+	"github.com/curltech/go-colla-node/p2p/dht/service"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*
+在线状态：
+1.客户端连接和断开的时候，连接节点在消抖时间之后把最后的状态发布到这个peerId的在线状态主题
+2.关注在线状态的客户端向自己的连接节点登记关注的peerId，连接节点订阅这些peerId的在线状态主题，
+收到在线状态的变化以后写给关注的本地客户端
+3.VisibilitySetting的在线状态位是N的客户端不发布在线状态
+*/
+var presenceEnable = true
+
+var presenceDebounce = 3 * time.Second
+
+// 每个连接会话最多关注的peerId数
+var presenceMaxWatch = 500
+
+type presenceState struct {
+	presence  *msg1.Presence
+	timer     *time.Timer
+	published string
+}
+
+var presenceMutex sync.Mutex
+
+// peerId/clientId与等待发布的在线状态的映射
+var presenceStates = make(map[string]*presenceState)
+
+var watcherMutex sync.Mutex
+
+// 被关注的peerId与关注的本地客户端的映射，客户端按照peerId和连接会话区分
+var presenceWatchers = make(map[string]map[string]*entity.PeerClient)
+
+// 关注的本地客户端与关注的peerId数的映射，限制每个连接会话总的关注数
+var watchCounts = make(map[string]int)
+
+func init() {
+	presenceEnable, _ = config.GetBool("p2p.chain.presence.enable", true)
+	debounce, _ := config.GetInt("p2p.chain.presence.debounce", 3000)
+	presenceDebounce = time.Millisecond * time.Duration(debounce)
+	presenceMaxWatch, _ = config.GetInt("p2p.chain.presence.maxWatch", 500)
+}
+
+func PresenceMaxWatch() int {
+	return presenceMaxWatch
+}
+
+/*
+*
+客户端的在线状态改变，消抖时间内的多次改变只发布最后的状态，最后的状态与上次发布的相同不再发布
+*/
+func NotifyPresence(peerClient *entity.PeerClient) {
+	if !presenceEnable || peerClient == nil || peerClient.PeerId == "" {
+		return
+	}
+	if !peerClient.IsVisible(entity.Visibility_Presence) {
+		return
+	}
+	key := peerClient.PeerId + "/" + peerClient.ClientId
+	presenceMutex.Lock()
+	defer presenceMutex.Unlock()
+	state, ok := presenceStates[key]
+	if !ok {
+		state = &presenceState{}
+		presenceStates[key] = state
+	}
+	state.presence = &msg1.Presence{
+		PeerId:         peerClient.PeerId,
+		ClientId:       peerClient.ClientId,
+		ActiveStatus:   peerClient.ActiveStatus,
+		LastAccessTime: peerClient.LastAccessTime,
+	}
+	if state.timer == nil {
+		state.timer = time.AfterFunc(presenceDebounce, func() {
+			flushPresence(key)
+		})
+	}
+}
+
+/*
+*
+消抖时间到了以后发布最后的状态，下线的状态发布以后不再保留
+*/
+func flushPresence(key string) {
+	presenceMutex.Lock()
+	state, ok := presenceStates[key]
+	if !ok {
+		presenceMutex.Unlock()
+		return
+	}
+	state.timer = nil
+	presence := state.presence
+	if presence.ActiveStatus == state.published {
+		presenceMutex.Unlock()
+		return
+	}
+	state.published = presence.ActiveStatus
+	if presence.ActiveStatus == entity.ActiveStatus_Down {
+		delete(presenceStates, key)
+	}
+	presenceMutex.Unlock()
+	err := publishPresence(presence)
+	if err != nil {
+		logger.Sugar.Errorf("publish presence peerId: %v failure: %v", presence.PeerId, err)
+	}
+}
+
+/*
+*
+发布到peerId的在线状态主题，没有节点订阅的时候不发布
+本节点有关注的客户端的时候已经订阅了主题，发布的消息经过GossipSub回到本节点再分发
+*/
+func publishPresence(presence *msg1.Presence) error {
+	topic := ns.GetPresenceTopic(presence.PeerId)
+	if !hasPresenceWatchers(presence.PeerId) && (pubsub.Pubsub == nil || len(pubsub.ListPeers(topic)) == 0) {
+		return nil
+	}
+	chainMessage := &msg1.ChainMessage{
+		MessageType:   msgtype.PRESENCE,
+		MessageDirect: msgtype.MsgDirect_Request,
+		Topic:         topic,
+		Payload:       presence,
+		PayloadType:   PayloadType_Presence,
+	}
+	_, err := Encrypt(chainMessage)
+	if err != nil {
+		return err
+	}
+	err = SignMessage(chainMessage)
+	if err != nil {
+		return err
+	}
+	data, err := message.Marshal(chainMessage)
+	if err != nil {
+		return err
+	}
+	pubsub.SendRaw(topic, data)
+
+	return nil
+}
+
+func watcherKey(peerClient *entity.PeerClient) string {
+	return peerClient.PeerId + "/" + peerClient.ConnectSessionId
+}
+
+/*
+*
+本地客户端关注peerIds的在线状态，第一个关注者关注的时候节点订阅在线状态主题
+每个连接会话总的关注数不超过maxWatch，超过的时候整个请求被拒绝
+*/
+func WatchPresence(peerIds []string, peerClient *entity.PeerClient) error {
+	watcherMutex.Lock()
+	defer watcherMutex.Unlock()
+	key := watcherKey(peerClient)
+	added := make(map[string]bool)
+	for _, peerId := range peerIds {
+		_, ok := presenceWatchers[peerId][key]
+		if !ok {
+			added[peerId] = true
+		}
+	}
+	if watchCounts[key]+len(added) > presenceMaxWatch {
+		return errors.New("TooManyWatches")
+	}
+	for peerId := range added {
+		watchers, ok := presenceWatchers[peerId]
+		if !ok {
+			_, err := pubsub.Subscribe(ns.GetPresenceTopic(peerId))
+			if err != nil {
+				return err
+			}
+			watchers = make(map[string]*entity.PeerClient)
+			presenceWatchers[peerId] = watchers
+		}
+		watchers[key] = peerClient
+		watchCounts[key]++
+	}
+
+	return nil
+}
+
+func unwatch(watchers map[string]*entity.PeerClient, key string) {
+	_, ok := watchers[key]
+	if !ok {
+		return
+	}
+	delete(watchers, key)
+	watchCounts[key]--
+	if watchCounts[key] <= 0 {
+		delete(watchCounts, key)
+	}
+}
+
+/*
+*
+本地客户端取消关注peerIds的在线状态
+*/
+func UnwatchPresence(peerIds []string, peerClient *entity.PeerClient) {
+	watcherMutex.Lock()
+	defer watcherMutex.Unlock()
+	key := watcherKey(peerClient)
+	for _, peerId := range peerIds {
+		watchers, ok := presenceWatchers[peerId]
+		if !ok {
+			continue
+		}
+		unwatch(watchers, key)
+		removeWatched(peerId, watchers)
+	}
+}
+
+/*
+*
+连接断开的时候取消这个连接会话所有的关注
+*/
+func UnwatchSession(connectSessionId string) {
+	watcherMutex.Lock()
+	defer watcherMutex.Unlock()
+	for peerId, watchers := range presenceWatchers {
+		for key, peerClient := range watchers {
+			if peerClient.ConnectSessionId == connectSessionId {
+				unwatch(watchers, key)
+			}
+		}
+		removeWatched(peerId, watchers)
+	}
+}
+
+/*
+*
+没有关注者的peerId取消订阅在线状态主题
+*/
+func removeWatched(peerId string, watchers map[string]*entity.PeerClient) {
+	if len(watchers) > 0 {
+		return
+	}
+	delete(presenceWatchers, peerId)
+	pubsub.Unsubscribe(ns.GetPresenceTopic(peerId))
+}
+
+func hasPresenceWatchers(peerId string) bool {
+	watcherMutex.Lock()
+	defer watcherMutex.Unlock()
+
+	return len(presenceWatchers[peerId]) > 0
+}
+
+/*
+*
+关注peerId在线状态的本地客户端
+*/
+func GetPresenceWatchers(peerId string) []*entity.PeerClient {
+	watcherMutex.Lock()
+	defer watcherMutex.Unlock()
+	peerClients := make([]*entity.PeerClient, 0, len(presenceWatchers[peerId]))
+	for _, peerClient := range presenceWatchers[peerId] {
+		peerClients = append(peerClients, peerClient)
+	}
+
+	return peerClients
+}
+
+/*
+*
+在线状态主题的消息只能由被关注的peerId自己或者它登记的连接节点发布，
+在线状态的peerId必须是主题的peerId，否则任何节点都可以伪造其他peerId的在线状态
+*/
+func CheckPresencePublisher(topicName string, chainMessage *msg1.ChainMessage) error {
+	if chainMessage.MessageType != msgtype.PRESENCE {
+		return errors.New("TopicPublishDenied")
+	}
+	peerId := strings.TrimPrefix(topicName, ns.GetPresenceTopic(""))
+	c := *chainMessage
+	if c.TransportPayload != "" {
+		_, err := Decrypt(&c)
+		if err != nil {
+			return err
+		}
+	}
+	presence, ok := c.Payload.(*msg1.Presence)
+	if !ok || presence == nil || presence.PeerId != peerId {
+		return errors.New("InconsistentPresencePeerId")
+	}
+	if chainMessage.SrcPeerId == peerId {
+		return nil
+	}
+	peerClients, err := service.GetPeerClientService().GetLocals(ns.GetPeerClientKey(peerId), presence.ClientId)
+	if err != nil || len(peerClients) == 0 {
+		peerClients, err = service.GetPeerClientService().GetValues(peerId, "", "", "")
+		if err != nil {
+			return err
+		}
+	}
+	for _, peerClient := range peerClients {
+		if peerClient.ClientId == presence.ClientId && peerClient.ConnectPeerId == chainMessage.SrcPeerId {
+			return nil
+		}
+	}
+
+	return errors.New("PresencePublisherNotConnectPeer")
+}
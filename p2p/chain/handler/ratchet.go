@@ -0,0 +1,325 @@
+package handler
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/curltech/go-colla-core/crypto/std"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"strconv"
+)
+
+/*
+*
+Double Ratchet的实现，参照Signal的规范
+每个消息使用链密钥派生的一次性消息密钥加密，每收到对方新的棘轮公钥就做一次DH棘轮，
+泄露当前的密钥不能解密以前的消息
+*/
+
+// maxSkip 一个链上最多跳过（乱序或者丢失）的消息数
+const maxSkip = 1000
+
+// maxSkipped 最多保存的跳过的消息密钥数
+const maxSkipped = 2000
+
+const (
+	ratchetInfo = "colla-ratchet"
+	messageInfo = "colla-message"
+)
+
+/*
+*
+会话的状态，以JSON保存
+*/
+type ratchetState struct {
+	// 自己当前的棘轮私钥
+	DHs []byte `json:"dhs,omitempty"`
+	// 对方当前的棘轮公钥
+	DHr []byte `json:"dhr,omitempty"`
+	RK  []byte `json:"rk,omitempty"`
+	CKs []byte `json:"cks,omitempty"`
+	CKr []byte `json:"ckr,omitempty"`
+	Ns  uint32 `json:"ns,omitempty"`
+	Nr  uint32 `json:"nr,omitempty"`
+	PN  uint32 `json:"pn,omitempty"`
+	// 跳过的消息密钥，键是对方的棘轮公钥和消息序号
+	Skipped map[string][]byte `json:"skipped,omitempty"`
+	// X3DH的关联数据，发起方和接收方的身份公钥
+	AD []byte `json:"ad,omitempty"`
+	// 建立会话的X3DH临时公钥
+	InitKey string `json:"initKey,omitempty"`
+	// 发起方在收到对方的消息之前，每个消息都带上的X3DH参数
+	PreKey *msg1.SessionHeader `json:"preKey,omitempty"`
+}
+
+func generateDH() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+func dh(privateKey []byte, publicKey []byte) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return priv.ECDH(pub)
+}
+
+func publicKeyOf(privateKey []byte) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return priv.PublicKey().Bytes(), nil
+}
+
+func kdfRK(rk []byte, dhOut []byte) ([]byte, []byte, error) {
+	out, err := hkdf.Key(sha256.New, dhOut, rk, ratchetInfo, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return out[:32], out[32:], nil
+}
+
+func kdfCK(ck []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x01})
+	mk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x02})
+
+	return mac.Sum(nil), mk
+}
+
+func messageCipher(mk []byte) (cipher.AEAD, []byte, error) {
+	out, err := hkdf.Key(sha256.New, mk, make([]byte, 32), messageInfo, 32+12)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(out[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aead, out[32:], nil
+}
+
+func sealMessage(mk []byte, plaintext []byte, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageCipher(mk)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func openMessage(mk []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageCipher(mk)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+/*
+*
+消息的关联数据：X3DH的关联数据加上Double Ratchet的消息头，消息头被篡改则解密失败
+*/
+func headerAD(ad []byte, header *msg1.SessionHeader) []byte {
+	buf := make([]byte, 0, len(ad)+len(header.RatchetKey)+8)
+	buf = append(buf, ad...)
+	buf = append(buf, header.RatchetKey...)
+	buf = binary.BigEndian.AppendUint32(buf, header.PreviousCount)
+	buf = binary.BigEndian.AppendUint32(buf, header.Count)
+
+	return buf
+}
+
+func skippedKey(ratchetKey []byte, n uint32) string {
+	return std.EncodeBase64(ratchetKey) + ":" + strconv.FormatUint(uint64(n), 10)
+}
+
+/*
+*
+发起方的初始化，sk是X3DH的共享密钥，bobPreKey是对方的预共享公钥，作为对方的第一个棘轮公钥
+*/
+func newAliceState(sk []byte, bobPreKey []byte, ad []byte) (*ratchetState, error) {
+	dhs, err := generateDH()
+	if err != nil {
+		return nil, err
+	}
+	dhOut, err := dh(dhs.Bytes(), bobPreKey)
+	if err != nil {
+		return nil, err
+	}
+	rk, cks, err := kdfRK(sk, dhOut)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ratchetState{DHs: dhs.Bytes(), DHr: bobPreKey, RK: rk, CKs: cks, AD: ad, Skipped: make(map[string][]byte)}, nil
+}
+
+/*
+*
+接收方的初始化，preKey是X3DH使用的自己的预共享私钥，作为自己的第一个棘轮私钥
+*/
+func newBobState(sk []byte, preKey []byte, ad []byte) *ratchetState {
+	return &ratchetState{DHs: preKey, RK: sk, AD: ad, Skipped: make(map[string][]byte)}
+}
+
+func (this *ratchetState) clone() *ratchetState {
+	c := *this
+	c.Skipped = make(map[string][]byte, len(this.Skipped))
+	for k, v := range this.Skipped {
+		c.Skipped[k] = v
+	}
+
+	return &c
+}
+
+/*
+*
+加密一个消息，返回消息头和密文
+*/
+func (this *ratchetState) encrypt(plaintext []byte) (*msg1.SessionHeader, []byte, error) {
+	if this.CKs == nil {
+		return nil, nil, errors.New("NoSendingChain")
+	}
+	ratchetKey, err := publicKeyOf(this.DHs)
+	if err != nil {
+		return nil, nil, err
+	}
+	var mk []byte
+	this.CKs, mk = kdfCK(this.CKs)
+	header := &msg1.SessionHeader{}
+	if this.PreKey != nil {
+		*header = *this.PreKey
+	}
+	header.RatchetKey = std.EncodeBase64(ratchetKey)
+	header.PreviousCount = this.PN
+	header.Count = this.Ns
+	this.Ns++
+	ciphertext, err := sealMessage(mk, plaintext, headerAD(this.AD, header))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header, ciphertext, nil
+}
+
+/*
+*
+解密一个消息，先查找跳过的消息密钥，对方换了棘轮公钥的时候做DH棘轮
+失败的时候状态不变，调用者在成功后才保存
+*/
+func (this *ratchetState) decrypt(header *msg1.SessionHeader, ciphertext []byte) ([]byte, error) {
+	ratchetKey := std.DecodeBase64(header.RatchetKey)
+	if len(ratchetKey) == 0 {
+		return nil, errors.New("NoRatchetKey")
+	}
+	ad := headerAD(this.AD, header)
+	key := skippedKey(ratchetKey, header.Count)
+	if mk, ok := this.Skipped[key]; ok {
+		plaintext, err := openMessage(mk, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+		delete(this.Skipped, key)
+		return plaintext, nil
+	}
+	if !hmac.Equal(ratchetKey, this.DHr) {
+		err := this.skip(header.PreviousCount)
+		if err != nil {
+			return nil, err
+		}
+		err = this.ratchet(ratchetKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := this.skip(header.Count)
+	if err != nil {
+		return nil, err
+	}
+	var mk []byte
+	this.CKr, mk = kdfCK(this.CKr)
+	this.Nr++
+
+	return openMessage(mk, ciphertext, ad)
+}
+
+/*
+*
+保存当前接收链上直到until的消息密钥，用于之后乱序到达的消息
+*/
+func (this *ratchetState) skip(until uint32) error {
+	if this.CKr == nil {
+		return nil
+	}
+	if this.Nr+maxSkip < until {
+		return errors.New("TooManySkippedMessages")
+	}
+	for this.Nr < until {
+		var mk []byte
+		this.CKr, mk = kdfCK(this.CKr)
+		if len(this.Skipped) >= maxSkipped {
+			for k := range this.Skipped {
+				delete(this.Skipped, k)
+				break
+			}
+		}
+		this.Skipped[skippedKey(this.DHr, this.Nr)] = mk
+		this.Nr++
+	}
+
+	return nil
+}
+
+/*
+*
+DH棘轮：用对方新的棘轮公钥派生接收链，再生成自己新的棘轮密钥派生发送链
+*/
+func (this *ratchetState) ratchet(ratchetKey []byte) error {
+	this.PN = this.Ns
+	this.Ns = 0
+	this.Nr = 0
+	this.DHr = ratchetKey
+	dhOut, err := dh(this.DHs, this.DHr)
+	if err != nil {
+		return err
+	}
+	this.RK, this.CKr, err = kdfRK(this.RK, dhOut)
+	if err != nil {
+		return err
+	}
+	dhs, err := generateDH()
+	if err != nil {
+		return err
+	}
+	this.DHs = dhs.Bytes()
+	dhOut, err = dh(this.DHs, this.DHr)
+	if err != nil {
+		return err
+	}
+	this.RK, this.CKs, err = kdfRK(this.RK, dhOut)
+
+	return err
+}
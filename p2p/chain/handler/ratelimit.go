@@ -0,0 +1,288 @@
+package handler
+
+import (
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/global"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*
+接收消息的限流：每个认证过的peerId和每个连接会话按照消息类型各有一个令牌桶，
+另外每个peerId和每个连接会话各有一个字节数的令牌桶
+消息类型的速率和突发数可以配置，比如p2p.chain.rateLimit.PUTVALUE.rate，p2p.chain.rateLimit.PUTVALUE.burst
+速率为0不限制，超过限制的消息被拒绝，一段时间内违规次数过多的peer被临时禁止，同时由libp2p的ConnectionGater拒绝连接
+*/
+const (
+	ValidateCode_RateLimited   = "RateLimited"
+	ValidateCode_QuotaExceeded = "QuotaExceeded"
+	ValidateCode_Banned        = "Banned"
+)
+
+type rateLimitRule struct {
+	// 每秒的消息数
+	rate float64
+	// 最多可以累积的消息数
+	burst float64
+}
+
+/*
+*
+缺省的规则，修改DHT和共识的消息严格，心跳和节点汇总发布的在线状态宽松
+*/
+var defaultRateLimitRules = map[string]rateLimitRule{
+	msgtype.PUTVALUE:  {rate: 2, burst: 10},
+	msgtype.CONSENSUS: {rate: 5, burst: 20},
+	msgtype.PING:      {rate: 100, burst: 200},
+	msgtype.PRESENCE:  {rate: 100, burst: 500},
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+*
+按照经过的时间补充令牌，够n个的时候取走返回true
+*/
+func (this *tokenBucket) take(rule rateLimitRule, n float64, now time.Time) bool {
+	if this.last.IsZero() {
+		this.tokens = rule.burst
+	} else {
+		this.tokens += now.Sub(this.last).Seconds() * rule.rate
+		if this.tokens > rule.burst {
+			this.tokens = rule.burst
+		}
+	}
+	this.last = now
+	if this.tokens < n {
+		return false
+	}
+	this.tokens -= n
+
+	return true
+}
+
+type rateLimiter struct {
+	mutex      sync.Mutex
+	enable     bool
+	rules      map[string]rateLimitRule
+	bytesRule  rateLimitRule
+	buckets    map[string]*tokenBucket
+	violations map[string][]time.Time
+	// 违规的次数达到banThreshold的peer禁止banDuration，banThreshold为0不禁止
+	banThreshold int
+	banWindow    time.Duration
+	banDuration  time.Duration
+	banned       map[string]time.Time
+}
+
+var limiter *rateLimiter
+
+func init() {
+	enable, _ := config.GetBool("p2p.chain.rateLimit.enable", true)
+	bytesRate, _ := config.GetInt("p2p.chain.rateLimit.bytesPerSecond", 1024*1024)
+	bytesBurst, _ := config.GetInt("p2p.chain.rateLimit.bytesBurst", 8*1024*1024)
+	banThreshold, _ := config.GetInt("p2p.chain.rateLimit.banThreshold", 0)
+	banWindow, _ := config.GetInt("p2p.chain.rateLimit.banWindow", 60000)
+	banDuration, _ := config.GetInt("p2p.chain.rateLimit.banDuration", 600000)
+	limiter = &rateLimiter{
+		enable:       enable,
+		rules:        make(map[string]rateLimitRule),
+		bytesRule:    rateLimitRule{rate: float64(bytesRate), burst: float64(bytesBurst)},
+		buckets:      make(map[string]*tokenBucket),
+		violations:   make(map[string][]time.Time),
+		banThreshold: banThreshold,
+		banWindow:    time.Millisecond * time.Duration(banWindow),
+		banDuration:  time.Millisecond * time.Duration(banDuration),
+		banned:       make(map[string]time.Time),
+	}
+	if enable {
+		go limiter.loopClean()
+	}
+}
+
+/*
+*
+消息类型的规则，第一次使用的时候读取配置，没有配置的使用缺省的规则
+*/
+func (this *rateLimiter) rule(msgType string) rateLimitRule {
+	rule, ok := this.rules[msgType]
+	if ok {
+		return rule
+	}
+	rule, ok = defaultRateLimitRules[msgType]
+	if !ok {
+		rate, _ := config.GetInt("p2p.chain.rateLimit.default.rate", 50)
+		burst, _ := config.GetInt("p2p.chain.rateLimit.default.burst", 100)
+		rule = rateLimitRule{rate: float64(rate), burst: float64(burst)}
+	}
+	rate, _ := config.GetInt("p2p.chain.rateLimit."+msgType+".rate", int(rule.rate))
+	burst, _ := config.GetInt("p2p.chain.rateLimit."+msgType+".burst", int(rule.burst))
+	if rate > 0 {
+		rule.rate = float64(rate)
+	}
+	if burst > 0 {
+		rule.burst = float64(burst)
+	}
+	this.rules[msgType] = rule
+
+	return rule
+}
+
+func (this *rateLimiter) take(key string, rule rateLimitRule, n float64, now time.Time) bool {
+	if rule.rate <= 0 {
+		return true
+	}
+	bucket, ok := this.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{}
+		this.buckets[key] = bucket
+	}
+
+	return bucket.take(rule, n, now)
+}
+
+func (this *rateLimiter) allow(srcPeerId string, connectSessionId string, msgType string, size int) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	now := time.Now()
+	if srcPeerId != "" {
+		until, ok := this.banned[srcPeerId]
+		if ok && now.Before(until) {
+			return &ValidateError{Code: ValidateCode_Banned, MsgType: msgType, Field: "SrcPeerId"}
+		}
+	}
+	//没有登记的消息类型共用缺省的规则和令牌桶，避免任意的消息类型占用内存
+	ruleKey := msgType
+	if _, found := chainMessageHandlers[msgType]; !found {
+		ruleKey = "default"
+	}
+	rule := this.rule(ruleKey)
+	keys := make([]string, 0, 2)
+	if srcPeerId != "" {
+		keys = append(keys, "peer/"+srcPeerId)
+	}
+	if connectSessionId != "" {
+		keys = append(keys, "session/"+connectSessionId)
+	}
+	for _, key := range keys {
+		if !this.take(key+"/"+ruleKey, rule, 1, now) {
+			this.violate(srcPeerId, now)
+			return &ValidateError{Code: ValidateCode_RateLimited, MsgType: msgType, Field: "MessageType"}
+		}
+		if size > 0 && !this.take(key, this.bytesRule, float64(size), now) {
+			this.violate(srcPeerId, now)
+			return &ValidateError{Code: ValidateCode_QuotaExceeded, MsgType: msgType, Field: "TransportPayload"}
+		}
+	}
+
+	return nil
+}
+
+/*
+*
+记录违规，窗口内的次数达到banThreshold的时候禁止
+*/
+func (this *rateLimiter) violate(srcPeerId string, now time.Time) {
+	if this.banThreshold <= 0 || srcPeerId == "" {
+		return
+	}
+	times := this.violations[srcPeerId]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > this.banWindow {
+		i++
+	}
+	times = append(times[i:], now)
+	if len(times) < this.banThreshold {
+		this.violations[srcPeerId] = times
+		return
+	}
+	delete(this.violations, srcPeerId)
+	this.banned[srcPeerId] = now.Add(this.banDuration)
+	logger.Sugar.Warnf("peer: %v is banned until: %v", srcPeerId, now.Add(this.banDuration))
+	go closePeer(srcPeerId)
+}
+
+/*
+*
+定时清除空闲的令牌桶，过期的违规记录和禁止
+*/
+func (this *rateLimiter) loopClean() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		this.mutex.Lock()
+		for key, bucket := range this.buckets {
+			if now.Sub(bucket.last) > 10*time.Minute {
+				delete(this.buckets, key)
+			}
+		}
+		for peerId, times := range this.violations {
+			if len(times) == 0 || now.Sub(times[len(times)-1]) > this.banWindow {
+				delete(this.violations, peerId)
+			}
+		}
+		for peerId, until := range this.banned {
+			if now.After(until) {
+				delete(this.banned, peerId)
+			}
+		}
+		this.mutex.Unlock()
+	}
+}
+
+/*
+*
+接收的消息在校验之前限流，srcPeerId是认证过的发送者（libp2p的对方节点或者会话登录的身份），
+不能使用消息中的SrcPeerId，否则可以伪造其他节点耗尽它的令牌桶并使它被禁止，没有认证的身份的时候为空，
+connectSessionId是连接会话，size是原始消息的字节数，被禁止或者超过限制返回ValidateError，由调用者返回REJECT
+*/
+func RateLimit(srcPeerId string, connectSessionId string, msgType string, size int) error {
+	if !limiter.enable {
+		return nil
+	}
+
+	return limiter.allow(srcPeerId, connectSessionId, msgType, size)
+}
+
+/*
+*
+临时禁止peer，断开它的libp2p连接
+*/
+func Ban(peerId string, duration time.Duration) {
+	limiter.mutex.Lock()
+	limiter.banned[peerId] = time.Now().Add(duration)
+	limiter.mutex.Unlock()
+	go closePeer(peerId)
+}
+
+/*
+*
+peer是否被禁止，libp2p的ConnectionGater使用
+*/
+func IsBanned(peerId string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	until, ok := limiter.banned[peerId]
+
+	return ok && time.Now().Before(until)
+}
+
+func closePeer(peerId string) {
+	if global.Global.Host == nil || strings.TrimSpace(peerId) == "" {
+		return
+	}
+	id, err := peer.Decode(peerId)
+	if err != nil {
+		return
+	}
+	_ = global.Global.Host.Network().ClosePeer(id)
+}
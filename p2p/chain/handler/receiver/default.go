@@ -3,16 +3,19 @@ package receiver
 import (
 	"github.com/curltech/go-colla-core/config"
 	"github.com/curltech/go-colla-core/logger"
-	"github.com/curltech/go-colla-core/util/message"
 	"github.com/curltech/go-colla-node/libp2p/global"
 	"github.com/curltech/go-colla-node/libp2p/pubsub"
+	entity2 "github.com/curltech/go-colla-node/p2p/chain/entity"
 	"github.com/curltech/go-colla-node/p2p/chain/handler"
+	"github.com/curltech/go-colla-node/p2p/chain/service"
+	"github.com/curltech/go-colla-node/p2p/codec"
 	"github.com/curltech/go-colla-node/p2p/dht/entity"
 	p2phandler "github.com/curltech/go-colla-node/p2p/handler"
 	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
 	"github.com/curltech/go-colla-node/p2p/msgtype"
 	"github.com/curltech/go-colla-node/transport/websocket/stdhttp"
 	"net/http"
+	"time"
 )
 
 // ReceiveRaw HandleChainMessage libp2p,wss,https的处理handler，将原始数据还原成ChainMessage，
@@ -22,34 +25,99 @@ import (
 // 对于wss，remotePeerId为空，必须从ChainMessage中获取，再建立连接池
 // 对于https，remotePeerId为空，必须从ChainMessage中获取，无须连接池，不能异步返回信息
 func ReceiveRaw(data []byte, srcPeerId string, clientId string, connectSessionId string, remoteAddr string) ([]byte, error) {
+	response, _, err := receive(data, srcPeerId, clientId, connectSessionId, remoteAddr, Dispatch)
+
+	return response, err
+}
+
+// ReceivePriority 与ReceiveRaw相同，同时返回按照回应的消息类型决定的发送优先级，用于websocket的写出
+func ReceivePriority(data []byte, srcPeerId string, clientId string, connectSessionId string, remoteAddr string) ([]byte, msgtype.Priority, error) {
+	return receive(data, srcPeerId, clientId, connectSessionId, remoteAddr, Dispatch)
+}
+
+// receive 还原，校验ChainMessage，然后交给dispatch分发，返回回应的原始数据和回应的发送优先级
+func receive(data []byte, srcPeerId string, clientId string, connectSessionId string, remoteAddr string,
+	dispatch func(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error)) ([]byte, msgtype.Priority, error) {
 	var response *msg1.ChainMessage
 	chainMessage := &msg1.ChainMessage{}
 	var peerClient *entity.PeerClient
-	err := message.Unmarshal(data, chainMessage)
+	var remotePeerId string
+	var session *handler.Session
+	start := time.Now()
+	//请求的编码，回应使用同样的编码
+	chainMessage.Codec = codec.CodecOf(data)
+	err := codec.Unmarshal(data, chainMessage)
 	if err != nil {
 		response = handler.Error(msgtype.ERROR, err)
 		goto responseProcess
 	}
 	clientId = chainMessage.SrcClientId
+	//libp2p的对方节点是认证过的，websocket和https的身份来自会话
+	remotePeerId = srcPeerId
 	if srcPeerId == "" {
 		srcPeerId = chainMessage.SrcPeerId
 	}
 	if chainMessage.SrcPeerId == "" {
 		chainMessage.SrcPeerId = srcPeerId
 	}
+	chainMessage.ConnectPeerId = string(global.Global.PeerId)
+	chainMessage.ConnectSessionId = connectSessionId
+	logger.Sugar.Infof("Received raw chain message, srcPeerId: %v, clientId: %v, connectSessionId: %v, remoteAddr: %v", srcPeerId, clientId, connectSessionId, remoteAddr)
+	//超过限流的请求和不合格的消息在分发前拒绝
+	//限流按照认证的身份，libp2p的对方节点或者会话登录的身份，消息中的SrcPeerId可以伪造，不能使用
+	if chainMessage.MessageDirect == msgtype.MsgDirect_Request {
+		err = handler.RateLimit(authenticatedPeerId(remotePeerId, connectSessionId), connectSessionId, chainMessage.MessageType, len(data))
+	}
+	if err == nil {
+		err = handler.ReceiveValidate(chainMessage)
+	}
+	if err == nil {
+		err = handler.ReplayValidate(chainMessage)
+	}
+	if err == nil {
+		session, err = validateIdentity(chainMessage, remotePeerId, connectSessionId)
+	}
+	if err == nil {
+		err = handler.ReceiveCapability(chainMessage, authenticatedPeerId(remotePeerId, connectSessionId))
+	}
+	if err != nil {
+		logger.Sugar.Warnf("Reject chain message, srcPeerId: %v, messageType: %v, error: %v", srcPeerId, chainMessage.MessageType, err)
+		response = handler.Reject(chainMessage.MessageType, err)
+		handler.SetResponse(chainMessage, response)
+		service.GetChainMessageLogService().Log(entity2.ChainMessageLogAction_Receive, chainMessage, response, start, err)
+		//对回应不再回应，避免来回循环
+		if chainMessage.MessageDirect == msgtype.MsgDirect_Response {
+			return nil, msgtype.Priority_Normal, nil
+		}
+		data, _ = codec.Marshal(chainMessage.Codec, response)
+
+		return data, msgtype.GetPriority(response.MessageType), nil
+	}
+
+	if remotePeerId == "" && connectSessionId != "" {
+		//直接连接的客户端的请求，源连接节点和会话由本节点填写，身份使用会话绑定的
+		srcPeerId = chainMessage.SrcPeerId
+		clientId = chainMessage.SrcClientId
+		if chainMessage.MessageDirect == msgtype.MsgDirect_Request {
+			chainMessage.SrcConnectPeerId = string(global.Global.PeerId)
+			chainMessage.SrcConnectSessionId = connectSessionId
+		}
+	}
 	if chainMessage.SrcConnectPeerId == "" {
 		chainMessage.SrcConnectPeerId = string(global.Global.PeerId)
 	}
-	chainMessage.ConnectPeerId = string(global.Global.PeerId)
 	if chainMessage.SrcConnectSessionId == "" {
 		chainMessage.SrcConnectSessionId = connectSessionId
 	}
-	chainMessage.ConnectSessionId = connectSessionId
-	logger.Sugar.Infof("Received raw chain message, srcPeerId: %v, clientId: %v, connectSessionId: %v, remoteAddr: %v", srcPeerId, clientId, connectSessionId, remoteAddr)
-
-	peerClient = &entity.PeerClient{PeerId: srcPeerId, ConnectPeerId: chainMessage.SrcConnectPeerId, ConnectSessionId: connectSessionId, ClientId: clientId}
-	UpdatePeerClient(peerClient)
-	response, err = Dispatch(chainMessage)
+	//主题的消息没有连接会话，不是直接连接的客户端，websocket和https的会话绑定了身份才更新
+	if connectSessionId != "" && (remotePeerId != "" || session != nil) {
+		peerClient = &entity.PeerClient{PeerId: srcPeerId, ConnectPeerId: chainMessage.SrcConnectPeerId, ConnectSessionId: connectSessionId, ClientId: clientId}
+		UpdatePeerClient(peerClient)
+	}
+	response, err = dispatch(chainMessage)
+	if err == nil && remotePeerId == "" && connectSessionId != "" && session == nil {
+		bindSession(chainMessage, response, connectSessionId)
+	}
 
 responseProcess:
 	if err != nil {
@@ -60,10 +128,14 @@ responseProcess:
 		}
 	} else {
 		if response != nil {
-			_, err = handler.Encrypt(response)
+			response.Codec = chainMessage.Codec
+			err = handler.ResponseValidate(response)
+			if err == nil {
+				_, err = handler.Encrypt(response)
+			}
 			if err != nil {
 				response = handler.Error(chainMessage.MessageType, err)
-			} else {
+			} else if response.StatusCode == 0 {
 				response.StatusCode = http.StatusOK
 			}
 		} else {
@@ -72,17 +144,21 @@ responseProcess:
 	}
 
 	handler.SetResponse(chainMessage, response)
-	data, _ = message.Marshal(response)
+	service.GetChainMessageLogService().Log(entity2.ChainMessageLogAction_Receive, chainMessage, response, start, err)
+	if chainMessage.MessageDirect == msgtype.MsgDirect_Response {
+		return nil, msgtype.Priority_Normal, nil
+	}
+	data, _ = codec.Marshal(chainMessage.Codec, response)
 
-	return data, nil
+	return data, msgtype.GetPriority(response.MessageType), nil
 }
 
 func init() {
 	//注册websocket的消息处理
-	stdhttp.RegistMessageHandler(ReceiveRaw)
+	stdhttp.RegistMessageHandler(ReceivePriority)
 	stdhttp.RegistDisconnectedHandler(HandleDisconnected)
 	//注册libp2p协议的消息处理
 	p2phandler.RegistProtocolMessageHandler(config.P2pParams.ChainProtocolID, ReceiveRaw)
 	//注册libp2p订阅的消息处理
-	pubsub.RegistMessageHandler(ReceiveRaw)
+	pubsub.RegistMessageHandler(ReceiveTopic)
 }
@@ -2,8 +2,10 @@ package receiver
 
 import (
 	"github.com/curltech/go-colla-node/libp2p/global"
+	"github.com/curltech/go-colla-node/p2p/chain/entity"
 	"github.com/curltech/go-colla-node/p2p/chain/handler"
 	"github.com/curltech/go-colla-node/p2p/chain/handler/sender"
+	"github.com/curltech/go-colla-node/p2p/chain/service"
 	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
 	"github.com/curltech/go-colla-node/p2p/msgtype"
 	"time"
@@ -12,28 +14,77 @@ import (
 // Dispatch 接收ChainMessage报文处理的入口，无论何种方式（libp2p,wss,stdhttp）发送过来
 // 的任何ChainMessage类型都统一在此处理分发
 func Dispatch(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	//本节点转发的请求的回应，原路返回给请求来的节点或者客户端，
+	//保存转发的消息重发的时候本节点也在等待同一个回应
+	if chainMessage.MessageDirect == msgtype.MsgDirect_Response && sender.ReturnRelayed(chainMessage) {
+		sender.Resolve(chainMessage)
+		return nil, nil
+	}
 	targetPeerId := chainMessage.TargetPeerId
-	//目标是自己，则对payload解密，否则直接转发
-	if targetPeerId == "" || global.IsMyself(targetPeerId) {
+	//多个接收者的消息，复制转发给其他的接收者，自己也是接收者的时候继续处理
+	if targetPeerId == "" && len(chainMessage.TargetPeerIds) > 0 {
+		err := sender.PrepareRelay(chainMessage)
+		if err != nil {
+			return handler.Reject(chainMessage.MessageType, err), nil
+		}
+		relayMessage := *chainMessage
+		if !isRecipient(chainMessage) {
+			sender.RegistRelayed(chainMessage)
+		}
+		go func() {
+			start := time.Now()
+			_, err := sender.RelaySend(&relayMessage)
+			service.GetChainMessageLogService().Log(entity.ChainMessageLogAction_Relay, &relayMessage, nil, start, err)
+		}()
+		if !isRecipient(chainMessage) {
+			return handler.Accepted(chainMessage.MessageType), nil
+		}
 		_, _ = handler.Decrypt(chainMessage)
+	} else if targetPeerId == "" && chainMessage.Topic != "" {
+		//发往主题的消息，分发给订阅了主题的本地客户端，然后发布到主题
+		return publish(chainMessage)
+	} else if targetPeerId == "" || global.IsMyself(targetPeerId) {
+		//目标是自己，则对payload解密，否则直接转发
+		//群组消息由GROUPCHAT处理器分发，保留TransportPayload给成员的副本使用
+		if chainMessage.TargetGroupId == "" {
+			_, _ = handler.Decrypt(chainMessage)
+		}
 	} else {
+		//Ttl用完或者循环转发的消息拒绝
+		err := sender.PrepareRelay(chainMessage)
+		if err != nil {
+			return handler.Reject(chainMessage.MessageType, err), nil
+		}
+		sender.RegistRelayed(chainMessage)
 		go func() {
-			_, _ = sender.RelaySend(chainMessage)
+			start := time.Now()
+			_, err := sender.RelaySend(chainMessage)
+			service.GetChainMessageLogService().Log(entity.ChainMessageLogAction_Relay, chainMessage, nil, start, err)
 		}()
-		response := handler.Response(chainMessage.MessageType, time.Now())
-		return response, nil
+		return handler.Accepted(chainMessage.MessageType), nil
 	}
+
+	return handle(chainMessage)
+}
+
+// handle 目标是自己的消息，经过拦截器链分发到对应的处理器
+func handle(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
 	typ := chainMessage.MessageType
 	direct := chainMessage.MessageDirect
+	//如果有请求在等待这个回应，唤醒等待的请求，如果是设备对需要回执的消息的回应，生成送达设备的回执
+	if direct == msgtype.MsgDirect_Response {
+		sender.Resolve(chainMessage)
+		sender.Acknowledge(chainMessage)
+	}
 	chainMessageHandler, err := handler.GetChainMessageHandler(string(typ))
 	var response *msg1.ChainMessage
 	if err != nil {
 		response = handler.Error(typ, err)
 		return response, err
 	}
-	//分发到对应注册好的处理器，主要是Receive和Response方法
+	//经过拦截器链分发到对应注册好的处理器，主要是Receive和Response方法
 	if direct == msgtype.MsgDirect_Request {
-		response, err = chainMessageHandler.ReceiveHandler(chainMessage)
+		response, err = chainMessageHandler.Receive(chainMessage)
 		if err != nil {
 			response = handler.Error(typ, err)
 			return response, err
@@ -43,8 +94,19 @@ func Dispatch(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
 			return response, nil
 		}
 	} else if direct == msgtype.MsgDirect_Response {
-		_ = chainMessageHandler.ResponseHandler(chainMessage)
+		_ = chainMessageHandler.Response(chainMessage)
 	}
 
 	return response, nil
 }
+
+// isRecipient 自己是否在多接收者消息的接收者列表中
+func isRecipient(chainMessage *msg1.ChainMessage) bool {
+	for _, targetPeerId := range chainMessage.TargetPeerIds {
+		if global.IsMyself(targetPeerId) {
+			return true
+		}
+	}
+
+	return false
+}
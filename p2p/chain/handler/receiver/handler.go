@@ -3,8 +3,14 @@ package receiver
 import (
 	"github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/p2p/chain/handler"
+	"github.com/curltech/go-colla-node/p2p/chain/handler/sender"
 	"github.com/curltech/go-colla-node/p2p/dht/entity"
 	svc "github.com/curltech/go-colla-node/p2p/dht/service"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"github.com/curltech/go-colla-node/p2p/push"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -18,6 +24,79 @@ type PeeClientId struct {
 // PeerClientConnectionPool connectSessionId与PeeClientId的映射
 var peerClientConnectionPool sync.Map //make(map[string]*PeeClientId)
 
+/*
+*
+认证过的peerId，libp2p的对方节点，或者websocket和https会话绑定的身份，用于限流和版本检查，
+没有绑定的会话返回空，只按照会话限流，主题的消息由GossipSub的校验器和评分限制
+*/
+func authenticatedPeerId(remotePeerId string, connectSessionId string) string {
+	if remotePeerId != "" || connectSessionId == "" {
+		return remotePeerId
+	}
+	session := handler.GetSession(connectSessionId)
+	if session == nil {
+		return ""
+	}
+
+	return session.PeerId
+}
+
+/*
+*
+校验消息与认证的身份一致，libp2p的消息与对方节点，websocket和https的消息与会话登录的身份，
+回应必须来自请求写到的对方，主题的请求没有连接会话不校验，返回会话绑定的身份
+*/
+func validateIdentity(chainMessage *msg1.ChainMessage, remotePeerId string, connectSessionId string) (*handler.Session, error) {
+	err := sender.ValidateResponder(chainMessage, remotePeerId, connectSessionId)
+	if err != nil {
+		return nil, err
+	}
+	if connectSessionId == "" {
+		return nil, nil
+	}
+	if remotePeerId != "" {
+		return nil, handler.ValidatePeerIdentity(chainMessage, remotePeerId)
+	}
+	session := handler.GetSession(connectSessionId)
+	if session == nil {
+		return nil, handler.ValidateSessionIdentity(chainMessage, "", "")
+	}
+
+	return session, handler.ValidateSessionIdentity(chainMessage, session.PeerId, session.ClientId)
+}
+
+/*
+*
+没有绑定身份的会话LOGIN成功以后，会话已经绑定到登录的身份，更新PeerClient的连接
+不要求登录的时候，CONNECT成功以后绑定到连接的PeerClient
+*/
+func bindSession(chainMessage *msg1.ChainMessage, response *msg1.ChainMessage, connectSessionId string) {
+	if chainMessage.MessageDirect != msgtype.MsgDirect_Request {
+		return
+	}
+	if response == nil || response.StatusCode != http.StatusOK {
+		return
+	}
+	if chainMessage.MessageType == msgtype.CONNECT && !handler.LoginEnforce() {
+		peerClient, ok := chainMessage.Payload.(*entity.PeerClient)
+		if !ok || peerClient.PeerId == "" {
+			return
+		}
+		//CONNECT没有校验签名，会话不带公钥
+		err := handler.BindSession(connectSessionId, &handler.Session{PeerId: peerClient.PeerId, ClientId: peerClient.ClientId})
+		if err != nil {
+			logger.Sugar.Errorf("failed to bind session: %v, err: %v", connectSessionId, err)
+			return
+		}
+	}
+	session := handler.GetSession(connectSessionId)
+	if session == nil {
+		return
+	}
+	logger.Sugar.Infof("bind session: %v to peerId: %v, clientId: %v", connectSessionId, session.PeerId, session.ClientId)
+	UpdatePeerClient(&entity.PeerClient{PeerId: session.PeerId, ConnectPeerId: chainMessage.SrcConnectPeerId, ConnectSessionId: connectSessionId, ClientId: session.ClientId})
+}
+
 func UpdatePeerClient(peerClient *entity.PeerClient) {
 	if peerClient.PeerId == "" {
 		logger.Sugar.Errorf("remotePeerId is blank")
@@ -44,6 +123,8 @@ func UpdatePeerClient(peerClient *entity.PeerClient) {
 					logger.Sugar.Errorf("failed to put peer client, peerId: %v, err: %v", pc.PeerId, err)
 				} else {
 					logger.Sugar.Infof("successfully put peer client, peerId: %v", pc.PeerId)
+					handler.NotifyPresence(pc)
+					push.ResetConversations(pc.PeerId, pc.ClientId)
 				}
 				break
 			}
@@ -52,6 +133,11 @@ func UpdatePeerClient(peerClient *entity.PeerClient) {
 }
 
 func HandleDisconnected(connectSessionId string) {
+	//断开的连接取消所有的主题订阅和在线状态的关注
+	handler.UnsubscribeSession(connectSessionId)
+	handler.UnwatchSession(connectSessionId)
+	handler.RemoveSession(connectSessionId)
+	handler.RemoveCapability("", "", connectSessionId)
 	v, ok := peerClientConnectionPool.Load(connectSessionId)
 	if ok {
 		var peerClientId *PeeClientId = v.(*PeeClientId)
@@ -72,6 +158,8 @@ func HandleDisconnected(connectSessionId string) {
 							err = svc.GetPeerClientService().PutValues(peerClient)
 							if err != nil {
 								logger.Sugar.Errorf("failed to PutPCs, peerId: %v, err: %v", peerClientId.PeerId, err)
+							} else {
+								handler.NotifyPresence(peerClient)
 							}
 							break
 						}
@@ -0,0 +1,73 @@
+package receiver
+
+import (
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/p2p/chain/handler"
+	"github.com/curltech/go-colla-node/p2p/chain/handler/sender"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"time"
+)
+
+// ReceiveTopic 订阅的主题收到的消息，已经经过GossipSub的校验器校验签名和发布者
+func ReceiveTopic(data []byte, srcPeerId string, clientId string, connectSessionId string, remoteAddr string) ([]byte, error) {
+	response, _, err := receive(data, srcPeerId, clientId, connectSessionId, remoteAddr, DispatchTopic)
+
+	return response, err
+}
+
+// DispatchTopic 主题消息分发给订阅了主题的本地客户端，节点自己的主题和在线状态的主题由节点处理
+func DispatchTopic(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	if chainMessage.Topic == "" {
+		return nil, nil
+	}
+	deliverTopic(chainMessage, "")
+	if chainMessage.Topic == config.Libp2pParams.Topic || ns.IsPresenceTopic(chainMessage.Topic) {
+		_, _ = handler.Decrypt(chainMessage)
+		return handle(chainMessage)
+	}
+
+	return nil, nil
+}
+
+// publish 客户端或者其他节点直接发来的主题消息，检查发布的权限，分发给本地的订阅者以后发布到主题
+// 发布的消息经过GossipSub回到本节点的时候作为重复的消息丢弃，不会重复分发
+func publish(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	if chainMessage.MessageDirect != msgtype.MsgDirect_Request {
+		return nil, nil
+	}
+	if chainMessage.MessageSignature == "" {
+		return handler.Reject(chainMessage.MessageType, &handler.ValidateError{Code: handler.ValidateCode_NeedSignature, MsgType: chainMessage.MessageType, Field: "MessageSignature"}), nil
+	}
+	err := handler.CheckPublish(chainMessage.Topic, chainMessage.SrcPeerId)
+	if err != nil {
+		return handler.Reject(chainMessage.MessageType, err), nil
+	}
+	deliverTopic(chainMessage, chainMessage.ConnectSessionId)
+	topicMessage := *chainMessage
+	go func() {
+		_, err := sender.RelaySend(&topicMessage)
+		if err != nil {
+			logger.Sugar.Errorf("publish topic: %v message uuid: %v failure: %v", topicMessage.Topic, topicMessage.UUID, err)
+		}
+	}()
+
+	return handler.Response(chainMessage.MessageType, time.Now()), nil
+}
+
+// deliverTopic 写给订阅了主题的本地客户端，跳过发布消息的连接会话，主题消息不保存也不生成回执
+func deliverTopic(chainMessage *msg1.ChainMessage, excludeSessionId string) {
+	for _, peerClient := range handler.GetTopicSubscribers(chainMessage.Topic) {
+		if excludeSessionId != "" && peerClient.ConnectSessionId == excludeSessionId {
+			continue
+		}
+		err := sender.WritePeerClient(chainMessage, peerClient)
+		if err != nil {
+			//连接已经断开的订阅取消，客户端重新连接以后再订阅
+			logger.Sugar.Warnf("deliver topic: %v message uuid: %v to peerId: %v failure: %v", chainMessage.Topic, chainMessage.UUID, peerClient.PeerId, err)
+			handler.UnsubscribeTopic(chainMessage.Topic, peerClient)
+		}
+	}
+}
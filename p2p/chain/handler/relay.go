@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/crypto/openpgp"
+	"github.com/curltech/go-colla-core/crypto/std"
+	"github.com/curltech/go-colla-node/libp2p/global"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"time"
+)
+
+// DefaultTtl 第一个转发节点为没有Ttl的消息设置的缺省转发次数
+var DefaultTtl = 8
+
+func init() {
+	DefaultTtl, _ = config.GetInt("p2p.chain.relay.ttl", 8)
+}
+
+/*
+*
+每一跳签名的数据，上一跳的签名（第一跳是消息签名）串起整个转发链
+*/
+func hopSignatureData(msg *msg1.ChainMessage, index int, hop *msg1.Hop) []byte {
+	previous := msg.MessageSignature
+	if index > 0 {
+		previous = msg.Hops[index-1].Signature
+	}
+	data := fmt.Sprintf("%v|%v|%v|%v|%v", msg.UUID, msg.MessageType, previous, hop.PeerId, hop.Timestamp)
+
+	return []byte(data)
+}
+
+/*
+*
+转发前检查：Ttl用完，自己已经在转发链中（循环），或者转发链的签名不对，都拒绝转发
+*/
+func CheckHops(msg *msg1.ChainMessage) error {
+	if len(msg.Hops) > 0 && msg.Ttl <= 0 {
+		return &ValidateError{Code: "TtlExpired", MsgType: msg.MessageType, Field: "Ttl"}
+	}
+	for i, hop := range msg.Hops {
+		if global.IsMyself(hop.PeerId) {
+			return &ValidateError{Code: "RelayLoop", MsgType: msg.MessageType, Field: "Hops"}
+		}
+		err := verifyHop(msg, i)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func verifyHop(msg *msg1.ChainMessage, index int) error {
+	hop := msg.Hops[index]
+	publicKey, err := GetPublicKey(hop.PeerId)
+	if err != nil {
+		return &ValidateError{Code: "HopVerifyFailure", MsgType: msg.MessageType, Field: "Hops"}
+	}
+	pass, _ := openpgp.Verify(publicKey, hopSignatureData(msg, index, hop), std.DecodeBase64(hop.Signature))
+	if !pass {
+		return &ValidateError{Code: "HopVerifyFailure", MsgType: msg.MessageType, Field: "Hops"}
+	}
+
+	return nil
+}
+
+/*
+*
+追加自己为转发节点，Ttl减一
+*/
+func AppendHop(msg *msg1.ChainMessage) error {
+	if global.Global.PrivateKey == nil {
+		return errors.New("NoPrivateKey")
+	}
+	if len(msg.Hops) == 0 && msg.Ttl <= 0 {
+		msg.Ttl = DefaultTtl
+	}
+	hop := &msg1.Hop{PeerId: global.Global.PeerId.String(), Timestamp: time.Now().UnixMilli()}
+	signature, err := openpgp.Sign(global.Global.PrivateKey, hopSignatureData(msg, len(msg.Hops), hop))
+	if err != nil {
+		return err
+	}
+	hop.Signature = std.EncodeBase64(signature)
+	msg.Hops = append(msg.Hops, hop)
+	msg.Ttl--
+
+	return nil
+}
+
+/*
+*
+peerId是否已经在转发链中
+*/
+func InHops(msg *msg1.ChainMessage, peerId string) bool {
+	for _, hop := range msg.Hops {
+		if hop.PeerId == peerId {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*
+重发保存的消息之前，更新自己的转发记录的时间和签名，下一个节点校验最后一跳的签名
+*/
+func RestampHop(msg *msg1.ChainMessage) error {
+	n := len(msg.Hops)
+	if n > 0 && global.IsMyself(msg.Hops[n-1].PeerId) {
+		msg.Hops = msg.Hops[:n-1]
+		msg.Ttl++
+	}
+
+	return AppendHop(msg)
+}
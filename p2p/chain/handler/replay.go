@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/crypto/openpgp"
+	"github.com/curltech/go-colla-core/crypto/std"
+	"github.com/curltech/go-colla-core/util/security"
+	"github.com/curltech/go-colla-node/libp2p/global"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*
+防重放：
+1.消息签名覆盖UUID，CreateTimestamp，源和目标，消息类型和TransportPayload的摘要，不能修改后重放
+2.CreateTimestamp必须在接受窗口内，窗口外的消息拒绝
+3.窗口内的消息按照(SrcPeerId, UUID, MessageDirect)去重，多接收者和群组的消息加上TargetPeerId，缓存的数量有上限，超过上限淘汰最早的
+转发节点可以随意追加转发记录，时间窗口和去重都只使用源节点签名的数据，不使用转发记录
+保存转发的消息可能在接收者上线以后才送达，经过转发的不需要签名的消息使用较长的relayWindow，
+需要签名的消息（比如PUTVALUE，CONSENSUS）总是使用window
+*/
+const (
+	ValidateCode_Duplicate        = "DuplicateMessage"
+	ValidateCode_StaleTimestamp   = "StaleTimestamp"
+	ValidateCode_NeedSignature    = "MessageSignatureRequired"
+	ValidateCode_SignatureFailure = "MessageVerifyFailure"
+)
+
+type replayCache struct {
+	mutex    sync.Mutex
+	capacity int
+	window   time.Duration
+	entries  map[string]time.Time
+	keys     []string
+	head     int
+}
+
+func newReplayCache(capacity int, window time.Duration) *replayCache {
+	if capacity <= 0 {
+		capacity = 100000
+	}
+	return &replayCache{
+		capacity: capacity,
+		window:   window,
+		entries:  make(map[string]time.Time, capacity),
+		keys:     make([]string, capacity),
+	}
+}
+
+/*
+*
+登记消息，已经在窗口内出现过返回false
+*/
+func (this *replayCache) add(key string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	now := time.Now()
+	seen, ok := this.entries[key]
+	if ok && (this.window <= 0 || now.Sub(seen) <= this.window) {
+		return false
+	}
+	//环形缓存，淘汰最早的
+	old := this.keys[this.head]
+	if old != "" {
+		delete(this.entries, old)
+	}
+	this.keys[this.head] = key
+	this.head = (this.head + 1) % this.capacity
+	this.entries[key] = now
+
+	return true
+}
+
+var replayWindow time.Duration
+
+var relayWindow time.Duration
+
+var enforceSignature bool
+
+var receivedCache *replayCache
+
+func init() {
+	window, _ := config.GetInt("p2p.chain.replay.window", 300000)
+	cacheSize, _ := config.GetInt("p2p.chain.replay.cacheSize", 100000)
+	relay, _ := config.GetInt("p2p.chain.replay.relayWindow", 7*24*3600000)
+	//老的客户端不签名，逐步升级以后再打开
+	enforceSignature, _ = config.GetBool("p2p.chain.replay.enforceSignature", false)
+	replayWindow = time.Millisecond * time.Duration(window)
+	relayWindow = time.Millisecond * time.Duration(relay)
+	cacheWindow := replayWindow
+	if relayWindow > cacheWindow {
+		cacheWindow = relayWindow
+	}
+	receivedCache = newReplayCache(cacheSize, cacheWindow)
+}
+
+/*
+*
+消息签名的数据
+*/
+func messageSignatureData(msg *msg1.ChainMessage) []byte {
+	var timestamp int64
+	if msg.CreateTimestamp != nil {
+		timestamp = msg.CreateTimestamp.UnixMilli()
+	}
+	digest := sha256.Sum256([]byte(msg.TransportPayload))
+	//多个接收者和群组的消息在转发节点复制时才填写TargetPeerId，签名覆盖接收者列表或者群组
+	target := msg.TargetPeerId
+	if len(msg.TargetPeerIds) > 0 {
+		target = strings.Join(msg.TargetPeerIds, ",")
+	} else if msg.TargetGroupId != "" {
+		target = msg.TargetGroupId
+	}
+	data := fmt.Sprintf("%v|%v|%v|%v|%v|%v|%v|%v|%x", msg.UUID, timestamp, msg.SrcPeerId, target,
+		msg.Topic, msg.MessageType, msg.MessageDirect, msg.PayloadType, digest)
+
+	return []byte(data)
+}
+
+/*
+*
+在Encrypt之后对自己发出的请求签名，转发的消息保留原来的签名
+没有UUID和CreateTimestamp的补上
+*/
+func SignMessage(msg *msg1.ChainMessage) error {
+	if msg.MessageDirect != msgtype.MsgDirect_Request {
+		return nil
+	}
+	if msg.SrcPeerId != "" && !global.IsMyself(msg.SrcPeerId) {
+		return nil
+	}
+	if global.Global.PrivateKey == nil {
+		return errors.New("NoPrivateKey")
+	}
+	msg.SrcPeerId = global.Global.PeerId.String()
+	if msg.UUID == "" {
+		msg.UUID = security.UUID()
+	}
+	if msg.CreateTimestamp == nil {
+		currentTime := time.Now()
+		msg.CreateTimestamp = &currentTime
+	}
+	signature, err := openpgp.Sign(global.Global.PrivateKey, messageSignatureData(msg))
+	if err != nil {
+		return err
+	}
+	msg.MessageSignature = std.EncodeBase64(signature)
+
+	return nil
+}
+
+/*
+*
+接收时校验时间窗口，签名，然后去重，在ReceiveRaw中分发之前调用，适用于websocket，libp2p和pubsub
+*/
+func ReplayValidate(msg *msg1.ChainMessage) error {
+	//转发链的签名在转发前的CheckHops中校验，这里只校验对方追加的最后一跳
+	n := len(msg.Hops)
+	if n > 0 {
+		err := verifyHop(msg, n-1)
+		if err != nil {
+			return err
+		}
+	}
+	window := replayWindow
+	if n > 0 && !needSignature(msg.MessageType) && relayWindow > window {
+		window = relayWindow
+	}
+	if msg.CreateTimestamp != nil && window > 0 {
+		diff := time.Since(*msg.CreateTimestamp)
+		if diff > window || diff < -replayWindow {
+			return &ValidateError{Code: ValidateCode_StaleTimestamp, MsgType: msg.MessageType, Field: "CreateTimestamp"}
+		}
+	}
+	if msg.MessageDirect == msgtype.MsgDirect_Request {
+		if msg.MessageSignature != "" {
+			err := verifyMessage(msg)
+			if err != nil {
+				return err
+			}
+		} else if enforceSignature && needSignature(msg.MessageType) {
+			return &ValidateError{Code: ValidateCode_NeedSignature, MsgType: msg.MessageType, Field: "MessageSignature"}
+		}
+	}
+	if msg.UUID != "" {
+		key := msg.SrcPeerId + "/" + msg.UUID + "/" + msg.MessageDirect
+		//同一个多接收者或者群组消息复制给不同接收者的副本不是重复的消息
+		if len(msg.TargetPeerIds) > 0 || msg.TargetGroupId != "" {
+			key = key + "/" + msg.TargetPeerId
+		}
+		if !receivedCache.add(key) {
+			return &ValidateError{Code: ValidateCode_Duplicate, MsgType: msg.MessageType, Field: "UUID"}
+		}
+	}
+
+	return nil
+}
+
+func verifyMessage(msg *msg1.ChainMessage) error {
+	//签名的消息必须有时间戳，否则可以无限期重放
+	if msg.CreateTimestamp == nil {
+		return &ValidateError{Code: ValidateCode_StaleTimestamp, MsgType: msg.MessageType, Field: "CreateTimestamp"}
+	}
+	srcPublicKey, err := GetPublicKey(msg.SrcPeerId)
+	if err != nil {
+		return &ValidateError{Code: ValidateCode_SignatureFailure, MsgType: msg.MessageType, Field: "SrcPeerId"}
+	}
+	signature := std.DecodeBase64(msg.MessageSignature)
+	pass, _ := openpgp.Verify(srcPublicKey, messageSignatureData(msg), signature)
+	if !pass {
+		return &ValidateError{Code: ValidateCode_SignatureFailure, MsgType: msg.MessageType, Field: "MessageSignature"}
+	}
+
+	return nil
+}
+
+func needSignature(msgType string) bool {
+	chainMessageHandler, found := chainMessageHandlers[msgType]
+	if !found || chainMessageHandler.Schema == nil {
+		return false
+	}
+	return chainMessageHandler.Schema.NeedSignature
+}
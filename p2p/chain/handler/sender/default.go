@@ -1,15 +1,20 @@
 package sender
 
 import (
+	"context"
 	"github.com/curltech/go-colla-core/config"
 	"github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-core/util/message"
+	"github.com/curltech/go-colla-node/libp2p/dht"
 	"github.com/curltech/go-colla-node/libp2p/global"
 	"github.com/curltech/go-colla-node/libp2p/ns"
 	"github.com/curltech/go-colla-node/libp2p/pipe/handler"
 	"github.com/curltech/go-colla-node/libp2p/pubsub"
 	"github.com/curltech/go-colla-node/libp2p/util"
+	entity2 "github.com/curltech/go-colla-node/p2p/chain/entity"
 	handler1 "github.com/curltech/go-colla-node/p2p/chain/handler"
+	service3 "github.com/curltech/go-colla-node/p2p/chain/service"
+	"github.com/curltech/go-colla-node/p2p/codec"
 	"github.com/curltech/go-colla-node/p2p/dht/entity"
 	"github.com/curltech/go-colla-node/p2p/dht/service"
 	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
@@ -17,8 +22,10 @@ import (
 	"github.com/curltech/go-colla-node/p2p/msgtype"
 	"github.com/curltech/go-colla-node/transport/websocket/stdhttp"
 	"github.com/gorilla/websocket"
+	"github.com/libp2p/go-libp2p/core/peer"
 	errors2 "github.com/pkg/errors"
 	"strings"
+	"time"
 )
 
 // Send 发送ChainMessage消息的唯一方法
@@ -27,92 +34,173 @@ import (
 // 3.建立合适的通道并发送，比如libp2p的Pipe并Write消息流
 // 4.等待即时的返回，校验，解密，解压缩等
 func Send(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	return SendWithContext(context.Background(), msg)
+}
+
+// SendWithContext 发送消息，如果是请求消息，等待对方的回应，ctx用于控制超时和取消
+// ctx没有截止时间的时候使用缺省的p2p.chain.responseTimeout
+func SendWithContext(ctx context.Context, msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	err := handler1.SendValidate(msg)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = handler1.Encrypt(msg)
+	err = handler1.SignMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	response, err := await(ctx, msg, RelaySend)
+	service3.GetChainMessageLogService().Log(entity2.ChainMessageLogAction_Send, msg, response, start, err)
+
+	return response, err
+}
+
+// Post 发送不需要等待回应的请求，比如回执，信令和共识的回复，发出以后立即返回
+func Post(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	err := handler1.SendValidate(msg)
+	if err != nil {
+		return nil, err
+	}
 	_, _ = handler1.Encrypt(msg)
+	err = handler1.SignMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	response, err := RelaySend(msg)
+	service3.GetChainMessageLogService().Log(entity2.ChainMessageLogAction_Send, msg, nil, start, err)
+
+	return response, err
+}
+
+// DirectPost 定位器之间直接发送，不等待回应
+func DirectPost(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	err := handler1.SendValidate(msg)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = handler1.Encrypt(msg)
+	err = handler1.SignMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	response, err := ForwardPeerEndpoint(msg, msg.ConnectPeerId)
+	service3.GetChainMessageLogService().Log(entity2.ChainMessageLogAction_Send, msg, nil, start, err)
 
-	return RelaySend(msg)
+	return response, err
 }
 
 // DirectSend 定位器之间直接发送方法
 func DirectSend(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	return DirectSendWithContext(context.Background(), msg)
+}
+
+// DirectSendWithContext 定位器之间直接发送，并等待回应
+func DirectSendWithContext(ctx context.Context, msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	err := handler1.SendValidate(msg)
+	if err != nil {
+		return nil, err
+	}
 	_, _ = handler1.Encrypt(msg)
+	err = handler1.SignMessage(msg)
+	if err != nil {
+		return nil, err
+	}
 
-	return ForwardPeerEndpoint(msg, msg.ConnectPeerId)
+	start := time.Now()
+	response, err := await(ctx, msg, func(msg *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+		return ForwardPeerEndpoint(msg, msg.ConnectPeerId)
+	})
+	service3.GetChainMessageLogService().Log(entity2.ChainMessageLogAction_Send, msg, response, start, err)
+
+	return response, err
 }
 
 func ForwardPeerEndpoint(msg *msg1.ChainMessage, connectPeerId string) (*msg1.ChainMessage, error) {
 	//转发到另一个定位器
 	if connectPeerId != "" && !global.IsMyself(connectPeerId) {
-		pipe := handler.GetRequestPipe(connectPeerId, config.P2pParams.ChainProtocolID)
-		if pipe != nil {
-			data, err := message.Marshal(msg)
-			if err == nil {
-				logger.Sugar.Debugf("Write data length:%v", len(data))
-				_, _, err := pipe.Write(data, false)
-				if err == nil {
-					return msg, nil
-				} else {
-					logger.Sugar.Errorf("pipe.Write failure: %v", err)
-				}
-			}
+		sentToPeer(msg, connectPeerId)
+		_, err := handler.WriteRequestPipe(connectPeerId, config.P2pParams.ChainProtocolID, codec.NewEncoded(msg), msgtype.GetPriority(msg.MessageType))
+		if err == nil {
+			return msg, nil
 		} else {
-			logger.Sugar.Errorf("targetConnectSessionId has no pipe")
+			logger.Sugar.Errorf("pipe.Write failure: %v", err)
+		}
+	} else if msg.TargetPeerId != "" && !global.IsMyself(msg.TargetPeerId) {
+		//找targetPeerId最近的节点发送
+		_, err := forwardClosestPeer(msg)
+		if err == nil {
+			return msg, nil
 		}
+		logger.Sugar.Errorf("InvalidConnectPeerId:%v, forwardClosestPeer failure:%v", connectPeerId, err)
 	} else {
-		//也许可以找targetPeerId最近的节点发送
 		logger.Sugar.Errorf("InvalidConnectPeerId:%v", connectPeerId)
 	}
 	//如果websocket连接没找到，先保存本地
-	if msgtype.CHAT == msg.MessageType {
-		_, _ = service2.GetChainMessageService().Insert(msg)
-	}
+	store(msg)
 	return msg, nil
 }
 
+// WritePeerEndpoint 直接写到另一个定位器，失败的时候返回错误，由调用者决定是否保存
+func WritePeerEndpoint(msg *msg1.ChainMessage, connectPeerId string) error {
+	sentToPeer(msg, connectPeerId)
+	_, err := handler.WriteRequestPipe(connectPeerId, config.P2pParams.ChainProtocolID, codec.NewEncoded(msg), msgtype.GetPriority(msg.MessageType))
+
+	return err
+}
+
 func ForwardPeerClient(chainMessage *msg1.ChainMessage, peerClient *entity.PeerClient) (*msg1.ChainMessage, error) {
-	data, err := message.Marshal(chainMessage)
-	if err != nil {
-		return nil, err
+	err := WritePeerClient(chainMessage, peerClient)
+	if err == nil {
+		delivered(chainMessage)
+		return chainMessage, nil
 	}
+	logger.Sugar.Errorf("ForwardPeerClient fail: %v", err)
+	store(chainMessage)
+
+	return chainMessage, nil
+}
+
+// WritePeerClient 直接写到连接在本节点的客户端，失败的时候返回错误，不生成回执也不保存
+// 消息按照连接协商的编码序列化
+func WritePeerClient(chainMessage *msg1.ChainMessage, peerClient *entity.PeerClient) error {
+	if peerClient.ConnectSessionId == "" {
+		logger.Sugar.Errorf("targetConnectSessionId is nil")
+		return errors2.New("NullConnectSessionId")
+	}
+	sentToSession(chainMessage, peerClient.ConnectSessionId)
+	encoded := codec.NewEncoded(chainMessage)
 	connectAddress := peerClient.ConnectAddress
 	//如果connectAddress表明是websocket，根据targetConnectSessionId直接转发
 	if strings.HasPrefix(connectAddress, "ws") {
-		if peerClient.ConnectSessionId != "" {
-			websocketConnection, ok := stdhttp.WebsocketConnectionPool[peerClient.ConnectSessionId]
-			if ok {
-				err = websocketConnection.Write(websocket.BinaryMessage, data)
-				if err == nil {
-					return chainMessage, nil
-				} else {
-					logger.Sugar.Errorf("pipe.Write failure: %v", err)
-				}
-			} else {
-				logger.Sugar.Errorf("targetConnectSessionId: %v has no websocketConnection", peerClient.ConnectSessionId)
-			}
-		} else {
-			logger.Sugar.Errorf("targetConnectSessionId is nil")
+		websocketConnection, ok := stdhttp.WebsocketConnectionPool[peerClient.ConnectSessionId]
+		if !ok {
+			logger.Sugar.Errorf("targetConnectSessionId: %v has no websocketConnection", peerClient.ConnectSessionId)
+			return errors2.New("NoConnection")
 		}
+		data, err := encoded.Marshal(websocketConnection.Codec)
+		if err != nil {
+			return err
+		}
+		err = websocketConnection.WritePriority(websocket.BinaryMessage, data, msgtype.GetPriority(chainMessage.MessageType))
+		if err != nil {
+			logger.Sugar.Errorf("pipe.Write failure: %v", err)
+		}
+		return err
 	} else if config.AppParams.P2pProtocol == "libp2p" {
-		if peerClient.ConnectSessionId != "" {
-			pipe := handler.GetResponsePipe(peerClient.ConnectSessionId)
-			if pipe != nil {
-				logger.Sugar.Debugf("Write data length:%v", len(data))
-				_, _, err = pipe.Write(data, false)
-				if err == nil {
-					return chainMessage, nil
-				}
-			} else {
-				logger.Sugar.Errorf("targetConnectSessionId has no pipe")
-			}
-		} else {
-			logger.Sugar.Errorf("targetConnectSessionId is nil")
+		_, err := handler.WriteResponsePipe(peerClient.ConnectSessionId, encoded, msgtype.GetPriority(chainMessage.MessageType))
+		if err != nil {
+			logger.Sugar.Errorf("targetConnectSessionId: %v pipe.Write failure: %v", peerClient.ConnectSessionId, err)
 		}
-	}
-	logger.Sugar.Errorf("ForwardPeerClient fail")
-	if msgtype.CHAT == chainMessage.MessageType {
-		_, _ = service2.GetChainMessageService().Insert(chainMessage)
+		return err
 	}
 
-	return chainMessage, nil
+	return errors2.New("NoConnection")
 }
 
 // RelaySend 转发chainmessage，
@@ -120,6 +208,7 @@ func ForwardPeerClient(chainMessage *msg1.ChainMessage, peerClient *entity.PeerC
 func RelaySend(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
 	topic := chainMessage.Topic
 	if topic != "" {
+		//主题的订阅者可能是不支持二进制编码的节点，使用json
 		data, err := message.Marshal(chainMessage)
 		if err != nil {
 			return nil, err
@@ -127,6 +216,10 @@ func RelaySend(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
 		go pubsub.SendRaw(topic, data)
 		return chainMessage, nil
 	}
+	//多个接收者的消息，为每个接收者复制一份
+	if chainMessage.TargetPeerId == "" && len(chainMessage.TargetPeerIds) > 0 {
+		return fanOut(chainMessage)
+	}
 	//当没有主题的时候，必须有TargetPeerId且不是自己，如果是自己不需要转发
 	if chainMessage.TargetPeerId == "" {
 		return nil, errors2.New("NullTargetPeerId")
@@ -157,13 +250,128 @@ func RelaySend(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
 			}
 		}
 	}
-	//如果无法转发，先保存本地
-	if msgtype.CHAT == chainMessage.MessageType {
-		_, _ = service2.GetChainMessageService().Insert(chainMessage)
+	//直接查找失败，转发到Kademlia距离TargetPeerId最近的节点
+	_, err = forwardClosestPeer(chainMessage)
+	if err == nil {
+		return chainMessage, nil
 	}
+	//如果无法转发，先保存本地
+	store(chainMessage)
 	return nil, err
 }
 
+// fanOut 多个接收者的消息为每个接收者（除了自己）复制一份并填写TargetPeerId，共用同一个密文
+// 副本只带上这个接收者的PayloadKeys条目，所有的副本都发送失败的时候返回最后的错误
+func fanOut(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	var err error
+	sent := false
+	for _, targetPeerId := range chainMessage.TargetPeerIds {
+		if global.IsMyself(targetPeerId) {
+			continue
+		}
+		c := *chainMessage
+		c.TargetPeerId = targetPeerId
+		c.Hops = append([]*msg1.Hop(nil), chainMessage.Hops...)
+		if len(chainMessage.PayloadKeys) > 0 {
+			c.PayloadKeys = nil
+			for _, payloadKey := range chainMessage.PayloadKeys {
+				if payloadKey.PeerId == targetPeerId {
+					c.PayloadKeys = append(c.PayloadKeys, payloadKey)
+				}
+			}
+		}
+		_, e := RelaySend(&c)
+		if e != nil {
+			logger.Sugar.Errorf("fan out message uuid: %v to: %v failure: %v", chainMessage.UUID, targetPeerId, e)
+			err = e
+		} else {
+			sent = true
+		}
+	}
+	if !sent && err != nil {
+		return nil, err
+	}
+
+	return chainMessage, nil
+}
+
+// store 选择了保存转发的请求消息无法送达的时候保存到待转发队列
+func store(chainMessage *msg1.ChainMessage) {
+	if chainMessage.MessageDirect != msgtype.MsgDirect_Request || !handler1.IsStoreAndForward(chainMessage.MessageType) {
+		return
+	}
+	err := service2.GetChainMessageService().Enqueue(chainMessage)
+	if err != nil {
+		logger.Sugar.Errorf("Enqueue message uuid: %v failure: %v", chainMessage.UUID, err)
+		return
+	}
+	notifyDeliver(chainMessage, msgtype.RECEIPT_DELIVERED_NODE)
+}
+
+// RelaySendWithContext 转发已经加密签名的消息（比如待转发队列中的消息），并等待接收方的确认
+func RelaySendWithContext(ctx context.Context, chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	return await(ctx, chainMessage, RelaySend)
+}
+
+// PrepareRelay 转发别的节点发来的消息之前，检查Ttl和转发链，拒绝循环转发，然后追加自己的签名
+func PrepareRelay(chainMessage *msg1.ChainMessage) error {
+	err := handler1.CheckHops(chainMessage)
+	if err != nil {
+		return err
+	}
+
+	return handler1.AppendHop(chainMessage)
+}
+
+// Relay 转发别的节点发来的消息
+func Relay(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	err := PrepareRelay(chainMessage)
+	if err != nil {
+		logger.Sugar.Errorf("reject relay message uuid: %v, error: %v", chainMessage.UUID, err)
+		return nil, err
+	}
+
+	return RelaySend(chainMessage)
+}
+
+// forwardClosestPeer 发送到Kademlia距离TargetPeerId最近的节点，跳过自己，源节点和已经经过的节点
+func forwardClosestPeer(chainMessage *msg1.ChainMessage) (*msg1.ChainMessage, error) {
+	id, err := peer.Decode(util.GetPeerId(chainMessage.TargetPeerId))
+	if err != nil {
+		return nil, err
+	}
+	peerIds, err := dht.PeerEndpointDHT.GetClosestPeers(string(id))
+	if err != nil {
+		return nil, err
+	}
+	myselfPeerId := global.Global.PeerId.String()
+	if !handler1.InHops(chainMessage, myselfPeerId) {
+		err = handler1.AppendHop(chainMessage)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if chainMessage.Ttl <= 0 {
+		return nil, errors2.New("TtlExpired")
+	}
+	//每种编码只序列化一次
+	encoded := codec.NewEncoded(chainMessage)
+	for _, p := range peerIds {
+		peerId := p.String()
+		if peerId == myselfPeerId || peerId == chainMessage.SrcPeerId || handler1.InHops(chainMessage, peerId) {
+			continue
+		}
+		sentToPeer(chainMessage, peerId)
+		_, err = handler.WriteRequestPipe(peerId, config.P2pParams.ChainProtocolID, encoded, msgtype.GetPriority(chainMessage.MessageType))
+		if err == nil {
+			logger.Sugar.Infof("forward message uuid: %v to closest peer: %v", chainMessage.UUID, peerId)
+			return chainMessage, nil
+		}
+	}
+
+	return nil, errors2.New("NoClosestPeer")
+}
+
 /*
 *
 本地和分布式查询PeerClient，如果找不到则查找PeerEndpoint
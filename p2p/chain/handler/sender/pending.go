@@ -0,0 +1,128 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/util/security"
+	handler1 "github.com/curltech/go-colla-node/p2p/chain/handler"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pendingRequest 已经发出等待回应的请求，按ChainMessage.UUID登记
+type pendingRequest struct {
+	uuid     string
+	response chan *msg1.ChainMessage
+}
+
+// pendingRequests UUID与pendingRequest的映射，收到回应、超时或者取消后删除
+var pendingRequests sync.Map //make(map[string]*pendingRequest)
+
+func registPendingRequest(uuid string) (*pendingRequest, error) {
+	p := &pendingRequest{uuid: uuid, response: make(chan *msg1.ChainMessage, 1)}
+	_, loaded := pendingRequests.LoadOrStore(uuid, p)
+	if loaded {
+		return nil, errors.New("DuplicateUUID")
+	}
+
+	return p, nil
+}
+
+func removePendingRequest(uuid string) {
+	pendingRequests.Delete(uuid)
+}
+
+// Resolve 收到MsgDirect_Response的消息时调用，如果有请求在等待同一UUID的回应，则唤醒它
+// 转发节点的确认不是目标的回应，返回是否找到等待者
+func Resolve(response *msg1.ChainMessage) bool {
+	if response == nil || response.UUID == "" || response.StatusCode == http.StatusAccepted {
+		return false
+	}
+	v, ok := pendingRequests.LoadAndDelete(response.UUID)
+	if !ok {
+		return false
+	}
+	p := v.(*pendingRequest)
+	p.response <- response
+
+	return true
+}
+
+// wait 等待回应，直到收到回应，或者ctx超时，取消
+// 超时返回NO_RESPONSE的消息，取消返回ctx的错误
+func (p *pendingRequest) wait(ctx context.Context, msgType string) (*msg1.ChainMessage, error) {
+	select {
+	case response := <-p.response:
+		if response.StatusCode != 0 && response.StatusCode != http.StatusOK {
+			tip := response.Tip
+			if tip == "" {
+				tip = "ErrorResponse"
+			}
+			return response, errors.New(tip)
+		}
+		return response, nil
+	case <-ctx.Done():
+		removePendingRequest(p.uuid)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			response := handler1.NoResponse(msgType)
+			response.UUID = p.uuid
+			return response, errors.New(msgtype.NO_RESPONSE)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// needResponse 只有点对点的请求消息需要等待回应，回应消息和主题消息不需要
+func needResponse(msg *msg1.ChainMessage) bool {
+	return msg.MessageDirect == msgtype.MsgDirect_Request && msg.Topic == ""
+}
+
+// withResponseTimeout ctx没有设置截止时间的时候，使用缺省的回应超时时间（毫秒）
+func withResponseTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	timeout := responseTimeout()
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// responseTimeout 缺省的回应超时时间，配置小于等于0表示不超时
+func responseTimeout() time.Duration {
+	responseTimeout, _ := config.GetInt("p2p.chain.responseTimeout", 30000)
+	if responseTimeout <= 0 {
+		return 0
+	}
+
+	return time.Millisecond * time.Duration(responseTimeout)
+}
+
+// await 登记等待的请求，调用send发送，然后等待回应
+func await(ctx context.Context, msg *msg1.ChainMessage, send func(msg *msg1.ChainMessage) (*msg1.ChainMessage, error)) (*msg1.ChainMessage, error) {
+	if !needResponse(msg) {
+		return send(msg)
+	}
+	if msg.UUID == "" {
+		msg.UUID = security.UUID()
+	}
+	p, err := registPendingRequest(msg.UUID)
+	if err != nil {
+		return nil, err
+	}
+	defer removePendingRequest(msg.UUID)
+	_, err = send(msg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withResponseTimeout(ctx)
+	defer cancel()
+
+	return p.wait(ctx, msg.MessageType)
+}
@@ -0,0 +1,80 @@
+package sender
+
+import (
+	"github.com/curltech/go-colla-core/cache"
+	handler1 "github.com/curltech/go-colla-node/p2p/chain/handler"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"net/http"
+	"time"
+)
+
+// DeliverHandler 请求消息到达接收者的连接节点或者设备的时候调用，status是回执的状态
+type DeliverHandler func(chainMessage *msg1.ChainMessage, status string)
+
+var deliverHandlers = make([]DeliverHandler, 0)
+
+/*
+*
+登记消息送达的处理器，比如生成回执
+*/
+func RegistDeliverHandler(deliverHandler DeliverHandler) {
+	deliverHandlers = append(deliverHandlers, deliverHandler)
+}
+
+// awaitingReceipts 已经写到接收者设备的需要回执的消息，UUID与消息的映射，等待设备的回应
+var awaitingReceipts = cache.NewMemCache("receipt", 0, 0)
+
+/*
+*
+异步调用送达的处理器，传递消息的副本，避免与后续的发送冲突
+*/
+func notifyDeliver(chainMessage *msg1.ChainMessage, status string) {
+	if chainMessage.MessageDirect != msgtype.MsgDirect_Request {
+		return
+	}
+	for _, deliverHandler := range deliverHandlers {
+		c := *chainMessage
+		go deliverHandler(&c, status)
+	}
+}
+
+/*
+*
+需要回执的消息写到了接收者的设备，送达节点，同时等待设备的回应
+*/
+func delivered(chainMessage *msg1.ChainMessage) {
+	if chainMessage.MessageDirect != msgtype.MsgDirect_Request {
+		return
+	}
+	if chainMessage.UUID != "" && handler1.IsNeedReceipt(chainMessage.MessageType) {
+		timeout := responseTimeout()
+		if timeout <= 0 {
+			timeout = time.Hour
+		}
+		awaitingReceipts.Set(chainMessage.UUID, *chainMessage, timeout)
+	}
+	notifyDeliver(chainMessage, msgtype.RECEIPT_DELIVERED_NODE)
+}
+
+/*
+*
+收到MsgDirect_Response的消息时调用，如果是设备对需要回执的消息的回应，送达设备
+*/
+func Acknowledge(response *msg1.ChainMessage) bool {
+	if response == nil || response.UUID == "" {
+		return false
+	}
+	if response.StatusCode != 0 && response.StatusCode != http.StatusOK {
+		return false
+	}
+	v, found := awaitingReceipts.Get(response.UUID)
+	if !found {
+		return false
+	}
+	awaitingReceipts.Delete(response.UUID)
+	chainMessage := v.(msg1.ChainMessage)
+	notifyDeliver(&chainMessage, msgtype.RECEIPT_DELIVERED_DEVICE)
+
+	return true
+}
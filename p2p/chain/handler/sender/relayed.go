@@ -0,0 +1,97 @@
+package sender
+
+import (
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/pipe/handler"
+	"github.com/curltech/go-colla-node/p2p/codec"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"github.com/curltech/go-colla-node/transport/websocket/stdhttp"
+	"github.com/gorilla/websocket"
+	"sync"
+	"time"
+)
+
+/*
+*
+转发的请求：转发节点只回应不带UUID的确认，目标的回应回到转发节点以后，
+按照请求来的连接会话原路返回，最终唤醒源节点等待的请求
+*/
+type relayedRequest struct {
+	// 请求来的libp2p连接编号或者websocket的会话
+	connectSessionId string
+	expireAt         time.Time
+}
+
+var relayedMutex sync.Mutex
+
+// relayedRequests SrcPeerId/UUID与relayedRequest的映射，回应返回或者超时后删除
+var relayedRequests = make(map[string]*relayedRequest)
+
+func relayedKey(srcPeerId string, uuid string) string {
+	return srcPeerId + "/" + uuid
+}
+
+/*
+*
+转发请求之前登记请求来的连接会话，没有UUID或者连接会话的不登记
+*/
+func RegistRelayed(chainMessage *msg1.ChainMessage) {
+	if chainMessage.MessageDirect != msgtype.MsgDirect_Request || chainMessage.UUID == "" || chainMessage.ConnectSessionId == "" {
+		return
+	}
+	timeout := responseTimeout()
+	if timeout <= 0 {
+		timeout = time.Hour
+	}
+	now := time.Now()
+	relayedMutex.Lock()
+	defer relayedMutex.Unlock()
+	relayedRequests[relayedKey(chainMessage.SrcPeerId, chainMessage.UUID)] = &relayedRequest{
+		connectSessionId: chainMessage.ConnectSessionId,
+		expireAt:         now.Add(timeout),
+	}
+	if len(relayedRequests) > 10000 {
+		for k, v := range relayedRequests {
+			if now.After(v.expireAt) {
+				delete(relayedRequests, k)
+			}
+		}
+	}
+}
+
+/*
+*
+收到回应的时候调用，如果是本节点转发的请求的回应，写回请求来的连接会话，返回是否转发的请求
+*/
+func ReturnRelayed(response *msg1.ChainMessage) bool {
+	if response == nil || response.MessageDirect != msgtype.MsgDirect_Response || response.UUID == "" {
+		return false
+	}
+	key := relayedKey(response.SrcPeerId, response.UUID)
+	relayedMutex.Lock()
+	relayed, ok := relayedRequests[key]
+	delete(relayedRequests, key)
+	relayedMutex.Unlock()
+	if !ok || time.Now().After(relayed.expireAt) {
+		return false
+	}
+	encoded := codec.NewEncoded(response)
+	priority := msgtype.GetPriority(response.MessageType)
+	var err error
+	websocketConnection, ok := stdhttp.WebsocketConnectionPool[relayed.connectSessionId]
+	if ok {
+		var data []byte
+		data, err = encoded.Marshal(websocketConnection.Codec)
+		if err == nil {
+			err = websocketConnection.WritePriority(websocket.BinaryMessage, data, priority)
+		}
+	} else {
+		_, err = handler.WriteResponsePipe(relayed.connectSessionId, encoded, priority)
+	}
+	if err != nil {
+		logger.Sugar.Errorf("return relayed response uuid: %v to: %v failure: %v", response.UUID, relayed.connectSessionId, err)
+	}
+
+	return true
+}
@@ -0,0 +1,98 @@
+package sender
+
+import (
+	handler1 "github.com/curltech/go-colla-node/p2p/chain/handler"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"sync"
+	"time"
+)
+
+/*
+*
+请求写到的对方：本节点发出和转发的请求，写出之前登记写到的libp2p节点或者连接会话，
+回应只能来自这些对方，否则可以伪造回应唤醒等待的请求，或者伪造送达设备的回执
+*/
+type sentRequest struct {
+	// 写到的libp2p节点，peerId
+	peerIds map[string]bool
+	// 写到的websocket会话或者libp2p连接
+	connectSessionIds map[string]bool
+	expireAt          time.Time
+}
+
+var sentMutex sync.Mutex
+
+// sentRequests SrcPeerId/UUID与sentRequest的映射，超时后清除
+var sentRequests = make(map[string]*sentRequest)
+
+func getSentRequest(chainMessage *msg1.ChainMessage) *sentRequest {
+	if chainMessage.MessageDirect != msgtype.MsgDirect_Request || chainMessage.UUID == "" {
+		return nil
+	}
+	timeout := responseTimeout()
+	if timeout <= 0 {
+		timeout = time.Hour
+	}
+	now := time.Now()
+	key := relayedKey(chainMessage.SrcPeerId, chainMessage.UUID)
+	sent, ok := sentRequests[key]
+	if !ok || now.After(sent.expireAt) {
+		sent = &sentRequest{peerIds: make(map[string]bool), connectSessionIds: make(map[string]bool)}
+		sentRequests[key] = sent
+	}
+	sent.expireAt = now.Add(timeout)
+	if len(sentRequests) > 10000 {
+		for k, v := range sentRequests {
+			if now.After(v.expireAt) {
+				delete(sentRequests, k)
+			}
+		}
+	}
+
+	return sent
+}
+
+// sentToPeer 请求写到libp2p节点之前登记
+func sentToPeer(chainMessage *msg1.ChainMessage, peerId string) {
+	sentMutex.Lock()
+	defer sentMutex.Unlock()
+	sent := getSentRequest(chainMessage)
+	if sent != nil {
+		sent.peerIds[peerId] = true
+	}
+}
+
+// sentToSession 请求写到websocket会话或者libp2p连接之前登记
+func sentToSession(chainMessage *msg1.ChainMessage, connectSessionId string) {
+	sentMutex.Lock()
+	defer sentMutex.Unlock()
+	sent := getSentRequest(chainMessage)
+	if sent != nil {
+		sent.connectSessionIds[connectSessionId] = true
+	}
+}
+
+/*
+*
+校验回应来自请求写到的对方，remotePeerId是libp2p认证的对方节点，connectSessionId是回应来的连接会话
+没有UUID的回应（比如转发节点的确认）不会唤醒任何请求，不校验
+*/
+func ValidateResponder(response *msg1.ChainMessage, remotePeerId string, connectSessionId string) error {
+	if response.MessageDirect != msgtype.MsgDirect_Response || response.UUID == "" {
+		return nil
+	}
+	sentMutex.Lock()
+	defer sentMutex.Unlock()
+	sent, ok := sentRequests[relayedKey(response.SrcPeerId, response.UUID)]
+	if ok && time.Now().Before(sent.expireAt) {
+		if remotePeerId != "" && sent.peerIds[remotePeerId] {
+			return nil
+		}
+		if connectSessionId != "" && sent.connectSessionIds[connectSessionId] {
+			return nil
+		}
+	}
+
+	return &handler1.ValidateError{Code: handler1.ValidateCode_IdentityMismatch, MsgType: response.MessageType, Field: "UUID"}
+}
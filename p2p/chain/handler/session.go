@@ -0,0 +1,525 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/crypto/openpgp"
+	"github.com/curltech/go-colla-core/crypto/std"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-core/util/message"
+	"github.com/curltech/go-colla-node/libp2p/global"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/p2p/dht/entity"
+	"github.com/curltech/go-colla-node/p2p/dht/service"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	service2 "github.com/curltech/go-colla-node/p2p/msg/service"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+*
+可选的前向安全会话层：peer在DHT中发布预共享密钥包，发送方通过X3DH与对方协商共享密钥，
+然后用Double Ratchet派生每个消息的密钥
+会话按照peer对协商，对方没有发布预共享密钥包或者校验失败的时候使用openpgp加密
+*/
+
+// sessionEnable 是否启用前向安全会话
+var sessionEnable = true
+
+// preKeyRotation 预共享密钥更换的间隔（小时）
+var preKeyRotation = 24 * 7
+
+// preKeyKeep 保留的预共享密钥数，用于解密更换之前发起的会话
+var preKeyKeep = 3
+
+const x3dhInfo = "colla-x3dh"
+
+func init() {
+	sessionEnable, _ = config.GetBool("p2p.chain.session.enable", true)
+	preKeyRotation, _ = config.GetInt("p2p.chain.session.preKeyRotation", 24*7)
+	preKeyKeep, _ = config.GetInt("p2p.chain.session.preKeyKeep", 3)
+	if preKeyKeep < 1 {
+		preKeyKeep = 1
+	}
+	ns.RegistPreKeyBundleVerifier(verifyPreKeyBundleRecord)
+}
+
+/*
+*
+自己的身份密钥和预共享密钥，从数据库装载，没有的时候生成
+*/
+type sessionKeys struct {
+	identityKey []byte
+	// 预共享密钥编号与私钥的映射
+	preKeys map[int64][]byte
+	// 当前发布的预共享密钥编号
+	preKeyId int64
+}
+
+var mySessionKeys *sessionKeys
+
+// sessionMutex 保护自己的会话密钥和所有会话的状态
+var sessionMutex sync.Mutex
+
+func loadSessionKeys() (*sessionKeys, error) {
+	if mySessionKeys != nil {
+		return mySessionKeys, nil
+	}
+	sessionService := service2.GetSessionService()
+	keys := &sessionKeys{preKeys: make(map[int64][]byte)}
+	identityKeys, err := sessionService.FindKeys(msg1.SessionKeyType_Identity)
+	if err != nil {
+		return nil, err
+	}
+	if len(identityKeys) > 0 {
+		keys.identityKey = std.DecodeBase64(identityKeys[0].PrivateKey)
+	} else {
+		identityKey, err := generateDH()
+		if err != nil {
+			return nil, err
+		}
+		keys.identityKey = identityKey.Bytes()
+		err = sessionService.InsertKey(&msg1.SessionKey{
+			KeyType:    msg1.SessionKeyType_Identity,
+			PrivateKey: std.EncodeBase64(identityKey.Bytes()),
+			PublicKey:  std.EncodeBase64(identityKey.PublicKey().Bytes()),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	preKeys, err := sessionService.FindKeys(msg1.SessionKeyType_PreKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, preKey := range preKeys {
+		keys.preKeys[preKey.KeyId] = std.DecodeBase64(preKey.PrivateKey)
+		if preKey.KeyId > keys.preKeyId {
+			keys.preKeyId = preKey.KeyId
+		}
+	}
+	mySessionKeys = keys
+
+	return keys, nil
+}
+
+/*
+*
+需要的时候更换预共享密钥，预共享密钥编号是生成的时间（秒）
+*/
+func rotatePreKey(keys *sessionKeys) (bool, error) {
+	currentTime := time.Now()
+	if keys.preKeyId > 0 && currentTime.Sub(time.Unix(keys.preKeyId, 0)) < time.Hour*time.Duration(preKeyRotation) {
+		return false, nil
+	}
+	preKey, err := generateDH()
+	if err != nil {
+		return false, err
+	}
+	preKeyId := currentTime.Unix()
+	if preKeyId <= keys.preKeyId {
+		preKeyId = keys.preKeyId + 1
+	}
+	sessionService := service2.GetSessionService()
+	err = sessionService.InsertKey(&msg1.SessionKey{
+		KeyType:    msg1.SessionKeyType_PreKey,
+		KeyId:      preKeyId,
+		PrivateKey: std.EncodeBase64(preKey.Bytes()),
+		PublicKey:  std.EncodeBase64(preKey.PublicKey().Bytes()),
+	})
+	if err != nil {
+		return false, err
+	}
+	keys.preKeys[preKeyId] = preKey.Bytes()
+	keys.preKeyId = preKeyId
+	// 只保留最新的preKeyKeep个预共享密钥
+	if len(keys.preKeys) > preKeyKeep {
+		ids := make([]int64, 0, len(keys.preKeys))
+		for id := range keys.preKeys {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+		for _, id := range ids[preKeyKeep:] {
+			delete(keys.preKeys, id)
+		}
+		err = sessionService.DeleteKeys(msg1.SessionKeyType_PreKey, ids[preKeyKeep-1])
+		if err != nil {
+			logger.Sugar.Errorf("DeleteKeys failure: %v", err)
+		}
+	}
+
+	return true, nil
+}
+
+/*
+*
+预共享密钥包的签名数据：peerId|身份公钥|预共享密钥编号|预共享公钥
+*/
+func preKeyBundleSignatureData(preKeyBundle *entity.PreKeyBundle) []byte {
+	return []byte(preKeyBundle.PeerId + "|" + preKeyBundle.IdentityKey + "|" +
+		strconv.FormatInt(preKeyBundle.SignedPreKeyId, 10) + "|" + preKeyBundle.SignedPreKey)
+}
+
+/*
+*
+校验预共享密钥包是peer的openpgp私钥签名的
+*/
+func verifyPreKeyBundle(preKeyBundle *entity.PreKeyBundle, openpgpPub *crypto.Key) error {
+	if preKeyBundle.IdentityKey == "" || preKeyBundle.SignedPreKey == "" || preKeyBundle.Signature == "" {
+		return errors.New("InvalidPreKeyBundle")
+	}
+	pass, _ := openpgp.Verify(openpgpPub, preKeyBundleSignatureData(preKeyBundle), std.DecodeBase64(preKeyBundle.Signature))
+	if !pass {
+		return errors.New("PreKeyBundleVerifyFailure")
+	}
+
+	return nil
+}
+
+/*
+*
+DHT的预共享密钥包记录的校验，用peer的openpgp公钥校验签名，由ns.PreKeyBundleValidator调用
+*/
+func verifyPreKeyBundleRecord(preKeyBundle *entity.PreKeyBundle) error {
+	openpgpPub, err := GetPublicKey(preKeyBundle.PeerId)
+	if err != nil {
+		return err
+	}
+
+	return verifyPreKeyBundle(preKeyBundle, openpgpPub)
+}
+
+/*
+*
+查找peer发布的校验通过的预共享密钥包
+*/
+func getPreKeyBundle(peerId string, openpgpPub *crypto.Key) (*entity.PreKeyBundle, error) {
+	return service.GetPreKeyBundleService().GetValue(peerId, func(preKeyBundle *entity.PreKeyBundle) error {
+		return verifyPreKeyBundle(preKeyBundle, openpgpPub)
+	})
+}
+
+/*
+*
+发布自己的预共享密钥包，预共享密钥到期的时候更换，force为true的时候总是发布
+*/
+func PublishPreKeyBundle(force bool) error {
+	if !sessionEnable {
+		return nil
+	}
+	sessionMutex.Lock()
+	keys, err := loadSessionKeys()
+	if err != nil {
+		sessionMutex.Unlock()
+		return err
+	}
+	rotated, err := rotatePreKey(keys)
+	if err != nil {
+		sessionMutex.Unlock()
+		return err
+	}
+	identityKey, _ := publicKeyOf(keys.identityKey)
+	preKey, _ := publicKeyOf(keys.preKeys[keys.preKeyId])
+	preKeyId := keys.preKeyId
+	sessionMutex.Unlock()
+	if !rotated && !force {
+		return nil
+	}
+	currentTime := time.Now()
+	preKeyBundle := &entity.PreKeyBundle{}
+	preKeyBundle.PeerId = global.Global.PeerId.String()
+	preKeyBundle.IdentityKey = std.EncodeBase64(identityKey)
+	preKeyBundle.SignedPreKeyId = preKeyId
+	preKeyBundle.SignedPreKey = std.EncodeBase64(preKey)
+	preKeyBundle.LastUpdateTime = &currentTime
+	signature, err := openpgp.Sign(global.Global.PrivateKey, preKeyBundleSignatureData(preKeyBundle))
+	if err != nil {
+		return err
+	}
+	preKeyBundle.Signature = std.EncodeBase64(signature)
+
+	return service.GetPreKeyBundleService().PutValue(preKeyBundle)
+}
+
+/*
+*
+启动的时候发布预共享密钥包，然后每小时检查是否需要更换
+*/
+func LoopPreKeyBundle() {
+	err := PublishPreKeyBundle(true)
+	if err != nil {
+		logger.Sugar.Errorf("PublishPreKeyBundle failure: %v", err)
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		err = PublishPreKeyBundle(false)
+		if err != nil {
+			logger.Sugar.Errorf("PublishPreKeyBundle failure: %v", err)
+		}
+	}
+}
+
+func x3dhKey(dh1 []byte, dh2 []byte, dh3 []byte) ([]byte, error) {
+	ikm := bytes.Repeat([]byte{0xFF}, 32)
+	ikm = append(ikm, dh1...)
+	ikm = append(ikm, dh2...)
+	ikm = append(ikm, dh3...)
+
+	return hkdf.Key(sha256.New, ikm, make([]byte, 32), x3dhInfo, 32)
+}
+
+/*
+*
+作为发起方与对方建立会话：DH1=DH(IKa,SPKb)，DH2=DH(EKa,IKb)，DH3=DH(EKa,SPKb)
+*/
+func initiateSession(keys *sessionKeys, preKeyBundle *entity.PreKeyBundle) (*ratchetState, error) {
+	identityKey := std.DecodeBase64(preKeyBundle.IdentityKey)
+	preKey := std.DecodeBase64(preKeyBundle.SignedPreKey)
+	ephemeralKey, err := generateDH()
+	if err != nil {
+		return nil, err
+	}
+	dh1, err := dh(keys.identityKey, preKey)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := dh(ephemeralKey.Bytes(), identityKey)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := dh(ephemeralKey.Bytes(), preKey)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := x3dhKey(dh1, dh2, dh3)
+	if err != nil {
+		return nil, err
+	}
+	myIdentityKey, err := publicKeyOf(keys.identityKey)
+	if err != nil {
+		return nil, err
+	}
+	ad := append(append([]byte{}, myIdentityKey...), identityKey...)
+	state, err := newAliceState(sk, preKey, ad)
+	if err != nil {
+		return nil, err
+	}
+	state.InitKey = std.EncodeBase64(ephemeralKey.PublicKey().Bytes())
+	state.PreKey = &msg1.SessionHeader{
+		IdentityKey:    std.EncodeBase64(myIdentityKey),
+		EphemeralKey:   state.InitKey,
+		SignedPreKeyId: preKeyBundle.SignedPreKeyId,
+	}
+
+	return state, nil
+}
+
+/*
+*
+作为接收方根据发起方的X3DH参数建立会话，发起方的身份公钥必须与它发布的校验过的预共享密钥包一致
+*/
+func acceptSession(keys *sessionKeys, preKeyBundle *entity.PreKeyBundle, header *msg1.SessionHeader) (*ratchetState, error) {
+	preKey, ok := keys.preKeys[header.SignedPreKeyId]
+	if !ok {
+		return nil, errors.New("UnknownPreKey")
+	}
+	if preKeyBundle.IdentityKey != header.IdentityKey {
+		return nil, errors.New("IdentityKeyMismatch")
+	}
+	identityKey := std.DecodeBase64(header.IdentityKey)
+	ephemeralKey := std.DecodeBase64(header.EphemeralKey)
+	dh1, err := dh(preKey, identityKey)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := dh(keys.identityKey, ephemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := dh(preKey, ephemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := x3dhKey(dh1, dh2, dh3)
+	if err != nil {
+		return nil, err
+	}
+	myIdentityKey, err := publicKeyOf(keys.identityKey)
+	if err != nil {
+		return nil, err
+	}
+	ad := append(append([]byte{}, identityKey...), myIdentityKey...)
+	state := newBobState(sk, preKey, ad)
+	state.InitKey = header.EphemeralKey
+
+	return state, nil
+}
+
+func loadState(peerId string) (*ratchetState, error) {
+	s, err := service2.GetSessionService().GetState(peerId)
+	if err != nil || s == "" {
+		return nil, err
+	}
+	state := &ratchetState{}
+	err = message.TextUnmarshal(s, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Skipped == nil {
+		state.Skipped = make(map[string][]byte)
+	}
+
+	return state, nil
+}
+
+func saveState(peerId string, state *ratchetState) error {
+	s, err := message.TextMarshal(state)
+	if err != nil {
+		return err
+	}
+
+	return service2.GetSessionService().SaveState(peerId, s)
+}
+
+// errNeedPreKeyBundle 需要对方的预共享密钥包才能继续，在sessionMutex之外查找以后重试
+var errNeedPreKeyBundle = errors.New("NeedPreKeyBundle")
+
+/*
+*
+用与目标的会话加密，没有会话的时候根据对方的预共享密钥包协商
+对方没有发布预共享密钥包或者校验失败返回错误，调用者使用openpgp加密
+DHT的查找可能很慢，在sessionMutex之外进行，不阻塞其他peer的加密和解密
+*/
+func sessionEncrypt(targetPeerId string, openpgpPub *crypto.Key, plaintext []byte) (*msg1.SessionHeader, []byte, error) {
+	if !sessionEnable {
+		return nil, nil, errors.New("SessionDisabled")
+	}
+	header, ciphertext, err := lockedEncrypt(targetPeerId, nil, plaintext)
+	if err != errNeedPreKeyBundle {
+		return header, ciphertext, err
+	}
+	preKeyBundle, err := getPreKeyBundle(targetPeerId, openpgpPub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return lockedEncrypt(targetPeerId, preKeyBundle, plaintext)
+}
+
+/*
+*
+持有sessionMutex加密，没有会话而且preKeyBundle为nil的时候返回errNeedPreKeyBundle
+*/
+func lockedEncrypt(targetPeerId string, preKeyBundle *entity.PreKeyBundle, plaintext []byte) (*msg1.SessionHeader, []byte, error) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	keys, err := loadSessionKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	state, err := loadState(targetPeerId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if state == nil || state.CKs == nil {
+		if preKeyBundle == nil {
+			return nil, nil, errNeedPreKeyBundle
+		}
+		state, err = initiateSession(keys, preKeyBundle)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	header, ciphertext, err := state.encrypt(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = saveState(targetPeerId, state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header, ciphertext, nil
+}
+
+/*
+*
+用与源的会话解密，带X3DH参数的消息如果不是当前会话建立时的参数，按照接收方建立新的会话
+双方同时发起会话的时候，peerId小的一方保留自己发起的会话，对方的消息用临时的会话解密
+建立新的会话需要的公钥和预共享密钥包在sessionMutex之外查找
+*/
+func sessionDecrypt(srcPeerId string, header *msg1.SessionHeader, ciphertext []byte) ([]byte, error) {
+	if srcPeerId == "" {
+		return nil, errors.New("NoSrcPeerId")
+	}
+	plaintext, err := lockedDecrypt(srcPeerId, nil, header, ciphertext)
+	if err != errNeedPreKeyBundle {
+		return plaintext, err
+	}
+	openpgpPub, err := GetPublicKey(srcPeerId)
+	if err != nil {
+		return nil, err
+	}
+	preKeyBundle, err := getPreKeyBundle(srcPeerId, openpgpPub)
+	if err != nil {
+		return nil, err
+	}
+
+	return lockedDecrypt(srcPeerId, preKeyBundle, header, ciphertext)
+}
+
+/*
+*
+持有sessionMutex解密，需要建立新的会话而且preKeyBundle为nil的时候返回errNeedPreKeyBundle
+*/
+func lockedDecrypt(srcPeerId string, preKeyBundle *entity.PreKeyBundle, header *msg1.SessionHeader, ciphertext []byte) ([]byte, error) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	keys, err := loadSessionKeys()
+	if err != nil {
+		return nil, err
+	}
+	state, err := loadState(srcPeerId)
+	if err != nil {
+		return nil, err
+	}
+	if header.EphemeralKey != "" && (state == nil || state.InitKey != header.EphemeralKey) {
+		if preKeyBundle == nil {
+			return nil, errNeedPreKeyBundle
+		}
+		accepted, err := acceptSession(keys, preKeyBundle, header)
+		if err != nil {
+			return nil, err
+		}
+		if state != nil && state.PreKey != nil && global.Global.PeerId.String() < srcPeerId {
+			return accepted.decrypt(header, ciphertext)
+		}
+		state = accepted
+	}
+	if state == nil {
+		return nil, errors.New("NoSession")
+	}
+	next := state.clone()
+	plaintext, err := next.decrypt(header, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	// 收到对方在这个会话上的消息，以后不再需要带X3DH参数
+	if header.EphemeralKey == "" {
+		next.PreKey = nil
+	}
+	err = saveState(srcPeerId, next)
+	if err != nil {
+		return nil, err
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,408 @@
+package handler
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/crypto/openpgp"
+	"github.com/curltech/go-colla-core/crypto/std"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/libp2p/pubsub"
+	"github.com/curltech/go-colla-node/p2p/codec"
+	"github.com/curltech/go-colla-node/p2p/dht/entity"
+	"github.com/curltech/go-colla-node/p2p/dht/service"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*
+主题的访问控制和本地客户端的订阅：
+1.主题的所有者对发布者和订阅者列表签名，发布在DHT中，使用前校验签名
+2.GossipSub的消息校验器校验主题消息的签名和发布者，校验失败的消息不转发
+3.本地客户端的订阅按照连接会话登记，断开连接的时候取消，最后一个订阅者取消的时候节点取消订阅
+没有发布访问控制的主题，p2p.chain.topic.requireAcl为false的时候任何peer都可以发布和订阅
+在线状态的主题由节点发布和订阅，客户端不能直接发布和订阅
+*/
+var requireTopicAcl = false
+
+var topicAclCacheTime = time.Minute
+
+type topicAcl struct {
+	topic    *entity.Topic
+	expireAt time.Time
+}
+
+var topicAclMutex sync.Mutex
+
+var errTopicVerifyFailure = errors.New("TopicVerifyFailure")
+
+var topicAcls = make(map[string]*topicAcl)
+
+var subscriptionMutex sync.Mutex
+
+// 主题名称与订阅的本地客户端的映射，客户端按照peerId和连接会话区分
+var subscriptions = make(map[string]map[string]*entity.PeerClient)
+
+func init() {
+	requireTopicAcl, _ = config.GetBool("p2p.chain.topic.requireAcl", false)
+	cacheTime, _ := config.GetInt("p2p.chain.topic.aclCacheTime", 60000)
+	topicAclCacheTime = time.Millisecond * time.Duration(cacheTime)
+	pubsub.RegistValidator(ValidateTopicMessage)
+	ns.RegistTopicVerifier(verifyTopicRecord, localTopic)
+}
+
+/*
+*
+主题签名的数据，覆盖主题名称，所有者，发布者，订阅者和版本
+*/
+func topicSignatureData(topic *entity.Topic) []byte {
+	return []byte(topic.TopicName + "|" + topic.OwnerPeerId + "|" + strings.Join(topic.Publishers, ",") + "|" +
+		strings.Join(topic.Subscribers, ",") + "|" + strconv.FormatInt(topic.Version, 10))
+}
+
+/*
+*
+校验主题的访问控制是所有者的openpgp私钥签名的
+*/
+func VerifyTopic(topic *entity.Topic) error {
+	if topic.TopicName == "" || topic.OwnerPeerId == "" || topic.Signature == "" {
+		return errors.New("InvalidTopic")
+	}
+	openpgpPub, err := GetPublicKey(topic.OwnerPeerId)
+	if err != nil {
+		return err
+	}
+	pass, _ := openpgp.Verify(openpgpPub, topicSignatureData(topic), std.DecodeBase64(topic.Signature))
+	if !pass {
+		return errTopicVerifyFailure
+	}
+
+	return nil
+}
+
+/*
+*
+主题的访问控制相对原来的记录的延续：版本不能降低，相同版本的记录必须相同，所有者不能改变，
+原来的记录校验不通过的时候不作为依据
+*/
+func checkTopicContinuity(topic *entity.Topic, previous *entity.Topic) error {
+	if previous == nil || previous.TopicName != topic.TopicName || VerifyTopic(previous) != nil {
+		return nil
+	}
+	if topic.Version < previous.Version {
+		return errors.New("StaleTopicVersion")
+	}
+	if topic.Version == previous.Version {
+		if topic.Signature != previous.Signature {
+			return errors.New("TopicVersionConflict")
+		}
+		return nil
+	}
+	if topic.OwnerPeerId != previous.OwnerPeerId {
+		return errors.New("TopicOwnerRequired")
+	}
+
+	return nil
+}
+
+/*
+*
+DHT的主题记录的校验，校验签名和相对原来的记录的延续，由ns.TopicValidator调用
+*/
+func verifyTopicRecord(topic *entity.Topic, previous *entity.Topic) error {
+	err := VerifyTopic(topic)
+	if err != nil {
+		return err
+	}
+
+	return checkTopicContinuity(topic, previous)
+}
+
+func localTopic(topicName string) *entity.Topic {
+	topic, err := service.GetTopicService().GetLocal(topicName)
+	if err != nil {
+		return nil
+	}
+
+	return topic
+}
+
+/*
+*
+发布主题的访问控制之前校验：由所有者发布，修改的版本必须更高，所有者不能改变
+*/
+func CheckTopicUpdate(topic *entity.Topic, srcPeerId string) error {
+	if topic.OwnerPeerId != srcPeerId {
+		return errors.New("TopicOwnerRequired")
+	}
+	err := VerifyTopic(topic)
+	if err != nil {
+		return err
+	}
+	ForgetTopic(topic.TopicName)
+	existing, err := GetTopic(topic.TopicName)
+	if err != nil && err != errTopicVerifyFailure {
+		return err
+	}
+	if existing != nil {
+		if existing.OwnerPeerId != srcPeerId {
+			return errors.New("TopicOwnerRequired")
+		}
+		if topic.Version <= existing.Version {
+			return errors.New("StaleTopicVersion")
+		}
+	}
+	ForgetTopic(topic.TopicName)
+
+	return nil
+}
+
+/*
+*
+取得校验过的主题访问控制，缓存一段时间，没有发布访问控制的返回nil，
+有多个记录的时候取签名校验通过的版本最高的，有记录但是都校验不通过或者查找失败的时候返回错误，
+调用者必须拒绝，不能当作没有访问控制
+*/
+func GetTopic(topicName string) (*entity.Topic, error) {
+	topicAclMutex.Lock()
+	acl, ok := topicAcls[topicName]
+	topicAclMutex.Unlock()
+	if ok && time.Now().Before(acl.expireAt) {
+		return acl.topic, nil
+	}
+	topics, err := service.GetTopicService().GetValues(topicName)
+	if err != nil && err != service.ErrNoTopic {
+		logger.Sugar.Warnf("topic: %v acl lookup failure: %v", topicName, err)
+		return nil, err
+	}
+	var topic *entity.Topic
+	for _, t := range topics {
+		if topic != nil && t.Version <= topic.Version {
+			continue
+		}
+		if VerifyTopic(t) != nil {
+			logger.Sugar.Warnf("topic: %v has invalid acl signature, version: %v", topicName, t.Version)
+			continue
+		}
+		topic = t
+	}
+	if topic == nil && len(topics) > 0 {
+		return nil, errTopicVerifyFailure
+	}
+	topicAclMutex.Lock()
+	topicAcls[topicName] = &topicAcl{topic: topic, expireAt: time.Now().Add(topicAclCacheTime)}
+	topicAclMutex.Unlock()
+
+	return topic, nil
+}
+
+// ForgetTopic 清除主题访问控制的缓存
+func ForgetTopic(topicName string) {
+	topicAclMutex.Lock()
+	defer topicAclMutex.Unlock()
+	delete(topicAcls, topicName)
+}
+
+/*
+*
+peerId是否可以向主题发布消息
+*/
+func CheckPublish(topicName string, peerId string) error {
+	if ns.IsPresenceTopic(topicName) {
+		return errors.New("TopicPublishDenied")
+	}
+	topic, err := GetTopic(topicName)
+	if err != nil {
+		return err
+	}
+	if topic == nil {
+		if requireTopicAcl {
+			return errors.New("NoTopicAcl")
+		}
+		return nil
+	}
+	if !topic.CanPublish(peerId) {
+		return errors.New("TopicPublishDenied")
+	}
+
+	return nil
+}
+
+/*
+*
+peerId是否可以订阅主题
+*/
+func CheckSubscribe(topicName string, peerId string) error {
+	if ns.IsPresenceTopic(topicName) {
+		return errors.New("TopicSubscribeDenied")
+	}
+	topic, err := GetTopic(topicName)
+	if err != nil {
+		return err
+	}
+	if topic == nil {
+		if requireTopicAcl {
+			return errors.New("NoTopicAcl")
+		}
+		return nil
+	}
+	if !topic.CanSubscribe(peerId) {
+		return errors.New("TopicSubscribeDenied")
+	}
+
+	return nil
+}
+
+/*
+*
+GossipSub的主题消息校验器，必须是发往这个主题的请求，签名校验通过，发布者在访问控制之内
+*/
+func ValidateTopicMessage(topicName string, data []byte) bool {
+	chainMessage := &msg1.ChainMessage{}
+	err := codec.Unmarshal(data, chainMessage)
+	if err != nil {
+		return false
+	}
+	if chainMessage.Topic != topicName || chainMessage.MessageDirect != msgtype.MsgDirect_Request {
+		return false
+	}
+	//与ReplayValidate相同，有签名的时候校验，没有签名的只有强制签名的消息类型拒绝，兼容旧版本的节点
+	if chainMessage.MessageSignature != "" {
+		err = verifyMessage(chainMessage)
+		if err != nil {
+			logger.Sugar.Warnf("Reject topic: %v message uuid: %v, error: %v", topicName, chainMessage.UUID, err)
+			return false
+		}
+	} else if enforceSignature && needSignature(chainMessage.MessageType) {
+		logger.Sugar.Warnf("Reject topic: %v message uuid: %v, error: %v", topicName, chainMessage.UUID, ValidateCode_NeedSignature)
+		return false
+	}
+	//没有签名的时候SrcPeerId不可信，只能发往没有访问控制的主题
+	if chainMessage.MessageSignature == "" {
+		if ns.IsPresenceTopic(topicName) {
+			return false
+		}
+		topic, err := GetTopic(topicName)
+		if err != nil || topic != nil {
+			logger.Sugar.Warnf("Reject topic: %v unsigned message uuid: %v", topicName, chainMessage.UUID)
+			return false
+		}
+	}
+	//在线状态的主题只能由被关注的peerId的连接节点发布在线状态
+	if ns.IsPresenceTopic(topicName) {
+		err = CheckPresencePublisher(topicName, chainMessage)
+		if err != nil {
+			logger.Sugar.Warnf("Reject topic: %v message uuid: %v, error: %v", topicName, chainMessage.UUID, err)
+			return false
+		}
+		return true
+	}
+	err = CheckPublish(topicName, chainMessage.SrcPeerId)
+	if err != nil {
+		logger.Sugar.Warnf("Reject topic: %v message uuid: %v, error: %v", topicName, chainMessage.UUID, err)
+		return false
+	}
+
+	return true
+}
+
+func subscriptionKey(peerClient *entity.PeerClient) string {
+	return peerClient.PeerId + "/" + peerClient.ConnectSessionId
+}
+
+/*
+*
+本地客户端订阅主题，第一个订阅者订阅的时候节点订阅主题
+*/
+func SubscribeTopic(topicName string, peerClient *entity.PeerClient) error {
+	err := CheckSubscribe(topicName, peerClient.PeerId)
+	if err != nil {
+		return err
+	}
+	subscriptionMutex.Lock()
+	defer subscriptionMutex.Unlock()
+	subscribers, ok := subscriptions[topicName]
+	if !ok {
+		_, err = pubsub.Subscribe(topicName)
+		if err != nil {
+			return err
+		}
+		subscribers = make(map[string]*entity.PeerClient)
+		subscriptions[topicName] = subscribers
+	}
+	subscribers[subscriptionKey(peerClient)] = peerClient
+
+	return nil
+}
+
+/*
+*
+本地客户端取消订阅主题
+*/
+func UnsubscribeTopic(topicName string, peerClient *entity.PeerClient) {
+	subscriptionMutex.Lock()
+	defer subscriptionMutex.Unlock()
+	subscribers, ok := subscriptions[topicName]
+	if !ok {
+		return
+	}
+	delete(subscribers, subscriptionKey(peerClient))
+	removeTopic(topicName, subscribers)
+}
+
+/*
+*
+连接断开的时候取消这个连接会话所有的订阅
+*/
+func UnsubscribeSession(connectSessionId string) {
+	subscriptionMutex.Lock()
+	defer subscriptionMutex.Unlock()
+	for topicName, subscribers := range subscriptions {
+		for key, peerClient := range subscribers {
+			if peerClient.ConnectSessionId == connectSessionId {
+				delete(subscribers, key)
+			}
+		}
+		removeTopic(topicName, subscribers)
+	}
+}
+
+/*
+*
+最后一个订阅者取消的时候节点取消订阅，节点自己的主题保持订阅
+*/
+func removeTopic(topicName string, subscribers map[string]*entity.PeerClient) {
+	if len(subscribers) > 0 {
+		return
+	}
+	delete(subscriptions, topicName)
+	if topicName != config.Libp2pParams.Topic {
+		pubsub.Unsubscribe(topicName)
+	}
+}
+
+/*
+*
+订阅了主题并且仍然在访问控制之内的本地客户端
+*/
+func GetTopicSubscribers(topicName string) []*entity.PeerClient {
+	subscriptionMutex.Lock()
+	peerClients := make([]*entity.PeerClient, 0, len(subscriptions[topicName]))
+	for _, peerClient := range subscriptions[topicName] {
+		peerClients = append(peerClients, peerClient)
+	}
+	subscriptionMutex.Unlock()
+	subscribers := make([]*entity.PeerClient, 0, len(peerClients))
+	for _, peerClient := range peerClients {
+		if CheckSubscribe(topicName, peerClient.PeerId) == nil {
+			subscribers = append(subscribers, peerClient)
+		}
+	}
+
+	return subscribers
+}
@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"github.com/curltech/go-colla-core/logger"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+	"net/http"
+	"reflect"
+)
+
+/*
+*
+消息类型的校验规则，在RegistChainMessageHandler之后通过RegistChainMessageSchema登记
+没有登记规则的消息类型只做公共的校验
+*/
+type ChainMessageSchema struct {
+	// 必须有值的ChainMessage字段名，比如TargetPeerId
+	RequiredFields []string
+	// 请求消息允许的PayloadType，为空不限制
+	PayloadTypes []string
+	// 回应消息允许的PayloadType，为空不限制，PayloadType_String总是允许（Ok，Error）
+	ResponsePayloadTypes []string
+	// TransportPayload解码后的最大字节数，0不限制
+	PayloadLimit int
+	// 允许的消息方向，为空请求和回应都允许
+	Directs []string
+	// 请求必须有MessageSignature，防止重放
+	NeedSignature bool
+	// 无法送达的请求保存到待转发队列，目标上线或者到期后重发
+	StoreAndForward bool
+	// 请求送达接收者的连接节点和设备的时候自动生成回执，发回给发送者
+	NeedReceipt bool
+}
+
+/*
+*
+校验失败的错误，Code是结构化的错误码，Field是出错的字段
+*/
+type ValidateError struct {
+	Code    string
+	MsgType string
+	Field   string
+}
+
+func (this *ValidateError) Error() string {
+	if this.Field == "" {
+		return this.Code
+	}
+	return this.Code + ":" + this.Field
+}
+
+const (
+	ValidateCode_NoMessageType      = "NoMessageType"
+	ValidateCode_UnknownMessageType = "UnknownMessageType"
+	ValidateCode_InvalidDirect      = "InvalidMessageDirect"
+	ValidateCode_RequiredField      = "RequiredField"
+	ValidateCode_InvalidPayloadType = "InvalidPayloadType"
+	ValidateCode_PayloadTooLarge    = "PayloadTooLarge"
+	ValidateCode_InvalidTarget      = "InvalidTarget"
+)
+
+func RegistChainMessageSchema(msgType string, schema *ChainMessageSchema) {
+	chainMessageHandler, found := chainMessageHandlers[msgType]
+	if !found {
+		logger.Sugar.Errorf("ChainMessageHandler:%v is not exist, schema can not be registed", msgType)
+		return
+	}
+	chainMessageHandler.Schema = schema
+}
+
+/*
+*
+消息类型是否选择了保存转发
+*/
+func IsStoreAndForward(msgType string) bool {
+	chainMessageHandler, found := chainMessageHandlers[msgType]
+	if !found || chainMessageHandler.Schema == nil {
+		return false
+	}
+	return chainMessageHandler.Schema.StoreAndForward
+}
+
+/*
+*
+消息类型是否需要回执
+*/
+func IsNeedReceipt(msgType string) bool {
+	chainMessageHandler, found := chainMessageHandlers[msgType]
+	if !found || chainMessageHandler.Schema == nil {
+		return false
+	}
+	return chainMessageHandler.Schema.NeedReceipt
+}
+
+func validate(msg *msg1.ChainMessage, direct string) error {
+	if msg.MessageType == "" {
+		return &ValidateError{Code: ValidateCode_NoMessageType, Field: "MessageType"}
+	}
+	if direct != msgtype.MsgDirect_Request && direct != msgtype.MsgDirect_Response {
+		return &ValidateError{Code: ValidateCode_InvalidDirect, MsgType: msg.MessageType, Field: "MessageDirect"}
+	}
+	chainMessageHandler, found := chainMessageHandlers[msg.MessageType]
+	if !found {
+		return &ValidateError{Code: ValidateCode_UnknownMessageType, MsgType: msg.MessageType, Field: "MessageType"}
+	}
+	//转发节点复制的副本的接收者必须在签名覆盖的接收者列表中
+	if msg.TargetPeerId != "" && len(msg.TargetPeerIds) > 0 && !contains(msg.TargetPeerIds, msg.TargetPeerId) {
+		return &ValidateError{Code: ValidateCode_InvalidTarget, MsgType: msg.MessageType, Field: "TargetPeerId"}
+	}
+	schema := chainMessageHandler.Schema
+	if schema == nil {
+		return nil
+	}
+	if len(schema.Directs) > 0 && !contains(schema.Directs, direct) {
+		return &ValidateError{Code: ValidateCode_InvalidDirect, MsgType: msg.MessageType, Field: "MessageDirect"}
+	}
+	if direct == msgtype.MsgDirect_Request {
+		v := reflect.ValueOf(msg).Elem()
+		for _, field := range schema.RequiredFields {
+			//多接收者的消息用TargetPeerIds代替TargetPeerId
+			if field == "TargetPeerId" && len(msg.TargetPeerIds) > 0 {
+				continue
+			}
+			f := v.FieldByName(field)
+			if !f.IsValid() || f.IsZero() {
+				return &ValidateError{Code: ValidateCode_RequiredField, MsgType: msg.MessageType, Field: field}
+			}
+		}
+	}
+	payloadType := msg.PayloadType
+	if payloadType == "" {
+		payloadType = PayloadType_Map
+	}
+	if direct == msgtype.MsgDirect_Request {
+		if len(schema.PayloadTypes) > 0 && !contains(schema.PayloadTypes, payloadType) {
+			return &ValidateError{Code: ValidateCode_InvalidPayloadType, MsgType: msg.MessageType, Field: "PayloadType"}
+		}
+	} else if payloadType != PayloadType_String {
+		if len(schema.ResponsePayloadTypes) > 0 && !contains(schema.ResponsePayloadTypes, payloadType) {
+			return &ValidateError{Code: ValidateCode_InvalidPayloadType, MsgType: msg.MessageType, Field: "PayloadType"}
+		}
+	}
+	//base64编码后的长度折算成原始字节数
+	if schema.PayloadLimit > 0 && len(msg.TransportPayload)/4*3 > schema.PayloadLimit {
+		return &ValidateError{Code: ValidateCode_PayloadTooLarge, MsgType: msg.MessageType, Field: "TransportPayload"}
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func Reject(msgType string, err error) *msg1.ChainMessage {
+	rejectMessage := msg1.ChainMessage{}
+	payload := map[string]interface{}{"code": err.Error()}
+	validateError, ok := err.(*ValidateError)
+	if ok {
+		payload["code"] = validateError.Code
+		payload["field"] = validateError.Field
+	}
+	rejectMessage.Payload = payload
+	rejectMessage.PayloadType = PayloadType_Map
+	rejectMessage.Tip = msgtype.REJECT
+	rejectMessage.StatusCode = http.StatusBadRequest
+	//重复的消息已经收到过，使用单独的状态码，重发的发送方据此标记为已经送达
+	if ok && validateError.Code == ValidateCode_Duplicate {
+		rejectMessage.StatusCode = http.StatusConflict
+	}
+	rejectMessage.MessageType = msgType
+	rejectMessage.MessageDirect = msgtype.MsgDirect_Response
+
+	return &rejectMessage
+}
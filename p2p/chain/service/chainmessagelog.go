@@ -1,10 +1,16 @@
 package service
 
 import (
+	"github.com/curltech/go-colla-core/config"
 	"github.com/curltech/go-colla-core/container"
+	"github.com/curltech/go-colla-core/logger"
 	"github.com/curltech/go-colla-core/service"
 	"github.com/curltech/go-colla-core/util/message"
+	"github.com/curltech/go-colla-node/libp2p/global"
 	"github.com/curltech/go-colla-node/p2p/chain/entity"
+	msg1 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"strconv"
+	"time"
 )
 
 /**
@@ -50,8 +56,20 @@ func (this *ChainMessageLogService) NewEntities(data []byte) (interface{}, error
 	return &entities, err
 }
 
+/**
+消息日志的配置：是否记录，是否记录负载，保留的时间（小时）
+*/
+var logEnable = false
+
+var logPayload = false
+
+var logRetention = 72
+
 func init() {
 	service.GetSession().Sync(new(entity.ChainMessageLog))
+	logEnable, _ = config.GetBool("p2p.chain.log.enable", false)
+	logPayload, _ = config.GetBool("p2p.chain.log.payload", false)
+	logRetention, _ = config.GetInt("p2p.chain.log.retention", 72)
 
 	chainMessageLogService.OrmBaseService.GetSeqName = chainMessageLogService.GetSeqName
 	chainMessageLogService.OrmBaseService.FactNewEntity = chainMessageLogService.NewEntity
@@ -59,3 +77,116 @@ func init() {
 	service.RegistSeq(seqname, 0)
 	container.RegistService("chainMessageLog", chainMessageLogService)
 }
+
+/**
+记录消息在本节点的发送，转发或者接收，response为空表示没有回应，start是开始处理的时间
+异步保存，不影响消息的处理，没有打开p2p.chain.log.enable的时候不记录
+*/
+func (this *ChainMessageLogService) Log(action string, chainMessage *msg1.ChainMessage, response *msg1.ChainMessage, start time.Time, err error) {
+	if !logEnable || chainMessage == nil {
+		return
+	}
+	chainMessageLog := &entity.ChainMessageLog{}
+	chainMessageLog.UUID = chainMessage.UUID
+	chainMessageLog.MessageType = chainMessage.MessageType
+	chainMessageLog.MessageDirect = chainMessage.MessageDirect
+	chainMessageLog.Action = action
+	chainMessageLog.SrcPeerId = chainMessage.SrcPeerId
+	chainMessageLog.TargetPeerId = chainMessage.TargetPeerId
+	chainMessageLog.SrcAddress = chainMessage.SrcConnectPeerId
+	chainMessageLog.TargetAddress = chainMessage.TargetConnectPeerId
+	chainMessageLog.PayloadClass = chainMessage.PayloadType
+	if global.Global.PeerId != "" {
+		chainMessageLog.HopPeerId = global.Global.PeerId.String()
+	}
+	chainMessageLog.HopCount = len(chainMessage.Hops)
+	if chainMessage.CreateTimestamp != nil {
+		chainMessageLog.CreateTimestamp = *chainMessage.CreateTimestamp
+	}
+	chainMessageLog.Latency = time.Since(start).Milliseconds()
+	if logPayload {
+		chainMessageLog.Payload = payloadOf(chainMessage)
+	}
+	if response != nil {
+		chainMessageLog.ResponseType = response.MessageType
+		chainMessageLog.StatusCode = response.StatusCode
+		chainMessageLog.ResponseCode = strconv.Itoa(response.StatusCode)
+		chainMessageLog.ResponseMessage = response.Tip
+		if logPayload {
+			chainMessageLog.ResponsePayload = payloadOf(response)
+		}
+	}
+	if err != nil {
+		chainMessageLog.ResponseMessage = err.Error()
+	}
+	go func() {
+		_, err := this.Insert(chainMessageLog)
+		if err != nil {
+			logger.Sugar.Errorf("Insert chainMessageLog uuid: %v failure: %v", chainMessageLog.UUID, err)
+		}
+	}()
+}
+
+func payloadOf(chainMessage *msg1.ChainMessage) string {
+	if chainMessage.TransportPayload != "" {
+		return chainMessage.TransportPayload
+	}
+	if chainMessage.Payload == nil {
+		return ""
+	}
+	payload, err := message.TextMarshal(chainMessage.Payload)
+	if err != nil {
+		return ""
+	}
+
+	return payload
+}
+
+/**
+查询消息日志，peerId是源或者目标，messageType为空不限制，from和to为空不限制时间，按照时间倒序
+*/
+func (this *ChainMessageLogService) FindLogs(peerId string, messageType string, from *time.Time, to *time.Time, limit int) ([]*entity.ChainMessageLog, error) {
+	chainMessageLogs := make([]*entity.ChainMessageLog, 0)
+	conds := "1=1"
+	params := make([]interface{}, 0)
+	if peerId != "" {
+		conds += " and (srcPeerId=? or targetPeerId=?)"
+		params = append(params, peerId, peerId)
+	}
+	if messageType != "" {
+		conds += " and messageType=?"
+		params = append(params, messageType)
+	}
+	if from != nil {
+		conds += " and createDate>=?"
+		params = append(params, from)
+	}
+	if to != nil {
+		conds += " and createDate<=?"
+		params = append(params, to)
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	err := this.Find(&chainMessageLogs, nil, "createDate desc", 0, limit, conds, params...)
+
+	return chainMessageLogs, err
+}
+
+/**
+按照UUID查询一个消息在本节点的所有记录
+*/
+func (this *ChainMessageLogService) FindByUUID(uuid string) ([]*entity.ChainMessageLog, error) {
+	chainMessageLogs := make([]*entity.ChainMessageLog, 0)
+	err := this.Find(&chainMessageLogs, nil, "createDate", 0, 0, "uuid=?", uuid)
+
+	return chainMessageLogs, err
+}
+
+/**
+删除超过保留时间的消息日志
+*/
+func (this *ChainMessageLogService) Purge() {
+	retention := time.Now().Add(-time.Hour * time.Duration(logRetention))
+	_, _ = this.Delete(&entity.ChainMessageLog{}, "createDate<=?", &retention)
+}
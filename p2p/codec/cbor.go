@@ -0,0 +1,399 @@
+package codec
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/curltech/go-colla-core/crypto/std"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cbor的主类型
+const (
+	majorUint   = 0
+	majorNegint = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+)
+
+const (
+	simpleFalse   = 0xf4
+	simpleTrue    = 0xf5
+	simpleNull    = 0xf6
+	simpleFloat32 = 0xfa
+	simpleFloat64 = 0xfb
+)
+
+// 日期时间字符串的tag，与json一样使用RFC3339格式
+const tagDateTime = 0
+
+var timeType = reflect.TypeOf(time.Time{})
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+/*
+*
+结构的字段，名字和omitempty取自json的标记，base64取自codec的标记
+*/
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	base64    bool
+}
+
+type structInfo struct {
+	fields []*field
+	names  map[string]*field
+}
+
+var structInfos sync.Map
+
+func getStructInfo(t reflect.Type) *structInfo {
+	if info, ok := structInfos.Load(t); ok {
+		return info.(*structInfo)
+	}
+	info := &structInfo{names: make(map[string]*field)}
+	depths := make(map[string]int)
+	collectFields(t, nil, 0, info, depths)
+	structInfos.Store(t, info)
+
+	return info
+}
+
+/*
+*
+收集结构的字段，匿名嵌入的结构展开（不展开嵌入的结构指针），同名的字段层次浅的优先，与json一致
+*/
+func collectFields(t reflect.Type, index []int, depth int, info *structInfo, depths map[string]int) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		idx := append(append([]int(nil), index...), i)
+		ft := sf.Type
+		if sf.Anonymous && name == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if sf.Type.Kind() != reflect.Ptr {
+					collectFields(ft, idx, depth+1, info, depths)
+				}
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if d, ok := depths[name]; ok && d <= depth {
+			continue
+		}
+		f := &field{
+			name:      name,
+			index:     idx,
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+			base64:    sf.Tag.Get("codec") == "base64",
+		}
+		if old, ok := info.names[name]; ok {
+			for j, o := range info.fields {
+				if o == old {
+					info.fields = append(info.fields[:j], info.fields[j+1:]...)
+					break
+				}
+			}
+		}
+		depths[name] = depth
+		info.names[name] = f
+		info.fields = append(info.fields, f)
+	}
+}
+
+// fieldByName 按照名字查找字段，找不到的时候不区分大小写，与json一致
+func (this *structInfo) fieldByName(name string) *field {
+	if f, ok := this.names[name]; ok {
+		return f
+	}
+	for _, f := range this.fields {
+		if strings.EqualFold(f.name, name) {
+			return f
+		}
+	}
+
+	return nil
+}
+
+/*
+*
+序列化成带自描述标记的cbor
+*/
+func marshalCbor(v interface{}) ([]byte, error) {
+	e := &encoder{buf: make([]byte, 0, 512)}
+	e.buf = append(e.buf, cborMagic...)
+	err := e.encode(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (this *encoder) writeHead(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		this.buf = append(this.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		this.buf = append(this.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		this.buf = binary.BigEndian.AppendUint16(append(this.buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		this.buf = binary.BigEndian.AppendUint32(append(this.buf, major|26), uint32(n))
+	default:
+		this.buf = binary.BigEndian.AppendUint64(append(this.buf, major|27), n)
+	}
+}
+
+func (this *encoder) writeText(s string) {
+	this.writeHead(majorText, uint64(len(s)))
+	this.buf = append(this.buf, s...)
+}
+
+func (this *encoder) writeBytes(b []byte) {
+	this.writeHead(majorBytes, uint64(len(b)))
+	this.buf = append(this.buf, b...)
+}
+
+func (this *encoder) writeInt(n int64) {
+	if n < 0 {
+		this.writeHead(majorNegint, uint64(-(n + 1)))
+	} else {
+		this.writeHead(majorUint, uint64(n))
+	}
+}
+
+func (this *encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		this.buf = append(this.buf, simpleNull)
+		return nil
+	}
+	t := v.Type()
+	if t == timeType {
+		this.writeHead(majorTag, tagDateTime)
+		this.writeText(v.Interface().(time.Time).Format(time.RFC3339Nano))
+		return nil
+	}
+	if t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface {
+		if t.Implements(jsonMarshalerType) {
+			return this.encodeJson(v)
+		}
+		if t.Implements(textMarshalerType) {
+			text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				return err
+			}
+			this.writeText(string(text))
+			return nil
+		}
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			this.buf = append(this.buf, simpleNull)
+			return nil
+		}
+		if t.Kind() == reflect.Ptr && t.Elem() != timeType && t.Implements(jsonMarshalerType) {
+			return this.encodeJson(v)
+		}
+		return this.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			this.buf = append(this.buf, simpleTrue)
+		} else {
+			this.buf = append(this.buf, simpleFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		this.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		this.writeHead(majorUint, v.Uint())
+	case reflect.Float32:
+		this.buf = binary.BigEndian.AppendUint32(append(this.buf, simpleFloat32), math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		this.buf = binary.BigEndian.AppendUint64(append(this.buf, simpleFloat64), math.Float64bits(v.Float()))
+	case reflect.String:
+		this.writeText(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			this.buf = append(this.buf, simpleNull)
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			this.writeBytes(v.Bytes())
+			return nil
+		}
+		return this.encodeArray(v)
+	case reflect.Array:
+		return this.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			this.buf = append(this.buf, simpleNull)
+			return nil
+		}
+		return this.encodeMap(v)
+	case reflect.Struct:
+		return this.encodeStruct(v)
+	default:
+		return errors.New("CborUnsupportedType:" + t.String())
+	}
+
+	return nil
+}
+
+func (this *encoder) encodeArray(v reflect.Value) error {
+	n := v.Len()
+	this.writeHead(majorArray, uint64(n))
+	for i := 0; i < n; i++ {
+		err := this.encode(v.Index(i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encodeMap 键转换成字符串并排序，与json一致
+func (this *encoder) encodeMap(v reflect.Value) error {
+	keys := v.MapKeys()
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		name, err := mapKeyString(key)
+		if err != nil {
+			return err
+		}
+		names[i] = name
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return names[order[i]] < names[order[j]] })
+	this.writeHead(majorMap, uint64(len(keys)))
+	for _, i := range order {
+		this.writeText(names[i])
+		err := this.encode(v.MapIndex(keys[i]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func mapKeyString(key reflect.Value) (string, error) {
+	switch key.Kind() {
+	case reflect.String:
+		return key.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	default:
+		return "", errors.New("CborUnsupportedMapKey:" + key.Type().String())
+	}
+}
+
+func (this *encoder) encodeStruct(v reflect.Value) error {
+	info := getStructInfo(v.Type())
+	values := make([]reflect.Value, 0, len(info.fields))
+	fields := make([]*field, 0, len(info.fields))
+	for _, f := range info.fields {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && isEmpty(fv) {
+			continue
+		}
+		values = append(values, fv)
+		fields = append(fields, f)
+	}
+	this.writeHead(majorMap, uint64(len(fields)))
+	for i, f := range fields {
+		this.writeText(f.name)
+		fv := values[i]
+		if f.base64 && fv.Kind() == reflect.String {
+			// 可以无损还原的base64字符串使用原始字节
+			s := fv.String()
+			raw := std.DecodeBase64(s)
+			if raw != nil && std.EncodeBase64(raw) == s {
+				this.writeBytes(raw)
+				continue
+			}
+		}
+		err := this.encode(fv)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encodeJson 自定义了json序列化的类型，把json转换成cbor
+func (this *encoder) encodeJson(v reflect.Value) error {
+	data, err := v.Interface().(json.Marshaler).MarshalJSON()
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	return this.encode(reflect.ValueOf(value))
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+
+	return false
+}
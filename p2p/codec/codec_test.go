@@ -0,0 +1,337 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/curltech/go-colla-node/p2p/msg/entity"
+)
+
+type testInner struct {
+	Name  string  `json:"name,omitempty"`
+	Value float64 `json:"value"`
+}
+
+type testEmbedded struct {
+	Embedded string `json:"embedded,omitempty"`
+}
+
+type testValue struct {
+	testEmbedded
+	Id        uint64            `json:"id,omitempty"`
+	Count     int               `json:"count"`
+	Negative  int64             `json:"negative"`
+	Small     int8              `json:"small"`
+	Ratio     float32           `json:"ratio"`
+	Enabled   bool              `json:"enabled"`
+	Text      string            `json:"text,omitempty"`
+	Raw       []byte            `json:"raw,omitempty"`
+	Payload   string            `json:"payload,omitempty" codec:"base64"`
+	Time      time.Time         `json:"time"`
+	TimePtr   *time.Time        `json:"timePtr,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Scores    map[int]int       `json:"scores,omitempty"`
+	Inner     *testInner        `json:"inner,omitempty"`
+	Inners    []*testInner      `json:"inners,omitempty"`
+	Array     [3]int            `json:"array"`
+	Ignored   string            `json:"-"`
+	Omitted   string            `json:"omitted,omitempty"`
+	Anything  interface{}       `json:"anything,omitempty"`
+	unexposed string
+}
+
+func newTestValue() *testValue {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	later := now.Add(time.Hour)
+
+	return &testValue{
+		testEmbedded: testEmbedded{Embedded: "embedded"},
+		Id:           1<<63 + 5,
+		Count:        300,
+		Negative:     -70000,
+		Small:        -128,
+		Ratio:        1.5,
+		Enabled:      true,
+		Text:         "文本 text",
+		Raw:          []byte{0, 1, 2, 255},
+		Payload:      base64.StdEncoding.EncodeToString([]byte("payload bytes")),
+		Time:         now,
+		TimePtr:      &later,
+		Tags:         []string{"a", "", "c"},
+		Labels:       map[string]string{"k": "v", "": "empty"},
+		Scores:       map[int]int{-1: 1, 2: -2},
+		Inner:        &testInner{Name: "inner", Value: -0.25},
+		Inners:       []*testInner{{Name: "first"}, nil, {Value: 3}},
+		Array:        [3]int{1, -1, 1 << 40},
+		Anything:     map[string]interface{}{"n": 1.5, "s": "x", "l": []interface{}{true, nil}},
+	}
+}
+
+func TestCodecOf(t *testing.T) {
+	data, err := Marshal(Codec_Cbor, newTestValue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsBinary(data) || CodecOf(data) != Codec_Cbor {
+		t.Errorf("cbor is not recognized: %x", data[:8])
+	}
+	data, err = Marshal(Codec_Json, newTestValue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsBinary(data) || CodecOf(data) != Codec_Json {
+		t.Errorf("json is recognized as binary: %s", data[:8])
+	}
+	if CodecOfSubprotocol("colla.cbor") != Codec_Cbor || CodecOfSubprotocol("colla.xml") != Codec_Json || CodecOfSubprotocol("") != Codec_Json {
+		t.Error("subprotocol is not mapped to codec")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	value := newTestValue()
+	value.Ignored = "ignored"
+	value.unexposed = "unexposed"
+	for _, codec := range []string{Codec_Cbor, Codec_Json} {
+		data, err := Marshal(codec, value)
+		if err != nil {
+			t.Fatalf("%v: %v", codec, err)
+		}
+		result := &testValue{}
+		err = Unmarshal(data, result)
+		if err != nil {
+			t.Fatalf("%v: %v", codec, err)
+		}
+		expected := *value
+		expected.Ignored = ""
+		expected.unexposed = ""
+		if !reflect.DeepEqual(result, &expected) {
+			t.Errorf("%v: round trip\n got: %+v\nwant: %+v", codec, result, &expected)
+		}
+	}
+}
+
+// cbor和json解码到同一个结构的结果一致，服务端可以用任一种编码与客户端通信
+func TestCborMatchesJson(t *testing.T) {
+	value := newTestValue()
+	cborData, err := Marshal(Codec_Cbor, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := Marshal(Codec_Json, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromCbor := &testValue{}
+	fromJson := &testValue{}
+	if err = Unmarshal(cborData, fromCbor); err != nil {
+		t.Fatal(err)
+	}
+	if err = Unmarshal(jsonData, fromJson); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromCbor, fromJson) {
+		t.Errorf("cbor and json differ\ncbor: %+v\njson: %+v", fromCbor, fromJson)
+	}
+}
+
+func TestChainMessageRoundTrip(t *testing.T) {
+	createTimestamp := time.Now().UTC()
+	chainMessage := &entity.ChainMessage{
+		UUID:             "uuid",
+		TargetPeerId:     "target",
+		TargetPeerIds:    []string{"target1", "target2"},
+		SrcPeerId:        "src",
+		MessageType:      "P2PCHAT",
+		MessageDirect:    "Request",
+		NeedEncrypt:      true,
+		TransportPayload: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xfe, 0x01}, 1000)),
+		PayloadType:      "map",
+		CreateTimestamp:  &createTimestamp,
+		Ttl:              3,
+		Hops:             []*entity.Hop{{}},
+		Payload:          "not transported",
+	}
+	data, err := Marshal(Codec_Cbor, chainMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := Marshal(Codec_Json, chainMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 负载使用原始字节，比json的base64小
+	if len(data) >= len(jsonData)-len(chainMessage.TransportPayload)/4 {
+		t.Errorf("cbor %v bytes is not smaller than json %v bytes", len(data), len(jsonData))
+	}
+	result := &entity.ChainMessage{}
+	err = Unmarshal(data, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := *chainMessage
+	expected.Payload = nil
+	if !reflect.DeepEqual(result, &expected) {
+		t.Errorf("round trip\n got: %+v\nwant: %+v", result, &expected)
+	}
+}
+
+// 不能无损还原的base64字段按照文本传输
+func TestBase64Fallback(t *testing.T) {
+	for _, payload := range []string{"not base64!", "YWJj\n", "YWI=", "YWI"} {
+		data, err := Marshal(Codec_Cbor, &testValue{Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := &testValue{}
+		err = Unmarshal(data, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Payload != payload {
+			t.Errorf("payload %q: got %q", payload, result.Payload)
+		}
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	magic := string(cborMagic)
+	tests := map[string]string{
+		"truncated":      magic + "\xa1\x64name",
+		"trailing":       magic + "\xa0\x00",
+		"invalid head":   magic + "\x1c",
+		"huge count":     magic + "\x9b\xff\xff\xff\xff\xff\xff\xff\xff",
+		"huge string":    magic + "\x7b\x7f\xff\xff\xff\xff\xff\xff\xff",
+		"invalid chunk":  magic + "\x7f\x41a\xff",
+		"type mismatch":  magic + "\xa1\x65count\x63abc",
+		"overflow":       magic + "\xa1\x65small\x19\x01\x00",
+		"negative uint":  magic + "\xa1\x62id\x20",
+		"invalid key":    magic + "\xa1\xf5\x00",
+		"too deep":       magic + strings.Repeat("\x81", maxDepth+1) + "\x00",
+		"too deep tags":  magic + strings.Repeat("\xc6", maxDepth+1) + "\x00",
+		"unterminated":   magic + "\x9f\x00",
+		"invalid simple": magic + "\xa1\x67enabled\xf0",
+	}
+	for name, data := range tests {
+		err := Unmarshal([]byte(data), &testValue{})
+		if err == nil {
+			t.Errorf("%v: no error", name)
+		}
+		var value interface{}
+		_ = Unmarshal([]byte(data), &value)
+	}
+	var value interface{}
+	err := Unmarshal([]byte(magic+strings.Repeat("\xc6", maxDepth+1)+"\x00"), &value)
+	if err == nil {
+		t.Error("too deep tags: no error")
+	}
+}
+
+/*
+*
+任意的输入不能让解码崩溃或者耗尽内存，解码成功的通用对象能够再次编码和解码，结果一致
+go test -fuzz=FuzzUnmarshal ./p2p/codec/
+*/
+func FuzzUnmarshal(f *testing.F) {
+	for _, v := range []interface{}{newTestValue(), &entity.ChainMessage{UUID: "uuid", TransportPayload: "YWJj", Ttl: 1}, []interface{}{1, "a", nil}, map[string]interface{}{}} {
+		data, err := Marshal(Codec_Cbor, v)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add(append(append([]byte(nil), cborMagic...), 0x9f, 0x7f, 0x61, 'a', 0xff, 0xc1, 0xf9, 0x3c, 0x00, 0xff))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		data = append(append([]byte(nil), cborMagic...), data...)
+		_ = Unmarshal(data, &testValue{})
+		_ = Unmarshal(data, &entity.ChainMessage{})
+		var value interface{}
+		err := Unmarshal(data, &value)
+		if err != nil {
+			return
+		}
+		encoded, err := Marshal(Codec_Cbor, value)
+		if err != nil {
+			// json不能表示的浮点数和映射的键
+			return
+		}
+		var decoded interface{}
+		err = Unmarshal(encoded, &decoded)
+		if err != nil {
+			t.Fatalf("decode re-encoded %x: %v", encoded, err)
+		}
+		if !equalAny(value, decoded) {
+			t.Fatalf("re-encoded value differs\n got: %#v\nwant: %#v", decoded, value)
+		}
+	})
+}
+
+// equalAny 比较通用的对象，NaN与自己相等
+func equalAny(a interface{}, b interface{}) bool {
+	if fa, ok := a.(float64); ok {
+		fb, ok := b.(float64)
+		return ok && (fa == fb || (fa != fa && fb != fb))
+	}
+	switch va := a.(type) {
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if !equalAny(va[i], vb[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for k := range va {
+			if !equalAny(va[k], vb[k]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+/*
+*
+json能够解码的消息，经过cbor转发与经过json转发的结果一致
+go test -fuzz=FuzzJsonCompatible ./p2p/codec/
+*/
+func FuzzJsonCompatible(f *testing.F) {
+	f.Add([]byte(`{"uuid":"u","ttl":3,"targetPeerIds":["a","b"],"transportPayload":"YWJj","createTimestamp":"2024-01-02T03:04:05Z"}`))
+	f.Add([]byte(`{"hops":[{}],"statusCode":-1,"needEncrypt":true}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		chainMessage := &entity.ChainMessage{}
+		if json.Unmarshal(data, chainMessage) != nil {
+			return
+		}
+		fromJson := &entity.ChainMessage{}
+		fromCbor := &entity.ChainMessage{}
+		for codec, result := range map[string]*entity.ChainMessage{Codec_Json: fromJson, Codec_Cbor: fromCbor} {
+			encoded, err := Marshal(codec, chainMessage)
+			if err != nil {
+				t.Fatalf("%v: %v", codec, err)
+			}
+			err = Unmarshal(encoded, result)
+			if err != nil {
+				t.Fatalf("%v: decode %x: %v", codec, encoded, err)
+			}
+		}
+		if !reflect.DeepEqual(fromCbor, fromJson) {
+			t.Fatalf("cbor differs from json\n got: %+v\nwant: %+v", fromCbor, fromJson)
+		}
+	})
+}
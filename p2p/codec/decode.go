@@ -0,0 +1,671 @@
+package codec
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/curltech/go-colla-core/crypto/std"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// 日期时间数字的tag，从1970年开始的秒数
+const tagEpoch = 1
+
+// 嵌套的最大层次，防止恶意的数据耗尽栈
+const maxDepth = 256
+
+const (
+	infoIndefinite = 31
+	breakCode      = 0xff
+)
+
+var ErrTruncated = errors.New("CborTruncated")
+
+var ErrTypeMismatch = errors.New("CborTypeMismatch")
+
+/*
+*
+反序列化cbor，v必须是非空的指针，与json一样，没有的字段保持原值，null把指针，切片，映射和接口置空
+*/
+func unmarshalCbor(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("CborInvalidUnmarshal")
+	}
+	d := &decoder{data: data}
+	err := d.decode(rv.Elem(), false)
+	if err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errors.New("CborTrailingData")
+	}
+
+	return nil
+}
+
+type decoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (this *decoder) peek() (byte, error) {
+	if this.pos >= len(this.data) {
+		return 0, ErrTruncated
+	}
+
+	return this.data[this.pos], nil
+}
+
+/*
+*
+读数据项的头，返回主类型，附加信息和长度或者值，不定长的时候附加信息是31
+*/
+func (this *decoder) readHead() (byte, byte, uint64, error) {
+	b, err := this.peek()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	this.pos++
+	major := b >> 5
+	info := b & 0x1f
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	case info == infoIndefinite && major >= majorBytes && major <= majorMap:
+		return major, info, 0, nil
+	case info == infoIndefinite && major == majorSimple:
+		return major, info, 0, nil
+	default:
+		return 0, 0, 0, errors.New("CborInvalidHead")
+	}
+	if len(this.data)-this.pos < size {
+		return 0, 0, 0, ErrTruncated
+	}
+	var n uint64
+	switch size {
+	case 1:
+		n = uint64(this.data[this.pos])
+	case 2:
+		n = uint64(binary.BigEndian.Uint16(this.data[this.pos:]))
+	case 4:
+		n = uint64(binary.BigEndian.Uint32(this.data[this.pos:]))
+	default:
+		n = binary.BigEndian.Uint64(this.data[this.pos:])
+	}
+	this.pos += size
+
+	return major, info, n, nil
+}
+
+// isBreak 不定长的数据项是否结束，结束的时候跳过结束符
+func (this *decoder) isBreak() (bool, error) {
+	b, err := this.peek()
+	if err != nil {
+		return false, err
+	}
+	if b == breakCode {
+		this.pos++
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// readString 读字节串或者文本串的内容，不定长的由同类型的定长分段拼接
+func (this *decoder) readString(major byte, info byte, n uint64) ([]byte, error) {
+	if info != infoIndefinite {
+		if n > uint64(len(this.data)-this.pos) {
+			return nil, ErrTruncated
+		}
+		b := this.data[this.pos : this.pos+int(n)]
+		this.pos += int(n)
+		return b, nil
+	}
+	var b []byte
+	for {
+		end, err := this.isBreak()
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			return b, nil
+		}
+		m, i, l, err := this.readHead()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || i == infoIndefinite {
+			return nil, errors.New("CborInvalidChunk")
+		}
+		chunk, err := this.readString(m, i, l)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, chunk...)
+	}
+}
+
+// checkCount 定长的数组和映射的元素个数不能超过剩余的字节数
+func (this *decoder) checkCount(n uint64) error {
+	if n > uint64(len(this.data)-this.pos) {
+		return ErrTruncated
+	}
+
+	return nil
+}
+
+// readFloat 读简单类型的浮点数，包括半精度
+func readFloat(info byte, n uint64) (float64, bool) {
+	switch info {
+	case 25:
+		return halfToFloat(uint16(n)), true
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), true
+	case 27:
+		return math.Float64frombits(n), true
+	}
+
+	return 0, false
+}
+
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+
+	return f
+}
+
+func (this *decoder) enter() error {
+	this.depth++
+	if this.depth > maxDepth {
+		return errors.New("CborTooDeep")
+	}
+
+	return nil
+}
+
+func (this *decoder) leave() {
+	this.depth--
+}
+
+/*
+*
+解码到v，base64表示v是标记了codec:"base64"的字符串字段，字节串转换成base64字符串
+*/
+func (this *decoder) decode(v reflect.Value, base64 bool) error {
+	b, err := this.peek()
+	if err != nil {
+		return err
+	}
+	// null和undefined
+	if b == simpleNull || b == simpleNull+1 {
+		this.pos++
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Interface {
+		if v.NumMethod() != 0 {
+			return ErrTypeMismatch
+		}
+		// 与json一样，接口中已经有非空的指针的时候解码到指针指向的对象
+		if !v.IsNil() && v.Elem().Kind() == reflect.Ptr && !v.Elem().IsNil() {
+			return this.decode(v.Elem(), base64)
+		}
+		value, err := this.decodeAny()
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(value))
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return this.decode(v.Elem(), base64)
+	}
+	if v.Type() != timeType && v.CanAddr() {
+		pv := v.Addr()
+		if pv.Type().Implements(jsonUnmarshalerType) {
+			return this.decodeJson(pv)
+		}
+		if pv.Type().Implements(textUnmarshalerType) && b>>5 == majorText {
+			major, info, n, err := this.readHead()
+			if err != nil {
+				return err
+			}
+			text, err := this.readString(major, info, n)
+			if err != nil {
+				return err
+			}
+			return pv.Interface().(encoding.TextUnmarshaler).UnmarshalText(text)
+		}
+	}
+	start := this.pos
+	major, info, n, err := this.readHead()
+	if err != nil {
+		return err
+	}
+	if major == majorTag {
+		if v.Type() == timeType && (n == tagDateTime || n == tagEpoch) {
+			return this.decodeTime(v)
+		}
+		// 自描述标记和其他的tag忽略，解码tag的内容，嵌套的tag也计算层次
+		err = this.enter()
+		if err != nil {
+			return err
+		}
+		defer this.leave()
+		return this.decode(v, base64)
+	}
+	if v.Type() == timeType && major == majorText {
+		this.pos = start
+		return this.decodeTime(v)
+	}
+	switch major {
+	case majorUint, majorNegint:
+		return setInt(v, major, n)
+	case majorBytes, majorText:
+		s, err := this.readString(major, info, n)
+		if err != nil {
+			return err
+		}
+		return setString(v, major, s, base64)
+	case majorArray:
+		return this.decodeArray(v, info, n)
+	case majorMap:
+		return this.decodeMap(v, info, n)
+	case majorSimple:
+		return setSimple(v, info, n)
+	}
+
+	return ErrTypeMismatch
+}
+
+// decodeTime 日期时间可以是RFC3339的字符串或者从1970年开始的秒数
+func (this *decoder) decodeTime(v reflect.Value) error {
+	value, err := this.decodeAny()
+	if err != nil {
+		return err
+	}
+	switch t := value.(type) {
+	case string:
+		tm, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(tm))
+	case float64:
+		sec, frac := math.Modf(t)
+		v.Set(reflect.ValueOf(time.Unix(int64(sec), int64(frac*1e9))))
+	default:
+		return ErrTypeMismatch
+	}
+
+	return nil
+}
+
+// decodeJson 自定义了json反序列化的类型，把cbor转换成json
+func (this *decoder) decodeJson(pv reflect.Value) error {
+	value, err := this.decodeAny()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return pv.Interface().(json.Unmarshaler).UnmarshalJSON(data)
+}
+
+func setInt(v reflect.Value, major byte, n uint64) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n > math.MaxInt64 {
+			return errors.New("CborOverflow")
+		}
+		i := int64(n)
+		if major == majorNegint {
+			i = -i - 1
+		}
+		if v.OverflowInt(i) {
+			return errors.New("CborOverflow")
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if major == majorNegint || v.OverflowUint(n) {
+			return errors.New("CborOverflow")
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f := float64(n)
+		if major == majorNegint {
+			f = -f - 1
+		}
+		v.SetFloat(f)
+	default:
+		return ErrTypeMismatch
+	}
+
+	return nil
+}
+
+// setString 字节串可以解码到字符串和字节切片，文本串解码到字节切片的时候与json一样作为base64
+func setString(v reflect.Value, major byte, s []byte, base64Field bool) error {
+	switch {
+	case v.Kind() == reflect.String:
+		if major == majorBytes && base64Field {
+			v.SetString(std.EncodeBase64(s))
+		} else {
+			v.SetString(string(s))
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		if major == majorText {
+			b, err := base64.StdEncoding.DecodeString(string(s))
+			if err != nil {
+				return err
+			}
+			s = b
+		}
+		v.SetBytes(append([]byte{}, s...))
+	default:
+		return ErrTypeMismatch
+	}
+
+	return nil
+}
+
+func setSimple(v reflect.Value, info byte, n uint64) error {
+	if f, ok := readFloat(info, n); ok {
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(f)
+			return nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			// 有的客户端把整数编码成浮点数
+			if f != math.Trunc(f) || v.OverflowInt(int64(f)) {
+				return ErrTypeMismatch
+			}
+			v.SetInt(int64(f))
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if f < 0 || f != math.Trunc(f) || v.OverflowUint(uint64(f)) {
+				return ErrTypeMismatch
+			}
+			v.SetUint(uint64(f))
+			return nil
+		}
+		return ErrTypeMismatch
+	}
+	if v.Kind() == reflect.Bool && (n == simpleFalse&0x1f || n == simpleTrue&0x1f) {
+		v.SetBool(n == simpleTrue&0x1f)
+		return nil
+	}
+
+	return ErrTypeMismatch
+}
+
+func (this *decoder) decodeArray(v reflect.Value, info byte, n uint64) error {
+	err := this.enter()
+	if err != nil {
+		return err
+	}
+	defer this.leave()
+	indefinite := info == infoIndefinite
+	if !indefinite {
+		err = this.checkCount(n)
+		if err != nil {
+			return err
+		}
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		capacity := int(n)
+		slice := reflect.MakeSlice(v.Type(), 0, capacity)
+		for i := 0; indefinite || i < int(n); i++ {
+			if indefinite {
+				end, err := this.isBreak()
+				if err != nil {
+					return err
+				}
+				if end {
+					break
+				}
+			}
+			slice = reflect.Append(slice, reflect.Zero(v.Type().Elem()))
+			err = this.decode(slice.Index(i), false)
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Array:
+		for i := 0; indefinite || i < int(n); i++ {
+			if indefinite {
+				end, err := this.isBreak()
+				if err != nil {
+					return err
+				}
+				if end {
+					break
+				}
+			}
+			if i < v.Len() {
+				err = this.decode(v.Index(i), false)
+			} else {
+				_, err = this.decodeAny()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return ErrTypeMismatch
+	}
+
+	return nil
+}
+
+func (this *decoder) decodeMap(v reflect.Value, info byte, n uint64) error {
+	err := this.enter()
+	if err != nil {
+		return err
+	}
+	defer this.leave()
+	indefinite := info == infoIndefinite
+	if !indefinite {
+		err = this.checkCount(n)
+		if err != nil {
+			return err
+		}
+	}
+	var structInfo *structInfo
+	switch v.Kind() {
+	case reflect.Struct:
+		structInfo = getStructInfo(v.Type())
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return ErrTypeMismatch
+	}
+	for i := 0; indefinite || i < int(n); i++ {
+		if indefinite {
+			end, err := this.isBreak()
+			if err != nil {
+				return err
+			}
+			if end {
+				break
+			}
+		}
+		key, err := this.readKey()
+		if err != nil {
+			return err
+		}
+		if structInfo != nil {
+			f := structInfo.fieldByName(key)
+			if f == nil {
+				_, err = this.decodeAny()
+			} else {
+				err = this.decode(v.FieldByIndex(f.index), f.base64)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		kv, err := mapKey(v.Type().Key(), key)
+		if err != nil {
+			return err
+		}
+		ev := reflect.New(v.Type().Elem()).Elem()
+		err = this.decode(ev, false)
+		if err != nil {
+			return err
+		}
+		v.SetMapIndex(kv, ev)
+	}
+
+	return nil
+}
+
+// readKey 映射的键，文本串或者整数
+func (this *decoder) readKey() (string, error) {
+	key, err := this.decodeAny()
+	if err != nil {
+		return "", err
+	}
+	switch k := key.(type) {
+	case string:
+		return k, nil
+	case float64:
+		return strconv.FormatFloat(k, 'f', -1, 64), nil
+	}
+
+	return "", errors.New("CborInvalidMapKey")
+}
+
+func mapKey(t reflect.Type, key string) (reflect.Value, error) {
+	kv := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		kv.SetString(key)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(key, 10, 64)
+		if err != nil || kv.OverflowInt(i) {
+			return kv, errors.New("CborInvalidMapKey")
+		}
+		kv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(key, 10, 64)
+		if err != nil || kv.OverflowUint(u) {
+			return kv, errors.New("CborInvalidMapKey")
+		}
+		kv.SetUint(u)
+	default:
+		return kv, errors.New("CborInvalidMapKey")
+	}
+
+	return kv, nil
+}
+
+/*
+*
+解码成通用的对象，与json一致：数字是float64，数组是[]interface{}，映射是map[string]interface{}，
+日期时间是字符串，字节串是[]byte
+*/
+func (this *decoder) decodeAny() (interface{}, error) {
+	major, info, n, err := this.readHead()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case majorUint:
+		return float64(n), nil
+	case majorNegint:
+		return -float64(n) - 1, nil
+	case majorBytes:
+		b, err := this.readString(major, info, n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, b...), nil
+	case majorText:
+		b, err := this.readString(major, info, n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case majorArray:
+		var array []interface{}
+		err = this.decodeArray(reflect.ValueOf(&array).Elem(), info, n)
+		return array, err
+	case majorMap:
+		m := make(map[string]interface{})
+		err = this.decodeMap(reflect.ValueOf(&m).Elem(), info, n)
+		return m, err
+	case majorTag:
+		err = this.enter()
+		if err != nil {
+			return nil, err
+		}
+		defer this.leave()
+		return this.decodeAny()
+	case majorSimple:
+		if f, ok := readFloat(info, n); ok {
+			return f, nil
+		}
+		switch n {
+		case simpleFalse & 0x1f:
+			return false, nil
+		case simpleTrue & 0x1f:
+			return true, nil
+		case simpleNull & 0x1f, (simpleNull + 1) & 0x1f:
+			return nil, nil
+		}
+	}
+
+	return nil, errors.New("CborUnsupportedItem")
+}
@@ -0,0 +1,145 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/util/message"
+	"strings"
+	"sync"
+)
+
+/*
+*
+ChainMessage和负载的编码：
+1.json是原来的编码，老的客户端和节点只支持json
+2.cbor是紧凑的二进制编码（RFC 8949），字段名与json的标记一致，标记了codec:"base64"的字符串字段
+（比如TransportPayload）直接使用原始字节，不再有base64的膨胀
+3.二进制编码以cbor的自描述标记0xd9d9f7开头，json不会以这个字节开头，接收的时候自动识别，
+所以同一个连接上两种编码都可以接收，发送的时候使用连接协商的编码
+4.libp2p的管道通过协议编号的后缀协商，websocket通过子协议协商，没有协商的连接使用json
+5.转发节点不解码负载，TransportPayload的字节原样转发，只按照下一个连接的编码序列化消息的外层
+*/
+const (
+	Codec_Json = "json"
+	Codec_Cbor = "cbor"
+)
+
+// cbor的自描述标记，tag 55799
+var cborMagic = []byte{0xd9, 0xd9, 0xf7}
+
+// websocket子协议的前缀，比如colla.cbor
+const subprotocolPrefix = "colla."
+
+var enable = true
+
+func init() {
+	enable, _ = config.GetBool("p2p.codec.enable", true)
+}
+
+// Enable 是否在协商的时候提供二进制编码
+func Enable() bool {
+	return enable
+}
+
+// Codecs 协商时提供的编码，优先的在前面
+func Codecs() []string {
+	if !enable {
+		return []string{Codec_Json}
+	}
+
+	return []string{Codec_Cbor, Codec_Json}
+}
+
+// IsBinary 数据是否是二进制编码
+func IsBinary(data []byte) bool {
+	return bytes.HasPrefix(data, cborMagic)
+}
+
+// CodecOf 识别数据的编码
+func CodecOf(data []byte) string {
+	if IsBinary(data) {
+		return Codec_Cbor
+	}
+
+	return Codec_Json
+}
+
+/*
+*
+按照指定的编码序列化，不认识的编码使用json
+*/
+func Marshal(codec string, v interface{}) ([]byte, error) {
+	if codec == Codec_Cbor {
+		return marshalCbor(v)
+	}
+
+	return message.Marshal(v)
+}
+
+/*
+*
+反序列化，自动识别编码
+*/
+func Unmarshal(data []byte, v interface{}) error {
+	if IsBinary(data) {
+		return unmarshalCbor(data, v)
+	}
+
+	return message.Unmarshal(data, v)
+}
+
+// Subprotocols websocket握手时服务端支持的子协议，优先的在前面
+func Subprotocols() []string {
+	codecs := Codecs()
+	subprotocols := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		subprotocols = append(subprotocols, subprotocolPrefix+codec)
+	}
+
+	return subprotocols
+}
+
+// CodecOfSubprotocol websocket协商的子协议对应的编码，没有协商子协议的是json
+func CodecOfSubprotocol(subprotocol string) string {
+	if strings.HasPrefix(subprotocol, subprotocolPrefix) {
+		codec := strings.TrimPrefix(subprotocol, subprotocolPrefix)
+		if codec == Codec_Cbor {
+			return Codec_Cbor
+		}
+	}
+
+	return Codec_Json
+}
+
+/*
+*
+按照编码缓存序列化的结果，同一个消息写到多个连接的时候每种编码只序列化一次
+*/
+type Encoded struct {
+	v     interface{}
+	mutex sync.Mutex
+	data  map[string][]byte
+}
+
+func NewEncoded(v interface{}) *Encoded {
+	return &Encoded{v: v, data: make(map[string][]byte, 2)}
+}
+
+func (this *Encoded) Marshal(codec string) ([]byte, error) {
+	if codec != Codec_Cbor {
+		codec = Codec_Json
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	data, ok := this.data[codec]
+	if ok {
+		return data, nil
+	}
+	data, err := Marshal(codec, this.v)
+	if err != nil {
+		return nil, err
+	}
+	this.data[codec] = data
+
+	return data, nil
+}
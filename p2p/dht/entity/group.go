@@ -0,0 +1,87 @@
+package entity
+
+import (
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"time"
+)
+
+/*
+*
+群组，与PeerClient一样发布在DHT中，按照GroupId保存
+每次修改成员Version加一，修改者（群主或者管理员）对群组签名，SignerPeerId是签名者
+连接节点根据成员列表为群组消息分发，客户端不再自己逐个发送
+*/
+type Group struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	GroupId               string     `xorm:"varchar(255)" json:"groupId,omitempty"`
+	Name                  string     `xorm:"varchar(255)" json:"name,omitempty"`
+	OwnerPeerId           string     `xorm:"varchar(255)" json:"ownerPeerId,omitempty"`
+	Admins                []string   `xorm:"json" json:"admins,omitempty"`
+	Members               []string   `xorm:"json" json:"members,omitempty"`
+	Version               int64      `json:"version,omitempty"`
+	SignerPeerId          string     `xorm:"varchar(255)" json:"signerPeerId,omitempty"`
+	Signature             string     `xorm:"varchar(1024)" json:"signature,omitempty"`
+	LastUpdateTime        *time.Time `json:"lastUpdateTime,omitempty"`
+}
+
+func (Group) TableName() string {
+	return "blc_group"
+}
+
+func (Group) KeyName() string {
+	return "GroupId"
+}
+
+func (Group) IdName() string {
+	return baseentity.FieldName_Id
+}
+
+/*
+*
+peerId是否是群组成员，群主总是成员
+*/
+func (this *Group) IsMember(peerId string) bool {
+	if this.OwnerPeerId == peerId {
+		return true
+	}
+	for _, member := range this.Members {
+		if member == peerId {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+*
+群主和所有成员
+*/
+func (this *Group) PeerIds() []string {
+	peerIds := make([]string, 0, len(this.Members)+1)
+	peerIds = append(peerIds, this.OwnerPeerId)
+	for _, member := range this.Members {
+		if member != this.OwnerPeerId {
+			peerIds = append(peerIds, member)
+		}
+	}
+
+	return peerIds
+}
+
+/*
+*
+peerId是否可以修改群组，群主或者管理员
+*/
+func (this *Group) IsAdmin(peerId string) bool {
+	if this.OwnerPeerId == peerId {
+		return true
+	}
+	for _, admin := range this.Admins {
+		if admin == peerId {
+			return true
+		}
+	}
+
+	return false
+}
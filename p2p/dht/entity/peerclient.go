@@ -42,11 +42,14 @@ type PeerClient struct {
 	ClientId         string `xorm:"varchar(255)" json:"clientId,omitempty"`
 	ClientDevice     string `xorm:"varchar(255)" json:"clientDevice,omitempty"`
 	ClientType       string `xorm:"varchar(255)" json:"clientType,omitempty"`
-	DeviceToken      string `xorm:"varchar(255)" json:"deviceToken,omitempty"`
+	DeviceToken      string `xorm:"varchar(1024)" json:"deviceToken,omitempty"`
 	Language         string `xorm:"varchar(255)" json:"language,omitempty"`
 	MobileVerified   string `xorm:"varchar(255)" json:"mobileVerified,omitempty"`
-	// 可见性YYYYY (peerId、mobileNumber、groupChat、qrCode、contactCard）
+	// 可见性YYYYYY (peerId、mobileNumber、groupChat、qrCode、contactCard、presence）
 	VisibilitySetting string `xorm:"varchar(255)" json:"visibilitySetting,omitempty"`
+	// 客户端连接时声明的协议版本和能力，连接后是与节点协商的结果，老的客户端为空
+	ProtocolVersion int      `json:"protocolVersion,omitempty"`
+	Capabilities    []string `xorm:"json" json:"capabilities,omitempty"`
 
 	LastUpdateTime             *time.Time `json:"lastUpdateTime,omitempty"`
 	LastAccessTime             *time.Time `json:"lastAccessTime,omitempty"`
@@ -80,3 +83,28 @@ func (PeerClient) KeyName() string {
 func (PeerClient) IdName() string {
 	return baseentity.FieldName_Id
 }
+
+/*
+*
+VisibilitySetting每一位对应的可见性，N表示不可见，没有设置的位可见
+*/
+const (
+	Visibility_PeerId      = 0
+	Visibility_Mobile      = 1
+	Visibility_GroupChat   = 2
+	Visibility_QrCode      = 3
+	Visibility_ContactCard = 4
+	Visibility_Presence    = 5
+)
+
+/*
+*
+VisibilitySetting的第index位是否可见
+*/
+func (this *PeerClient) IsVisible(index int) bool {
+	if index < 0 || index >= len(this.VisibilitySetting) {
+		return true
+	}
+
+	return this.VisibilitySetting[index] != 'N'
+}
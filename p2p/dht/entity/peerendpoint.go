@@ -7,6 +7,9 @@ type PeerEndpoint struct {
 	EndpointType     string `xorm:"varchar(255)" json:"endpointType,omitempty"`
 	DiscoveryAddress string `xorm:"varchar(255)" json:"discoveryAddress,omitempty"`
 	Sdp              string `xorm:"varchar(3096)" json:"sdp,omitempty"`
+	// 节点发布的是自己支持的协议版本和能力，握手以后本地保存的是与本节点协商的结果，老的节点为空
+	ProtocolVersion int      `json:"protocolVersion,omitempty"`
+	Capabilities    []string `xorm:"json" json:"capabilities,omitempty"`
 }
 
 func (PeerEndpoint) TableName() string {
@@ -0,0 +1,35 @@
+package entity
+
+import (
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"time"
+)
+
+/*
+*
+前向安全会话的预共享密钥包，与PeerClient一样发布在DHT中，按照PeerId保存
+IdentityKey是X25519的身份公钥，SignedPreKey是定期更换的X25519预共享公钥，都是base64编码
+Signature是peer的openpgp私钥对身份公钥和预共享公钥的签名，使用者用PeerClient或者PeerEndpoint的公钥校验
+DHT的记录无法原子地消费，因此不发布一次性预共享密钥
+*/
+type PreKeyBundle struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	PeerId                string     `xorm:"varchar(255)" json:"peerId,omitempty"`
+	IdentityKey           string     `xorm:"varchar(255)" json:"identityKey,omitempty"`
+	SignedPreKeyId        int64      `json:"signedPreKeyId,omitempty"`
+	SignedPreKey          string     `xorm:"varchar(255)" json:"signedPreKey,omitempty"`
+	Signature             string     `xorm:"varchar(1024)" json:"signature,omitempty"`
+	LastUpdateTime        *time.Time `json:"lastUpdateTime,omitempty"`
+}
+
+func (PreKeyBundle) TableName() string {
+	return "blc_prekeybundle"
+}
+
+func (PreKeyBundle) KeyName() string {
+	return "PeerId"
+}
+
+func (PreKeyBundle) IdName() string {
+	return baseentity.FieldName_Id
+}
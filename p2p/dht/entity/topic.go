@@ -0,0 +1,64 @@
+package entity
+
+import (
+	baseentity "github.com/curltech/go-colla-core/entity"
+	"time"
+)
+
+// TopicAcl_Anyone 发布者或者订阅者列表中包含的时候，任何peer都可以发布或者订阅
+const TopicAcl_Anyone = "*"
+
+/*
+*
+主题的访问控制，与群组一样发布在DHT中，按照TopicName保存
+主题的所有者决定谁可以发布和订阅，每次修改Version加一，所有者对访问控制签名
+所有者总是可以发布和订阅
+*/
+type Topic struct {
+	baseentity.BaseEntity `xorm:"extends"`
+	TopicName             string     `xorm:"varchar(255)" json:"topicName,omitempty"`
+	OwnerPeerId           string     `xorm:"varchar(255)" json:"ownerPeerId,omitempty"`
+	Publishers            []string   `xorm:"json" json:"publishers,omitempty"`
+	Subscribers           []string   `xorm:"json" json:"subscribers,omitempty"`
+	Version               int64      `json:"version,omitempty"`
+	Signature             string     `xorm:"varchar(1024)" json:"signature,omitempty"`
+	LastUpdateTime        *time.Time `json:"lastUpdateTime,omitempty"`
+}
+
+func (Topic) TableName() string {
+	return "blc_topic"
+}
+
+func (Topic) KeyName() string {
+	return "TopicName"
+}
+
+func (Topic) IdName() string {
+	return baseentity.FieldName_Id
+}
+
+/*
+*
+peerId是否可以向主题发布消息
+*/
+func (this *Topic) CanPublish(peerId string) bool {
+	return this.OwnerPeerId == peerId || containsPeerId(this.Publishers, peerId)
+}
+
+/*
+*
+peerId是否可以订阅主题
+*/
+func (this *Topic) CanSubscribe(peerId string) bool {
+	return this.OwnerPeerId == peerId || containsPeerId(this.Subscribers, peerId)
+}
+
+func containsPeerId(peerIds []string, peerId string) bool {
+	for _, id := range peerIds {
+		if id == peerId || id == TopicAcl_Anyone {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/container"
+	"github.com/curltech/go-colla-core/service"
+	"github.com/curltech/go-colla-core/util/message"
+	"github.com/curltech/go-colla-node/libp2p/dht"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/p2p/dht/entity"
+)
+
+/*
+*
+同步表结构，服务继承基本服务的方法
+*/
+type GroupService struct {
+	PeerEntityService
+}
+
+var groupService = &GroupService{}
+
+func GetGroupService() *GroupService {
+	return groupService
+}
+
+func (svc *GroupService) GetSeqName() string {
+	return seqname
+}
+
+func (svc *GroupService) NewEntity(data []byte) (interface{}, error) {
+	group := &entity.Group{}
+	if data == nil {
+		return group, nil
+	}
+	err := message.Unmarshal(data, group)
+	if err != nil {
+		return nil, err
+	}
+
+	return group, err
+}
+
+func (svc *GroupService) NewEntities(data []byte) (interface{}, error) {
+	entities := make([]*entity.Group, 0)
+	if data == nil {
+		return &entities, nil
+	}
+	err := message.Unmarshal(data, &entities)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entities, err
+}
+
+func init() {
+	_ = service.GetSession().Sync(new(entity.Group))
+	groupService.OrmBaseService.GetSeqName = groupService.GetSeqName
+	groupService.OrmBaseService.FactNewEntity = groupService.NewEntity
+	groupService.OrmBaseService.FactNewEntities = groupService.NewEntities
+	container.RegistService(ns.Group_Prefix, groupService)
+}
+
+/*
+*
+分布式查找群组，有多个的时候返回成员版本最高的
+*/
+func (svc *GroupService) GetValue(groupId string) (*entity.Group, error) {
+	key := ns.GetGroupKey(groupId)
+	buf, err := dht.PeerEndpointDHT.GetValue(key)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]*entity.Group, 0)
+	err = message.Unmarshal(buf, &groups)
+	if err != nil {
+		group := &entity.Group{}
+		err = message.Unmarshal(buf, group)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	var latest *entity.Group
+	for _, group := range groups {
+		if group.GroupId != groupId {
+			continue
+		}
+		if latest == nil || group.Version > latest.Version {
+			latest = group
+		}
+	}
+	if latest == nil {
+		return nil, errors.New("NoGroup")
+	}
+
+	return latest, nil
+}
+
+/*
+*
+本地保存的群组，有多个的时候返回成员版本最高的，没有的返回nil
+*/
+func (svc *GroupService) GetLocal(groupId string) (*entity.Group, error) {
+	key := ns.GetGroupKey(groupId)
+	rec, err := dht.PeerEndpointDHT.GetLocal(key)
+	if err != nil || rec == nil {
+		return nil, err
+	}
+	groups := make([]*entity.Group, 0)
+	err = message.Unmarshal(rec.GetValue(), &groups)
+	if err != nil {
+		group := &entity.Group{}
+		err = message.Unmarshal(rec.GetValue(), group)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	var latest *entity.Group
+	for _, group := range groups {
+		if group.GroupId == groupId && (latest == nil || group.Version > latest.Version) {
+			latest = group
+		}
+	}
+
+	return latest, nil
+}
+
+func (svc *GroupService) PutValue(group *entity.Group) error {
+	key := ns.GetGroupKey(group.GroupId)
+	value, err := message.Marshal(group)
+	if err != nil {
+		return err
+	}
+
+	return dht.PeerEndpointDHT.PutValue(key, value)
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/container"
+	"github.com/curltech/go-colla-core/service"
+	"github.com/curltech/go-colla-core/util/message"
+	"github.com/curltech/go-colla-node/libp2p/dht"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/p2p/dht/entity"
+)
+
+/*
+*
+同步表结构，服务继承基本服务的方法
+*/
+type PreKeyBundleService struct {
+	PeerEntityService
+}
+
+var preKeyBundleService = &PreKeyBundleService{}
+
+func GetPreKeyBundleService() *PreKeyBundleService {
+	return preKeyBundleService
+}
+
+func (svc *PreKeyBundleService) GetSeqName() string {
+	return seqname
+}
+
+func (svc *PreKeyBundleService) NewEntity(data []byte) (interface{}, error) {
+	preKeyBundle := &entity.PreKeyBundle{}
+	if data == nil {
+		return preKeyBundle, nil
+	}
+	err := message.Unmarshal(data, preKeyBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return preKeyBundle, err
+}
+
+func (svc *PreKeyBundleService) NewEntities(data []byte) (interface{}, error) {
+	entities := make([]*entity.PreKeyBundle, 0)
+	if data == nil {
+		return &entities, nil
+	}
+	err := message.Unmarshal(data, &entities)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entities, err
+}
+
+func init() {
+	_ = service.GetSession().Sync(new(entity.PreKeyBundle))
+	preKeyBundleService.OrmBaseService.GetSeqName = preKeyBundleService.GetSeqName
+	preKeyBundleService.OrmBaseService.FactNewEntity = preKeyBundleService.NewEntity
+	preKeyBundleService.OrmBaseService.FactNewEntities = preKeyBundleService.NewEntities
+	container.RegistService(ns.PreKeyBundle_Prefix, preKeyBundleService)
+}
+
+/*
+*
+分布式查找peer发布的预共享密钥包，有多个的时候返回校验通过的最新的，
+校验不通过的包是伪造的，跳过
+*/
+func (svc *PreKeyBundleService) GetValue(peerId string, verify func(preKeyBundle *entity.PreKeyBundle) error) (*entity.PreKeyBundle, error) {
+	key := ns.GetPreKeyBundleKey(peerId)
+	buf, err := dht.PeerEndpointDHT.GetValue(key)
+	if err != nil {
+		return nil, err
+	}
+	preKeyBundles := make([]*entity.PreKeyBundle, 0)
+	err = message.Unmarshal(buf, &preKeyBundles)
+	if err != nil {
+		preKeyBundle := &entity.PreKeyBundle{}
+		err = message.Unmarshal(buf, preKeyBundle)
+		if err != nil {
+			return nil, err
+		}
+		preKeyBundles = append(preKeyBundles, preKeyBundle)
+	}
+	var latest *entity.PreKeyBundle
+	err = errors.New("NoPreKeyBundle")
+	for _, preKeyBundle := range preKeyBundles {
+		if preKeyBundle.PeerId != peerId {
+			continue
+		}
+		if latest != nil && (preKeyBundle.LastUpdateTime == nil || latest.LastUpdateTime == nil ||
+			!preKeyBundle.LastUpdateTime.After(*latest.LastUpdateTime)) {
+			continue
+		}
+		verifyErr := verify(preKeyBundle)
+		if verifyErr != nil {
+			err = verifyErr
+			continue
+		}
+		latest = preKeyBundle
+	}
+	if latest == nil {
+		return nil, err
+	}
+
+	return latest, nil
+}
+
+func (svc *PreKeyBundleService) PutValue(preKeyBundle *entity.PreKeyBundle) error {
+	key := ns.GetPreKeyBundleKey(preKeyBundle.PeerId)
+	value, err := message.Marshal(preKeyBundle)
+	if err != nil {
+		return err
+	}
+
+	return dht.PeerEndpointDHT.PutValue(key, value)
+}
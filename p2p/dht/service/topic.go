@@ -0,0 +1,165 @@
+package service
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/container"
+	"github.com/curltech/go-colla-core/service"
+	"github.com/curltech/go-colla-core/util/message"
+	"github.com/curltech/go-colla-node/libp2p/dht"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/p2p/dht/entity"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+/*
+*
+同步表结构，服务继承基本服务的方法
+*/
+type TopicService struct {
+	PeerEntityService
+}
+
+var topicService = &TopicService{}
+
+func GetTopicService() *TopicService {
+	return topicService
+}
+
+func (svc *TopicService) GetSeqName() string {
+	return seqname
+}
+
+func (svc *TopicService) NewEntity(data []byte) (interface{}, error) {
+	topic := &entity.Topic{}
+	if data == nil {
+		return topic, nil
+	}
+	err := message.Unmarshal(data, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return topic, err
+}
+
+func (svc *TopicService) NewEntities(data []byte) (interface{}, error) {
+	entities := make([]*entity.Topic, 0)
+	if data == nil {
+		return &entities, nil
+	}
+	err := message.Unmarshal(data, &entities)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entities, err
+}
+
+func init() {
+	_ = service.GetSession().Sync(new(entity.Topic))
+	topicService.OrmBaseService.GetSeqName = topicService.GetSeqName
+	topicService.OrmBaseService.FactNewEntity = topicService.NewEntity
+	topicService.OrmBaseService.FactNewEntities = topicService.NewEntities
+	container.RegistService(ns.Topic_Prefix, topicService)
+}
+
+// ErrNoTopic 主题没有发布访问控制
+var ErrNoTopic = errors.New("NoTopic")
+
+func unmarshalTopics(value []byte, topicName string) ([]*entity.Topic, error) {
+	topics := make([]*entity.Topic, 0)
+	err := message.Unmarshal(value, &topics)
+	if err != nil {
+		topic := &entity.Topic{}
+		err = message.Unmarshal(value, topic)
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	result := make([]*entity.Topic, 0, len(topics))
+	for _, topic := range topics {
+		if topic.TopicName == topicName {
+			result = append(result, topic)
+		}
+	}
+
+	return result, nil
+}
+
+/*
+*
+分布式查找主题的访问控制的所有记录，没有发布的返回ErrNoTopic，由调用者校验签名
+*/
+func (svc *TopicService) GetValues(topicName string) ([]*entity.Topic, error) {
+	key := ns.GetTopicKey(topicName)
+	buf, err := dht.PeerEndpointDHT.GetValue(key)
+	if errors.Is(err, routing.ErrNotFound) {
+		return nil, ErrNoTopic
+	}
+	if err != nil {
+		return nil, err
+	}
+	topics, err := unmarshalTopics(buf, topicName)
+	if err != nil {
+		return nil, err
+	}
+	if len(topics) == 0 {
+		return nil, ErrNoTopic
+	}
+
+	return topics, nil
+}
+
+/*
+*
+分布式查找主题的访问控制，有多个的时候返回版本最高的
+*/
+func (svc *TopicService) GetValue(topicName string) (*entity.Topic, error) {
+	topics, err := svc.GetValues(topicName)
+	if err != nil {
+		return nil, err
+	}
+	var latest *entity.Topic
+	for _, topic := range topics {
+		if latest == nil || topic.Version > latest.Version {
+			latest = topic
+		}
+	}
+
+	return latest, nil
+}
+
+/*
+*
+本地保存的主题的访问控制，有多个的时候返回版本最高的，没有的时候返回nil
+*/
+func (svc *TopicService) GetLocal(topicName string) (*entity.Topic, error) {
+	key := ns.GetTopicKey(topicName)
+	rec, err := dht.PeerEndpointDHT.GetLocal(key)
+	if err != nil || rec == nil {
+		return nil, err
+	}
+	topics, err := unmarshalTopics(rec.GetValue(), topicName)
+	if err != nil {
+		return nil, err
+	}
+	var latest *entity.Topic
+	for _, topic := range topics {
+		if latest == nil || topic.Version > latest.Version {
+			latest = topic
+		}
+	}
+
+	return latest, nil
+}
+
+func (svc *TopicService) PutValue(topic *entity.Topic) error {
+	key := ns.GetTopicKey(topic.TopicName)
+	value, err := message.Marshal(topic)
+	if err != nil {
+		return err
+	}
+
+	return dht.PeerEndpointDHT.PutValue(key, value)
+}
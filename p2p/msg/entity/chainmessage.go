@@ -40,6 +40,15 @@ type ChainMessage struct {
 	TargetConnectSessionId string `xorm:"varchar(255)" json:"targetConnectSessionId,omitempty"`
 	TargetConnectPeerId    string `xorm:"varchar(255)" json:"targetConnectPeerId,omitempty"`
 	TargetConnectAddress   string `xorm:"varchar(255)" json:"targetConnectAddress,omitempty"`
+	/**
+	 * 多个接收者的消息，payload只加密一次，每个接收者有自己的PayloadKeys条目
+	 * 转发节点为每个接收者复制一份消息并填写TargetPeerId，密文不变
+	 */
+	TargetPeerIds []string `xorm:"json" json:"targetPeerIds,omitempty"`
+	/**
+	 * 群组消息的目标群组，连接节点根据群组成员分发，为每个成员复制一份消息并填写TargetPeerId
+	 */
+	TargetGroupId string `xorm:"varchar(255)" json:"targetGroupId,omitempty"`
 	/**
 	src字段,SrcConnectSessionId在发送的时候不填，到接收端自动填充，表示src的连接peerendpoint
 	最初的发送peerclient信息，在最初连接节点接收的时候填写
@@ -60,14 +69,19 @@ type ChainMessage struct {
 	/**
 	 * 经过目标peer的公钥加密过的对称秘钥，这个对称秘钥是随机生成，每次不同，用于加密payload
 	 */
-	PayloadKey      string                  `xorm:"varchar(255)" json:"payloadKey,omitempty"`
+	PayloadKey string `xorm:"varchar(255)" json:"payloadKey,omitempty"`
+	/**
+	 * 多个接收者的时候，对称秘钥经过每个接收者公钥加密，这时PayloadKey为空
+	 */
+	PayloadKeys     []*PayloadKey           `xorm:"json" json:"payloadKeys,omitempty"`
 	NeedCompress    bool                    `json:"needCompress,omitempty"`
 	NeedEncrypt     bool                    `json:"needEncrypt,omitempty"`
 	SecurityContext *crypto.SecurityContext `xorm:"-" json:"securityContext,omitempty"`
 	/**
 	 * 消息负载序列化后的寄送格式，再经过客户端自己的加密方式比如openpgp（更安全）加密，签名，压缩，base64处理后的字符串
+	 * 二进制编码的时候直接传输base64之前的字节
 	 */
-	TransportPayload string `xorm:"text" json:"transportPayload,omitempty"`
+	TransportPayload string `xorm:"text" json:"transportPayload,omitempty" codec:"base64"`
 	/**
 	 * 不跨网络传输，是transportPayload检验过后还原的对象，传输时通过转换成transportPayload传输
 	 */
@@ -78,6 +92,10 @@ type ChainMessage struct {
 	 */
 	PayloadSignature                  string `json:"payloadSignature,omitempty"`
 	PreviousPublicKeyPayloadSignature string `json:"previousPublicKeyPayloadSignature,omitempty"`
+	/**
+	 * 源peer对UUID，CreateTimestamp，源和目标，消息类型和TransportPayload摘要的签名，用于防重放
+	 */
+	MessageSignature string `xorm:"text" json:"messageSignature,omitempty"`
 	/**
 	 * 根据此字段来把TransportPayload对应的字节还原成Payload的对象，最简单的就是字符串
 	 * 也可以是一个复杂的结构，但是dht的数据结构（peerendpoint），通用网络块存储（datablock）一般不用这种方式操作
@@ -86,6 +104,69 @@ type ChainMessage struct {
 	PayloadType     string     `json:"payloadType,omitempty"`
 	CreateTimestamp *time.Time `json:"createTimestamp,omitempty"`
 	StatusCode      int        `json:"statusCode,omitempty"`
+	/**
+	 * 还可以转发的次数，每经过一个转发节点减一，为0的时候不再转发
+	 */
+	Ttl int `json:"ttl,omitempty"`
+	/**
+	 * 经过的转发节点，每个转发节点追加自己的签名，用于拒绝循环转发
+	 */
+	Hops []*Hop `xorm:"json" json:"hops,omitempty"`
+	/**
+	 * 使用前向安全会话加密的时候的消息头，这时PayloadKey为空
+	 */
+	SessionHeader *SessionHeader `xorm:"json" json:"sessionHeader,omitempty"`
+	/**
+	 * 以下字段只用于本地保存的待转发队列，不跨网络传输
+	 */
+	QueueStatus     string     `xorm:"varchar(32)" json:"-"`
+	Attempts        int        `json:"-"`
+	NextAttemptTime *time.Time `json:"-"`
+	LastAttemptTime *time.Time `json:"-"`
+	ExpireTime      *time.Time `json:"-"`
+	QueueError      string     `xorm:"varchar(255)" json:"-"`
+	// 接收的编码，回应和负载使用同样的编码，为空的时候是json
+	Codec string `xorm:"-" json:"-"`
+}
+
+/**
+待转发队列中消息的状态
+*/
+const (
+	QueueStatus_Queued    = "Queued"
+	QueueStatus_Sending   = "Sending"
+	QueueStatus_Delivered = "Delivered"
+	QueueStatus_Expired   = "Expired"
+)
+
+/**
+转发节点的记录，签名覆盖消息的UUID，上一个签名，节点和时间，形成签名链
+*/
+type Hop struct {
+	PeerId    string `json:"peerId,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+/**
+多个接收者的消息中，经过某个接收者公钥加密的对称秘钥，参照DataBlock的TransactionKey
+*/
+type PayloadKey struct {
+	PeerId     string `json:"peerId,omitempty"`
+	PayloadKey string `json:"payloadKey,omitempty"`
+}
+
+/**
+前向安全会话的消息头，RatchetKey，PreviousCount和Count是Double Ratchet的消息头
+会话的发起方在收到对方的消息之前，每个消息都带上X3DH的参数：身份公钥，临时公钥和使用的预共享公钥编号
+*/
+type SessionHeader struct {
+	IdentityKey    string `json:"identityKey,omitempty"`
+	EphemeralKey   string `json:"ephemeralKey,omitempty"`
+	SignedPreKeyId int64  `json:"signedPreKeyId,omitempty"`
+	RatchetKey     string `json:"ratchetKey,omitempty"`
+	PreviousCount  uint32 `json:"previousCount,omitempty"`
+	Count          uint32 `json:"count,omitempty"`
 }
 
 func (this *ChainMessage) Marshal() ([]byte, error) {
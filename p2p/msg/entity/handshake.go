@@ -0,0 +1,15 @@
+package entity
+
+/*
+*
+握手交换的协议版本和能力，请求是发起方声明的，回应是协商的结果
+回应中Error不为空表示协商失败，比如版本不兼容
+*/
+type Handshake struct {
+	PeerId             string   `json:"peerId,omitempty"`
+	ClientId           string   `json:"clientId,omitempty"`
+	ProtocolVersion    int      `json:"protocolVersion,omitempty"`
+	MinProtocolVersion int      `json:"minProtocolVersion,omitempty"`
+	Capabilities       []string `json:"capabilities,omitempty"`
+	Error              string   `json:"error,omitempty"`
+}
@@ -0,0 +1,15 @@
+package entity
+
+/*
+*
+客户端登录：第一次请求只有PeerId和ClientId，节点回应Nonce，
+第二次请求带上Nonce和用PeerPublicKey对应的私钥的签名，节点校验以后绑定连接会话
+PeerPublicKey可选，节点只使用保存的这个peerId的公钥校验，提供的公钥必须与保存的一致
+*/
+type Login struct {
+	PeerId        string `json:"peerId,omitempty"`
+	ClientId      string `json:"clientId,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+	PeerPublicKey string `json:"peerPublicKey,omitempty"`
+	Signature     string `json:"signature,omitempty"`
+}
@@ -0,0 +1,17 @@
+package entity
+
+import (
+	"time"
+)
+
+/*
+*
+客户端的在线状态，由客户端连接的节点在连接和断开的时候发布
+同一个peerId的多个客户端分别发布，ActiveStatus是Up或者Down，LastAccessTime是最后在线的时间
+*/
+type Presence struct {
+	PeerId         string     `json:"peerId,omitempty"`
+	ClientId       string     `json:"clientId,omitempty"`
+	ActiveStatus   string     `json:"activeStatus,omitempty"`
+	LastAccessTime *time.Time `json:"lastAccessTime,omitempty"`
+}
@@ -0,0 +1,48 @@
+package entity
+
+import (
+	"github.com/curltech/go-colla-core/entity"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
+)
+
+/*
+*
+消息的回执，按照原消息的UUID和接收者关联，Status是回执的状态，StatusDate是状态的时间
+在生成回执的节点和原发送者的连接节点保存，原发送者可以查询离线期间发送的消息的回执
+*/
+type Receipt struct {
+	entity.StatusEntity `xorm:"extends"`
+	// 原消息的UUID
+	UUID        string `xorm:"varchar(255)" json:"uuid,omitempty"`
+	MessageType string `xorm:"varchar(255)" json:"messageType,omitempty"`
+	// 原消息的发送者，回执发回的目标
+	SrcPeerId string `xorm:"varchar(255)" json:"srcPeerId,omitempty"`
+	// 原消息的接收者
+	TargetPeerId   string `xorm:"varchar(255)" json:"targetPeerId,omitempty"`
+	TargetClientId string `xorm:"varchar(255)" json:"targetClientId,omitempty"`
+}
+
+func (Receipt) TableName() string {
+	return "blc_receipt"
+}
+
+func (Receipt) IdName() string {
+	return entity.FieldName_Id
+}
+
+/*
+*
+回执状态的先后顺序，未知的状态为0
+*/
+func ReceiptRank(status string) int {
+	switch status {
+	case msgtype.RECEIPT_DELIVERED_NODE:
+		return 1
+	case msgtype.RECEIPT_DELIVERED_DEVICE:
+		return 2
+	case msgtype.RECEIPT_READ:
+		return 3
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,48 @@
+package entity
+
+import (
+	"github.com/curltech/go-colla-core/entity"
+)
+
+/*
+*
+与对方peer的前向安全会话，State是Double Ratchet的状态（JSON），每次加密解密后更新
+*/
+type Session struct {
+	entity.BaseEntity `xorm:"extends"`
+	PeerId            string `xorm:"varchar(255)" json:"peerId,omitempty"`
+	State             string `xorm:"text" json:"-"`
+}
+
+func (Session) TableName() string {
+	return "blc_session"
+}
+
+func (Session) IdName() string {
+	return entity.FieldName_Id
+}
+
+const (
+	SessionKeyType_Identity = "Identity"
+	SessionKeyType_PreKey   = "PreKey"
+)
+
+/*
+*
+自己的会话密钥，X25519的身份密钥和定期更换的预共享密钥，base64编码
+*/
+type SessionKey struct {
+	entity.BaseEntity `xorm:"extends"`
+	KeyType           string `xorm:"varchar(32)" json:"keyType,omitempty"`
+	KeyId             int64  `json:"keyId,omitempty"`
+	PrivateKey        string `xorm:"varchar(255)" json:"-"`
+	PublicKey         string `xorm:"varchar(255)" json:"publicKey,omitempty"`
+}
+
+func (SessionKey) TableName() string {
+	return "blc_sessionkey"
+}
+
+func (SessionKey) IdName() string {
+	return entity.FieldName_Id
+}
@@ -1,49 +1,93 @@
 package biz
 
 import (
+	"context"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/p2p/chain/handler"
 	"github.com/curltech/go-colla-node/p2p/chain/handler/sender"
+	service3 "github.com/curltech/go-colla-node/p2p/chain/service"
 	"github.com/curltech/go-colla-node/p2p/dht/entity"
 	entity3 "github.com/curltech/go-colla-node/p2p/msg/entity"
 	service2 "github.com/curltech/go-colla-node/p2p/msg/service"
 	"github.com/robfig/cron"
-	"time"
+	"net/http"
 )
 
-// RelaySend 发送保存的转发消息，并把转发的消息删除
+// RelaySend 接收者上线的时候发送保存的转发消息
 func RelaySend(peerClient *entity.PeerClient) error {
-	targetPeerId := peerClient.PeerId
-	chainMessages := make([]*entity3.ChainMessage, 0)
-	err := service2.GetChainMessageService().Find(&chainMessages, nil, "", 0, 0, "targetPeerId=?", targetPeerId)
+	chainMessages, err := service2.GetChainMessageService().FindDue(peerClient.PeerId, 0)
 	if err != nil {
 		return err
 	}
 	for _, chainMessage := range chainMessages {
-		//chainMessage.TargetConnectSessionId = peerClient.ConnectSessionId
-		//chainMessage.TargetConnectPeerId = peerClient.ConnectPeerId
-		//chainMessage.TargetConnectAddress = peerClient.ConnectAddress
-		//chainMessage.TargetClientId = peerClient.ClientId
-		go func() {
-			_, err := sender.RelaySend(chainMessage)
-			if err != nil {
+		go deliver(chainMessage)
+	}
+
+	return nil
+}
 
-			}
-		}()
+// Retry 定时重发已经到期的保存消息，先把没有结果的发送中的消息放回队列
+func Retry() {
+	service2.GetChainMessageService().Requeue()
+	chainMessages, err := service2.GetChainMessageService().FindDue("", 100)
+	if err != nil {
+		logger.Sugar.Errorf("FindDue failure: %v", err)
+		return
+	}
+	for _, chainMessage := range chainMessages {
+		go deliver(chainMessage)
 	}
+}
 
-	chainMessage := &entity3.ChainMessage{}
-	_, err = service2.GetChainMessageService().Delete(chainMessage, "targetPeerId=?", targetPeerId)
-	return err
+/*
+*
+发送一个保存的消息并等待接收方的确认，确认后标记为送达，失败则按照退避时间等待下一次重发
+转发节点的确认（202）不会唤醒等待，只有最终目标的回应原路返回以后才标记为送达，
+接收方回应重复的消息（409）说明以前的发送已经收到，同样标记为送达，
+等待不超过lease，超时的按照失败处理
+*/
+func deliver(chainMessage *entity3.ChainMessage) {
+	chainMessageService := service2.GetChainMessageService()
+	if !chainMessageService.Claim(chainMessage) {
+		return
+	}
+	err := handler.RestampHop(chainMessage)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), chainMessageService.Lease())
+		var response *entity3.ChainMessage
+		response, err = sender.RelaySendWithContext(ctx, chainMessage)
+		cancel()
+		//上一次发送已经到达，只是确认丢失，重发的同一UUID的消息作为重复的消息被拒绝
+		if err != nil && response != nil && response.StatusCode == http.StatusConflict {
+			logger.Sugar.Infof("deliver uuid: %v already received", chainMessage.UUID)
+			err = nil
+		}
+	}
+	if err == nil {
+		err = chainMessageService.MarkDelivered(chainMessage)
+		if err != nil {
+			logger.Sugar.Errorf("MarkDelivered uuid: %v failure: %v", chainMessage.UUID, err)
+		}
+		return
+	}
+	logger.Sugar.Warnf("deliver uuid: %v attempts: %v failure: %v", chainMessage.UUID, chainMessage.Attempts, err)
+	err = chainMessageService.MarkFailed(chainMessage, err)
+	if err != nil {
+		logger.Sugar.Errorf("MarkFailed uuid: %v failure: %v", chainMessage.UUID, err)
+	}
 }
 
+// DeleteTimeout 按照保留策略删除送达和过期的消息，过期的回执和消息日志
 func DeleteTimeout() {
-	timeout := time.Now().Add(time.Hour * 24 * 7)
-	chainMessage := &entity3.ChainMessage{}
-	_, _ = service2.GetChainMessageService().Delete(chainMessage, "createDate<=?", &timeout)
+	service2.GetChainMessageService().Purge()
+	service2.GetReceiptService().Purge()
+	service3.GetChainMessageLogService().Purge()
 }
 
 func Cron() *cron.Cron {
 	c := cron.New()
 	_ = c.AddFunc("0 0 2 * * *", DeleteTimeout)
+	_ = c.AddFunc("0 * * * * *", Retry)
 	c.Start()
 
 	return c
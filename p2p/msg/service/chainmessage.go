@@ -1,11 +1,15 @@
 package service
 
 import (
+	"errors"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
 	coreservice "github.com/curltech/go-colla-core/service"
 	"github.com/curltech/go-colla-core/util/message"
 	"github.com/curltech/go-colla-node/p2p/dht/service"
 	entity3 "github.com/curltech/go-colla-node/p2p/msg/entity"
 	"sync"
+	"time"
 )
 
 /**
@@ -56,8 +60,225 @@ func (this *ChainMessageService) NewEntities(data []byte) (interface{}, error) {
 
 func init() {
 	coreservice.GetSession().Sync(new(entity3.ChainMessage))
+	queueQuota, _ = config.GetInt("p2p.chain.queue.quota", 1000)
+	queueExpire, _ = config.GetInt("p2p.chain.queue.expire", 24*7)
+	queueRetention, _ = config.GetInt("p2p.chain.queue.retention", 24)
+	queueBackoff, _ = config.GetInt("p2p.chain.queue.backoff", 30)
+	queueMaxBackoff, _ = config.GetInt("p2p.chain.queue.maxBackoff", 3600)
+	queueLease, _ = config.GetInt("p2p.chain.queue.lease", 60)
 
 	chainMessageService.OrmBaseService.GetSeqName = chainMessageService.GetSeqName
 	chainMessageService.OrmBaseService.FactNewEntity = chainMessageService.NewEntity
 	chainMessageService.OrmBaseService.FactNewEntities = chainMessageService.NewEntities
+	chainMessageService.migrate()
+}
+
+/**
+待转发队列的参数
+quota：每个接收者最多保存的消息数，expire：消息的有效期（小时），retention：已经送达的消息保留的时间（小时）
+backoff：第一次重发的间隔（秒），每次失败加倍，不超过maxBackoff（秒）
+lease：一次发送等待确认的最长时间（秒），发送中的消息超过两个lease没有结果的重新放回队列
+*/
+var (
+	queueQuota      = 1000
+	queueExpire     = 24 * 7
+	queueRetention  = 24
+	queueBackoff    = 30
+	queueMaxBackoff = 3600
+	queueLease      = 60
+)
+
+/**
+一次发送等待确认的最长时间
+*/
+func (this *ChainMessageService) Lease() time.Duration {
+	return time.Second * time.Duration(queueLease)
+}
+
+/**
+以前保存的离线消息没有队列状态和有效期，不会被FindDue找到，启动的时候放入队列，
+有效期从保存的时间开始计算，已经过期的标记为Expired
+*/
+func (this *ChainMessageService) migrate() {
+	for {
+		chainMessages := make([]*entity3.ChainMessage, 0)
+		err := this.Find(&chainMessages, nil, "id", 0, 1000, "queueStatus is null or queueStatus=?", "")
+		if err != nil {
+			logger.Sugar.Errorf("find legacy chainMessage failure: %v", err)
+			return
+		}
+		if len(chainMessages) == 0 {
+			return
+		}
+		currentTime := time.Now()
+		for _, chainMessage := range chainMessages {
+			expireTime := currentTime.Add(time.Hour * time.Duration(queueExpire))
+			if chainMessage.CreateDate != nil {
+				expireTime = chainMessage.CreateDate.Add(time.Hour * time.Duration(queueExpire))
+			}
+			chainMessage.QueueStatus = entity3.QueueStatus_Queued
+			if !expireTime.After(currentTime) {
+				chainMessage.QueueStatus = entity3.QueueStatus_Expired
+			}
+			chainMessage.NextAttemptTime = &currentTime
+			chainMessage.ExpireTime = &expireTime
+			_, err = this.Update(chainMessage, []string{"queueStatus", "nextAttemptTime", "expireTime"}, "id=?", chainMessage.Id)
+			if err != nil {
+				logger.Sugar.Errorf("migrate legacy chainMessage id: %v failure: %v", chainMessage.Id, err)
+				return
+			}
+		}
+		if len(chainMessages) < 1000 {
+			return
+		}
+	}
+}
+
+/**
+保存到待转发队列，同一个接收者同一个UUID的消息只保存一次，超过接收者的配额拒绝
+*/
+func (this *ChainMessageService) Enqueue(chainMessage *entity3.ChainMessage) error {
+	if chainMessage.TargetPeerId == "" {
+		return errors.New("NullTargetPeerId")
+	}
+	if chainMessage.UUID != "" {
+		count, err := this.Count(&entity3.ChainMessage{}, "targetPeerId=? and uuid=?", chainMessage.TargetPeerId, chainMessage.UUID)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+	}
+	count, err := this.Count(&entity3.ChainMessage{}, "targetPeerId=? and queueStatus=?", chainMessage.TargetPeerId, entity3.QueueStatus_Queued)
+	if err != nil {
+		return err
+	}
+	if count >= int64(queueQuota) {
+		return errors.New("QueueQuotaExceeded")
+	}
+	currentTime := time.Now()
+	expireTime := currentTime.Add(time.Hour * time.Duration(queueExpire))
+	chainMessage.Id = 0
+	chainMessage.QueueStatus = entity3.QueueStatus_Queued
+	chainMessage.Attempts = 0
+	chainMessage.NextAttemptTime = &currentTime
+	chainMessage.LastAttemptTime = nil
+	chainMessage.ExpireTime = &expireTime
+	chainMessage.QueueError = ""
+	_, err = this.Insert(chainMessage)
+
+	return err
+}
+
+/**
+查找接收者已经到期需要重发的消息，targetPeerId为空查找所有的接收者
+*/
+func (this *ChainMessageService) FindDue(targetPeerId string, limit int) ([]*entity3.ChainMessage, error) {
+	chainMessages := make([]*entity3.ChainMessage, 0)
+	currentTime := time.Now()
+	var err error
+	if targetPeerId == "" {
+		err = this.Find(&chainMessages, nil, "nextAttemptTime", 0, limit, "queueStatus=? and nextAttemptTime<=? and expireTime>?",
+			entity3.QueueStatus_Queued, &currentTime, &currentTime)
+	} else {
+		err = this.Find(&chainMessages, nil, "nextAttemptTime", 0, limit, "targetPeerId=? and queueStatus=? and expireTime>?",
+			targetPeerId, entity3.QueueStatus_Queued, &currentTime)
+	}
+
+	return chainMessages, err
+}
+
+/**
+把消息的状态从Queued改成Sending，只有一个发送者能够成功，避免同时重发
+*/
+func (this *ChainMessageService) Claim(chainMessage *entity3.ChainMessage) bool {
+	currentTime := time.Now()
+	chainMessage.QueueStatus = entity3.QueueStatus_Sending
+	chainMessage.Attempts++
+	chainMessage.LastAttemptTime = &currentTime
+	affected, err := this.Update(chainMessage, []string{"queueStatus", "attempts", "lastAttemptTime"},
+		"id=? and queueStatus=?", chainMessage.Id, entity3.QueueStatus_Queued)
+	if err != nil || affected == 0 {
+		return false
+	}
+
+	return true
+}
+
+/**
+发送中的消息超过两个lease没有结果（发送的协程异常或者节点在发送中重启），重新放回队列，由定时重发调用
+*/
+func (this *ChainMessageService) Requeue() {
+	stale := time.Now().Add(-2 * this.Lease())
+	chainMessage := &entity3.ChainMessage{QueueStatus: entity3.QueueStatus_Queued}
+	_, err := this.Update(chainMessage, []string{"queueStatus"}, "queueStatus=? and lastAttemptTime<=?", entity3.QueueStatus_Sending, &stale)
+	if err != nil {
+		logger.Sugar.Errorf("Requeue failure: %v", err)
+	}
+}
+
+/**
+收到接收者的确认，标记为已经送达，保留到retention之后删除
+*/
+func (this *ChainMessageService) MarkDelivered(chainMessage *entity3.ChainMessage) error {
+	chainMessage.QueueStatus = entity3.QueueStatus_Delivered
+	chainMessage.QueueError = ""
+	_, err := this.Update(chainMessage, []string{"queueStatus", "queueError"}, "id=?", chainMessage.Id)
+
+	return err
+}
+
+/**
+发送失败或者没有确认，按照指数退避计算下一次发送的时间，过期的标记为Expired
+*/
+func (this *ChainMessageService) MarkFailed(chainMessage *entity3.ChainMessage, cause error) error {
+	currentTime := time.Now()
+	backoff := queueBackoff
+	for i := 1; i < chainMessage.Attempts && backoff < queueMaxBackoff; i++ {
+		backoff = backoff * 2
+	}
+	if backoff > queueMaxBackoff {
+		backoff = queueMaxBackoff
+	}
+	nextAttemptTime := currentTime.Add(time.Second * time.Duration(backoff))
+	chainMessage.NextAttemptTime = &nextAttemptTime
+	chainMessage.QueueStatus = entity3.QueueStatus_Queued
+	if chainMessage.ExpireTime != nil && chainMessage.ExpireTime.Before(nextAttemptTime) {
+		chainMessage.QueueStatus = entity3.QueueStatus_Expired
+	}
+	if cause != nil {
+		chainMessage.QueueError = cause.Error()
+	}
+	_, err := this.Update(chainMessage, []string{"queueStatus", "nextAttemptTime", "queueError"}, "id=?", chainMessage.Id)
+
+	return err
+}
+
+/**
+保留策略：删除已经送达超过retention的消息，已经过期的消息
+*/
+func (this *ChainMessageService) Purge() {
+	currentTime := time.Now()
+	retention := currentTime.Add(-time.Hour * time.Duration(queueRetention))
+	chainMessage := &entity3.ChainMessage{}
+	_, _ = this.Delete(chainMessage, "queueStatus=? and lastAttemptTime<=?", entity3.QueueStatus_Delivered, &retention)
+	_, _ = this.Delete(chainMessage, "queueStatus=?", entity3.QueueStatus_Expired)
+	_, _ = this.Delete(chainMessage, "expireTime<=?", &currentTime)
+}
+
+/**
+接收者的消息队列的状态，用于查询
+*/
+func (this *ChainMessageService) QueueStatus(targetPeerId string) (map[string]int64, error) {
+	result := make(map[string]int64)
+	for _, status := range []string{entity3.QueueStatus_Queued, entity3.QueueStatus_Sending, entity3.QueueStatus_Delivered, entity3.QueueStatus_Expired} {
+		count, err := this.Count(&entity3.ChainMessage{}, "targetPeerId=? and queueStatus=?", targetPeerId, status)
+		if err != nil {
+			return nil, err
+		}
+		result[status] = count
+	}
+
+	return result, nil
 }
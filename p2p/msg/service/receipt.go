@@ -0,0 +1,135 @@
+package service
+
+import (
+	"errors"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/container"
+	coreservice "github.com/curltech/go-colla-core/service"
+	"github.com/curltech/go-colla-core/util/message"
+	entity3 "github.com/curltech/go-colla-node/p2p/msg/entity"
+	"strings"
+	"time"
+)
+
+/*
+*
+同步表结构，服务继承基本服务的方法
+*/
+type ReceiptService struct {
+	coreservice.OrmBaseService
+}
+
+var receiptService = &ReceiptService{}
+
+func GetReceiptService() *ReceiptService {
+	return receiptService
+}
+
+func (this *ReceiptService) GetSeqName() string {
+	return seqname
+}
+
+func (this *ReceiptService) NewEntity(data []byte) (interface{}, error) {
+	entity := &entity3.Receipt{}
+	if data == nil {
+		return entity, nil
+	}
+	err := message.Unmarshal(data, entity)
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, err
+}
+
+func (this *ReceiptService) NewEntities(data []byte) (interface{}, error) {
+	entities := make([]*entity3.Receipt, 0)
+	if data == nil {
+		return &entities, nil
+	}
+	err := message.Unmarshal(data, &entities)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entities, err
+}
+
+// receiptRetention 回执保留的时间（小时）
+var receiptRetention = 24 * 7
+
+func init() {
+	coreservice.GetSession().Sync(new(entity3.Receipt))
+	receiptRetention, _ = config.GetInt("p2p.chain.receipt.retention", 24*7)
+
+	receiptService.OrmBaseService.GetSeqName = receiptService.GetSeqName
+	receiptService.OrmBaseService.FactNewEntity = receiptService.NewEntity
+	receiptService.OrmBaseService.FactNewEntities = receiptService.NewEntities
+	container.RegistService("receipt", receiptService)
+}
+
+/*
+*
+保存回执，同一个消息同一个接收者只有一条回执，状态只会前进
+返回状态是否改变，没有改变的回执不需要再发送
+*/
+func (this *ReceiptService) Record(receipt *entity3.Receipt) (bool, error) {
+	if receipt.UUID == "" {
+		return false, errors.New("NullUUID")
+	}
+	if entity3.ReceiptRank(receipt.Status) == 0 {
+		return false, errors.New("InvalidReceiptStatus")
+	}
+	if receipt.StatusDate == nil {
+		currentTime := time.Now()
+		receipt.StatusDate = &currentTime
+	}
+	old := &entity3.Receipt{}
+	found, err := this.Get(old, false, "", "uuid=? and targetPeerId=?", receipt.UUID, receipt.TargetPeerId)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		if entity3.ReceiptRank(receipt.Status) <= entity3.ReceiptRank(old.Status) {
+			return false, nil
+		}
+		old.Status = receipt.Status
+		old.StatusDate = receipt.StatusDate
+		_, err = this.Update(old, []string{"status", "statusDate"}, "id=?", old.Id)
+
+		return err == nil, err
+	}
+	receipt.Id = 0
+	_, err = this.Insert(receipt)
+
+	return err == nil, err
+}
+
+/*
+*
+查询发送者发送的消息的回执，uuids是原消息的UUID
+*/
+func (this *ReceiptService) FindReceipts(srcPeerId string, uuids []string) ([]*entity3.Receipt, error) {
+	receipts := make([]*entity3.Receipt, 0)
+	if len(uuids) == 0 {
+		return receipts, nil
+	}
+	params := make([]interface{}, 0, len(uuids)+1)
+	params = append(params, srcPeerId)
+	for _, uuid := range uuids {
+		params = append(params, uuid)
+	}
+	conds := "srcPeerId=? and uuid in (" + strings.TrimSuffix(strings.Repeat("?,", len(uuids)), ",") + ")"
+	err := this.Find(&receipts, nil, "uuid", 0, 0, conds, params...)
+
+	return receipts, err
+}
+
+/*
+*
+删除超过保留时间的回执
+*/
+func (this *ReceiptService) Purge() {
+	retention := time.Now().Add(-time.Hour * time.Duration(receiptRetention))
+	_, _ = this.Delete(&entity3.Receipt{}, "statusDate<=?", &retention)
+}
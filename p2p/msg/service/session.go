@@ -0,0 +1,122 @@
+package service
+
+import (
+	coreservice "github.com/curltech/go-colla-core/service"
+	"github.com/curltech/go-colla-core/util/message"
+	entity3 "github.com/curltech/go-colla-node/p2p/msg/entity"
+)
+
+/*
+*
+同步表结构，服务继承基本服务的方法，同时管理自己的会话密钥
+*/
+type SessionService struct {
+	coreservice.OrmBaseService
+}
+
+var sessionService = &SessionService{}
+
+func GetSessionService() *SessionService {
+	return sessionService
+}
+
+func (this *SessionService) GetSeqName() string {
+	return seqname
+}
+
+func (this *SessionService) NewEntity(data []byte) (interface{}, error) {
+	entity := &entity3.Session{}
+	if data == nil {
+		return entity, nil
+	}
+	err := message.Unmarshal(data, entity)
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, err
+}
+
+func (this *SessionService) NewEntities(data []byte) (interface{}, error) {
+	entities := make([]*entity3.Session, 0)
+	if data == nil {
+		return &entities, nil
+	}
+	err := message.Unmarshal(data, &entities)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entities, err
+}
+
+func init() {
+	coreservice.GetSession().Sync(new(entity3.Session))
+	coreservice.GetSession().Sync(new(entity3.SessionKey))
+
+	sessionService.OrmBaseService.GetSeqName = sessionService.GetSeqName
+	sessionService.OrmBaseService.FactNewEntity = sessionService.NewEntity
+	sessionService.OrmBaseService.FactNewEntities = sessionService.NewEntities
+}
+
+/*
+*
+与peerId的会话状态，没有会话返回空
+*/
+func (this *SessionService) GetState(peerId string) (string, error) {
+	session := &entity3.Session{}
+	found, err := this.Get(session, false, "", "peerId=?", peerId)
+	if err != nil || !found {
+		return "", err
+	}
+
+	return session.State, nil
+}
+
+/*
+*
+保存与peerId的会话状态
+*/
+func (this *SessionService) SaveState(peerId string, state string) error {
+	session := &entity3.Session{}
+	found, err := this.Get(session, false, "", "peerId=?", peerId)
+	if err != nil {
+		return err
+	}
+	session.State = state
+	if found {
+		_, err = this.Update(session, []string{"state"}, "id=?", session.Id)
+		return err
+	}
+	session.PeerId = peerId
+	_, err = this.Insert(session)
+
+	return err
+}
+
+/*
+*
+自己的会话密钥，按照KeyId从新到旧排序
+*/
+func (this *SessionService) FindKeys(keyType string) ([]*entity3.SessionKey, error) {
+	sessionKeys := make([]*entity3.SessionKey, 0)
+	err := this.Find(&sessionKeys, nil, "keyId desc", 0, 0, "keyType=?", keyType)
+
+	return sessionKeys, err
+}
+
+func (this *SessionService) InsertKey(sessionKey *entity3.SessionKey) error {
+	_, err := this.Insert(sessionKey)
+
+	return err
+}
+
+/*
+*
+删除旧的预共享密钥，保留keyId大于等于minKeyId的
+*/
+func (this *SessionService) DeleteKeys(keyType string, minKeyId int64) error {
+	_, err := this.Delete(&entity3.SessionKey{}, "keyType=? and keyId<?", keyType, minKeyId)
+
+	return err
+}
@@ -0,0 +1,101 @@
+package msgtype
+
+import (
+	"sync"
+)
+
+/*
+*
+协议版本和能力：
+1.节点和客户端连接的时候交换协议版本和能力，websocket客户端在CONNECT中声明，
+libp2p的节点在打开流之后发送HANDSHAKE
+2.使用双方都支持的最高版本，低于任何一方的最低版本的时候拒绝，能力取双方的交集
+3.老的节点和客户端不声明版本，作为LegacyProtocolVersion处理，认为支持原来的所有功能
+4.新的功能登记一个能力，发送之前检查目标是否支持，不支持的降级或者返回明确的错误
+*/
+const (
+	// 当前的协议版本
+	ProtocolVersion = 2
+	// 没有握手的老的节点和客户端的协议版本
+	LegacyProtocolVersion = 1
+)
+
+const (
+	// libp2p的管道使用长度前缀的帧
+	Capability_Frame = "frame"
+	// 二进制的cbor编码
+	Capability_Cbor = "cbor"
+	// 前向安全的会话加密
+	Capability_Session = "session"
+	// 多个接收者的负载密钥
+	Capability_MultiRecipient = "multiRecipient"
+	// 群组消息由连接节点分发
+	Capability_GroupChat = "groupChat"
+	// 消息回执
+	Capability_Receipt = "receipt"
+	// 订阅主题
+	Capability_Topic = "topic"
+	// 在线状态
+	Capability_Presence = "presence"
+	// 转发的跳数和签名的路径
+	Capability_Hops = "hops"
+)
+
+var capabilityMutex sync.RWMutex
+
+var capabilities = []string{
+	Capability_Frame,
+	Capability_Cbor,
+	Capability_Session,
+	Capability_MultiRecipient,
+	Capability_GroupChat,
+	Capability_Receipt,
+	Capability_Topic,
+	Capability_Presence,
+	Capability_Hops,
+}
+
+// 消息类型与需要的能力的映射，没有登记的消息类型所有的版本都支持
+var messageCapabilities = map[string]string{
+	GROUPCHAT:    Capability_GroupChat,
+	RECEIPT:      Capability_Receipt,
+	QUERYRECEIPT: Capability_Receipt,
+	SUBSCRIBE:    Capability_Topic,
+	UNSUBSCRIBE:  Capability_Topic,
+	PRESENCE:     Capability_Presence,
+}
+
+// RegistCapability 登记本节点支持的能力，重复登记的忽略
+func RegistCapability(capability string) {
+	capabilityMutex.Lock()
+	defer capabilityMutex.Unlock()
+	for _, c := range capabilities {
+		if c == capability {
+			return
+		}
+	}
+	capabilities = append(capabilities, capability)
+}
+
+// Capabilities 本节点支持的能力
+func Capabilities() []string {
+	capabilityMutex.RLock()
+	defer capabilityMutex.RUnlock()
+
+	return append([]string(nil), capabilities...)
+}
+
+// RegistMessageCapability 登记消息类型需要的能力
+func RegistMessageCapability(msgType string, capability string) {
+	capabilityMutex.Lock()
+	defer capabilityMutex.Unlock()
+	messageCapabilities[msgType] = capability
+}
+
+// GetMessageCapability 消息类型需要的能力，不需要的返回空
+func GetMessageCapability(msgType string) string {
+	capabilityMutex.RLock()
+	defer capabilityMutex.RUnlock()
+
+	return messageCapabilities[msgType]
+}
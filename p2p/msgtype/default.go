@@ -28,10 +28,25 @@ const (
 	PUTVALUE  = "PUTVALUE"
 	SIGNAL    = "SIGNAL"
 	IONSIGNAL = "IONSIGNAL"
+	// 消息回执，送达节点，送达设备，已读
+	RECEIPT = "RECEIPT"
+	// 查询发送消息的回执
+	QUERYRECEIPT = "QUERYRECEIPT"
+	// 群组消息，由连接节点按照群组成员分发
+	GROUPCHAT = "GROUPCHAT"
+	// 客户端订阅和取消订阅主题
+	SUBSCRIBE   = "SUBSCRIBE"
+	UNSUBSCRIBE = "UNSUBSCRIBE"
+	// 关注联系人的在线状态，以及在线状态的变化
+	PRESENCE = "PRESENCE"
 	// PEERENDPOINT更新
 	PEERENDPOINT = "PEERENDPOINT"
 	// PeerClient连接
 	CONNECT = "CONNECT"
+	// 节点之间打开流的时候交换协议版本和能力
+	HANDSHAKE = "HANDSHAKE"
+	// 客户端用节点发出的随机数签名登录，绑定连接会话的身份
+	LOGIN = "LOGIN"
 	// PeerClient查找
 	FINDCLIENT = "FINDCLIENT"
 	// DataBlock查找
@@ -74,6 +89,17 @@ const (
 	CHAT_ADD_LINKMAN_INDIVIDUAL_RECEIPT = "ADD_LINKMAN_INDIVIDUAL_RECEIPT"
 )
 
+// Receipt Status，按照先后顺序，回执的状态只会前进
+
+const (
+	// 送达接收者的连接节点（包括保存在待转发队列）
+	RECEIPT_DELIVERED_NODE = "DELIVERED_NODE"
+	// 送达接收者的设备
+	RECEIPT_DELIVERED_DEVICE = "DELIVERED_DEVICE"
+	// 接收者已读
+	RECEIPT_READ = "READ"
+)
+
 func init() {
 
 }
@@ -0,0 +1,82 @@
+package msgtype
+
+import (
+	"sync"
+)
+
+// Priority 发送消息的优先级，数值越小越优先
+type Priority int
+
+const (
+	// 实时的信令消息，比如SIGNAL，IONSIGNAL
+	Priority_Realtime Priority = 0
+	// 一般的消息
+	Priority_Normal Priority = 1
+	// 大的数据消息，比如共识的数据块
+	Priority_Bulk Priority = 2
+)
+
+// PriorityCount 优先级的个数，每个连接为每个优先级建立一个发送队列
+const PriorityCount = 3
+
+// bulkSize 没有消息类型的数据超过这个字节数的时候作为大的数据消息
+const bulkSize = 64 * 1024
+
+var priorityMutex sync.RWMutex
+
+var priorities = map[string]Priority{
+	PING:                       Priority_Realtime,
+	HANDSHAKE:                  Priority_Realtime,
+	LOGIN:                      Priority_Realtime,
+	SIGNAL:                     Priority_Realtime,
+	IONSIGNAL:                  Priority_Realtime,
+	ManageRoom:                 Priority_Realtime,
+	PUTVALUE:                   Priority_Bulk,
+	QUERYVALUE:                 Priority_Bulk,
+	CONSENSUS:                  Priority_Bulk,
+	CONSENSUS_REPLY:            Priority_Bulk,
+	CONSENSUS_PREPREPARED:      Priority_Bulk,
+	CONSENSUS_PREPARED:         Priority_Bulk,
+	CONSENSUS_COMMITED:         Priority_Bulk,
+	CONSENSUS_RAFT:             Priority_Bulk,
+	CONSENSUS_RAFT_REPLY:       Priority_Bulk,
+	CONSENSUS_RAFT_PREPREPARED: Priority_Bulk,
+	CONSENSUS_RAFT_PREPARED:    Priority_Bulk,
+	CONSENSUS_RAFT_COMMITED:    Priority_Bulk,
+	CONSENSUS_PBFT:             Priority_Bulk,
+	CONSENSUS_PBFT_REPLY:       Priority_Bulk,
+	CONSENSUS_PBFT_PREPREPARED: Priority_Bulk,
+	CONSENSUS_PBFT_PREPARED:    Priority_Bulk,
+	CONSENSUS_PBFT_COMMITED:    Priority_Bulk,
+}
+
+// RegistPriority 注册消息类型的发送优先级，没有注册的消息类型是Priority_Normal
+func RegistPriority(msgType string, priority Priority) {
+	if priority < Priority_Realtime || priority > Priority_Bulk {
+		return
+	}
+	priorityMutex.Lock()
+	defer priorityMutex.Unlock()
+	priorities[msgType] = priority
+}
+
+// GetPriority 消息类型的发送优先级
+func GetPriority(msgType string) Priority {
+	priorityMutex.RLock()
+	defer priorityMutex.RUnlock()
+	priority, ok := priorities[msgType]
+	if !ok {
+		return Priority_Normal
+	}
+
+	return priority
+}
+
+// PriorityOf 不知道消息类型的数据，比如处理器返回的回应，按照大小决定优先级
+func PriorityOf(data []byte) Priority {
+	if len(data) > bulkSize {
+		return Priority_Bulk
+	}
+
+	return Priority_Normal
+}
@@ -0,0 +1,340 @@
+package push
+
+import (
+	"context"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/ns"
+	"github.com/curltech/go-colla-node/p2p/dht/entity"
+	"github.com/curltech/go-colla-node/p2p/dht/service"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*
+离线推送：
+1.每个推送通道实现PushProvider，按照客户端的ClientType选择通道，没有通道接受的使用缺省通道
+2.推送任务放入队列，由工作协程按照通道的批量大小分批推送
+3.临时的失败按照指数退避重试，超过最大重试次数放弃
+4.通道返回无效的DeviceToken的时候，清除本地客户端的DeviceToken，不再推送
+*/
+type Notification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	// 自定义数据，只支持一维
+	Data map[string]string `json:"data,omitempty"`
+	// 同一个会话的通知折叠成一条
+	CollapseKey string `json:"collapseKey,omitempty"`
+	// 同一组的通知在通知栏中归在一起
+	Group string `json:"group,omitempty"`
+	// 及时性要求高的通知
+	Urgent bool `json:"urgent,omitempty"`
+}
+
+// PushResult 每个DeviceToken的推送结果，Err为空表示成功
+type PushResult struct {
+	DeviceToken string
+	Err         error
+	// DeviceToken无效，需要清除
+	Invalid bool
+	// 临时的失败，可以重试
+	Retry bool
+	// 通道要求的重试等待时间
+	RetryAfter time.Duration
+}
+
+func Success(deviceToken string) *PushResult {
+	return &PushResult{DeviceToken: deviceToken}
+}
+
+func Failure(deviceToken string, err error) *PushResult {
+	return &PushResult{DeviceToken: deviceToken, Err: err}
+}
+
+func InvalidToken(deviceToken string, err error) *PushResult {
+	return &PushResult{DeviceToken: deviceToken, Err: err, Invalid: true}
+}
+
+func Retry(deviceToken string, err error, retryAfter time.Duration) *PushResult {
+	return &PushResult{DeviceToken: deviceToken, Err: err, Retry: true, RetryAfter: retryAfter}
+}
+
+/*
+*
+推送通道，Push对一批DeviceToken推送同一个通知，返回每个DeviceToken的结果
+*/
+type PushProvider interface {
+	Name() string
+	// Accept 是否推送这种ClientType的客户端，参数是ClientType括号前面的部分
+	Accept(clientType string) bool
+	// MaxBatch 一次Push最多的DeviceToken数
+	MaxBatch() int
+	Push(ctx context.Context, deviceTokens []string, notification *Notification) []*PushResult
+}
+
+var providerMutex sync.RWMutex
+
+var providers = make([]PushProvider, 0)
+
+// 没有通道接受ClientType的时候使用的通道名称
+var defaultProvider = "fcm"
+
+var workers = 4
+
+var queueSize = 10000
+
+var maxRetry = 5
+
+var retryInterval = time.Second
+
+var maxRetryInterval = time.Minute
+
+var pushTimeout = 30 * time.Second
+
+type pushTask struct {
+	provider     PushProvider
+	notification *Notification
+	deviceTokens []string
+	// DeviceToken与客户端的映射，用于清除无效的DeviceToken
+	peerClients map[string]*entity.PeerClient
+	attempt     int
+}
+
+var pushQueue chan *pushTask
+
+var startOnce sync.Once
+
+func init() {
+	defaultProvider, _ = config.GetString("p2p.push.defaultProvider", "fcm")
+	workers, _ = config.GetInt("p2p.push.workers", 4)
+	queueSize, _ = config.GetInt("p2p.push.queueSize", 10000)
+	maxRetry, _ = config.GetInt("p2p.push.maxRetry", 5)
+	interval, _ := config.GetInt("p2p.push.retryInterval", 1000)
+	retryInterval = time.Millisecond * time.Duration(interval)
+	maxInterval, _ := config.GetInt("p2p.push.maxRetryInterval", 60000)
+	maxRetryInterval = time.Millisecond * time.Duration(maxInterval)
+	timeout, _ := config.GetInt("p2p.push.timeout", 30000)
+	pushTimeout = time.Millisecond * time.Duration(timeout)
+}
+
+/*
+*
+登记推送通道，同名的通道替换原来的
+*/
+func RegistPushProvider(provider PushProvider) {
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+	for i, p := range providers {
+		if p.Name() == provider.Name() {
+			providers[i] = provider
+			return
+		}
+	}
+	providers = append(providers, provider)
+}
+
+// ClientTypePrefix ClientType括号前面的部分，比如HUAWEI(P40)是HUAWEI
+func ClientTypePrefix(clientType string) string {
+	return strings.TrimSpace(strings.Split(clientType, "(")[0])
+}
+
+/*
+*
+按照ClientType选择推送通道，没有通道接受的时候使用缺省通道
+*/
+func GetPushProvider(clientType string) PushProvider {
+	prefix := ClientTypePrefix(clientType)
+	providerMutex.RLock()
+	defer providerMutex.RUnlock()
+	var fallback PushProvider
+	for _, provider := range providers {
+		if provider.Accept(prefix) {
+			return provider
+		}
+		if provider.Name() == defaultProvider {
+			fallback = provider
+		}
+	}
+	//PC客户端的DeviceToken是Web Push的订阅，不能使用缺省通道
+	if prefix == "PC" || prefix == "Web" {
+		return nil
+	}
+
+	return fallback
+}
+
+func start() {
+	pushQueue = make(chan *pushTask, queueSize)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range pushQueue {
+				execute(task)
+			}
+		}()
+	}
+}
+
+/*
+*
+推送通知给一个客户端
+*/
+func Notify(peerClient *entity.PeerClient, notification *Notification) {
+	NotifyAll([]*entity.PeerClient{peerClient}, notification)
+}
+
+/*
+*
+推送同一个通知给多个客户端，按照通道分组，按照通道的批量大小分批放入队列
+*/
+func NotifyAll(peerClients []*entity.PeerClient, notification *Notification) {
+	groups := make(map[PushProvider]map[string]*entity.PeerClient)
+	for _, peerClient := range peerClients {
+		if peerClient == nil || peerClient.DeviceToken == "" {
+			continue
+		}
+		provider := GetPushProvider(peerClient.ClientType)
+		if provider == nil {
+			logger.Sugar.Debugf("no push provider for clientType: %v", peerClient.ClientType)
+			continue
+		}
+		group, ok := groups[provider]
+		if !ok {
+			group = make(map[string]*entity.PeerClient)
+			groups[provider] = group
+		}
+		group[peerClient.DeviceToken] = peerClient
+	}
+	for provider, group := range groups {
+		deviceTokens := make([]string, 0, len(group))
+		for deviceToken := range group {
+			deviceTokens = append(deviceTokens, deviceToken)
+		}
+		for _, batch := range split(deviceTokens, provider.MaxBatch()) {
+			task := &pushTask{
+				provider:     provider,
+				notification: notification,
+				deviceTokens: batch,
+				peerClients:  group,
+			}
+			enqueue(task)
+		}
+	}
+}
+
+func split(deviceTokens []string, size int) [][]string {
+	if size <= 0 {
+		size = 1
+	}
+	batches := make([][]string, 0, len(deviceTokens)/size+1)
+	for len(deviceTokens) > size {
+		batches = append(batches, deviceTokens[:size])
+		deviceTokens = deviceTokens[size:]
+	}
+	if len(deviceTokens) > 0 {
+		batches = append(batches, deviceTokens)
+	}
+
+	return batches
+}
+
+/*
+*
+放入队列，队列满的时候丢弃
+*/
+func enqueue(task *pushTask) {
+	startOnce.Do(start)
+	select {
+	case pushQueue <- task:
+	default:
+		logger.Sugar.Warnf("push queue is full, drop %v deviceTokens of provider: %v", len(task.deviceTokens), task.provider.Name())
+	}
+}
+
+/*
+*
+执行推送，无效的DeviceToken清除，临时失败的DeviceToken退避以后重试
+*/
+func execute(task *pushTask) {
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	results := task.provider.Push(ctx, task.deviceTokens, task.notification)
+	cancel()
+	retryTokens := make([]string, 0)
+	var retryAfter time.Duration
+	for _, result := range results {
+		if result.Err == nil {
+			continue
+		}
+		if result.Invalid {
+			logger.Sugar.Warnf("provider: %v invalid deviceToken, error: %v", task.provider.Name(), result.Err)
+			removeDeviceToken(task.peerClients[result.DeviceToken], result.DeviceToken)
+		} else if result.Retry && task.attempt < maxRetry {
+			retryTokens = append(retryTokens, result.DeviceToken)
+			if result.RetryAfter > retryAfter {
+				retryAfter = result.RetryAfter
+			}
+		} else {
+			logger.Sugar.Errorf("provider: %v push failure, attempt: %v, error: %v", task.provider.Name(), task.attempt, result.Err)
+		}
+	}
+	if len(retryTokens) == 0 {
+		return
+	}
+	delay := backoff(task.attempt)
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	retry := &pushTask{
+		provider:     task.provider,
+		notification: task.notification,
+		deviceTokens: retryTokens,
+		peerClients:  task.peerClients,
+		attempt:      task.attempt + 1,
+	}
+	time.AfterFunc(delay, func() {
+		enqueue(retry)
+	})
+}
+
+/*
+*
+指数退避，加上最多一半的随机抖动，不超过最大间隔
+*/
+func backoff(attempt int) time.Duration {
+	delay := retryInterval << uint(attempt)
+	if delay <= 0 || delay > maxRetryInterval {
+		delay = maxRetryInterval
+	}
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+
+	return delay
+}
+
+/*
+*
+清除本地客户端无效的DeviceToken并分布式保存
+*/
+func removeDeviceToken(peerClient *entity.PeerClient, deviceToken string) {
+	if peerClient == nil {
+		return
+	}
+	peerClients, err := service.GetPeerClientService().GetLocals(ns.GetPeerClientKey(peerClient.PeerId), peerClient.ClientId)
+	if err != nil {
+		logger.Sugar.Errorf("failed to GetLocals by peerId: %v, err: %v", peerClient.PeerId, err)
+		return
+	}
+	for _, pc := range peerClients {
+		if pc.DeviceToken != deviceToken {
+			continue
+		}
+		pc.DeviceToken = ""
+		err = service.GetPeerClientService().PutValues(pc)
+		if err != nil {
+			logger.Sugar.Errorf("failed to remove deviceToken, peerId: %v, err: %v", pc.PeerId, err)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+const fcmTokenUri = "https://oauth2.googleapis.com/token"
+
+// fcmServiceAccount Firebase控制台下载的服务账号json
+type fcmServiceAccount struct {
+	ProjectId    string `json:"project_id"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenUri     string `json:"token_uri"`
+}
+
+/*
+*
+FCM HTTP v1推送通道，没有其他通道接受的Android客户端使用
+用服务账号签名的JWT换取OAuth2的AccessToken，每个DeviceToken一个请求
+endpoint和tokenUri可以配置成本地的模拟服务器
+*/
+type FcmProvider struct {
+	account    *fcmServiceAccount
+	privateKey *rsa.PrivateKey
+	endpoint   string
+	tokenUri   string
+	client     *http.Client
+	parallel   int
+
+	mutex       sync.Mutex
+	accessToken string
+	expireAt    time.Time
+}
+
+func NewFcmProvider(credentials []byte, endpoint string, tokenUri string, client *http.Client) (*FcmProvider, error) {
+	account := &fcmServiceAccount{}
+	err := json.Unmarshal(credentials, account)
+	if err != nil {
+		return nil, err
+	}
+	if account.ProjectId == "" || account.ClientEmail == "" {
+		return nil, errors.New("InvalidFcmCredentials")
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("InvalidFcmPrivateKey")
+	}
+	var privateKey *rsa.PrivateKey
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err == nil {
+		var ok bool
+		privateKey, ok = key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("InvalidFcmPrivateKey")
+		}
+	} else {
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if endpoint == "" {
+		endpoint = "https://fcm.googleapis.com"
+	}
+	if tokenUri == "" {
+		tokenUri = account.TokenUri
+	}
+	if tokenUri == "" {
+		tokenUri = fcmTokenUri
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &FcmProvider{
+		account:    account,
+		privateKey: privateKey,
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		tokenUri:   tokenUri,
+		client:     client,
+		parallel:   8,
+	}, nil
+}
+
+func (this *FcmProvider) Name() string {
+	return "fcm"
+}
+
+func (this *FcmProvider) Accept(clientType string) bool {
+	return clientType == "Android" || clientType == "FCM"
+}
+
+func (this *FcmProvider) MaxBatch() int {
+	return 500
+}
+
+/*
+*
+取得OAuth2的AccessToken，过期前一分钟重新申请
+*/
+func (this *FcmProvider) getAccessToken(ctx context.Context) (string, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.accessToken != "" && time.Now().Before(this.expireAt) {
+		return this.accessToken, nil
+	}
+	now := time.Now()
+	assertion, err := signJwt("RS256", map[string]interface{}{
+		"iss":   this.account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   this.tokenUri,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}, func(data []byte) ([]byte, error) {
+		digest := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, this.privateKey, crypto.SHA256, digest[:])
+	})
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, this.tokenUri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := this.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	token := &struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return "", fmt.Errorf("FcmAccessTokenFailure: %v %v", response.StatusCode, string(body))
+	}
+	err = json.NewDecoder(response.Body).Decode(token)
+	if err != nil {
+		return "", err
+	}
+	this.accessToken = token.AccessToken
+	this.expireAt = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+
+	return this.accessToken, nil
+}
+
+func (this *FcmProvider) resetAccessToken() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.accessToken = ""
+}
+
+/*
+*
+FCM HTTP v1每个请求只能发给一个DeviceToken，并发发送
+*/
+func (this *FcmProvider) Push(ctx context.Context, deviceTokens []string, notification *Notification) []*PushResult {
+	accessToken, err := this.getAccessToken(ctx)
+	if err != nil {
+		logger.Sugar.Errorf("fcm get access token error: %v", err)
+		return all(deviceTokens, retry, err)
+	}
+	results := make([]*PushResult, len(deviceTokens))
+	semaphore := make(chan struct{}, this.parallel)
+	var wg sync.WaitGroup
+	for i, deviceToken := range deviceTokens {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, deviceToken string) {
+			defer wg.Done()
+			results[i] = this.send(ctx, accessToken, deviceToken, notification)
+			<-semaphore
+		}(i, deviceToken)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (this *FcmProvider) send(ctx context.Context, accessToken string, deviceToken string, notification *Notification) *PushResult {
+	priority := "NORMAL"
+	if notification.Urgent {
+		priority = "HIGH"
+	}
+	android := map[string]interface{}{"priority": priority}
+	apns := map[string]interface{}{}
+	// 同一个折叠键的通知在通知栏中替换，同一组的通知归在一起
+	if notification.CollapseKey != "" {
+		android["collapse_key"] = notification.CollapseKey
+		android["notification"] = map[string]string{"tag": notification.CollapseKey}
+		apns["headers"] = map[string]string{"apns-collapse-id": notification.CollapseKey}
+	}
+	if notification.Group != "" {
+		apns["payload"] = map[string]interface{}{"aps": map[string]string{"thread-id": notification.Group}}
+	}
+	msg := map[string]interface{}{
+		"token": deviceToken,
+		"notification": map[string]string{
+			"title": notification.Title,
+			"body":  notification.Body,
+		},
+		"android": android,
+	}
+	if len(apns) > 0 {
+		msg["apns"] = apns
+	}
+	if len(notification.Data) > 0 {
+		msg["data"] = notification.Data
+	}
+	body, err := json.Marshal(map[string]interface{}{"message": msg})
+	if err != nil {
+		return Failure(deviceToken, err)
+	}
+	uri := fmt.Sprintf("%v/v1/projects/%v/messages:send", this.endpoint, this.account.ProjectId)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(body))
+	if err != nil {
+		return Failure(deviceToken, err)
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := this.client.Do(request)
+	if err != nil {
+		return Retry(deviceToken, err, 0)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusOK && response.StatusCode < http.StatusMultipleChoices {
+		io.Copy(io.Discard, response.Body)
+		return Success(deviceToken)
+	}
+
+	return this.failure(response, deviceToken)
+}
+
+/*
+*
+FCM的错误：UNREGISTERED和SENDER_ID_MISMATCH是无效的DeviceToken，
+UNAVAILABLE，INTERNAL和QUOTA_EXCEEDED可以重试，认证失败重新申请AccessToken以后重试
+*/
+func (this *FcmProvider) failure(response *http.Response, deviceToken string) *PushResult {
+	fcmError := &struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Status  string `json:"status"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}{}
+	_ = json.NewDecoder(response.Body).Decode(fcmError)
+	errorCode := fcmError.Error.Status
+	for _, detail := range fcmError.Error.Details {
+		if detail.ErrorCode != "" {
+			errorCode = detail.ErrorCode
+		}
+	}
+	err := fmt.Errorf("%v %v %v", response.StatusCode, errorCode, fcmError.Error.Message)
+	switch {
+	case errorCode == "UNREGISTERED" || errorCode == "SENDER_ID_MISMATCH" || response.StatusCode == http.StatusNotFound:
+		return InvalidToken(deviceToken, err)
+	case response.StatusCode == http.StatusUnauthorized:
+		this.resetAccessToken()
+		return Retry(deviceToken, err, 0)
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError:
+		return Retry(deviceToken, err, retryAfter(response))
+	default:
+		return Failure(deviceToken, err)
+	}
+}
+
+func init() {
+	enable, _ := config.GetBool("p2p.push.fcm.enable", false)
+	if !enable {
+		return
+	}
+	filename, _ := config.GetString("p2p.push.fcm.credentials", "./conf/fcm.json")
+	endpoint, _ := config.GetString("p2p.push.fcm.endpoint", "")
+	tokenUri, _ := config.GetString("p2p.push.fcm.tokenUri", "")
+	credentials, err := os.ReadFile(filename)
+	if err != nil {
+		logger.Sugar.Errorf("read fcm credentials: %v error: %v", filename, err)
+		return
+	}
+	provider, err := NewFcmProvider(credentials, endpoint, tokenUri, nil)
+	if err != nil {
+		logger.Sugar.Errorf("create fcm provider error: %v", err)
+		return
+	}
+	RegistPushProvider(provider)
+}
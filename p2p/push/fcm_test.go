@@ -0,0 +1,102 @@
+package push
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestFcmProvider(t *testing.T, server *httptest.Server) *FcmProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := json.Marshal(map[string]string{
+		"project_id":   "test",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email": "test@test.iam.gserviceaccount.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewFcmProvider(credentials, server.URL, server.URL+"/token", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+func TestFcmStatus(t *testing.T) {
+	tests := []struct {
+		status    int
+		errorCode string
+		success   bool
+		invalid   bool
+		retry     bool
+	}{
+		{http.StatusOK, "", true, false, false},
+		{http.StatusNotFound, "UNREGISTERED", false, true, false},
+		{http.StatusBadRequest, "SENDER_ID_MISMATCH", false, true, false},
+		{http.StatusBadRequest, "INVALID_ARGUMENT", false, false, false},
+		{http.StatusUnauthorized, "THIRD_PARTY_AUTH_ERROR", false, false, true},
+		{http.StatusTooManyRequests, "QUOTA_EXCEEDED", false, false, true},
+		{http.StatusServiceUnavailable, "UNAVAILABLE", false, false, true},
+		{http.StatusInternalServerError, "INTERNAL", false, false, true},
+	}
+	for _, test := range tests {
+		var tokens int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				atomic.AddInt32(&tokens, 1)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+				return
+			}
+			if r.URL.Path != "/v1/projects/test/messages:send" || r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if test.status == http.StatusOK {
+				_, _ = w.Write([]byte(`{"name":"projects/test/messages/1"}`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(test.status)
+			_, _ = w.Write([]byte(`{"error":{"code":` + strconv.Itoa(test.status) + `,"status":"ERROR","details":[{"errorCode":"` + test.errorCode + `"}]}}`))
+		}))
+		provider := newTestFcmProvider(t, server)
+		results := provider.Push(context.Background(), []string{"device"}, &Notification{Title: "title", Body: "body"})
+		if len(results) != 1 {
+			t.Fatalf("status %v: %v results", test.status, len(results))
+		}
+		result := results[0]
+		if (result.Err == nil) != test.success || result.Invalid != test.invalid || result.Retry != test.retry {
+			t.Errorf("status %v %v: got err=%v invalid=%v retry=%v", test.status, test.errorCode, result.Err, result.Invalid, result.Retry)
+		}
+		if (test.status == http.StatusTooManyRequests || test.status >= http.StatusInternalServerError) && result.RetryAfter.Seconds() != 5 {
+			t.Errorf("status %v: retryAfter %v", test.status, result.RetryAfter)
+		}
+		//认证失败以后重新申请AccessToken
+		if test.status == http.StatusUnauthorized {
+			provider.Push(context.Background(), []string{"device"}, &Notification{Title: "title"})
+			if atomic.LoadInt32(&tokens) != 2 {
+				t.Errorf("access token is not renewed after 401, requested %v times", tokens)
+			}
+		}
+		server.Close()
+	}
+}
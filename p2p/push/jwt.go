@@ -0,0 +1,58 @@
+package push
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+*
+生成JWT，FCM的服务账号使用RS256，Web Push的VAPID使用ES256，sign对header.claims签名
+*/
+func signJwt(alg string, claims map[string]interface{}, sign func(data []byte) ([]byte, error)) (string, error) {
+	header, err := json.Marshal(map[string]string{"typ": "JWT", "alg": alg})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := sign([]byte(data))
+	if err != nil {
+		return "", err
+	}
+
+	return data + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// decodeBase64Url 兼容带填充和不带填充的base64url
+func decodeBase64Url(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+/*
+*
+Retry-After头，可以是秒数或者HTTP日期
+*/
+func retryAfter(response *http.Response) time.Duration {
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
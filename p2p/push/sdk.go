@@ -0,0 +1,332 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/libp2p/global"
+	"github.com/curltech/go-push-sdk/push/huawei_channel"
+	"github.com/curltech/go-push-sdk/push/ios_channel"
+	"github.com/curltech/go-push-sdk/push/meizu_channel"
+	"github.com/curltech/go-push-sdk/push/oppo_channel"
+	"github.com/curltech/go-push-sdk/push/setting"
+	"github.com/curltech/go-push-sdk/push/vivo_channel"
+	"github.com/curltech/go-push-sdk/push/xiaomi_channel"
+	"github.com/google/uuid"
+	"net/http"
+	"sync"
+)
+
+/*
+*
+厂商推送通道，使用go-push-sdk，客户端在conf/pushSetting.json中配置
+需要AccessToken的通道失败的时候刷新AccessToken再推送一次
+*/
+type sdkProvider struct {
+	name     string
+	prefix   string
+	maxBatch int
+	platform setting.PlatformType
+	// 保存AccessToken的位置，不需要AccessToken的通道为nil
+	accessToken *string
+	// 从GetAccessToken的响应中取得AccessToken
+	refresh func(resp interface{}) string
+	// 判断PushNotice的响应，返回每个DeviceToken的结果
+	check func(resp interface{}, deviceTokens []string) []*PushResult
+	// 厂商通道需要的自定义数据
+	extra map[string]string
+}
+
+// AccessToken保存在全局变量中，多个工作协程并发读写
+var accessTokenMutex sync.Mutex
+
+func (this *sdkProvider) Name() string {
+	return this.name
+}
+
+func (this *sdkProvider) Accept(clientType string) bool {
+	return clientType == this.prefix
+}
+
+func (this *sdkProvider) MaxBatch() int {
+	return this.maxBatch
+}
+
+func (this *sdkProvider) Push(ctx context.Context, deviceTokens []string, notification *Notification) []*PushResult {
+	if global.Global.PushRegisterClient == nil {
+		return all(deviceTokens, Failure, errors.New("NoPushRegisterClient"))
+	}
+	client, err := global.Global.PushRegisterClient.GetPlatformClient(this.platform)
+	if err != nil {
+		return all(deviceTokens, Failure, err)
+	}
+	results := this.push(ctx, client, deviceTokens, notification)
+	if this.accessToken == nil || !needRefresh(results) {
+		return results
+	}
+	resp, err := client.GetAccessToken(ctx)
+	if err != nil {
+		logger.Sugar.Errorf("%v get access token error: %+v", this.name, err)
+		return results
+	}
+	accessTokenMutex.Lock()
+	*this.accessToken = this.refresh(resp)
+	accessTokenMutex.Unlock()
+
+	return this.push(ctx, client, deviceTokens, notification)
+}
+
+func (this *sdkProvider) push(ctx context.Context, client setting.PushClientInterface, deviceTokens []string, notification *Notification) []*PushResult {
+	extra := make(map[string]string, len(this.extra)+len(notification.Data)+2)
+	for k, v := range this.extra {
+		extra[k] = v
+	}
+	for k, v := range notification.Data {
+		extra[k] = v
+	}
+	// 厂商通道没有统一的折叠和分组参数，由客户端处理
+	if notification.CollapseKey != "" {
+		extra["collapseKey"] = notification.CollapseKey
+	}
+	if notification.Group != "" {
+		extra["group"] = notification.Group
+	}
+	msg := &setting.PushMessageRequest{
+		DeviceTokens: deviceTokens,
+		Message: &setting.Message{
+			BusinessId: uuid.New().String(),
+			Title:      notification.Title,
+			Content:    notification.Body,
+			Extra:      extra,
+		},
+	}
+	if this.accessToken != nil {
+		accessTokenMutex.Lock()
+		msg.AccessToken = *this.accessToken
+		accessTokenMutex.Unlock()
+	}
+	resp, err := client.PushNotice(ctx, msg)
+	if err != nil {
+		logger.Sugar.Errorf("%v push error: %+v", this.name, err)
+		return all(deviceTokens, retry, err)
+	}
+	logger.Sugar.Infof("%v push response: %+v", this.name, resp)
+	if resp == nil {
+		return all(deviceTokens, retry, errors.New("NullPushResponse"))
+	}
+
+	return this.check(resp, deviceTokens)
+}
+
+/*
+*
+有不是DeviceToken无效的失败的时候刷新AccessToken
+*/
+func needRefresh(results []*PushResult) bool {
+	for _, result := range results {
+		if result.Err != nil && !result.Invalid {
+			return true
+		}
+	}
+
+	return false
+}
+
+func retry(deviceToken string, err error) *PushResult {
+	return Retry(deviceToken, err, 0)
+}
+
+func all(deviceTokens []string, result func(string, error) *PushResult, err error) []*PushResult {
+	results := make([]*PushResult, 0, len(deviceTokens))
+	for _, deviceToken := range deviceTokens {
+		results = append(results, result(deviceToken, err))
+	}
+
+	return results
+}
+
+func allSuccess(deviceTokens []string) []*PushResult {
+	results := make([]*PushResult, 0, len(deviceTokens))
+	for _, deviceToken := range deviceTokens {
+		results = append(results, Success(deviceToken))
+	}
+
+	return results
+}
+
+func checkApple(resp interface{}, deviceTokens []string) []*PushResult {
+	response, ok := resp.(*ios_channel.PushMessageResponse)
+	if !ok {
+		return all(deviceTokens, Failure, errors.New("InvalidPushResponse"))
+	}
+	err := fmt.Errorf("%v %v", response.StatusCode, response.Reason)
+	switch {
+	case response.StatusCode == http.StatusOK:
+		return allSuccess(deviceTokens)
+	case response.StatusCode == http.StatusGone || response.Reason == "BadDeviceToken" || response.Reason == "Unregistered":
+		return all(deviceTokens, InvalidToken, err)
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError:
+		return all(deviceTokens, retry, err)
+	default:
+		return all(deviceTokens, Failure, err)
+	}
+}
+
+/*
+*
+华为部分成功的时候，msg中是无效的DeviceToken列表
+*/
+func checkHuawei(resp interface{}, deviceTokens []string) []*PushResult {
+	response, ok := resp.(*huawei_channel.PushMessageResponse)
+	if !ok {
+		return all(deviceTokens, Failure, errors.New("InvalidPushResponse"))
+	}
+	err := fmt.Errorf("%v %v", response.Code, response.Msg)
+	switch response.Code {
+	case "80000000":
+		return allSuccess(deviceTokens)
+	case "80300007":
+		return all(deviceTokens, InvalidToken, err)
+	case "80100000":
+		detail := &struct {
+			IllegalTokens []string `json:"illegal_tokens"`
+		}{}
+		_ = json.Unmarshal([]byte(response.Msg), detail)
+		illegal := make(map[string]bool, len(detail.IllegalTokens))
+		for _, token := range detail.IllegalTokens {
+			illegal[token] = true
+		}
+		results := make([]*PushResult, 0, len(deviceTokens))
+		for _, deviceToken := range deviceTokens {
+			if illegal[deviceToken] {
+				results = append(results, InvalidToken(deviceToken, err))
+			} else {
+				results = append(results, Success(deviceToken))
+			}
+		}
+		return results
+	default:
+		return all(deviceTokens, retry, err)
+	}
+}
+
+func checkXiaomi(resp interface{}, deviceTokens []string) []*PushResult {
+	response, ok := resp.(*xiaomi_channel.PushMessageResponse)
+	if !ok {
+		return all(deviceTokens, Failure, errors.New("InvalidPushResponse"))
+	}
+	if response.Code == 0 {
+		return allSuccess(deviceTokens)
+	}
+
+	return all(deviceTokens, retry, fmt.Errorf("%v %v", response.Code, response.Reason))
+}
+
+func checkOppo(resp interface{}, deviceTokens []string) []*PushResult {
+	response, ok := resp.(*oppo_channel.PushMessageResponse)
+	if !ok {
+		return all(deviceTokens, Failure, errors.New("InvalidPushResponse"))
+	}
+	if response.Code == 0 {
+		return allSuccess(deviceTokens)
+	}
+
+	return all(deviceTokens, retry, fmt.Errorf("%v %v", response.Code, response.Message))
+}
+
+func checkVivo(resp interface{}, deviceTokens []string) []*PushResult {
+	response, ok := resp.(*vivo_channel.PushMessageResponse)
+	if !ok {
+		return all(deviceTokens, Failure, errors.New("InvalidPushResponse"))
+	}
+	if response.Result == 0 {
+		return allSuccess(deviceTokens)
+	}
+
+	return all(deviceTokens, retry, fmt.Errorf("%v %v", response.Result, response.Desc))
+}
+
+func checkMeizu(resp interface{}, deviceTokens []string) []*PushResult {
+	response, ok := resp.(*meizu_channel.PushMessageResponse)
+	if !ok {
+		return all(deviceTokens, Failure, errors.New("InvalidPushResponse"))
+	}
+	if response.Code == "200" {
+		return allSuccess(deviceTokens)
+	}
+
+	return all(deviceTokens, retry, fmt.Errorf("%v %v", response.Code, response.Message))
+}
+
+func init() {
+	RegistPushProvider(&sdkProvider{
+		name:     "apple",
+		prefix:   "Apple",
+		maxBatch: 1,
+		platform: setting.IosTokenPlatform,
+		check:    checkApple,
+		extra: map[string]string{
+			"type":        "TodoRemind",
+			"link_type":   "TaskList",
+			"link_params": "[]",
+		},
+	})
+	RegistPushProvider(&sdkProvider{
+		name:        "huawei",
+		prefix:      "HUAWEI",
+		maxBatch:    100,
+		platform:    setting.HuaweiPlatform,
+		accessToken: &global.Global.HuaweiAccessToken,
+		refresh: func(resp interface{}) string {
+			if response, ok := resp.(*huawei_channel.AccessTokenResp); ok {
+				return response.AccessToken
+			}
+			return ""
+		},
+		check: checkHuawei,
+	})
+	RegistPushProvider(&sdkProvider{
+		name:     "xiaomi",
+		prefix:   "Xiaomi",
+		maxBatch: 100,
+		platform: setting.XiaomiPlatform,
+		check:    checkXiaomi,
+	})
+	RegistPushProvider(&sdkProvider{
+		name:        "oppo",
+		prefix:      "OPPO",
+		maxBatch:    1000,
+		platform:    setting.OppoPlatform,
+		accessToken: &global.Global.OppoAccessToken,
+		refresh: func(resp interface{}) string {
+			if response, ok := resp.(*oppo_channel.AuthTokenResp); ok && response.Data != nil {
+				return response.Data.AuthToken
+			}
+			return ""
+		},
+		check: checkOppo,
+	})
+	RegistPushProvider(&sdkProvider{
+		name:        "vivo",
+		prefix:      "VIVO",
+		maxBatch:    1000,
+		platform:    setting.VivoPlatform,
+		accessToken: &global.Global.VivoAccessToken,
+		refresh: func(resp interface{}) string {
+			if response, ok := resp.(*vivo_channel.AuthTokenResp); ok {
+				return response.AuthToken
+			}
+			return ""
+		},
+		check: checkVivo,
+	})
+	RegistPushProvider(&sdkProvider{
+		name:     "meizu",
+		prefix:   "Meizu",
+		maxBatch: 1000,
+		platform: setting.MeizuPlatform,
+		check:    checkMeizu,
+	})
+}
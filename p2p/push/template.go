@@ -0,0 +1,303 @@
+package push
+
+import (
+	"encoding/json"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
+	"github.com/curltech/go-colla-node/p2p/dht/entity"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*
+推送内容的模板：
+1.每种消息子类型每种语言一个模板，标题和内容可以使用{name}，{count}，{group}等占位符
+2.语言按照客户端的Language查找，找不到的时候依次使用去掉地区的语言，缺省语言和英语，
+子类型找不到的时候使用default
+3.同一个会话的通知使用同一个折叠键，累计未读的条数，多条的时候使用BodyMany
+4.模板可以在p2p.push.template配置的json文件中覆盖，格式是{子类型:{语言:模板}}
+*/
+const (
+	Subtype_Default   = "default"
+	Subtype_Chat      = "chat"
+	Subtype_GroupChat = "groupChat"
+)
+
+type Template struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	// 折叠了多条通知的时候使用，为空的时候使用Body
+	BodyMany string `json:"bodyMany,omitempty"`
+}
+
+var templateMutex sync.RWMutex
+
+// 子类型与语言模板的映射
+var templates = make(map[string]map[string]*Template)
+
+var defaultLanguage = "en-us"
+
+var collapseTime = time.Hour
+
+type conversation struct {
+	count    int
+	expireAt time.Time
+}
+
+var conversationMutex sync.Mutex
+
+// 客户端和会话与未读条数的映射
+var conversations = make(map[string]*conversation)
+
+var placeholder = regexp.MustCompile(`\{(\w+)\}`)
+
+func init() {
+	defaultLanguage, _ = config.GetString("p2p.push.defaultLanguage", "en-us")
+	defaultLanguage = normalizeLanguage(defaultLanguage)
+	collapse, _ := config.GetInt("p2p.push.collapseTime", 3600000)
+	collapseTime = time.Millisecond * time.Duration(collapse)
+	registDefaultTemplates()
+	filename, _ := config.GetString("p2p.push.template", "")
+	if filename != "" {
+		err := LoadTemplates(filename)
+		if err != nil {
+			logger.Sugar.Errorf("load push template: %v error: %v", filename, err)
+		}
+	}
+}
+
+func registDefaultTemplates() {
+	chat := map[string]*Template{
+		"en":      {Title: "Message Reminder", Body: "You have 1 message from {name}", BodyMany: "You have {count} messages from {name}"},
+		"ja":      {Title: "メッセージ通知", Body: "{name} からのメッセージが1つあります", BodyMany: "{name} からのメッセージが{count}つあります"},
+		"ko":      {Title: "메시지 알림", Body: "{name}님의 메시지 1개가 있습니다", BodyMany: "{name}님의 메시지 {count}개가 있습니다"},
+		"zh":      {Title: "消息提醒", Body: "您有1条来自 {name} 的消息", BodyMany: "您有{count}条来自 {name} 的消息"},
+		"zh-hant": {Title: "消息提醒", Body: "您有1條來自 {name} 的消息", BodyMany: "您有{count}條來自 {name} 的消息"},
+	}
+	groupChat := map[string]*Template{
+		"en":      {Title: "{group}", Body: "{name}: 1 new message", BodyMany: "{count} new messages, latest from {name}"},
+		"ja":      {Title: "{group}", Body: "{name}: 新しいメッセージが1つあります", BodyMany: "新しいメッセージが{count}つあります、最新は {name}"},
+		"ko":      {Title: "{group}", Body: "{name}: 새 메시지 1개", BodyMany: "새 메시지 {count}개, 최근 {name}"},
+		"zh":      {Title: "{group}", Body: "{name}：1条新消息", BodyMany: "{count}条新消息，最新来自 {name}"},
+		"zh-hant": {Title: "{group}", Body: "{name}：1條新消息", BodyMany: "{count}條新消息，最新來自 {name}"},
+	}
+	for language, template := range chat {
+		RegistTemplate(Subtype_Chat, language, template)
+		RegistTemplate(Subtype_Default, language, template)
+	}
+	for language, template := range groupChat {
+		RegistTemplate(Subtype_GroupChat, language, template)
+	}
+	// 繁体中文的地区
+	for _, language := range []string{"zh-tw", "zh-hk", "zh-mo"} {
+		RegistTemplate(Subtype_Chat, language, chat["zh-hant"])
+		RegistTemplate(Subtype_Default, language, chat["zh-hant"])
+		RegistTemplate(Subtype_GroupChat, language, groupChat["zh-hant"])
+	}
+}
+
+// normalizeLanguage 小写，下划线换成连字符，比如zh_TW是zh-tw
+func normalizeLanguage(language string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(language)), "_", "-")
+}
+
+/*
+*
+登记子类型和语言的模板，同一个子类型和语言的替换原来的
+*/
+func RegistTemplate(subtype string, language string, template *Template) {
+	templateMutex.Lock()
+	defer templateMutex.Unlock()
+	languages, ok := templates[subtype]
+	if !ok {
+		languages = make(map[string]*Template)
+		templates[subtype] = languages
+	}
+	languages[normalizeLanguage(language)] = template
+}
+
+/*
+*
+从json文件中加载模板，覆盖同一个子类型和语言的模板
+*/
+func LoadTemplates(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	catalog := make(map[string]map[string]*Template)
+	err = json.Unmarshal(data, &catalog)
+	if err != nil {
+		return err
+	}
+	for subtype, languages := range catalog {
+		for language, template := range languages {
+			RegistTemplate(subtype, language, template)
+		}
+	}
+
+	return nil
+}
+
+/*
+*
+语言的查找顺序：完整的语言，依次去掉最后一段，缺省语言，英语
+*/
+func languageChain(language string) []string {
+	chain := make([]string, 0, 6)
+	for _, l := range []string{normalizeLanguage(language), defaultLanguage, "en"} {
+		for l != "" {
+			if !containsLanguage(chain, l) {
+				chain = append(chain, l)
+			}
+			i := strings.LastIndex(l, "-")
+			if i < 0 {
+				break
+			}
+			l = l[:i]
+		}
+	}
+
+	return chain
+}
+
+func containsLanguage(chain []string, language string) bool {
+	for _, l := range chain {
+		if l == language {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+*
+按照子类型和语言查找模板，子类型找不到的时候使用default
+*/
+func GetTemplate(subtype string, language string) *Template {
+	templateMutex.RLock()
+	defer templateMutex.RUnlock()
+	chain := languageChain(language)
+	for _, s := range []string{subtype, Subtype_Default} {
+		languages, ok := templates[s]
+		if !ok {
+			continue
+		}
+		for _, l := range chain {
+			if template, ok := languages[l]; ok {
+				return template
+			}
+		}
+	}
+
+	return nil
+}
+
+// replace 替换占位符，没有参数的占位符保留
+func replace(text string, params map[string]string) string {
+	return placeholder.ReplaceAllStringFunc(text, func(s string) string {
+		if value, ok := params[s[1:len(s)-1]]; ok {
+			return value
+		}
+		return s
+	})
+}
+
+/*
+*
+渲染标题和内容，count大于1的时候使用BodyMany
+*/
+func Render(subtype string, language string, params map[string]string) (string, string) {
+	template := GetTemplate(subtype, language)
+	if template == nil {
+		return "", ""
+	}
+	body := template.Body
+	if count, _ := strconv.Atoi(params["count"]); count > 1 && template.BodyMany != "" {
+		body = template.BodyMany
+	}
+
+	return replace(template.Title, params), replace(body, params)
+}
+
+func conversationKey(peerClient *entity.PeerClient, conversationId string) string {
+	return peerClient.PeerId + "/" + peerClient.ClientId + "/" + conversationId
+}
+
+/*
+*
+累计客户端在会话中未读的条数，超过折叠时间没有新消息的重新计数
+*/
+func countConversation(key string) int {
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	now := time.Now()
+	c, ok := conversations[key]
+	if !ok || now.After(c.expireAt) {
+		c = &conversation{}
+		conversations[key] = c
+	}
+	c.count++
+	c.expireAt = now.Add(collapseTime)
+	// 顺便清除过期的会话
+	if len(conversations) > 10000 {
+		for k, v := range conversations {
+			if now.After(v.expireAt) {
+				delete(conversations, k)
+			}
+		}
+	}
+
+	return c.count
+}
+
+/*
+*
+客户端上线的时候清除它所有会话的未读条数
+*/
+func ResetConversations(peerId string, clientId string) {
+	prefix := peerId + "/" + clientId + "/"
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	for key := range conversations {
+		if strings.HasPrefix(key, prefix) {
+			delete(conversations, key)
+		}
+	}
+}
+
+/*
+*
+消息通知：按照客户端的语言渲染子类型的模板，同一个会话的通知折叠成一条，显示累计的条数
+params中的count由会话累计的条数填写
+*/
+func NotifyMessage(peerClient *entity.PeerClient, subtype string, conversationId string, params map[string]string) {
+	if peerClient == nil || peerClient.DeviceToken == "" {
+		return
+	}
+	count := countConversation(conversationKey(peerClient, conversationId))
+	values := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		values[k] = v
+	}
+	values["count"] = strconv.Itoa(count)
+	title, body := Render(subtype, peerClient.Language, values)
+	Notify(peerClient, &Notification{
+		Title: title,
+		Body:  body,
+		Data: map[string]string{
+			"subtype":      subtype,
+			"conversation": conversationId,
+			"count":        values["count"],
+		},
+		CollapseKey: conversationId,
+		Group:       subtype + "/" + conversationId,
+		Urgent:      true,
+	})
+}
@@ -0,0 +1,407 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/curltech/go-colla-core/config"
+	"github.com/curltech/go-colla-core/logger"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 加密记录的大小，整个请求体不超过4096字节
+const webPushRecordSize = 4096
+
+const webPushMaxPayload = webPushRecordSize - 86 - 17
+
+/*
+*
+浏览器PushSubscription的json，PC客户端把它作为DeviceToken
+*/
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+/*
+*
+缺省允许的推送服务的域名，包括子域名，可以用p2p.push.webpush.hosts配置，逗号分隔
+*/
+var webPushHosts = []string{
+	"fcm.googleapis.com",
+	"push.services.mozilla.com",
+	"notify.windows.com",
+	"push.apple.com",
+}
+
+/*
+*
+Web Push推送通道，PC客户端使用
+消息按照RFC 8291用aes128gcm加密，请求用RFC 8292的VAPID签名，推送服务的地址在DeviceToken中
+DeviceToken由客户端提交，推送服务的地址必须是https而且在允许的域名中，
+缺省的http客户端不连接内网，回环和链路本地的地址，不跟随重定向，避免被用来访问内部的服务
+*/
+type WebPushProvider struct {
+	privateKey *ecdsa.PrivateKey
+	// base64url编码的未压缩公钥，浏览器订阅的时候使用
+	publicKey string
+	subject   string
+	ttl       int
+	client    *http.Client
+	parallel  int
+	// 允许的推送服务的域名
+	hosts []string
+}
+
+/*
+*
+privateKey是base64url编码的P-256私钥，subject是mailto:或者https:的联系地址
+*/
+func NewWebPushProvider(privateKey string, subject string, ttl int, client *http.Client) (*WebPushProvider, error) {
+	d, err := decodeBase64Url(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := key.PublicKey().Bytes()
+	curve := elliptic.P256()
+	ecdsaKey := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(publicKey[1:33]),
+			Y:     new(big.Int).SetBytes(publicKey[33:]),
+		},
+		D: new(big.Int).SetBytes(d),
+	}
+	if client == nil {
+		client = newWebPushClient()
+	}
+
+	return &WebPushProvider{
+		privateKey: ecdsaKey,
+		publicKey:  base64.RawURLEncoding.EncodeToString(publicKey),
+		subject:    subject,
+		ttl:        ttl,
+		client:     client,
+		parallel:   8,
+		hosts:      webPushHosts,
+	}, nil
+}
+
+/*
+*
+缺省的http客户端，连接之前检查解析出来的地址，DNS指向内部地址的域名也被拒绝
+*/
+func newWebPushClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			return checkPublicAddress(address)
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+/*
+*
+拒绝回环，内网，链路本地，组播和未指定的地址
+*/
+func checkPublicAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.New("InvalidAddress")
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return errors.New("ForbiddenAddress")
+	}
+
+	return nil
+}
+
+/*
+*
+推送服务的地址必须是https，域名是允许的域名或者它的子域名
+*/
+func (this *WebPushProvider) checkEndpoint(endpoint *url.URL) error {
+	if endpoint.Scheme != "https" || endpoint.User != nil {
+		return errors.New("ForbiddenWebPushEndpoint")
+	}
+	hostname := strings.ToLower(endpoint.Hostname())
+	for _, host := range this.hosts {
+		if hostname == host || strings.HasSuffix(hostname, "."+host) {
+			return nil
+		}
+	}
+
+	return errors.New("ForbiddenWebPushEndpoint")
+}
+
+func (this *WebPushProvider) Name() string {
+	return "webpush"
+}
+
+func (this *WebPushProvider) Accept(clientType string) bool {
+	return clientType == "PC" || clientType == "Web"
+}
+
+func (this *WebPushProvider) MaxBatch() int {
+	return 500
+}
+
+// PublicKey VAPID公钥，浏览器订阅的时候作为applicationServerKey
+func (this *WebPushProvider) PublicKey() string {
+	return this.publicKey
+}
+
+func (this *WebPushProvider) Push(ctx context.Context, deviceTokens []string, notification *Notification) []*PushResult {
+	payload, err := json.Marshal(map[string]interface{}{
+		"title": notification.Title,
+		"body":  notification.Body,
+		"data":  notification.Data,
+		"tag":   notification.CollapseKey,
+		"group": notification.Group,
+	})
+	if err != nil {
+		return all(deviceTokens, Failure, err)
+	}
+	if len(payload) > webPushMaxPayload {
+		return all(deviceTokens, Failure, errors.New("PayloadTooLarge"))
+	}
+	results := make([]*PushResult, len(deviceTokens))
+	semaphore := make(chan struct{}, this.parallel)
+	var wg sync.WaitGroup
+	for i, deviceToken := range deviceTokens {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, deviceToken string) {
+			defer wg.Done()
+			results[i] = this.send(ctx, deviceToken, payload, notification)
+			<-semaphore
+		}(i, deviceToken)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (this *WebPushProvider) send(ctx context.Context, deviceToken string, payload []byte, notification *Notification) *PushResult {
+	subscription := &WebPushSubscription{}
+	err := json.Unmarshal([]byte(deviceToken), subscription)
+	if err != nil || subscription.Endpoint == "" {
+		return InvalidToken(deviceToken, errors.New("InvalidWebPushSubscription"))
+	}
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return InvalidToken(deviceToken, errors.New("InvalidWebPushEndpoint"))
+	}
+	err = this.checkEndpoint(endpoint)
+	if err != nil {
+		return InvalidToken(deviceToken, err)
+	}
+	body, err := encryptWebPush(subscription, payload)
+	if err != nil {
+		return InvalidToken(deviceToken, err)
+	}
+	authorization, err := this.vapid(endpoint.Scheme + "://" + endpoint.Host)
+	if err != nil {
+		return Failure(deviceToken, err)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return Failure(deviceToken, err)
+	}
+	urgency := "normal"
+	if notification.Urgent {
+		urgency = "high"
+	}
+	request.Header.Set("Authorization", authorization)
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("TTL", strconv.Itoa(this.ttl))
+	request.Header.Set("Urgency", urgency)
+	if notification.CollapseKey != "" {
+		request.Header.Set("Topic", webPushTopic(notification.CollapseKey))
+	}
+	response, err := this.client.Do(request)
+	if err != nil {
+		return Retry(deviceToken, err, 0)
+	}
+	defer response.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	err = fmt.Errorf("%v %v", response.StatusCode, string(message))
+	switch {
+	case response.StatusCode >= http.StatusOK && response.StatusCode < http.StatusMultipleChoices:
+		return Success(deviceToken)
+	case response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone:
+		return InvalidToken(deviceToken, err)
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError:
+		return Retry(deviceToken, err, retryAfter(response))
+	default:
+		return Failure(deviceToken, err)
+	}
+}
+
+/*
+*
+VAPID的Authorization头，JWT的aud是推送服务的origin，有效期12小时
+*/
+func (this *WebPushProvider) vapid(audience string) (string, error) {
+	token, err := signJwt("ES256", map[string]interface{}{
+		"aud": audience,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": this.subject,
+	}, func(data []byte) ([]byte, error) {
+		digest := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, this.privateKey, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "vapid t=" + token + ", k=" + this.publicKey, nil
+}
+
+// Topic头最多32个base64url字符，使用折叠键的摘要
+func webPushTopic(collapseKey string) string {
+	digest := sha256.Sum256([]byte(collapseKey))
+	return base64.RawURLEncoding.EncodeToString(digest[:])[:32]
+}
+
+/*
+*
+RFC 8291的aes128gcm加密：临时密钥与浏览器公钥ECDH，用auth密钥和两个公钥派生IKM，
+再用随机salt派生内容密钥和nonce，加密一个记录，头部是salt，记录大小和临时公钥
+*/
+func encryptWebPush(subscription *WebPushSubscription, payload []byte) ([]byte, error) {
+	uaPublic, err := decodeBase64Url(subscription.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := decodeBase64Url(subscription.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+	secret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm, err := hkdf.Key(sha256.New, secret, authSecret, string(keyInfo), 32)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 最后一个记录的填充分隔符是0x02
+	plaintext := append(append([]byte{}, payload...), 0x02)
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+func init() {
+	enable, _ := config.GetBool("p2p.push.webpush.enable", false)
+	if !enable {
+		return
+	}
+	privateKey, _ := config.GetString("p2p.push.webpush.privateKey", "")
+	subject, _ := config.GetString("p2p.push.webpush.subject", "")
+	ttl, _ := config.GetInt("p2p.push.webpush.ttl", 86400)
+	hosts, _ := config.GetString("p2p.push.webpush.hosts", "")
+	provider, err := NewWebPushProvider(privateKey, subject, ttl, nil)
+	if err != nil {
+		logger.Sugar.Errorf("create webpush provider error: %v", err)
+		return
+	}
+	if hosts != "" {
+		provider.hosts = make([]string, 0)
+		for _, host := range strings.Split(hosts, ",") {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if host != "" {
+				provider.hosts = append(provider.hosts, host)
+			}
+		}
+	}
+	RegistPushProvider(provider)
+}
@@ -0,0 +1,156 @@
+package push
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func newTestWebPushProvider(t *testing.T, server *httptest.Server) *WebPushProvider {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewWebPushProvider(base64.RawURLEncoding.EncodeToString(key.Bytes()), "mailto:test@example.com", 60, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverUrl, _ := url.Parse(server.URL)
+	provider.hosts = []string{serverUrl.Hostname()}
+
+	return provider
+}
+
+func newTestSubscription(t *testing.T, endpoint string) string {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	_, _ = rand.Read(auth)
+	subscription := &WebPushSubscription{Endpoint: endpoint}
+	subscription.Keys.P256dh = base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	subscription.Keys.Auth = base64.RawURLEncoding.EncodeToString(auth)
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestWebPushStatus(t *testing.T) {
+	tests := []struct {
+		status  int
+		success bool
+		invalid bool
+		retry   bool
+	}{
+		{http.StatusCreated, true, false, false},
+		{http.StatusNotFound, false, true, false},
+		{http.StatusGone, false, true, false},
+		{http.StatusTooManyRequests, false, false, true},
+		{http.StatusServiceUnavailable, false, false, true},
+		{http.StatusBadRequest, false, false, false},
+		{http.StatusRequestEntityTooLarge, false, false, false},
+	}
+	for _, test := range tests {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(test.status)
+		}))
+		provider := newTestWebPushProvider(t, server)
+		deviceToken := newTestSubscription(t, server.URL+"/push/1")
+		results := provider.Push(context.Background(), []string{deviceToken}, &Notification{Title: "title", Body: "body"})
+		server.Close()
+		if len(results) != 1 {
+			t.Fatalf("status %v: %v results", test.status, len(results))
+		}
+		result := results[0]
+		if (result.Err == nil) != test.success || result.Invalid != test.invalid || result.Retry != test.retry {
+			t.Errorf("status %v: got err=%v invalid=%v retry=%v", test.status, result.Err, result.Invalid, result.Retry)
+		}
+		if test.retry && result.RetryAfter.Seconds() != 7 {
+			t.Errorf("status %v: retryAfter %v", test.status, result.RetryAfter)
+		}
+	}
+}
+
+func TestWebPushForbiddenEndpoint(t *testing.T) {
+	requested := false
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	provider := newTestWebPushProvider(t, server)
+	serverUrl, _ := url.Parse(server.URL)
+	endpoints := []string{
+		"http://" + serverUrl.Host + "/push/1",
+		"https://169.254.169.254/latest/meta-data",
+		"https://push.example.com/push/1",
+		"https://user@" + serverUrl.Host + "/push/1",
+	}
+	for _, endpoint := range endpoints {
+		results := provider.Push(context.Background(), []string{newTestSubscription(t, endpoint)}, &Notification{Title: "title"})
+		if results[0].Err == nil || !results[0].Invalid {
+			t.Errorf("endpoint %v: got err=%v invalid=%v", endpoint, results[0].Err, results[0].Invalid)
+		}
+	}
+	if requested {
+		t.Error("forbidden endpoint is requested")
+	}
+}
+
+func TestWebPushHosts(t *testing.T) {
+	provider := &WebPushProvider{hosts: webPushHosts}
+	tests := map[string]bool{
+		"https://fcm.googleapis.com/fcm/send/abc":              true,
+		"https://updates.push.services.mozilla.com/wpush/v2/a": true,
+		"https://wns2-par02p.notify.windows.com/w/?token=a":    true,
+		"https://web.push.apple.com/abc":                       true,
+		"https://evilpush.apple.com.example.com/abc":           false,
+		"https://notpush.apple.com/abc":                        false,
+		"http://fcm.googleapis.com/fcm/send/abc":               false,
+	}
+	for endpoint, allowed := range tests {
+		u, _ := url.Parse(endpoint)
+		err := provider.checkEndpoint(u)
+		if (err == nil) != allowed {
+			t.Errorf("endpoint %v: got %v", endpoint, err)
+		}
+	}
+}
+
+func TestCheckPublicAddress(t *testing.T) {
+	tests := map[string]bool{
+		"142.250.72.10:443":      true,
+		"[2607:f8b0::1]:443":     true,
+		"127.0.0.1:443":          false,
+		"10.1.2.3:443":           false,
+		"172.16.0.1:443":         false,
+		"192.168.1.1:443":        false,
+		"169.254.169.254:80":     false,
+		"0.0.0.0:443":            false,
+		"[::1]:443":              false,
+		"[fe80::1]:443":          false,
+		"[fd00::1]:443":          false,
+		"[::ffff:127.0.0.1]:443": false,
+	}
+	for address, allowed := range tests {
+		err := checkPublicAddress(address)
+		if (err == nil) != allowed {
+			t.Errorf("address %v: got %v", address, err)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/curltech/go-colla-core/logger"
 	session2 "github.com/curltech/go-colla-core/session"
 	"github.com/curltech/go-colla-core/util/security"
+	"github.com/curltech/go-colla-node/p2p/codec"
+	"github.com/curltech/go-colla-node/p2p/msgtype"
 	"github.com/curltech/go-colla-node/transport/util"
 	"github.com/gorilla/websocket"
 	"io"
@@ -25,13 +27,16 @@ import (
 type WebsocketMessage struct {
 	messageType int
 	data        []byte
+	priority    msgtype.Priority
 }
 
 type WebsocketConnection struct {
 	Session   *session2.Session
 	WsConnect *websocket.Conn
+	Codec     string
 	inChan    chan *WebsocketMessage
-	outChan   chan *WebsocketMessage
+	// 每个优先级一个输出管道，优先写出优先级高的消息
+	outChans  [msgtype.PriorityCount]chan *WebsocketMessage
 	closeChan chan byte
 
 	mutex    sync.Mutex // 对closeChan关闭上锁
@@ -86,14 +91,14 @@ func errorf(w http.ResponseWriter, msg string, code int) {
 	_, _ = w.Write([]byte(msg))
 }
 
-var messageHandler func(data []byte, remotePeerId string, clientId string, connectSessionId string, remoteAddr string) ([]byte, error)
+var messageHandler func(data []byte, remotePeerId string, clientId string, connectSessionId string, remoteAddr string) ([]byte, msgtype.Priority, error)
 var disconnectedHandler func(connectSessionId string)
 
 /*
 *
-注册读取原生数据的处理器
+注册读取原生数据的处理器，处理器返回回应的数据和按照回应的消息类型决定的发送优先级
 */
-func RegistMessageHandler(handler func(data []byte, remotePeerId string, clientId string, connectSessionId string, remoteAddr string) ([]byte, error)) {
+func RegistMessageHandler(handler func(data []byte, remotePeerId string, clientId string, connectSessionId string, remoteAddr string) ([]byte, msgtype.Priority, error)) {
 	messageHandler = handler
 }
 
@@ -117,7 +122,10 @@ func receiveHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Access-Control-Allow-Origin, Access-Control-Allow-Headers, Cache-Control, Content-Language, Content-Type")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 	w.Header().Set("Access-Control-Max-Age", "86400") // 可选
-	data, err := messageHandler(body, "", "", sessId, remoteAddr)
+	data, _, err := messageHandler(body, "", "", sessId, remoteAddr)
+	if codec.IsBinary(data) {
+		w.Header().Set("Content-Type", "application/cbor")
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 	} else {
@@ -193,9 +201,11 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("SUCCESS"))
 }
 
+// 客户端在Sec-WebSocket-Protocol中请求colla.cbor的时候使用二进制编码，老的客户端不请求子协议，使用json
 var upgrade = &websocket.Upgrader{
 	ReadBufferSize:  config.ServerWebsocketParams.WriteBufferSize,
 	WriteBufferSize: config.ServerWebsocketParams.ReadBufferSize,
+	Subprotocols:    codec.Subprotocols(),
 	CheckOrigin: func(r *http.Request) bool {
 		if r.Method != "POST" && r.Method != "GET" {
 			logger.Sugar.Errorf("method is not POST or GET")
@@ -222,16 +232,19 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	connection := &WebsocketConnection{
 		Session:   session,
 		WsConnect: conn,
+		Codec:     codec.CodecOfSubprotocol(conn.Subprotocol()),
 		inChan:    make(chan *WebsocketMessage, chanBufferSize),
-		outChan:   make(chan *WebsocketMessage, chanBufferSize),
 		closeChan: make(chan byte, 1),
 	}
+	for i := range connection.outChans {
+		connection.outChans[i] = make(chan *WebsocketMessage, chanBufferSize)
+	}
 	//建立会话与连接之间的映射
 	sessionId := session.SessionID()
 	mutex.Lock()
 	defer mutex.Unlock()
 	WebsocketConnectionPool[sessionId] = connection
-	logger.Sugar.Warnf("New websocket connection, address: %v, session: %v", connection.WsConnect.RemoteAddr(), sessionId)
+	logger.Sugar.Warnf("New websocket connection, address: %v, session: %v, codec: %v", connection.WsConnect.RemoteAddr(), sessionId, connection.Codec)
 	// 启动读协程
 	go connection.loopRead()
 	// 启动写协程
@@ -263,12 +276,12 @@ func (conn *WebsocketConnection) read() (msg *WebsocketMessage, err error) {
 	select {
 	case msg = <-conn.inChan:
 		if messageHandler != nil {
-			response, err := messageHandler(msg.data, "", "", conn.Session.SessionID(), conn.WsConnect.RemoteAddr().String())
+			response, priority, err := messageHandler(msg.data, "", "", conn.Session.SessionID(), conn.WsConnect.RemoteAddr().String())
 			if err != nil {
 				return nil, err
 			}
 			if response != nil {
-				_ = conn.Write(websocket.BinaryMessage, response)
+				_ = conn.WritePriority(websocket.BinaryMessage, response, priority)
 			}
 		}
 	case <-conn.closeChan:
@@ -279,10 +292,19 @@ func (conn *WebsocketConnection) read() (msg *WebsocketMessage, err error) {
 	return
 }
 
-// 数据写入输出管道，然后通过无限循环的写出操作写出数据
+// 数据写入输出管道，然后通过无限循环的写出操作写出数据，
+// 不知道消息类型的数据优先级按照数据的大小决定，知道消息类型的使用WritePriority
 func (conn *WebsocketConnection) Write(messageType int, data []byte) (err error) {
+	return conn.WritePriority(messageType, data, msgtype.PriorityOf(data))
+}
+
+// WritePriority 数据按照优先级写入输出管道，优先级高的消息在消息之间优先写出
+func (conn *WebsocketConnection) WritePriority(messageType int, data []byte, priority msgtype.Priority) (err error) {
+	if priority < msgtype.Priority_Realtime || priority >= msgtype.PriorityCount {
+		priority = msgtype.Priority_Normal
+	}
 	select {
-	case conn.outChan <- &WebsocketMessage{messageType, data}:
+	case conn.outChans[priority] <- &WebsocketMessage{messageType: messageType, data: data, priority: priority}:
 	case <-conn.closeChan:
 		///前端关闭连接时会调用
 		err = errors.New("connection is closeed")
@@ -290,6 +312,27 @@ func (conn *WebsocketConnection) Write(messageType int, data []byte) (err error)
 	return
 }
 
+// 取下一个写出的消息，优先级高的管道有消息的时候先写出，连接关闭的时候返回false
+func (conn *WebsocketConnection) nextOut() (*WebsocketMessage, bool) {
+	for _, outChan := range conn.outChans {
+		select {
+		case msg := <-outChan:
+			return msg, true
+		default:
+		}
+	}
+	select {
+	case msg := <-conn.outChans[msgtype.Priority_Realtime]:
+		return msg, true
+	case msg := <-conn.outChans[msgtype.Priority_Normal]:
+		return msg, true
+	case msg := <-conn.outChans[msgtype.Priority_Bulk]:
+		return msg, true
+	case <-conn.closeChan:
+		return nil, false
+	}
+}
+
 func (conn *WebsocketConnection) Close() {
 	// 线程安全，可多次调用
 	_ = conn.WsConnect.Close()
@@ -366,6 +409,7 @@ func (conn *WebsocketConnection) loopRead() {
 func (conn *WebsocketConnection) loopWrite() {
 	var (
 		msg *WebsocketMessage
+		ok  bool
 		err error
 	)
 	if conn.isClosed {
@@ -373,24 +417,24 @@ func (conn *WebsocketConnection) loopWrite() {
 		return
 	}
 	var writeTimeout, _ = config.GetInt("websocket.writeTimeout", 0)
+	var fragmentSize, _ = config.GetInt("websocket.fragmentSize", 16*1024)
 	for {
 		if conn.isClosed {
 			logger.Sugar.Errorf("websocket connection:%v is closed!", conn.Session.SessionID())
 			return
 		}
-		select {
-		case msg = <-conn.outChan:
-		case <-conn.closeChan:
+		msg, ok = conn.nextOut()
+		if !ok {
 			conn.Close()
 			return
 		}
 		if msg != nil {
-			if writeTimeout > 0 {
-				_ = conn.WsConnect.SetWriteDeadline(time.Now().Add(time.Millisecond * time.Duration(writeTimeout)))
+			if msg.priority == msgtype.Priority_Bulk && fragmentSize > 0 && len(msg.data) > fragmentSize {
+				err = conn.writeFragments(msg, fragmentSize, writeTimeout)
 			} else {
-				_ = conn.WsConnect.SetWriteDeadline(time.Time{})
+				conn.setWriteDeadline(writeTimeout)
+				err = conn.WsConnect.WriteMessage(msg.messageType, msg.data)
 			}
-			err = conn.WsConnect.WriteMessage(msg.messageType, msg.data)
 			if err != nil {
 				// 判断是不是超时
 				var netErr net.Error
@@ -410,6 +454,47 @@ func (conn *WebsocketConnection) loopWrite() {
 	}
 }
 
+func (conn *WebsocketConnection) setWriteDeadline(writeTimeout int) {
+	if writeTimeout > 0 {
+		_ = conn.WsConnect.SetWriteDeadline(time.Now().Add(time.Millisecond * time.Duration(writeTimeout)))
+	} else {
+		_ = conn.WsConnect.SetWriteDeadline(time.Time{})
+	}
+}
+
+/*
+*
+大的数据消息用NextWriter分段写出，写缓冲区满的时候写出一个分片帧，每段单独计算写超时，
+慢的客户端不会因为整个消息的超时被断开，两段之间连接关闭的时候放弃写出。
+websocket协议不允许其他的数据消息插入分片的消息中间（只有控制帧可以），
+所以优先级高的消息在当前的大消息写完以后，排在队列中其他的大消息之前写出
+*/
+func (conn *WebsocketConnection) writeFragments(msg *WebsocketMessage, fragmentSize int, writeTimeout int) error {
+	conn.setWriteDeadline(writeTimeout)
+	w, err := conn.WsConnect.NextWriter(msg.messageType)
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(msg.data); offset += fragmentSize {
+		if conn.isClosed {
+			_ = w.Close()
+			return errors.New("connection is closeed")
+		}
+		end := offset + fragmentSize
+		if end > len(msg.data) {
+			end = len(msg.data)
+		}
+		conn.setWriteDeadline(writeTimeout)
+		_, err = w.Write(msg.data[offset:end])
+		if err != nil {
+			_ = w.Close()
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
 // 发送存活心跳
 func (conn *WebsocketConnection) loopHeartbeat() {
 	var heartbeatInterval = config.ServerWebsocketParams.HeartbeatInteval
@@ -418,7 +503,7 @@ func (conn *WebsocketConnection) loopHeartbeat() {
 		return
 	}
 	var sessionId = conn.Session.SessionID()
-	err := conn.Write(websocket.BinaryMessage, []byte("heartbeat:"+sessionId))
+	err := conn.WritePriority(websocket.BinaryMessage, []byte("heartbeat:"+sessionId), msgtype.Priority_Realtime)
 	if err != nil {
 		logger.Sugar.Errorf("heartbeat fail:%v", err.Error())
 		conn.Close()
@@ -426,7 +511,7 @@ func (conn *WebsocketConnection) loopHeartbeat() {
 	for {
 		time.Sleep(time.Duration(heartbeatInterval) * time.Second)
 		var sessionId = conn.Session.SessionID()
-		err := conn.Write(websocket.BinaryMessage, []byte("heartbeat:"+sessionId))
+		err := conn.WritePriority(websocket.BinaryMessage, []byte("heartbeat:"+sessionId), msgtype.Priority_Realtime)
 		if err != nil {
 			logger.Sugar.Errorf("remote client: %v, heartbeat fail: %v", conn.WsConnect.RemoteAddr().String(), err.Error())
 			conn.Close()